@@ -0,0 +1,63 @@
+package wam
+
+import (
+	"sync"
+)
+
+// circuitBreaker tracks the health of the suggestion store.
+// It opens after a number of consecutive failures and stays open until a successful call or background probe
+// closes it again. While open, the plugin does not talk to the store at all.
+type circuitBreaker struct {
+	mu                  sync.Mutex
+	threshold           int
+	consecutiveFailures int
+	open                bool
+}
+
+func newCircuitBreaker(threshold int) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold}
+}
+
+// Allow reports whether a call to the store may be attempted.
+func (cb *circuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return !cb.open
+}
+
+// IsOpen reports whether the breaker is currently open.
+func (cb *circuitBreaker) IsOpen() bool {
+	return !cb.Allow()
+}
+
+// RecordSuccess resets the failure count and closes the breaker.
+// It returns true if the breaker was open before the call.
+func (cb *circuitBreaker) RecordSuccess() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	wasOpen := cb.open
+	cb.consecutiveFailures = 0
+	cb.open = false
+	return wasOpen
+}
+
+// RecordFailure counts a failed call and opens the breaker once the threshold is reached.
+// It returns true if this call opened the breaker.
+func (cb *circuitBreaker) RecordFailure() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.consecutiveFailures++
+	if !cb.open && cb.consecutiveFailures >= cb.threshold {
+		cb.open = true
+		return true
+	}
+	return false
+}
+
+// Trip opens the breaker immediately, e.g. when the store is unreachable at start-up.
+func (cb *circuitBreaker) Trip() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.consecutiveFailures = cb.threshold
+	cb.open = true
+}
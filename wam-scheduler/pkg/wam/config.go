@@ -0,0 +1,94 @@
+package wam
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// FailurePolicy decides what the plugin does with a pod when the suggestion store is unavailable.
+type FailurePolicy string
+
+const (
+	// FailOpen schedules the pod without a scheduling suggestion.
+	FailOpen FailurePolicy = "open"
+	// FailClosed refuses to schedule the pod until the store is reachable again.
+	FailClosed FailurePolicy = "closed"
+)
+
+const (
+	defaultFailurePolicy    = FailOpen
+	defaultFailureThreshold = 3
+	defaultProbeInterval    = 5 * time.Second
+)
+
+type config struct {
+	RedisHost     string
+	RedisPort     string
+	RedisPassword string
+
+	// FailurePolicy is applied while the circuit breaker is open.
+	FailurePolicy FailurePolicy
+	// FailureThreshold is the number of consecutive store errors that open the circuit breaker.
+	FailureThreshold int
+	// ProbeInterval is how often the store is pinged in the background while the circuit breaker is open.
+	ProbeInterval time.Duration
+
+	// TracingEndpoint is the OTLP gRPC collector spans are exported to. Tracing is disabled if empty.
+	TracingEndpoint string
+	// TracingInsecure disables TLS towards the collector.
+	TracingInsecure bool
+
+	// Cluster is the name WAM knows this cluster by if it is a remote cluster of WAM, empty in the cluster of WAM.
+	Cluster string
+}
+
+// loadConfig reads the plugin configuration from WAM_* environment variables.
+func loadConfig() (*config, error) {
+	c := &config{
+		RedisHost:        os.Getenv("WAM_REDIS_HOST"),
+		RedisPort:        os.Getenv("WAM_REDIS_PORT"),
+		RedisPassword:    os.Getenv("WAM_REDIS_PASSWORD"),
+		FailurePolicy:    defaultFailurePolicy,
+		FailureThreshold: defaultFailureThreshold,
+		ProbeInterval:    defaultProbeInterval,
+		TracingEndpoint:  os.Getenv("WAM_TRACING_ENDPOINT"),
+		Cluster:          os.Getenv("WAM_CLUSTER"),
+	}
+
+	if v := os.Getenv("WAM_FAILURE_POLICY"); v != "" {
+		switch FailurePolicy(v) {
+		case FailOpen, FailClosed:
+			c.FailurePolicy = FailurePolicy(v)
+		default:
+			return nil, fmt.Errorf("invalid WAM_FAILURE_POLICY %q: must be %q or %q", v, FailOpen, FailClosed)
+		}
+	}
+
+	if v := os.Getenv("WAM_BREAKER_FAILURE_THRESHOLD"); v != "" {
+		threshold, err := strconv.Atoi(v)
+		if err != nil || threshold < 1 {
+			return nil, fmt.Errorf("invalid WAM_BREAKER_FAILURE_THRESHOLD %q: must be a positive integer", v)
+		}
+		c.FailureThreshold = threshold
+	}
+
+	if v := os.Getenv("WAM_BREAKER_PROBE_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid WAM_BREAKER_PROBE_INTERVAL %q: must be a positive duration", v)
+		}
+		c.ProbeInterval = interval
+	}
+
+	if v := os.Getenv("WAM_TRACING_INSECURE"); v != "" {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WAM_TRACING_INSECURE %q: must be a boolean", v)
+		}
+		c.TracingInsecure = insecure
+	}
+
+	return c, nil
+}
@@ -0,0 +1,63 @@
+package wam
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const metricsSubsystem = "wam_plugin"
+
+const (
+	suggestionConsumed = "consumed"
+	suggestionHonored  = "honored"
+	suggestionRejected = "rejected"
+)
+
+var (
+	storeUnavailable = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "store_unavailable_total",
+			Help:           "Number of scheduling attempts handled while the suggestion store was unavailable, by failure policy.",
+			StabilityLevel: metrics.ALPHA,
+		}, []string{"policy"})
+
+	circuitBreakerOpen = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "circuit_breaker_open",
+			Help:           "Whether the circuit breaker guarding the suggestion store is open (1) or closed (0).",
+			StabilityLevel: metrics.ALPHA,
+		})
+
+	suggestionsTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "suggestions_total",
+			Help:           "Number of scheduling suggestions by result: consumed from the queue, honored by binding to the suggested node, or rejected because the suggested node did not fit the pod.",
+			StabilityLevel: metrics.ALPHA,
+		}, []string{"result"})
+
+	storeRequestDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "store_request_duration_seconds",
+			Help:           "Latency of requests to the suggestion store made in PreFilter and Unreserve, by operation and result.",
+			Buckets:        metrics.ExponentialBuckets(0.0005, 2, 14),
+			StabilityLevel: metrics.ALPHA,
+		}, []string{"operation", "result"})
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers the plugin metrics with the legacy registry served by kube-scheduler.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(storeUnavailable)
+		legacyregistry.MustRegister(circuitBreakerOpen)
+		legacyregistry.MustRegister(suggestionsTotal)
+		legacyregistry.MustRegister(storeRequestDuration)
+	})
+}
@@ -6,41 +6,62 @@ import (
 	"errors"
 	"fmt"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/scheduler/framework"
-	"log"
-	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type WAM struct {
 	handle    framework.Handle
-	k8sClient *kubernetes.Clientset
+	k8sClient kubernetes.Interface
 	rdb       *redis.Client
+	config    *config
+	breaker   *circuitBreaker
+	tracer    trace.Tracer
 }
 
 type SchedulingSuggestion struct {
 	ID       types.UID `json:"id"`
 	NodeName string    `json:"node_name"`
+	// TraceContext carries the trace of the WAM action that pushed the suggestion
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+
+	// span covers the scheduling cycle of the pod the suggestion was consumed by
+	span trace.Span
+	// queue and encoded are where and how the suggestion was stored, so Unreserve can push it back
+	queue   string
+	encoded string
 }
 
 func (sg *SchedulingSuggestion) Clone() framework.StateData {
 	return &SchedulingSuggestion{
-		ID:       sg.ID,
-		NodeName: sg.NodeName,
+		ID:           sg.ID,
+		NodeName:     sg.NodeName,
+		TraceContext: sg.TraceContext,
+		span:         sg.span,
+		queue:        sg.queue,
+		encoded:      sg.encoded,
 	}
 }
 
 var _ = framework.PreFilterPlugin(&WAM{})
 var _ = framework.FilterPlugin(&WAM{})
+var _ = framework.PostFilterPlugin(&WAM{})
+var _ = framework.ReservePlugin(&WAM{})
 var _ = framework.PostBindPlugin(&WAM{})
 
 // Name is the name of the plugin used in the Registry and configurations.
@@ -51,12 +72,22 @@ func (w *WAM) Name() string {
 	return Name
 }
 
-func queueName(or *metav1.OwnerReference, namespace string) string {
-	return fmt.Sprintf("%s:%s:%s:%s", namespace, or.APIVersion, or.Kind, or.Name)
+// queueName returns the suggestion queue of the workload, prefixed with the name of the cluster if WAM knows this
+// cluster as a remote one.
+func queueName(cluster string, or *metav1.OwnerReference, namespace string) string {
+	queue := fmt.Sprintf("%s:%s:%s:%s", namespace, or.APIVersion, or.Kind, or.Name)
+	if cluster != "" {
+		queue = cluster + "/" + queue
+	}
+	return queue
 }
 
-func (w *WAM) getDeploymentName(pod *v1.Pod) (*metav1.OwnerReference, error) {
+// getWorkload returns the Deployment or StatefulSet owning the pod, whose queue holds the pod's suggestions.
+func (w *WAM) getWorkload(pod *v1.Pod) (*metav1.OwnerReference, error) {
 	for _, ownerRef := range pod.OwnerReferences {
+		if ownerRef.Kind == "StatefulSet" {
+			return &ownerRef, nil
+		}
 		if ownerRef.Kind == "ReplicaSet" {
 			rs, err := w.k8sClient.AppsV1().ReplicaSets(pod.Namespace).Get(context.TODO(), ownerRef.Name, metav1.GetOptions{})
 			if err != nil {
@@ -71,30 +102,43 @@ func (w *WAM) getDeploymentName(pod *v1.Pod) (*metav1.OwnerReference, error) {
 		}
 	}
 
-	return nil, fmt.Errorf("deployment not found for pod %s", pod.Name)
+	return nil, fmt.Errorf("deployment or statefulset not found for pod %s", pod.Name)
 }
 
 func (w *WAM) PreFilter(ctx context.Context, state *framework.CycleState, pod *v1.Pod) (*framework.PreFilterResult, *framework.Status) {
 	lh := klog.FromContext(ctx)
 
-	deployment, err := w.getDeploymentName(pod)
+	workload, err := w.getWorkload(pod)
 	if err != nil {
-		lh.V(3).Error(err, "pod's deployment not found")
+		lh.V(3).Error(err, "pod's workload not found")
 		return nil, nil
 	}
 
-	lh.V(5).Info(fmt.Sprintf("found pod's deployment %+v", deployment))
+	lh.V(5).Info(fmt.Sprintf("found pod's workload %+v", workload))
 
-	queue := queueName(deployment, pod.Namespace)
+	queue := queueName(w.config.Cluster, workload, pod.Namespace)
+
+	if !w.breaker.Allow() {
+		lh.V(3).Info(fmt.Sprintf("circuit breaker is open: not querying Redis for %s", pod.Name))
+		return nil, w.storeUnavailable(pod)
+	}
 
-	sugEncoded, err := w.rdb.LPop(context.TODO(), queue).Result()
+	start := time.Now()
+	sugEncoded, err := w.rdb.LPop(ctx, queue).Result()
+	observeStoreRequest("lpop", start, err)
 	if errors.Is(err, redis.Nil) {
+		w.recordStoreSuccess(lh)
 		lh.V(3).Info(fmt.Sprintf("no suggestion found for %s: scheduling without a scheduling suggestion", pod.Name))
 		return nil, framework.NewStatus(framework.Success, "")
 	} else if err != nil {
 		lh.Error(err, "error connecting to Redis")
-		return nil, framework.NewStatus(framework.Error, "")
+		if w.breaker.RecordFailure() {
+			circuitBreakerOpen.Set(1)
+			lh.Info("opened circuit breaker: Redis is unavailable")
+		}
+		return nil, w.storeUnavailable(pod)
 	}
+	w.recordStoreSuccess(lh)
 
 	var suggestion SchedulingSuggestion
 
@@ -103,16 +147,90 @@ func (w *WAM) PreFilter(ctx context.Context, state *framework.CycleState, pod *v
 		return nil, framework.NewStatus(framework.Error, "")
 	}
 
+	w.startScheduleSpan(ctx, pod, &suggestion, start)
+
 	state.Write(schedulingSuggestionKey, &SchedulingSuggestion{
-		ID:       suggestion.ID,
-		NodeName: suggestion.NodeName,
+		ID:           suggestion.ID,
+		NodeName:     suggestion.NodeName,
+		TraceContext: suggestion.TraceContext,
+		span:         suggestion.span,
+		queue:        queue,
+		encoded:      sugEncoded,
 	})
+	suggestionsTotal.WithLabelValues(suggestionConsumed).Inc()
 
 	lh.V(5).Info(fmt.Sprintf("adding suggestion %+v to cycle state", suggestion))
 
 	return nil, framework.NewStatus(framework.Success, "")
 }
 
+// readSuggestion returns the suggestion stored in the cycle state by PreFilter, or nil if there is none.
+func readSuggestion(state *framework.CycleState) *SchedulingSuggestion {
+	data, err := state.Read(schedulingSuggestionKey)
+	if err != nil {
+		return nil
+	}
+	suggestion, ok := data.(*SchedulingSuggestion)
+	if !ok {
+		return nil
+	}
+	return suggestion
+}
+
+func observeStoreRequest(operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil && !errors.Is(err, redis.Nil) {
+		result = "error"
+	}
+	storeRequestDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+// storeUnavailable applies the configured failure policy to a pod that could not get its suggestion from Redis.
+func (w *WAM) storeUnavailable(pod *v1.Pod) *framework.Status {
+	policy := w.config.FailurePolicy
+	storeUnavailable.WithLabelValues(string(policy)).Inc()
+
+	w.event(pod, v1.EventTypeWarning, "WAMSuggestionStoreUnavailable",
+		"WAM suggestion store is unavailable, applying fail-%s policy", policy)
+
+	if policy == FailClosed {
+		return framework.NewStatus(framework.Error, "WAM suggestion store is unavailable")
+	}
+
+	// fail open: schedule the pod as if there was no suggestion for it
+	return framework.NewStatus(framework.Success, "")
+}
+
+// event emits an Event on the pod, if the framework provides a recorder.
+func (w *WAM) event(pod *v1.Pod, eventType, reason, note string, args ...interface{}) {
+	if w.handle == nil || w.handle.EventRecorder() == nil {
+		return
+	}
+	w.handle.EventRecorder().Eventf(pod, nil, eventType, reason, "Scheduling", note, args...)
+}
+
+func (w *WAM) recordStoreSuccess(lh klog.Logger) {
+	if w.breaker.RecordSuccess() {
+		circuitBreakerOpen.Set(0)
+		lh.Info("closed circuit breaker: Redis is available again")
+	}
+}
+
+// probeStore pings Redis while the circuit breaker is open and closes the breaker once it responds.
+func (w *WAM) probeStore(ctx context.Context) {
+	if !w.breaker.IsOpen() {
+		return
+	}
+
+	lh := klog.FromContext(ctx)
+	if err := w.rdb.Ping(ctx).Err(); err != nil {
+		lh.V(3).Info(fmt.Sprintf("Redis is still unavailable: %s", err.Error()))
+		return
+	}
+
+	w.recordStoreSuccess(lh)
+}
+
 func (w *WAM) PreFilterExtensions() framework.PreFilterExtensions {
 	return nil
 }
@@ -139,25 +257,115 @@ func (w *WAM) Filter(ctx context.Context, state *framework.CycleState, pod *v1.P
 	return framework.NewStatus(framework.Unschedulable)
 }
 
-func (w *WAM) PostBind(ctx context.Context, state *framework.CycleState, pod *v1.Pod, nodeName string) {
+// PostFilter is called when no node passed filtering. If the pod carried a suggestion, its suggested node did not fit
+// the pod, so the suggestion is counted as rejected. The status lets the remaining PostFilter plugins run.
+func (w *WAM) PostFilter(ctx context.Context, state *framework.CycleState, pod *v1.Pod, filteredNodeStatusMap framework.NodeToStatusMap) (*framework.PostFilterResult, *framework.Status) {
 	lh := klog.FromContext(ctx)
 
-	data, err := state.Read(schedulingSuggestionKey)
+	suggestion := readSuggestion(state)
+	if suggestion == nil {
+		return nil, framework.NewStatus(framework.Unschedulable)
+	}
+
+	suggestionsTotal.WithLabelValues(suggestionRejected).Inc()
+	lh.V(3).Info(fmt.Sprintf("suggested node %s rejected pod %s", suggestion.NodeName, pod.Name))
+	w.event(pod, v1.EventTypeWarning, "WAMSuggestedNodeRejected",
+		"Suggested node %s of suggestion %s did not pass filtering: %s", suggestion.NodeName, suggestion.ID, rejection(filteredNodeStatusMap, suggestion.NodeName))
+
+	if suggestion.span != nil {
+		suggestion.span.SetStatus(codes.Error, fmt.Sprintf("suggested node %s rejected the pod", suggestion.NodeName))
+		suggestion.span.End()
+	}
+
+	return nil, framework.NewStatus(framework.Unschedulable)
+}
+
+// rejection returns why filtering rejected the node, if known.
+func rejection(statuses framework.NodeToStatusMap, node string) string {
+	status, ok := statuses[node]
+	if !ok || status == nil || len(status.Reasons()) == 0 {
+		return "unknown reason"
+	}
+	return strings.Join(status.Reasons(), ", ")
+}
+
+// Reserve is a no-op, WAM only takes part in the reserve phase to learn of reservations that are undone.
+func (w *WAM) Reserve(ctx context.Context, state *framework.CycleState, pod *v1.Pod, nodeName string) *framework.Status {
+	return nil
+}
+
+// Unreserve is called when a later phase failed for the node the pod was reserved on. The pod is not bound in this
+// scheduling cycle, so the suggestion it consumed is pushed back onto its queue for the next attempt, and PostBind will
+// not end the span of the suggestion.
+func (w *WAM) Unreserve(ctx context.Context, state *framework.CycleState, pod *v1.Pod, nodeName string) {
+	lh := klog.FromContext(ctx)
+
+	suggestion := readSuggestion(state)
+	if suggestion == nil {
+		return
+	}
+
+	if suggestion.span != nil {
+		suggestion.span.SetAttributes(attribute.String("wam.reserved_node", nodeName))
+		suggestion.span.SetStatus(codes.Error, fmt.Sprintf("pod was not bound to reserved node %s", nodeName))
+		suggestion.span.End()
+	}
+
+	if suggestion.queue == "" {
+		return
+	}
+	if !w.breaker.Allow() {
+		lh.V(3).Info(fmt.Sprintf("circuit breaker is open: dropping suggestion %s of unreserved pod %s", suggestion.ID, pod.Name))
+		return
+	}
+
+	start := time.Now()
+	err := w.rdb.LPush(ctx, suggestion.queue, suggestion.encoded).Err()
+	observeStoreRequest("lpush", start, err)
 	if err != nil {
-		// todo
+		lh.Error(err, "error pushing back the suggestion of an unreserved pod", "suggestionID", suggestion.ID)
+		if w.breaker.RecordFailure() {
+			circuitBreakerOpen.Set(1)
+			lh.Info("opened circuit breaker: Redis is unavailable")
+		}
 		return
 	}
-	suggestion, ok := data.(*SchedulingSuggestion)
-	if !ok {
-		// todo
+	w.recordStoreSuccess(lh)
+	lh.V(3).Info(fmt.Sprintf("pushed back suggestion %s of unreserved pod %s", suggestion.ID, pod.Name))
+}
+
+func (w *WAM) PostBind(ctx context.Context, state *framework.CycleState, pod *v1.Pod, nodeName string) {
+	lh := klog.FromContext(ctx)
+
+	suggestion := readSuggestion(state)
+	if suggestion == nil {
 		return
 	}
 
+	if nodeName == suggestion.NodeName {
+		suggestionsTotal.WithLabelValues(suggestionHonored).Inc()
+		w.event(pod, v1.EventTypeNormal, "WAMPodPlaced", "Placed on suggested node %s by suggestion %s", nodeName, suggestion.ID)
+	} else {
+		suggestionsTotal.WithLabelValues(suggestionRejected).Inc()
+		w.event(pod, v1.EventTypeWarning, "WAMSuggestedNodeRejected",
+			"Bound to node %s instead of suggested node %s of suggestion %s", nodeName, suggestion.NodeName, suggestion.ID)
+	}
+
+	if suggestion.span != nil {
+		suggestion.span.SetAttributes(attribute.String("wam.bound_node", nodeName))
+		defer suggestion.span.End()
+	}
+
+	annotations := map[string]string{
+		"example.com/scheduling-suggestion-id": string(suggestion.ID),
+	}
+	if traceParent := suggestion.traceParent(); traceParent != "" {
+		annotations[traceParentAnnotation] = traceParent
+	}
+
 	patch := map[string]interface{}{
 		"metadata": map[string]interface{}{
-			"annotations": map[string]string{
-				"example.com/scheduling-suggestion-id": string(suggestion.ID),
-			},
+			"annotations": annotations,
 		},
 	}
 
@@ -178,42 +386,62 @@ func (w *WAM) PostBind(ctx context.Context, state *framework.CycleState, pod *v1
 }
 
 // New initializes a new plugin and returns it.
+// The plugin starts even if Redis is unreachable; it then keeps the circuit breaker open and reconnects in the
+// background.
 func New(ctx context.Context, args runtime.Object, h framework.Handle) (framework.Plugin, error) {
 	lh := klog.FromContext(ctx)
 
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	kubeConfig, err := clientcmd.BuildConfigFromFlags("", filepath.Join(homedir.HomeDir(), ".kube", "config"))
 	if err != nil {
 		kubeConfig, err = rest.InClusterConfig()
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 	}
 
 	k8sClient, err := kubernetes.NewForConfig(kubeConfig)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	redisHost := os.Getenv("WAM_REDIS_HOST")
-	redisPort := os.Getenv("WAM_REDIS_PORT")
-	redisPassword := os.Getenv("WAM_REDIS_PASSWORD")
-	lh.V(5).Info(fmt.Sprintf("connecting to Redis on %s:%s", redisHost, redisPort))
+	lh.V(5).Info(fmt.Sprintf("connecting to Redis on %s:%s", config.RedisHost, config.RedisPort))
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%s", redisHost, redisPort),
-		Password: redisPassword,
+		Addr:     fmt.Sprintf("%s:%s", config.RedisHost, config.RedisPort),
+		Password: config.RedisPassword,
 		DB:       0,
 	})
 
-	_, err = rdb.Ping(ctx).Result()
+	registerMetrics()
+
+	tp, err := newTracerProvider(ctx, config)
 	if err != nil {
-		log.Fatal("error connecting to Redis")
+		return nil, err
 	}
 
-	lh.V(5).Info("creating a new WAM plugin")
-
-	return &WAM{
+	w := &WAM{
 		handle:    h,
 		rdb:       rdb,
 		k8sClient: k8sClient,
-	}, nil
+		config:    config,
+		breaker:   newCircuitBreaker(config.FailureThreshold),
+		tracer:    tp.Tracer(tracerName),
+	}
+
+	_, err = rdb.Ping(ctx).Result()
+	if err != nil {
+		lh.Error(err, fmt.Sprintf("error connecting to Redis: starting with an open circuit breaker and fail-%s policy", config.FailurePolicy))
+		w.breaker.Trip()
+		circuitBreakerOpen.Set(1)
+	}
+
+	go wait.UntilWithContext(ctx, w.probeStore, config.ProbeInterval)
+
+	lh.V(5).Info("creating a new WAM plugin")
+
+	return w, nil
 }
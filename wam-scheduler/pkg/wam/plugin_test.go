@@ -2,19 +2,29 @@ package wam
 
 import (
 	"context"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/informers"
 	clientsetfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/events"
+	metricstestutil "k8s.io/component-base/metrics/testutil"
 	"k8s.io/kubernetes/pkg/scheduler/framework"
 	"k8s.io/kubernetes/pkg/scheduler/framework/plugins/defaultbinder"
 	"k8s.io/kubernetes/pkg/scheduler/framework/plugins/queuesort"
 	frameworkruntime "k8s.io/kubernetes/pkg/scheduler/framework/runtime"
 	tf "k8s.io/kubernetes/pkg/scheduler/testing/framework"
+	"sync"
 	"testing"
+	"time"
 )
 
 func newFake(ctx context.Context, args runtime.Object, h framework.Handle) (framework.Plugin, error) {
@@ -22,6 +32,9 @@ func newFake(ctx context.Context, args runtime.Object, h framework.Handle) (fram
 		handle:    h,
 		rdb:       nil,
 		k8sClient: nil,
+		config:    &config{FailurePolicy: FailOpen, FailureThreshold: defaultFailureThreshold},
+		breaker:   newCircuitBreaker(defaultFailureThreshold),
+		tracer:    noop.NewTracerProvider().Tracer(tracerName),
 	}, nil
 }
 
@@ -117,6 +130,273 @@ func TestWAMPlugin(t *testing.T) {
 	}
 }
 
+func TestPreFilterStoreUnavailable(t *testing.T) {
+	tests := []struct {
+		name           string
+		policy         FailurePolicy
+		expected       []framework.Code
+		expectedOpen   []bool
+		breakerTripped bool
+	}{
+		{
+			name:         "fail open schedules without a suggestion",
+			policy:       FailOpen,
+			expected:     []framework.Code{framework.Success, framework.Success, framework.Success},
+			expectedOpen: []bool{false, true, true},
+		},
+		{
+			name:         "fail closed refuses to schedule",
+			policy:       FailClosed,
+			expected:     []framework.Code{framework.Error, framework.Error, framework.Error},
+			expectedOpen: []bool{false, true, true},
+		},
+		{
+			name:           "open breaker does not query the store",
+			policy:         FailOpen,
+			expected:       []framework.Code{framework.Success},
+			expectedOpen:   []bool{true},
+			breakerTripped: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cs := clientsetfake.NewSimpleClientset(&appsv1.ReplicaSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-a-rs",
+					Namespace: "default",
+					OwnerReferences: []metav1.OwnerReference{
+						{APIVersion: "apps/v1", Kind: "Deployment", Name: "test-a"},
+					},
+				},
+			})
+			pod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-a-pod",
+					Namespace: "default",
+					OwnerReferences: []metav1.OwnerReference{
+						{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "test-a-rs"},
+					},
+				},
+			}
+
+			// nothing listens on port 1, so every Redis call fails
+			rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+			defer rdb.Close()
+
+			w := &WAM{
+				k8sClient: cs,
+				rdb:       rdb,
+				config:    &config{FailurePolicy: test.policy, FailureThreshold: 2},
+				breaker:   newCircuitBreaker(2),
+				tracer:    noop.NewTracerProvider().Tracer(tracerName),
+			}
+			if test.breakerTripped {
+				w.breaker.Trip()
+			}
+
+			var actual []framework.Code
+			var actualOpen []bool
+			for range test.expected {
+				state := framework.NewCycleState()
+				_, status := w.PreFilter(ctx, state, pod)
+				actual = append(actual, status.Code())
+				actualOpen = append(actualOpen, w.breaker.IsOpen())
+
+				_, err := state.Read(schedulingSuggestionKey)
+				assert.Error(t, err, "no suggestion should be written to the cycle state")
+			}
+
+			assert.Equal(t, test.expected, actual)
+			assert.Equal(t, test.expectedOpen, actualOpen)
+		})
+	}
+}
+
+func TestGetWorkload(t *testing.T) {
+	cs := clientsetfake.NewSimpleClientset(&appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-a-rs",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{
+				{APIVersion: "apps/v1", Kind: "Deployment", Name: "test-a"},
+			},
+		},
+	})
+	w := &WAM{k8sClient: cs}
+
+	tests := []struct {
+		name     string
+		owner    metav1.OwnerReference
+		expected string
+	}{
+		{
+			name:     "deployment",
+			owner:    metav1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "test-a-rs"},
+			expected: "default:apps/v1:Deployment:test-a",
+		},
+		{
+			name:     "statefulset",
+			owner:    metav1.OwnerReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "test-b"},
+			expected: "default:apps/v1:StatefulSet:test-b",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:            "pod",
+				Namespace:       "default",
+				OwnerReferences: []metav1.OwnerReference{test.owner},
+			}}
+
+			workload, err := w.getWorkload(pod)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, queueName("", workload, pod.Namespace))
+			assert.Equal(t, "edge-1/"+test.expected, queueName("edge-1", workload, pod.Namespace),
+				"queues of a remote cluster are prefixed with its name")
+		})
+	}
+
+	_, err := w.getWorkload(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bare", Namespace: "default"}})
+	assert.Error(t, err, "pods without a workload have no queue")
+}
+
+func TestSuggestionMetrics(t *testing.T) {
+	registerMetrics()
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-a-pod", Namespace: "default"}}
+	cs := clientsetfake.NewSimpleClientset(pod)
+	w := &WAM{k8sClient: cs}
+
+	counter := func(result string) float64 {
+		v, err := metricstestutil.GetCounterMetricValue(suggestionsTotal.WithLabelValues(result))
+		assert.NoError(t, err)
+		return v
+	}
+	honored, rejected := counter(suggestionHonored), counter(suggestionRejected)
+
+	state := framework.NewCycleState()
+	_, status := w.PostFilter(context.Background(), state, pod, nil)
+	assert.Equal(t, framework.Unschedulable, status.Code())
+	assert.Equal(t, rejected, counter(suggestionRejected), "pods without a suggestion are not counted")
+
+	state.Write(schedulingSuggestionKey, &SchedulingSuggestion{ID: "id", NodeName: "node_1"})
+	_, status = w.PostFilter(context.Background(), state, pod, nil)
+	assert.Equal(t, framework.Unschedulable, status.Code(), "other PostFilter plugins must still run")
+	assert.Equal(t, rejected+1, counter(suggestionRejected))
+
+	w.PostBind(context.Background(), state, pod, "node_1")
+	assert.Equal(t, honored+1, counter(suggestionHonored))
+
+	w.PostBind(context.Background(), state, pod, "node_2")
+	assert.Equal(t, rejected+2, counter(suggestionRejected))
+}
+
+// recordingHandle provides the plugin with an event recorder only.
+type recordingHandle struct {
+	framework.Handle
+	recorder *events.FakeRecorder
+}
+
+func (h recordingHandle) EventRecorder() events.EventRecorder {
+	return h.recorder
+}
+
+func TestSuggestionEvents(t *testing.T) {
+	registerMetrics()
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-a-pod", Namespace: "default"}}
+	recorder := events.NewFakeRecorder(3)
+	w := &WAM{k8sClient: clientsetfake.NewSimpleClientset(pod), handle: recordingHandle{recorder: recorder}}
+
+	state := framework.NewCycleState()
+	state.Write(schedulingSuggestionKey, &SchedulingSuggestion{ID: "id", NodeName: "node_1"})
+
+	w.PostFilter(context.Background(), state, pod, framework.NodeToStatusMap{
+		"node_1": framework.NewStatus(framework.Unschedulable, "Insufficient cpu"),
+	})
+	assert.Equal(t, "Warning WAMSuggestedNodeRejected Suggested node node_1 of suggestion id did not pass filtering: Insufficient cpu", <-recorder.Events)
+
+	w.PostBind(context.Background(), state, pod, "node_1")
+	assert.Equal(t, "Normal WAMPodPlaced Placed on suggested node node_1 by suggestion id", <-recorder.Events)
+
+	w.PostBind(context.Background(), state, pod, "node_2")
+	assert.Equal(t, "Warning WAMSuggestedNodeRejected Bound to node node_2 instead of suggested node node_1 of suggestion id", <-recorder.Events)
+}
+
+// inMemoryExporter keeps the exported spans in memory for assertions.
+type inMemoryExporter struct {
+	mu    sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (e *inMemoryExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *inMemoryExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func TestTracePropagation(t *testing.T) {
+	exporter := &inMemoryExporter{}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	// the span of the WAM action that pushed the suggestion
+	actionCtx, actionSpan := tp.Tracer("wam").Start(context.Background(), "CreateHandler")
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(actionCtx, carrier)
+	actionSpan.End()
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-a-pod", Namespace: "default"}}
+	cs := clientsetfake.NewSimpleClientset(pod)
+	w := &WAM{k8sClient: cs, tracer: tp.Tracer(tracerName)}
+
+	suggestion := &SchedulingSuggestion{ID: "id", NodeName: "node_1", TraceContext: carrier}
+	w.startScheduleSpan(context.Background(), pod, suggestion, time.Now())
+
+	state := framework.NewCycleState()
+	state.Write(schedulingSuggestionKey, suggestion)
+	w.PostBind(context.Background(), state.Clone(), pod, "node_1")
+
+	assert.Len(t, exporter.spans, 2)
+	scheduleSpan := exporter.spans[1]
+	assert.Equal(t, "WAM.Schedule", scheduleSpan.Name())
+	assert.Equal(t, actionSpan.SpanContext().TraceID(), scheduleSpan.SpanContext().TraceID())
+	assert.Equal(t, actionSpan.SpanContext().SpanID(), scheduleSpan.Parent().SpanID())
+
+	bound, err := cs.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "id", bound.Annotations["example.com/scheduling-suggestion-id"])
+	assert.Contains(t, bound.Annotations[traceParentAnnotation], scheduleSpan.SpanContext().TraceID().String())
+	assert.Contains(t, bound.Annotations[traceParentAnnotation], scheduleSpan.SpanContext().SpanID().String())
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := newCircuitBreaker(2)
+	assert.True(t, cb.Allow())
+
+	assert.False(t, cb.RecordFailure())
+	assert.True(t, cb.Allow())
+	assert.True(t, cb.RecordFailure())
+	assert.False(t, cb.Allow())
+	assert.False(t, cb.RecordFailure(), "an already open breaker is not opened again")
+
+	assert.True(t, cb.RecordSuccess())
+	assert.True(t, cb.Allow())
+	assert.False(t, cb.RecordSuccess())
+
+	cb.Trip()
+	assert.True(t, cb.IsOpen())
+}
+
 func makeNodeInfo(node string, milliCPU, memory int64) *framework.NodeInfo {
 	ni := framework.NewNodeInfo()
 	ni.SetNode(&v1.Node{
@@ -166,3 +446,71 @@ func (f *fakeSharedLister) StorageInfos() framework.StorageInfoLister {
 func (f *fakeSharedLister) NodeInfos() framework.NodeInfoLister {
 	return tf.NodeInfoLister(f.nodes)
 }
+
+func TestUnreserveEndsSpan(t *testing.T) {
+	exporter := &inMemoryExporter{}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-a-pod", Namespace: "default"}}
+	w := &WAM{k8sClient: clientsetfake.NewSimpleClientset(pod), tracer: tp.Tracer(tracerName)}
+
+	suggestion := &SchedulingSuggestion{ID: "id", NodeName: "node_1"}
+	w.startScheduleSpan(context.Background(), pod, suggestion, time.Now())
+
+	state := framework.NewCycleState()
+	state.Write(schedulingSuggestionKey, suggestion)
+	assert.True(t, w.Reserve(context.Background(), state, pod, "node_1").IsSuccess())
+	w.Unreserve(context.Background(), state.Clone(), pod, "node_1")
+
+	assert.Len(t, exporter.spans, 1)
+	assert.Equal(t, "WAM.Schedule", exporter.spans[0].Name())
+	assert.Equal(t, codes.Error, exporter.spans[0].Status().Code)
+}
+
+// recordingHook records the commands sent to Redis instead of sending them.
+type recordingHook struct {
+	mu   sync.Mutex
+	cmds [][]interface{}
+}
+
+func (h *recordingHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *recordingHook) ProcessHook(redis.ProcessHook) redis.ProcessHook {
+	return func(_ context.Context, cmd redis.Cmder) error {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.cmds = append(h.cmds, cmd.Args())
+		return nil
+	}
+}
+
+func (h *recordingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestUnreserveRequeuesSuggestion(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+	defer rdb.Close()
+	hook := &recordingHook{}
+	rdb.AddHook(hook)
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-a-pod", Namespace: "default"}}
+	w := &WAM{
+		rdb:     rdb,
+		config:  &config{FailurePolicy: FailOpen, FailureThreshold: defaultFailureThreshold},
+		breaker: newCircuitBreaker(defaultFailureThreshold),
+	}
+
+	encoded := `{"id":"id","node_name":"node_1"}`
+	state := framework.NewCycleState()
+	state.Write(schedulingSuggestionKey, &SchedulingSuggestion{ID: "id", NodeName: "node_1", queue: "default:apps/v1:Deployment:test-a", encoded: encoded})
+	w.Unreserve(context.Background(), state.Clone(), pod, "node_1")
+
+	assert.Equal(t, [][]interface{}{{"lpush", "default:apps/v1:Deployment:test-a", encoded}}, hook.cmds)
+
+	// pods scheduled without a suggestion have nothing to push back
+	w.Unreserve(context.Background(), framework.NewCycleState(), pod, "node_1")
+	assert.Len(t, hook.cmds, 1)
+}
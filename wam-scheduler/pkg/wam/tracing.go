@@ -0,0 +1,81 @@
+package wam
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	tracerName = "sigs.k8s.io/scheduler-plugins/pkg/wam"
+	// traceParentAnnotation holds the W3C traceparent of the scheduling span, so the pod can be related to the
+	// action that created it
+	traceParentAnnotation = "example.com/traceparent"
+)
+
+// propagator matches the W3C trace context propagation used by WAM when it injects the trace into suggestions.
+var propagator = propagation.TraceContext{}
+
+// newTracerProvider returns a tracer provider exporting to the configured OTLP endpoint, or a no-op provider if
+// tracing is disabled. The provider is kept local to the plugin so kube-scheduler's own tracing is not affected.
+func newTracerProvider(ctx context.Context, config *config) (trace.TracerProvider, error) {
+	if config.TracingEndpoint == "" {
+		return noop.NewTracerProvider(), nil
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(config.TracingEndpoint)}
+	if config.TracingInsecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("wam-scheduler"))),
+	)
+
+	go func() {
+		<-ctx.Done()
+		_ = tp.Shutdown(context.Background())
+	}()
+
+	return tp, nil
+}
+
+// startScheduleSpan starts the span covering the scheduling of pod with the suggestion, as a child of the action
+// trace carried by the suggestion. The span starts at start, when PreFilter was entered.
+func (w *WAM) startScheduleSpan(ctx context.Context, pod *v1.Pod, suggestion *SchedulingSuggestion, start time.Time) {
+	ctx = propagator.Extract(ctx, propagation.MapCarrier(suggestion.TraceContext))
+	_, suggestion.span = w.tracer.Start(ctx, "WAM.Schedule",
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			attribute.String("wam.pod", pod.Namespace+"/"+pod.Name),
+			attribute.String("wam.suggestion_id", string(suggestion.ID)),
+			attribute.String("wam.node", suggestion.NodeName),
+		))
+}
+
+// traceParent returns the W3C traceparent of the scheduling span of the suggestion, or an empty string if it is not
+// traced.
+func (suggestion *SchedulingSuggestion) traceParent() string {
+	if suggestion.span == nil {
+		return ""
+	}
+
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(trace.ContextWithSpan(context.Background(), suggestion.span), carrier)
+	return carrier.Get("traceparent")
+}
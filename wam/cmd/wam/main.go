@@ -1,43 +1,81 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/ACES-EU/workload-actions-manager/wam/pkg/actions"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/audit"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/auth"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/clusters"
 	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/health"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/leader"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/logging"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/metrics"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/policy"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/tracing"
 	"github.com/gorilla/rpc"
 	jsoncodec "github.com/gorilla/rpc/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
-	"log"
+	"k8s.io/klog/v2"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
+	// the time zones of schedule windows, the image has no tzdata
+	_ "time/tzdata"
 )
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	if err := run(); err != nil {
+		klog.Background().Error(err, "WAM failed")
+		os.Exit(1)
+	}
+}
 
+// run serves the actions until WAM is told to shut down. It returns instead of exiting on errors, so the deferred
+// cleanup, e.g. flushing the buffered spans, runs before main exits.
+func run() error {
 	config, err := wamconfig.New()
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("error loading config: %w", err)
+	}
+
+	lh := logging.Setup(config.Log)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), config.Tracing)
+	if err != nil {
+		return fmt.Errorf("error setting up tracing: %w", err)
 	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			lh.Error(err, "error shutting down tracing")
+		}
+	}()
 
 	kubeConfig, err := clientcmd.BuildConfigFromFlags("", filepath.Join(homedir.HomeDir(), ".kube", "config"))
 	if err != nil {
 		kubeConfig, err = rest.InClusterConfig()
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("error loading k8s config: %w", err)
 		}
 	}
 
 	k8sClient, err := kubernetes.NewForConfig(kubeConfig)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("error creating k8s client: %w", err)
 	}
 
-	log.Println("configured k8s client")
+	lh.Info("configured k8s client")
 
 	rdb := redis.NewClient(&redis.Options{
 		Addr:     fmt.Sprintf("%s:%s", config.Redis.Host, config.Redis.Port),
@@ -45,19 +83,127 @@ func main() {
 		DB:       0,
 	})
 
-	log.Println("configured Redis client")
+	lh.Info("configured Redis client")
+
+	tlsEnabled := config.Server.TLSCertFile != "" && config.Server.TLSKeyFile != ""
+	if config.Auth.ClientCAFile != "" && !tlsEnabled {
+		return errors.New("client certificate authentication requires TLS, set SERVER_TLS_CERT_FILE and SERVER_TLS_KEY_FILE")
+	}
+
+	var authorizer *auth.Authorizer
+	if config.Auth.Enabled {
+		authorizer = auth.NewAuthorizer(k8sClient)
+	} else {
+		lh.Info("authentication and authorization are disabled, anyone reaching the server can run actions")
+	}
+
+	policies := policy.NewEngine(k8sClient, rdb, config.Policy)
+
+	auditSink, err := audit.New(config.Audit, rdb, k8sClient)
+	if err != nil {
+		return fmt.Errorf("error configuring audit log: %w", err)
+	}
+	if auditSink == nil {
+		lh.Info("audit log is disabled")
+	}
+
+	service := actions.NewActionService(k8sClient, rdb, config.Actions, authorizer, policies, auditSink)
+
+	syncCtx, cancelSync := context.WithTimeout(klog.NewContext(context.Background(), lh), time.Minute)
+	remoteClients, err := clusters.Load(syncCtx, config.Clusters, k8sClient)
+	if err != nil {
+		cancelSync()
+		return fmt.Errorf("error loading remote clusters: %w", err)
+	}
+	for name, client := range remoteClients {
+		service.AddCluster(name, client)
+		lh.Info("configured remote cluster", "cluster", name)
+	}
+
+	err = service.Start(syncCtx)
+	cancelSync()
+	if err != nil {
+		return fmt.Errorf("error starting action service: %w", err)
+	}
 
 	s := rpc.NewServer()
 	s.RegisterCodec(jsoncodec.NewCodec(), "application/json")
-	err = s.RegisterService(actions.NewActionService(k8sClient, rdb), "action")
+	err = s.RegisterService(service, "action")
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("error registering action service: %w", err)
+	}
+	if config.Auth.Enabled {
+		http.Handle("/rpc", auth.NewAuthenticator(k8sClient, config.Auth.Audiences).Middleware(s))
+	} else {
+		http.Handle("/rpc", s)
 	}
-	http.Handle("/rpc", s)
 
-	log.Printf("Listening on %s...\n", config.Server.Address)
-	err = http.ListenAndServe(config.Server.Address, nil)
-	if err != nil {
-		panic(err)
+	prometheus.MustRegister(metrics.NewQueueDepthCollector(rdb, actions.QueuePattern, actions.QueueType))
+	http.Handle("/metrics", promhttp.Handler())
+
+	// Redis is only checked for readiness, so an outage of Redis does not restart every replica
+	http.Handle("/healthz", health.Handler(health.Kubernetes(k8sClient)))
+	// stops passing on shutdown, so no new actions are routed to this replica while running ones are drained
+	http.Handle("/readyz", health.Handler(health.Kubernetes(k8sClient), health.Redis(rdb),
+		health.Check{Name: "accepting-actions", Check: service.Accepting}))
+
+	server := &http.Server{Addr: config.Server.Address}
+	if tlsEnabled {
+		server.TLSConfig, err = auth.ServerTLSConfig(config.Auth.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("error configuring TLS: %w", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// the heartbeat tells the reconciler of the leader that the journaled actions of this replica are still running
+	go service.Heartbeat()
+	// actions are cancelled through any replica, the replica running the action is told over Redis
+	go service.WatchCancels()
+	if !config.Reconciler.Enabled {
+		lh.Info("reconciler is disabled, actions interrupted by a dying replica are not recovered")
+	}
+	// the leader dispatches the actions deferred by their schedule and reconciles
+	go leader.Run(klog.NewContext(ctx, lh), k8sClient, config.Leader, service.Identity(), func(ctx context.Context) {
+		if config.Reconciler.Enabled {
+			go service.Reconcile(ctx, config.Reconciler)
+		}
+		service.Dispatch(ctx, config.Scheduler)
+	})
+
+	serveErr := make(chan error, 1)
+	go func() {
+		lh.Info("listening", "address", config.Server.Address, "tls", tlsEnabled)
+		if tlsEnabled {
+			serveErr <- server.ListenAndServeTLS(config.Server.TLSCertFile, config.Server.TLSKeyFile)
+			return
+		}
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("error serving: %w", err)
+	case <-ctx.Done():
 	}
+
+	lh.Info("shutting down", "gracePeriod", config.Server.ShutdownGracePeriod)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), config.Server.ShutdownGracePeriod)
+	defer cancel()
+	if err := service.Shutdown(klog.NewContext(drainCtx, lh)); err != nil {
+		lh.Error(err, "running actions were interrupted")
+	}
+
+	// the actions are done, give the remaining requests, e.g. metric scrapes, a moment to complete
+	serverCtx, cancelServer := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelServer()
+	if err := server.Shutdown(serverCtx); err != nil {
+		lh.Error(err, "error shutting down server")
+	}
+
+	lh.Info("shutdown complete")
+	return nil
 }
@@ -0,0 +1,497 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/logging"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"slices"
+	"sync"
+)
+
+const (
+	// BatchSequential runs the actions of a batch one after another, in order.
+	BatchSequential = "sequential"
+	// BatchParallel runs the actions of a batch in parallel, except actions on the same workloads, which run in order.
+	BatchParallel = "parallel"
+)
+
+// BatchAction is a single action of a batch, exactly one of its fields is set.
+type BatchAction struct {
+	Create *CreateArgs `json:"create,omitempty"`
+	Delete *DeleteArgs `json:"delete,omitempty"`
+	Move   *MoveArgs   `json:"move,omitempty"`
+	Swap   *SwapArgs   `json:"swap,omitempty"`
+}
+
+type BatchArgs struct {
+	Actions []BatchAction `json:"actions"`
+	// Mode is sequential, the default, or parallel
+	Mode string `json:"mode,omitempty"`
+	// Atomic undoes the completed actions if one of the actions fails
+	Atomic bool `json:"atomic,omitempty"`
+	ActionOptions
+}
+
+type BatchReply struct {
+	Message  string `json:"message"`
+	ActionID string `json:"actionId"`
+	// Status of the batch, for a repeated idempotency key that of the original batch
+	Status string `json:"status,omitempty"`
+	// Plans of the actions, in the order of the request
+	Plans []*Plan `json:"plans,omitempty"`
+}
+
+// action returns the type of the action.
+func (ba *BatchAction) action() string {
+	switch {
+	case ba.Create != nil:
+		return actionCreate
+	case ba.Delete != nil:
+		return actionDelete
+	case ba.Move != nil:
+		return actionMove
+	default:
+		return actionSwap
+	}
+}
+
+// namespaces returns the namespaces the action touches.
+func (ba *BatchAction) namespaces() []string {
+	switch {
+	case ba.Create != nil:
+		return []string{ba.Create.Workload.Namespace}
+	case ba.Delete != nil:
+		return []string{ba.Delete.Pod.Namespace}
+	case ba.Move != nil:
+		return []string{ba.Move.Pod.Namespace}
+	default:
+		namespaces := []string{ba.Swap.X.Namespace}
+		for _, pod := range ba.Swap.Y {
+			namespaces = append(namespaces, pod.Namespace)
+		}
+		return namespaces
+	}
+}
+
+// namespaces returns the namespaces the actions of the batch touch.
+func (args *BatchArgs) namespaces() []string {
+	var namespaces []string
+	for i := range args.Actions {
+		namespaces = append(namespaces, args.Actions[i].namespaces()...)
+	}
+	return namespaces
+}
+
+// cluster returns the cluster the action acts on, for a move the cluster of the moved pod.
+func (ba *BatchAction) cluster() string {
+	switch {
+	case ba.Create != nil:
+		return ba.Create.Workload.Cluster
+	case ba.Delete != nil:
+		return ba.Delete.Pod.Cluster
+	case ba.Move != nil:
+		return ba.Move.Pod.Cluster
+	default:
+		return ba.Swap.X.Cluster
+	}
+}
+
+// policyArgs returns what the action creates and deletes, see checkPolicies.
+func (ba *BatchAction) policyArgs() (workloads []Workload, removed []Pod, target string) {
+	switch {
+	case ba.Create != nil:
+		return []Workload{ba.Create.Workload}, nil, ba.Create.Node.Name
+	case ba.Delete != nil:
+		return nil, []Pod{ba.Delete.Pod}, ""
+	case ba.Move != nil:
+		return nil, []Pod{ba.Move.Pod}, ba.Move.Node.Name
+	default:
+		return nil, append([]Pod{ba.Swap.X}, ba.Swap.Y...), ""
+	}
+}
+
+// planBatchAction returns the plan of the action.
+func (as *ActionService) planBatchAction(ctx context.Context, id string, ba *BatchAction) (*Plan, error) {
+	switch {
+	case ba.Create != nil:
+		return as.planCreate(ctx, id, ba.Create)
+	case ba.Delete != nil:
+		return as.planDelete(ctx, id, ba.Delete)
+	case ba.Move != nil:
+		return as.planMove(ctx, id, ba.Move)
+	default:
+		return as.planSwap(ctx, id, ba.Swap)
+	}
+}
+
+func validateBatchReq(args *BatchArgs) error {
+	if len(args.Actions) == 0 {
+		return fmt.Errorf("at least one action is required")
+	}
+
+	if args.Mode == "" {
+		args.Mode = BatchSequential
+	}
+	if args.Mode != BatchSequential && args.Mode != BatchParallel {
+		return fmt.Errorf("mode must be %s or %s", BatchSequential, BatchParallel)
+	}
+
+	for i := range args.Actions {
+		ba := &args.Actions[i]
+
+		set := 0
+		var err error
+		var options ActionOptions
+		if ba.Create != nil {
+			set++
+			err = validateCreateReq(ba.Create)
+			options = ba.Create.ActionOptions
+		}
+		if ba.Delete != nil {
+			set++
+			err = validateDeleteReq(ba.Delete)
+			options = ba.Delete.ActionOptions
+		}
+		if ba.Move != nil {
+			set++
+			err = validateMoveReq(ba.Move)
+			options = ba.Move.ActionOptions
+		}
+		if ba.Swap != nil {
+			set++
+			err = validateSwapReq(ba.Swap)
+			options = ba.Swap.ActionOptions
+		}
+
+		if set != 1 {
+			return fmt.Errorf("action at index %d must set exactly one of create, delete, move and swap", i)
+		}
+		if err != nil {
+			return fmt.Errorf("action at index %d: %w", i, err)
+		}
+		if options != (ActionOptions{}) {
+			return fmt.Errorf("action at index %d: dryRun, idempotencyKey, schedule, priority, timeouts and retry must be set on the batch", i)
+		}
+	}
+
+	return nil
+}
+
+// batchStep is a resolved action of a batch.
+type batchStep struct {
+	index  int
+	action string
+	// workloads are the namespace/name of the Deployments the step scales, steps sharing one conflict
+	workloads []string
+	run       func(ctx context.Context) error
+	// compensate undoes the step once it completed
+	compensate func(ctx context.Context) error
+}
+
+func workloadKey(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+// resolveBatchStep resolves the workloads of an action and what is needed to undo it, e.g. the node of a deleted pod.
+func (as *ActionService) resolveBatchStep(ctx context.Context, index int, ba *BatchAction) (*batchStep, error) {
+	step := &batchStep{index: index, action: ba.action()}
+
+	switch {
+	case ba.Create != nil:
+		args := ba.Create
+		step.workloads = []string{workloadKey(args.Workload.Namespace, args.Workload.Name)}
+		step.run = func(ctx context.Context) error {
+			suggestion, err := as.CreateHandler(ctx, args)
+			if err != nil {
+				return err
+			}
+			// the step completes with the new pod, so it can be found to undo the step
+			_, err = as.waitToBeReady(ctx, actionCreate, args.Workload.Namespace, suggestion, as.timeouts(ctx).Ready)
+			if err != nil {
+				return err
+			}
+			// undoing the completed step deletes the new pod, a cancel does not roll the create back on top
+			as.journalSettle(ctx, suggestion)
+			return nil
+		}
+		step.compensate = func(ctx context.Context) error {
+			pods, err := as.newestPods(ctx, args.Workload.Namespace, args.Workload.Name, args.Node.Name, 1)
+			if err != nil {
+				return err
+			}
+			_, err = as.DeleteHandler(ctx, &DeleteArgs{Pod: pods[0]})
+			return err
+		}
+
+	case ba.Delete != nil:
+		args := ba.Delete
+		removal, err := as.resolveDeploymentRemoval(ctx, args.Pod)
+		if err != nil {
+			return nil, err
+		}
+		workload := Workload{removal.Workload.Namespace, "apps/v1", "Deployment", removal.Workload.Name, as.name}
+		node := removal.Pod.Spec.NodeName
+
+		step.workloads = []string{workloadKey(workload.Namespace, workload.Name)}
+		step.run = func(ctx context.Context) error {
+			_, err := as.DeleteHandler(ctx, args)
+			return err
+		}
+		step.compensate = func(ctx context.Context) error {
+			suggestion, err := as.CreateHandler(ctx, &CreateArgs{Workload: workload, Node: Node{node, as.name}})
+			if err != nil {
+				return err
+			}
+			// the create restores the deleted replica, a cancel does not roll it back
+			as.journalSettle(ctx, suggestion)
+			return nil
+		}
+
+	case ba.Move != nil:
+		args := ba.Move
+		removal, err := as.resolveDeploymentRemoval(ctx, args.Pod)
+		if err != nil {
+			return nil, err
+		}
+		workload := removal.Workload
+		node := removal.Pod.Spec.NodeName
+
+		step.workloads = []string{workloadKey(workload.Namespace, workload.Name)}
+		step.run = func(ctx context.Context) error {
+			return as.MoveHandler(ctx, args)
+		}
+		step.compensate = func(ctx context.Context) error {
+			pods, err := as.newestPods(ctx, workload.Namespace, workload.Name, args.Node.Name, 1)
+			if err != nil {
+				return err
+			}
+			return as.MoveHandler(ctx, &MoveArgs{Pod: pods[0], Node: Node{node, as.name}})
+		}
+
+	case ba.Swap != nil:
+		args := ba.Swap
+		t, err := as.resolveSwap(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ca := range t.createArgs {
+			key := workloadKey(ca.Workload.Namespace, ca.Workload.Name)
+			if !slices.Contains(step.workloads, key) {
+				step.workloads = append(step.workloads, key)
+			}
+		}
+		step.run = func(ctx context.Context) error {
+			return as.SwapHandler(ctx, args)
+		}
+		step.compensate = func(ctx context.Context) error {
+			// swap the re-created pods back, X is now on the node of the Y pods and the other way round
+			x, err := as.newestPods(ctx, t.createArgs[0].Workload.Namespace, t.createArgs[0].Workload.Name, t.nodeY, 1)
+			if err != nil {
+				return err
+			}
+
+			back := &SwapArgs{X: x[0]}
+			for _, ca := range t.createArgs[1:] {
+				pods, err := as.newestPods(ctx, ca.Workload.Namespace, ca.Workload.Name, t.nodeX, len(back.Y)+1)
+				if err != nil {
+					return err
+				}
+				// Y pods of the same workload take the next newest pod each
+				for _, pod := range pods {
+					if !slices.Contains(back.Y, pod) {
+						back.Y = append(back.Y, pod)
+						break
+					}
+				}
+			}
+			if len(back.Y) != len(t.createArgs)-1 {
+				return fmt.Errorf("could not find the re-created y pods on node %s", t.nodeX)
+			}
+
+			return as.SwapHandler(ctx, back)
+		}
+	}
+
+	return step, nil
+}
+
+// newestPods returns the n most recently created pods of a Deployment running on a node.
+func (as *ActionService) newestPods(ctx context.Context, namespace string, name string, node string, n int) ([]Pod, error) {
+	deployment, err := as.getDeployment(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	podList, err := as.k8sClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: metav1.FormatLabelSelector(deployment.Spec.Selector),
+		FieldSelector: "spec.nodeName=" + node,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []v1.Pod
+	for _, pod := range podList.Items {
+		if pod.DeletionTimestamp == nil && pod.Spec.NodeName == node {
+			candidates = append(candidates, pod)
+		}
+	}
+	if len(candidates) < n {
+		return nil, fmt.Errorf("found %d of %d pods of workload %s on node %s", len(candidates), n, klog.KObj(deployment), node)
+	}
+
+	slices.SortFunc(candidates, func(a, b v1.Pod) int {
+		return b.CreationTimestamp.Compare(a.CreationTimestamp.Time)
+	})
+
+	pods := make([]Pod, n)
+	for i := range pods {
+		pods[i] = Pod{Namespace: candidates[i].Namespace, Name: candidates[i].Name, Cluster: as.name}
+	}
+	return pods, nil
+}
+
+// batchGroups splits the steps into groups that can run in parallel. Steps sharing a workload are in the same group,
+// in the order of the request.
+func batchGroups(steps []*batchStep) [][]*batchStep {
+	// union-find over the step indexes
+	parent := make([]int, len(steps))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	owner := map[string]int{}
+	for i, step := range steps {
+		for _, workload := range step.workloads {
+			if j, ok := owner[workload]; ok {
+				parent[find(i)] = find(j)
+			} else {
+				owner[workload] = i
+			}
+		}
+	}
+
+	var groups [][]*batchStep
+	groupOf := map[int]int{}
+	for i, step := range steps {
+		root := find(i)
+		g, ok := groupOf[root]
+		if !ok {
+			g = len(groups)
+			groupOf[root] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], step)
+	}
+
+	return groups
+}
+
+// BatchHandler runs the resolved steps of a batch. In atomic mode, no further steps are started once a step failed,
+// and the completed steps are undone in reverse order.
+func (as *ActionService) BatchHandler(ctx context.Context, args *BatchArgs, steps []*batchStep) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "BatchHandler", trace.WithAttributes(
+		attribute.Int("wam.batch_size", len(steps)),
+		attribute.String("wam.batch_mode", args.Mode),
+		attribute.Bool("wam.batch_atomic", args.Atomic),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	lh := klog.FromContext(ctx)
+
+	var mu sync.Mutex
+	var completed []*batchStep
+	var errs []error
+
+	runGroup := func(group []*batchStep) {
+		for _, step := range group {
+			mu.Lock()
+			stop := args.Atomic && len(errs) > 0
+			mu.Unlock()
+			if stop || ctx.Err() != nil {
+				return
+			}
+
+			stepCtx, stepLh := logging.WithValues(ctx, "step", step.index, "stepAction", step.action)
+			stepLh.V(2).Info("running batch step")
+
+			if err := step.run(stepCtx); err != nil {
+				stepLh.Error(err, "batch step failed")
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("step %d (%s): %w", step.index, step.action, err))
+				mu.Unlock()
+				// the next steps of the group may depend on this one
+				return
+			}
+
+			mu.Lock()
+			completed = append(completed, step)
+			mu.Unlock()
+		}
+	}
+
+	if args.Mode == BatchSequential {
+		runGroup(steps)
+	} else {
+		var wg sync.WaitGroup
+		for _, group := range batchGroups(steps) {
+			wg.Add(1)
+			go func(group []*batchStep) {
+				defer wg.Done()
+				runGroup(group)
+			}(group)
+		}
+		wg.Wait()
+	}
+
+	// the batch was cancelled or interrupted between two steps
+	if len(errs) == 0 && ctx.Err() != nil {
+		errs = append(errs, context.Cause(ctx))
+	}
+
+	if len(errs) == 0 {
+		lh.Info("batch action successful", "steps", len(steps))
+		return nil
+	}
+
+	err = errors.Join(errs...)
+	if !args.Atomic {
+		lh.Info("batch action failed", "completed", len(completed), "steps", len(steps))
+		return err
+	}
+
+	lh.Info("batch action failed, undoing the completed steps", "completed", len(completed))
+	// the completed steps of a cancelled batch are undone regardless
+	undoCtx := ctx
+	if cancelled(ctx) {
+		undoCtx = context.WithoutCancel(ctx)
+	}
+	for i := len(completed) - 1; i >= 0; i-- {
+		step := completed[i]
+		stepCtx, stepLh := logging.WithValues(undoCtx, "step", step.index, "stepAction", step.action)
+
+		if cerr := step.compensate(stepCtx); cerr != nil {
+			stepLh.Error(cerr, "error undoing batch step")
+			err = errors.Join(err, fmt.Errorf("undoing step %d (%s): %w", step.index, step.action, cerr))
+			continue
+		}
+		stepLh.V(2).Info("undid batch step")
+	}
+
+	return err
+}
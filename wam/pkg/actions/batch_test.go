@@ -0,0 +1,214 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+func TestBatchGroups(t *testing.T) {
+	steps := []*batchStep{
+		{index: 0, workloads: []string{"default/a"}},
+		{index: 1, workloads: []string{"default/b"}},
+		// a swap links the groups of a and c
+		{index: 2, workloads: []string{"default/c", "default/a"}},
+		{index: 3, workloads: []string{"default/c"}},
+		{index: 4, workloads: []string{"default/d"}},
+	}
+
+	var got [][]int
+	for _, group := range batchGroups(steps) {
+		var indexes []int
+		for _, step := range group {
+			indexes = append(indexes, step.index)
+		}
+		got = append(got, indexes)
+	}
+
+	want := [][]int{{0, 2, 3}, {1}, {4}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected groups %v, got %v", want, got)
+	}
+}
+
+func TestValidateBatchReq(t *testing.T) {
+	move := &MoveArgs{Pod: Pod{Name: "a-0"}, Node: Node{Name: "node-1"}}
+
+	tests := []struct {
+		name    string
+		args    *BatchArgs
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			args: &BatchArgs{Actions: []BatchAction{{Move: move}}},
+		},
+		{
+			name:    "no actions",
+			args:    &BatchArgs{},
+			wantErr: true,
+		},
+		{
+			name:    "unknown mode",
+			args:    &BatchArgs{Actions: []BatchAction{{Move: move}}, Mode: "random"},
+			wantErr: true,
+		},
+		{
+			name:    "two actions in one",
+			args:    &BatchArgs{Actions: []BatchAction{{Move: move, Delete: &DeleteArgs{Pod: Pod{Name: "a-1"}}}}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid sub-action",
+			args:    &BatchArgs{Actions: []BatchAction{{Delete: &DeleteArgs{}}}},
+			wantErr: true,
+		},
+		{
+			name:    "dry run on sub-action",
+			args:    &BatchArgs{Actions: []BatchAction{{Delete: &DeleteArgs{Pod: Pod{Name: "a-1"}, ActionOptions: ActionOptions{DryRun: true}}}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBatchReq(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestResolveBatchStepStatefulSetPod(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            "db-0",
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "db"}},
+		},
+		Spec: v1.PodSpec{NodeName: "node-1"},
+	})
+	as := NewActionService(client, nil, wamconfig.Actions{}, nil, nil, nil)
+	pod := Pod{Namespace: "default", Name: "db-0"}
+
+	for _, ba := range []*BatchAction{
+		{Delete: &DeleteArgs{Pod: pod}},
+		{Move: &MoveArgs{Pod: pod, Node: Node{Name: "node-2"}}},
+	} {
+		t.Run(ba.action(), func(t *testing.T) {
+			if _, err := as.resolveBatchStep(context.Background(), 0, ba); err == nil {
+				t.Error("expected a StatefulSet pod to be rejected")
+			}
+		})
+	}
+}
+
+func TestBatchHandlerAtomic(t *testing.T) {
+	fail := errors.New("failed")
+
+	tests := []struct {
+		name   string
+		atomic bool
+		// failing is the index of the failing step, -1 if all succeed
+		failing    int
+		wantRun    []int
+		wantUndone []int
+		wantErr    bool
+	}{
+		{name: "succeeds", atomic: true, failing: -1, wantRun: []int{0, 1, 2}},
+		{name: "undoes completed steps in reverse", atomic: true, failing: 2, wantRun: []int{0, 1, 2}, wantUndone: []int{1, 0},
+			wantErr: true},
+		{name: "stops at the failed step", atomic: true, failing: 1, wantRun: []int{0, 1}, wantUndone: []int{0}, wantErr: true},
+		{name: "not atomic", failing: 1, wantRun: []int{0, 1}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			as := NewActionService(nil, nil, wamconfig.Actions{}, nil, nil, nil)
+
+			var run, undone []int
+			var steps []*batchStep
+			for i := 0; i < 3; i++ {
+				steps = append(steps, &batchStep{
+					index:     i,
+					action:    actionCreate,
+					workloads: []string{"default/a"},
+					run: func(context.Context) error {
+						run = append(run, i)
+						if i == test.failing {
+							return fail
+						}
+						return nil
+					},
+					compensate: func(context.Context) error {
+						undone = append(undone, i)
+						return nil
+					},
+				})
+			}
+
+			err := as.BatchHandler(context.Background(), &BatchArgs{Mode: BatchSequential, Atomic: test.atomic}, steps)
+			if (err != nil) != test.wantErr {
+				t.Errorf("expected error %v, got %v", test.wantErr, err)
+			}
+			if test.wantErr && !errors.Is(err, fail) {
+				t.Errorf("expected the error of the failed step, got %v", err)
+			}
+			if !reflect.DeepEqual(run, test.wantRun) {
+				t.Errorf("expected steps %v to run, got %v", test.wantRun, run)
+			}
+			if !reflect.DeepEqual(undone, test.wantUndone) {
+				t.Errorf("expected steps %v to be undone, got %v", test.wantUndone, undone)
+			}
+		})
+	}
+}
+
+func TestBatchHandlerCancelled(t *testing.T) {
+	as := NewActionService(nil, nil, wamconfig.Actions{}, nil, nil, nil)
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	var undone []int
+	var undoErr error
+	steps := []*batchStep{
+		{
+			index: 0,
+			run: func(context.Context) error {
+				// the batch is cancelled while the first step runs
+				cancel(errCancelled)
+				return nil
+			},
+			compensate: func(ctx context.Context) error {
+				undone = append(undone, 0)
+				undoErr = ctx.Err()
+				return nil
+			},
+		},
+		{
+			index: 1,
+			run: func(context.Context) error {
+				t.Error("expected no step to start after the cancel")
+				return nil
+			},
+		},
+	}
+
+	err := as.BatchHandler(ctx, &BatchArgs{Mode: BatchSequential, Atomic: true}, steps)
+	if !errors.Is(err, errCancelled) {
+		t.Errorf("expected the batch to fail with the cancel, got %v", err)
+	}
+	if !reflect.DeepEqual(undone, []int{0}) {
+		t.Errorf("expected step 0 to be undone, got %v", undone)
+	}
+	if undoErr != nil {
+		t.Errorf("expected the undo to run on a live context, got %v", undoErr)
+	}
+}
@@ -0,0 +1,301 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/auth"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/logging"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/metrics"
+	"github.com/redis/go-redis/v9"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog/v2"
+)
+
+// cancelChannel is the Redis channel the IDs of the actions to cancel are published on, the replica running the
+// action cancels it, see WatchCancels
+const cancelChannel = "wam:cancel"
+
+// errCancelled is the cause of the context of a cancelled action
+var errCancelled = errors.New("action was cancelled")
+
+type CancelArgs struct {
+	ActionID string `json:"actionId"`
+}
+
+type CancelReply struct {
+	Message  string `json:"message"`
+	ActionID string `json:"actionId"`
+	// Status is cancelled for an action that was still scheduled, a running action reports its own outcome once it
+	// rolled back
+	Status string `json:"status,omitempty"`
+}
+
+// cancelled reports whether ctx is that of a cancelled action.
+func cancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errCancelled)
+}
+
+// Cancel stops a running action and rolls back its unfinished steps, or removes a scheduled action before it starts.
+// The caller needs the verb of the action in the namespaces it touches.
+func (as *ActionService) Cancel(r *http.Request, args *CancelArgs, reply *CancelReply) error {
+	ctx, lh := logging.WithValues(r.Context(), "actionID", args.ActionID)
+
+	if args.ActionID == "" {
+		return fmt.Errorf("action ID is required")
+	}
+
+	reply.ActionID = args.ActionID
+
+	cancelledScheduled, err := as.cancelScheduled(ctx, args.ActionID)
+	if err != nil {
+		return err
+	}
+	if cancelledScheduled {
+		lh.Info("cancelled scheduled action")
+		reply.Message = "cancelled"
+		reply.Status = statusCancelled
+		return nil
+	}
+
+	encoded, err := as.rdb.HGet(ctx, journalKey, args.ActionID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return fmt.Errorf("no running action with action ID %s", args.ActionID)
+	}
+	if err != nil {
+		return err
+	}
+	entry := &journalEntry{}
+	if err := json.Unmarshal(encoded, entry); err != nil {
+		return fmt.Errorf("error decoding journal entry: %w", err)
+	}
+
+	err = as.authorize(ctx, entry.Action, entry.Namespaces...)
+	if err != nil {
+		return err
+	}
+
+	alive, err := as.rdb.Exists(ctx, replicaKey(entry.Owner)).Result()
+	if err != nil {
+		return err
+	}
+	if alive == 0 {
+		return fmt.Errorf("action %s was interrupted on replica %s, the reconciler recovers it", args.ActionID, entry.Owner)
+	}
+
+	if !as.cancelLocal(args.ActionID) {
+		if err := as.rdb.Publish(ctx, cancelChannel, args.ActionID).Err(); err != nil {
+			return fmt.Errorf("error publishing cancel: %w", err)
+		}
+	}
+	lh.Info("cancelling action", "actionType", entry.Action, "owner", entry.Owner)
+
+	reply.Message = "cancelling"
+	return nil
+}
+
+// cancelScheduled cancels an action waiting for its schedule and returns true. It returns false if there is no such
+// action or the scheduler already claimed it.
+func (as *ActionService) cancelScheduled(ctx context.Context, id string) (bool, error) {
+	record, err := as.loadScheduled(ctx, id)
+	if err != nil || record.Status != statusScheduled {
+		return false, nil
+	}
+
+	err = as.authorize(ctx, record.Action, record.Namespaces...)
+	if err != nil {
+		return false, err
+	}
+
+	// removing the action from the due set claims it, like the scheduler does before dispatching it
+	claimed, err := as.rdb.ZRem(ctx, dueKey, id).Result()
+	if err != nil {
+		return false, fmt.Errorf("error cancelling scheduled action: %w", err)
+	}
+	if claimed == 0 {
+		return false, nil
+	}
+
+	record.Status = statusCancelled
+	if err := as.saveScheduled(ctx, record, scheduledTTL); err != nil {
+		klog.FromContext(ctx).Error(err, "error storing cancelled action")
+	}
+	// the idempotency key is scoped to the caller of the action, see idempotencyKey
+	if record.Caller != nil {
+		ctx = auth.WithUser(ctx, record.Caller)
+	}
+	as.finishIdempotencyKey(ctx, record.IdempotencyKey, id, record.Action, statusCancelled, nil)
+	metrics.ScheduledActions.WithLabelValues(record.Action, statusCancelled).Inc()
+
+	return true, nil
+}
+
+// cancelLocal cancels the action if it runs on this replica and returns whether it does.
+func (as *ActionService) cancelLocal(id string) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	cancel, ok := as.cancels[id]
+	if ok {
+		cancel(errCancelled)
+	}
+	return ok
+}
+
+// WatchCancels cancels the actions of this replica cancelled through another replica until the service is shut down.
+func (as *ActionService) WatchCancels() {
+	lh := klog.FromContext(as.ctx)
+
+	sub := as.rdb.Subscribe(as.ctx, cancelChannel)
+	defer func() {
+		if err := sub.Close(); err != nil {
+			lh.Error(err, "error closing cancel subscription")
+		}
+	}()
+
+	for {
+		select {
+		case <-as.ctx.Done():
+			return
+		case msg, ok := <-sub.Channel():
+			if !ok {
+				return
+			}
+			if as.cancelLocal(msg.Payload) {
+				lh.Info("cancelling action", "actionID", msg.Payload)
+			}
+		}
+	}
+}
+
+// decideCancelledStep decides how to roll back a step a cancelled action left unsettled, given the pod placed by its
+// suggestion or nil if there is none yet. A create is rolled back until its pod is placed. A move is rolled back until
+// its new pod is ready, after that the pod it replaces is deleted, as either way the workload keeps its replicas.
+func decideCancelledStep(step *journalStep, placed *v1.Pod) stepOutcome {
+	if step.Pod == nil {
+		if placed != nil {
+			return stepSettled
+		}
+		return stepCompensate
+	}
+
+	if step.Deleting || (placed != nil && isPodReady(placed)) {
+		return stepResume
+	}
+	return stepCompensate
+}
+
+// compensateCancelled rolls back the steps of a cancelled action its handler left unsettled, see decideCancelledStep,
+// then removes the deletion costs it set and reverts its scale changes. It runs once the handler returned, so no step
+// changes in between.
+func (as *ActionService) compensateCancelled(ctx context.Context, id string) {
+	ctx = context.WithoutCancel(ctx)
+	lh := klog.FromContext(ctx)
+
+	as.mu.Lock()
+	var steps []journalStep
+	var marked []Pod
+	var scales []journalScale
+	if entry, ok := as.entries[id]; ok {
+		for _, step := range entry.Steps {
+			steps = append(steps, *step)
+		}
+		marked = slices.Clone(entry.Marked)
+		scales = slices.Clone(entry.Scales)
+	}
+	as.mu.Unlock()
+
+	for _, step := range steps {
+		stepLh := lh.WithValues("suggestionID", step.Suggestion.ID)
+
+		workload, ok := parseQueueName(step.Queue)
+		if !ok {
+			continue
+		}
+		target, err := as.inCluster(workload.Cluster)
+		if err != nil {
+			stepLh.Error(err, "error resolving cluster of step")
+			continue
+		}
+
+		placed, err := target.placedPod(workload.Namespace, step.Suggestion)
+		if err != nil {
+			stepLh.Error(err, "error listing pods")
+			continue
+		}
+
+		switch decideCancelledStep(&step, placed) {
+		case stepResume:
+			err = target.resumeMove(ctx, workload, &step)
+		case stepCompensate:
+			err = target.compensate(ctx, workload, &step, placed)
+		default:
+			continue
+		}
+		if err != nil {
+			stepLh.Error(err, "error rolling back step of cancelled action")
+			continue
+		}
+		as.journalSettle(ctx, step.Suggestion)
+		stepLh.V(2).Info("rolled back step of cancelled action")
+	}
+	for _, pod := range marked {
+		as.unmark(ctx, pod)
+	}
+
+	// the latest scale change is reverted first
+	for i := len(scales) - 1; i >= 0; i-- {
+		scale := scales[i]
+		target, err := as.inCluster(scale.Workload.Cluster)
+		if err == nil {
+			err = target.revertScale(ctx, scale.Workload, scale.Delta)
+		}
+		if err != nil {
+			lh.Error(err, "error reverting scale change of cancelled action", "workload", klog.KRef(scale.Workload.Namespace, scale.Workload.Name))
+		}
+	}
+}
+
+// unmark removes the deletion cost WAM set on the pod, if it still runs.
+func (as *ActionService) unmark(ctx context.Context, pod Pod) {
+	lh := klog.FromContext(ctx).WithValues("markedPod", klog.KRef(pod.Namespace, pod.Name))
+
+	target, err := as.inCluster(pod.Cluster)
+	if err != nil {
+		lh.Error(err, "error resolving cluster of marked pod")
+		return
+	}
+	cached, err := target.pods.Pods(pod.Namespace).Get(pod.Name)
+	if apierrors.IsNotFound(err) || (err == nil && (cached.DeletionTimestamp != nil || !markedForDeletion(cached))) {
+		return
+	}
+	if err != nil {
+		lh.Error(err, "error getting marked pod")
+		return
+	}
+
+	target.clearDeletionCost(ctx, cached)
+}
+
+// revertScale undoes a scale change of the workload by delta replicas while holding its lock and removes it from the
+// journal.
+func (as *ActionService) revertScale(ctx context.Context, workload Workload, delta int32) error {
+	unlock, err := as.lock(ctx, workload.QueueName())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, to, err := as.scaleBy(ctx, workload.Namespace, workload.Name, -delta)
+	if err != nil {
+		return err
+	}
+	as.journalUnscaled(ctx, workload, delta)
+	klog.FromContext(ctx).V(2).Info("reverted scale change", "workload", klog.KRef(workload.Namespace, workload.Name), "replicas", to)
+	return nil
+}
@@ -0,0 +1,156 @@
+package actions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+func TestDecideCancelledStep(t *testing.T) {
+	pending := &v1.Pod{}
+	ready := &v1.Pod{Status: v1.PodStatus{Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}}}
+	moved := &Pod{Namespace: "default", Name: "a"}
+
+	tests := []struct {
+		name   string
+		step   *journalStep
+		placed *v1.Pod
+		want   stepOutcome
+	}{
+		{name: "create not placed", step: &journalStep{Scaled: true}, want: stepCompensate},
+		{name: "create placed", step: &journalStep{Scaled: true}, placed: pending, want: stepSettled},
+		{name: "move not placed", step: &journalStep{Scaled: true, Pod: moved}, want: stepCompensate},
+		{name: "move not ready", step: &journalStep{Scaled: true, Pod: moved}, placed: pending, want: stepCompensate},
+		{name: "move ready", step: &journalStep{Scaled: true, Pod: moved}, placed: ready, want: stepResume},
+		{name: "move deleting", step: &journalStep{Scaled: true, Pod: moved, Deleting: true}, want: stepResume},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := decideCancelledStep(test.step, test.placed); got != test.want {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCancelLocal(t *testing.T) {
+	as := NewActionService(nil, nil, wamconfig.Actions{}, nil, nil, nil)
+
+	status := make(chan string, 1)
+	if err := as.spawn(context.Background(), "a", actionMove, nil, func(ctx context.Context) {
+		<-ctx.Done()
+		status <- statusOf(ctx, ctx.Err())
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if as.cancelLocal("b") {
+		t.Error("expected an unknown action not to be cancelled")
+	}
+	if !as.cancelLocal("a") {
+		t.Fatal("expected the running action to be cancelled")
+	}
+
+	select {
+	case got := <-status:
+		if got != statusCancelled {
+			t.Errorf("expected status %s, got %s", statusCancelled, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelled action did not return")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := as.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if as.cancelLocal("a") {
+		t.Error("expected the finished action to be forgotten")
+	}
+}
+
+func TestCancelDelete(t *testing.T) {
+	client := fake.NewSimpleClientset(newWorkload("a", "node-1", "node-2")...)
+	replicas := int32(2)
+	client.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		return true, &autoscalingv1.Scale{Spec: autoscalingv1.ScaleSpec{Replicas: replicas}}, nil
+	})
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	as := NewActionService(client, rdb, wamconfig.Actions{}, nil, nil, nil)
+
+	updates := 0
+	client.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		updates++
+		switch updates {
+		case 1:
+			// the delete is cancelled while it waits for the pod to terminate
+			as.cancelLocal("a")
+		case 2:
+			// the delete fails to undo its scale down, so the cancel has to
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "deployments"}, "a", nil)
+		}
+		scale := action.(k8stesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+		replicas = scale.Spec.Replicas
+		return true, scale, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer as.cancel()
+	if err := as.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx = context.WithValue(ctx, actionIDKey{}, "a")
+	if err := as.spawn(ctx, "a", actionDelete, []string{"default"}, func(ctx context.Context) {
+		if _, err := as.DeleteHandler(ctx, &DeleteArgs{Pod: Pod{Namespace: "default", Name: "a-0"}}); err == nil {
+			t.Error("expected the cancelled delete to fail")
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdownCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stop()
+	if err := as.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	if updates != 3 || replicas != 2 {
+		t.Errorf("expected the cancel to revert the scale down, got %d replicas after %d updates", replicas, updates)
+	}
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "a-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if markedForDeletion(pod) {
+		t.Errorf("expected the deletion cost to be removed, got %v", pod.Annotations)
+	}
+	if mr.Exists(journalKey) {
+		t.Error("expected the journal entry of the cancelled delete to be removed")
+	}
+}
@@ -3,15 +3,17 @@ package actions
 import (
 	"context"
 	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	clientset "k8s.io/client-go/kubernetes"
 )
 
-func getPodsDeployment(pod *v1.Pod, k8sClient *clientset.Clientset) (*metav1.OwnerReference, error) {
+func (as *ActionService) getPodsDeployment(ctx context.Context, pod *v1.Pod) (*metav1.OwnerReference, error) {
 	for _, owner := range pod.OwnerReferences {
 		if owner.Kind == "ReplicaSet" {
-			rs, err := k8sClient.AppsV1().ReplicaSets(pod.Namespace).Get(context.TODO(), owner.Name, metav1.GetOptions{})
+			rs, err := retryValue(ctx, as, func(ctx context.Context) (*appsv1.ReplicaSet, error) {
+				return as.k8sClient.AppsV1().ReplicaSets(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+			})
 			if err != nil {
 				return nil, fmt.Errorf("error getting replicaset: %w", err)
 			}
@@ -26,18 +28,34 @@ func getPodsDeployment(pod *v1.Pod, k8sClient *clientset.Clientset) (*metav1.Own
 	return nil, fmt.Errorf("error getting deployment")
 }
 
+func getPodsStatefulSet(pod *v1.Pod) *metav1.OwnerReference {
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == "StatefulSet" {
+			return &owner
+		}
+	}
+
+	return nil
+}
+
 type Workload struct {
 	Namespace  string `json:"namespace"`
 	APIVersion string `json:"apiVersion"`
 	Kind       string `json:"kind"`
 	Name       string `json:"name"`
+	// Cluster is the name of a remote cluster, the cluster WAM runs in if empty
+	Cluster string `json:"cluster,omitempty"`
 }
 
 type Pod struct {
 	Namespace string `json:"namespace"`
 	Name      string `json:"name"`
+	// Cluster is the name of a remote cluster, the cluster WAM runs in if empty
+	Cluster string `json:"cluster,omitempty"`
 }
 
 type Node struct {
 	Name string `json:"name"`
+	// Cluster is the name of a remote cluster, the cluster WAM runs in if empty
+	Cluster string `json:"cluster,omitempty"`
 }
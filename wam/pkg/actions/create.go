@@ -4,14 +4,48 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/audit"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/logging"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/uuid"
-	"log"
+	"k8s.io/klog/v2"
+	"strings"
 )
 
+// QueuePattern matches the suggestion queues of all workloads, see Workload.QueueName. It also matches the locks of
+// the workloads, see lockKey, so scans take keys of QueueType only.
+const QueuePattern = "*:apps/v1:*:*"
+
+// QueueType is the Redis type of the suggestion queues
+const QueueType = "list"
+
+// QueueName returns the name of the workload's suggestion queue. The queues of a remote cluster are prefixed with the
+// cluster name, the scheduler plugin of the cluster is configured with the same name.
 func (w Workload) QueueName() string {
-	return fmt.Sprintf("%s:%s:%s:%s", w.Namespace, w.APIVersion, w.Kind, w.Name)
+	queue := fmt.Sprintf("%s:%s:%s:%s", w.Namespace, w.APIVersion, w.Kind, w.Name)
+	if w.Cluster != "" {
+		queue = w.Cluster + "/" + queue
+	}
+	return queue
+}
+
+// parseQueueName returns the workload of a suggestion queue, see QueueName.
+func parseQueueName(queue string) (Workload, bool) {
+	var cluster string
+	// namespaces cannot contain a slash, so one before the first colon ends the cluster name
+	if i := strings.Index(queue, "/"); i >= 0 && i < strings.Index(queue, ":") {
+		cluster, queue = queue[:i], queue[i+1:]
+	}
+
+	parts := strings.SplitN(queue, ":", 4)
+	if len(parts) != 4 {
+		return Workload{}, false
+	}
+	return Workload{Namespace: parts[0], APIVersion: parts[1], Kind: parts[2], Name: parts[3], Cluster: cluster}, true
 }
 
 func validateCreateReq(args *CreateArgs) error {
@@ -38,100 +72,121 @@ func validateCreateReq(args *CreateArgs) error {
 	return nil
 }
 
-func (as *ActionService) addSchedulingSuggestion(queue string, nodeName string) (*SchedulingSuggestion, error) {
+func (as *ActionService) addSchedulingSuggestion(ctx context.Context, queue string, nodeName string) (*SchedulingSuggestion, error) {
 	sug := &SchedulingSuggestion{
-		ID:       uuid.NewUUID(),
-		NodeName: nodeName,
+		ID:           uuid.NewUUID(),
+		NodeName:     nodeName,
+		TraceContext: tracing.Inject(ctx),
 	}
 
-	log.Printf("created scheduling suggestion %+v\n", sug)
+	lh := klog.FromContext(ctx).WithValues("suggestionID", sug.ID, "queue", queue)
+	lh.V(4).Info("created scheduling suggestion")
 
 	sugEncoded, err := json.Marshal(sug)
 	if err != nil {
 		return sug, err
 	}
 
-	_, err = as.rdb.LPush(context.TODO(), queue, sugEncoded).Result()
+	_, err = as.rdb.LPush(ctx, queue, sugEncoded).Result()
 	if err != nil {
 		return sug, err
 	}
 
-	log.Printf("pushed suggestion to the queue %s\n", queue)
+	lh.V(4).Info("pushed suggestion to the queue")
+	as.journalSuggestion(ctx, queue, sug)
+	if w, ok := parseQueueName(queue); ok {
+		as.event(ctx, workloadRef(w), v1.EventTypeNormal, reasonSuggestionQueued, "Queued suggestion %s for node %s", sug.ID, nodeName)
+	}
+	audit.Add(ctx, audit.Event{Type: audit.EventSuggestion, Workload: queueWorkload(queue), Node: nodeName, SuggestionID: string(sug.ID)})
 
 	return sug, nil
 }
 
-func (as *ActionService) removeSchedulingSuggestion(queue string, sug *SchedulingSuggestion) error {
-	log.Printf("removing suggestion %+v\n", sug)
+// removeSchedulingSuggestion rolls back addSchedulingSuggestion. It also runs if ctx was cancelled because the action
+// was interrupted on shutdown, so the suggestion does not linger in the queue.
+func (as *ActionService) removeSchedulingSuggestion(ctx context.Context, queue string, sug *SchedulingSuggestion) error {
+	ctx = context.WithoutCancel(ctx)
+	lh := klog.FromContext(ctx).WithValues("suggestionID", sug.ID, "queue", queue)
+	lh.V(4).Info("removing suggestion")
 
 	sugEncoded, err := json.Marshal(sug)
 	if err != nil {
 		return err
 	}
 
-	_, err = as.rdb.LRem(context.TODO(), queue, 1, sugEncoded).Result()
+	_, err = as.rdb.LRem(ctx, queue, 1, sugEncoded).Result()
 	if err != nil {
 		return err
 	}
 
-	log.Println("suggestion removed")
+	lh.V(4).Info("suggestion removed")
+	as.journalSettle(ctx, sug)
 
 	return nil
 }
 
-func (as *ActionService) CreateHandler(args *CreateArgs) (*SchedulingSuggestion, error) {
-	queue := args.Workload.QueueName()
+func (as *ActionService) CreateHandler(ctx context.Context, args *CreateArgs) (suggestion *SchedulingSuggestion, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "CreateHandler", trace.WithAttributes(
+		attribute.String("wam.workload", args.Workload.QueueName()),
+		attribute.String("wam.node", args.Node.Name),
+	))
+	defer func() { tracing.End(span, err) }()
 
-	log.Printf("using queue %s\n", queue)
+	ctx, lh := logging.WithValues(ctx,
+		"workload", klog.KRef(args.Workload.Namespace, args.Workload.Name),
+		"node", args.Node.Name,
+	)
+
+	queue := args.Workload.QueueName()
 
-	suggestion, err := as.addSchedulingSuggestion(queue, args.Node.Name)
+	suggestion, err = as.addSchedulingSuggestion(ctx, queue, args.Node.Name)
 	if err != nil {
-		log.Println(err)
+		lh.Error(err, "error adding scheduling suggestion")
 		return nil, err
 	}
+	span.SetAttributes(attribute.String("wam.suggestion_id", string(suggestion.ID)))
 
 	// send WAM scheduling suggestion to the queue
-	// call API and increment replication by 1
-	// exponential backoff retry
+	// call API and increment replication by 1, retrying per the action's retry policy
 	// if it fails, remove suggestion from the queue and abort action
 
-	// todo: race conditions here, think about a distributed lock
-	scale, err := as.k8sClient.AppsV1().
-		Deployments(args.Workload.Namespace).
-		GetScale(context.TODO(), args.Workload.Name, metav1.GetOptions{})
+	unlock, err := as.lock(ctx, queue)
 	if err != nil {
-		log.Println(err)
+		lh.Error(err, "error locking workload")
 
-		err = as.removeSchedulingSuggestion(queue, suggestion)
-		if err != nil {
-			log.Println(err)
+		if rerr := as.removeSchedulingSuggestion(ctx, queue, suggestion); rerr != nil {
+			lh.Error(rerr, "error removing scheduling suggestion")
 		}
 
 		return nil, err
 	}
+	defer unlock()
 
-	log.Printf("got current scale for %s: %d\n", args.Workload.Name, scale.Spec.Replicas)
-
-	s := *scale
-	s.Spec.Replicas += 1
-
-	_, err = as.k8sClient.AppsV1().
-		Deployments(args.Workload.Namespace).UpdateScale(context.TODO(),
-		args.Workload.Name, &s, metav1.UpdateOptions{})
+	from, to, err := as.scaleBy(ctx, args.Workload.Namespace, args.Workload.Name, 1)
 	if err != nil {
-		log.Println(err)
+		lh.Error(err, "error updating scale")
 
-		err = as.removeSchedulingSuggestion(queue, suggestion)
-		if err != nil {
-			log.Println(err)
+		if rerr := as.removeSchedulingSuggestion(ctx, queue, suggestion); rerr != nil {
+			lh.Error(rerr, "error removing scheduling suggestion")
 		}
 
 		return nil, err
 	}
 
-	log.Printf("updated new scale of %s to: %d\n", args.Workload.Name, s.Spec.Replicas)
-
-	log.Println("create action successful")
+	lh.V(2).Info("updated scale", "replicas", to, "suggestionID", suggestion.ID)
+	as.journalStep(ctx, suggestion, func(step *journalStep) {
+		step.Scaled = true
+		step.Replicas = to
+	})
+	as.event(ctx, workloadRef(args.Workload), v1.EventTypeNormal, reasonCreateRequested,
+		"Scaled up from %d to %d replicas for a pod on node %s", from, to, args.Node.Name)
+	audit.Add(ctx, audit.Event{
+		Type:     audit.EventScale,
+		Workload: workloadKey(args.Workload.Namespace, args.Workload.Name),
+		Replicas: &audit.Replicas{From: from, To: to},
+	})
+
+	lh.Info("create action successful")
 
 	return suggestion, nil
 }
@@ -139,13 +194,20 @@ func (as *ActionService) CreateHandler(args *CreateArgs) (*SchedulingSuggestion,
 type CreateArgs struct {
 	Workload `json:"workload"`
 	Node     `json:"node"`
+	ActionOptions
 }
 
 type CreateReply struct {
-	Message string `json:"message"`
+	Message  string `json:"message"`
+	ActionID string `json:"actionId"`
+	// Status of the action, for a repeated idempotency key that of the original action
+	Status string `json:"status,omitempty"`
+	Plan   *Plan  `json:"plan,omitempty"`
 }
 
 type SchedulingSuggestion struct {
 	ID       types.UID `json:"id"`
 	NodeName string    `json:"node_name"`
+	// TraceContext carries the trace of the action into the scheduler, see tracing.Inject
+	TraceContext map[string]string `json:"trace_context,omitempty"`
 }
@@ -2,9 +2,30 @@ package actions
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/audit"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/logging"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/metrics"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/tracing"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"log"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"time"
+)
+
+const (
+	// minDeletionCost makes the ReplicaSet controller prefer removing a pod when scaling down
+	minDeletionCost = "-1000"
+	// deletePollInterval is the pause between two checks which pod the controller removed
+	deletePollInterval = 500 * time.Millisecond
 )
 
 func validateDeleteReq(args *DeleteArgs) error {
@@ -19,64 +40,302 @@ func validateDeleteReq(args *DeleteArgs) error {
 	return nil
 }
 
-func (as *ActionService) DeleteHandler(args *DeleteArgs) {
-	pod, err := as.k8sClient.CoreV1().Pods(args.Pod.Namespace).Get(context.TODO(), args.Pod.Name, metav1.GetOptions{})
+// DeleteHandler removes the named pod and scales its Deployment down by one. The pod is marked with the lowest
+// deletion cost before the scale down, which the ReplicaSet controller honours only as a hint
+// (https://kubernetes.io/docs/concepts/workloads/controllers/replicaset/#pod-deletion-cost), so the handler then
+// watches which pod terminates. If the controller picks another pod, the named pod is deleted directly and its
+// replacement is suggested to the node of the pod removed instead, restoring the layout. If it picks none within the
+// delete verify timeout, the named pod is deleted directly, which completes the scale down. A delete failing after the
+// scale down is rolled back, see abortDelete. It returns the pods that terminated.
+func (as *ActionService) DeleteHandler(ctx context.Context, args *DeleteArgs) (status *DeleteStatusReply, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "DeleteHandler", trace.WithAttributes(
+		attribute.String("wam.pod", args.Pod.Namespace+"/"+args.Pod.Name),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, lh := logging.WithValues(ctx, "pod", klog.KRef(args.Pod.Namespace, args.Pod.Name))
+
+	pod, err := as.getPod(ctx, args.Pod.Namespace, args.Pod.Name)
 	if err != nil {
-		log.Printf("error getting pod: %v\n", err)
-		return
+		lh.Error(err, "error getting pod")
+		return nil, err
 	}
 
-	deployment, err := getPodsDeployment(pod, as.k8sClient)
+	ctx, lh = logging.WithValues(ctx, "node", pod.Spec.NodeName)
+
+	owner, err := as.getPodsDeployment(ctx, pod)
 	if err != nil {
-		log.Printf("error getting %s's deployment\n", pod.Name)
-		return
+		lh.Error(err, "error getting pod's deployment")
+		return nil, err
 	}
 
-	// Prefer removing this pod. It is not guaranteed though.
-	// https://kubernetes.io/docs/concepts/workloads/controllers/replicaset/#pod-deletion-cost
-	if pod.Annotations == nil {
-		pod.Annotations = make(map[string]string)
+	ctx, lh = logging.WithValues(ctx, "workload", klog.KRef(args.Pod.Namespace, owner.Name))
+
+	deployment, err := as.getDeployment(ctx, args.Pod.Namespace, owner.Name)
+	if err != nil {
+		lh.Error(err, "error getting deployment")
+		return nil, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	workload := Workload{
+		Namespace:  args.Pod.Namespace,
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Name:       owner.Name,
+		Cluster:    as.name,
+	}
+	queue := workload.QueueName()
+
+	unlock, err := as.lock(ctx, queue)
+	if err != nil {
+		lh.Error(err, "error locking workload")
+		return nil, err
+	}
+
+	as.journalMark(ctx, pod)
+	err = as.setDeletionCost(ctx, pod, minDeletionCost)
+	if err != nil {
+		lh.Error(err, "error marking pod for deletion")
+		unlock()
+		return nil, err
 	}
-	pod.Annotations["controller.kubernetes.io/pod-deletion-cost"] = "-1000"
+	as.event(ctx, pod, v1.EventTypeNormal, reasonPodMarkedForDeletion, "Marked for deletion, scaling %s down by one", owner.Name)
 
-	_, err = as.k8sClient.CoreV1().Pods(args.Pod.Namespace).Update(context.TODO(), pod, metav1.UpdateOptions{})
+	// the pods the controller may remove instead of the named one
+	candidates, err := as.deletionCandidates(pod, selector)
 	if err != nil {
-		panic(err.Error())
+		lh.Error(err, "error listing the workload's pods")
+		as.clearDeletionCost(ctx, pod)
+		unlock()
+		return nil, err
 	}
 
-	// todo: race conditions here, think about a distributed lock
-	scale, err := as.k8sClient.AppsV1().
-		Deployments(args.Pod.Namespace).
-		GetScale(context.TODO(), deployment.Name, metav1.GetOptions{})
+	from, to, err := as.scaleBy(ctx, args.Pod.Namespace, owner.Name, -1)
 	if err != nil {
-		log.Println(err)
-		return
+		lh.Error(err, "error updating scale")
+		as.clearDeletionCost(ctx, pod)
+		unlock()
+		return nil, err
 	}
 
-	log.Printf("got current scale for %s: %d\n", deployment.Name, scale.Spec.Replicas)
+	as.journalScaled(ctx, workload, -1)
+	audit.Add(ctx, audit.Event{
+		Type:     audit.EventScale,
+		Workload: workloadKey(args.Pod.Namespace, owner.Name),
+		Replicas: &audit.Replicas{From: from, To: to},
+	})
 
-	s := *scale
-	s.Spec.Replicas -= 1
+	// Concurrent deletes of the workload's pods are told apart by their deletion cost, the lock only serializes the
+	// scale updates.
+	unlock()
 
-	_, err = as.k8sClient.AppsV1().
-		Deployments(args.Pod.Namespace).UpdateScale(context.TODO(),
-		deployment.Name, &s, metav1.UpdateOptions{})
+	lh.V(2).Info("updated scale, waiting for the pod to terminate", "replicas", to)
+
+	victim, err := as.waitForDeletion(ctx, pod, candidates)
 	if err != nil {
-		log.Println(err)
-		return
+		lh.Error(err, "error waiting for the pod to terminate")
+		as.abortDelete(ctx, pod, workload)
+		return nil, err
+	}
+
+	status = &DeleteStatusReply{Pod: args.Pod, TerminatedPods: []Pod{args.Pod}}
+	if victim == nil {
+		// the delete is done, a cancel no longer reverts its scale down
+		as.journalUnscaled(ctx, workload, -1)
+		audit.Add(ctx, audit.Event{Type: audit.EventPodDeleted, Workload: workloadKey(args.Pod.Namespace, owner.Name), Pod: args.Pod.Namespace + "/" + args.Pod.Name, Node: pod.Spec.NodeName})
+		span.SetAttributes(attribute.String("wam.terminated_pod", args.Pod.Namespace+"/"+args.Pod.Name))
+		as.event(ctx, workloadRef(workload), v1.EventTypeNormal, reasonPodDeleted, "Scaled down by one, removing pod %s", args.Pod.Name)
+		lh.Info("delete action successful", "terminatedPod", klog.KObj(pod))
+		return status, nil
 	}
 
-	log.Printf("updated new scale of %s to: %d\n", deployment.Name, s.Spec.Replicas)
+	// The controller removed another pod or none at all, so the named pod is deleted directly. If it removed none,
+	// the direct delete completes the scale down and nothing replaces the named pod. If it removed another pod, the
+	// controller replaces the named pod on the node of the pod it removed, see the suggestion below.
+	reason := "timeout"
+	if victim != pod {
+		reason = "mismatch"
+		lh.Info("controller removed another pod than the named one", "terminatedPod", klog.KObj(victim))
+
+		suggestion, err := as.addSchedulingSuggestion(ctx, queue, victim.Spec.NodeName)
+		if err != nil {
+			lh.Error(err, "error adding scheduling suggestion")
+			as.abortDelete(ctx, pod, workload)
+			return nil, err
+		}
+		// the replacement is created once the handler returned, so the suggestion outlives the action
+		as.journalSettle(ctx, suggestion)
+		as.journalReplacement(ctx, queue, suggestion)
+	}
+	metrics.DeleteFallbacks.WithLabelValues(reason).Inc()
 
-	log.Printf("pod %s will be preferentially deleted\n", args.Pod.Name)
+	err = as.retry(ctx, func(ctx context.Context) error {
+		return as.k8sClient.CoreV1().Pods(args.Pod.Namespace).Delete(ctx, args.Pod.Name, metav1.DeleteOptions{})
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		lh.Error(err, "error deleting pod")
+		as.abortDelete(ctx, pod, workload)
+		return nil, err
+	}
+
+	as.journalUnscaled(ctx, workload, -1)
+	status.Fallback = reason
+	terminated := []string{args.Pod.Namespace + "/" + args.Pod.Name}
+	if victim != pod {
+		status.TerminatedPods = append(status.TerminatedPods, Pod{Namespace: victim.Namespace, Name: victim.Name, Cluster: as.name})
+		terminated = append(terminated, victim.Namespace+"/"+victim.Name)
+		audit.Add(ctx, audit.Event{Type: audit.EventPodDeleted, Workload: workloadKey(args.Pod.Namespace, owner.Name), Pod: victim.Namespace + "/" + victim.Name, Node: victim.Spec.NodeName})
+	}
+	audit.Add(ctx, audit.Event{Type: audit.EventPodDeleted, Workload: workloadKey(args.Pod.Namespace, owner.Name), Pod: args.Pod.Namespace + "/" + args.Pod.Name, Node: pod.Spec.NodeName})
+	span.SetAttributes(attribute.StringSlice("wam.terminated_pod", terminated))
+	if victim != pod {
+		as.event(ctx, workloadRef(workload), v1.EventTypeNormal, reasonPodDeleted,
+			"Deleted pod %s directly as the controller removed pod %s instead", args.Pod.Name, victim.Name)
+	} else {
+		as.event(ctx, workloadRef(workload), v1.EventTypeNormal, reasonPodDeleted,
+			"Deleted pod %s directly as the controller removed no pod within %s", args.Pod.Name, as.timeouts(ctx).DeleteVerify)
+	}
+	lh.Info("delete action successful, deleted the pod directly", "reason", reason, "terminatedPods", terminated)
 
-	log.Println("delete action successful")
+	return status, nil
+}
+
+// clearDeletionCost removes the deletion cost marking the pod of an aborted delete, even if the context is cancelled.
+func (as *ActionService) clearDeletionCost(ctx context.Context, pod *v1.Pod) {
+	if err := as.setDeletionCost(context.WithoutCancel(ctx), pod, ""); err != nil && !apierrors.IsNotFound(err) {
+		klog.FromContext(ctx).Error(err, "error removing deletion cost")
+	}
+}
+
+// abortDelete rolls back a delete failing after the scale down: it removes the deletion cost of the named pod and
+// scales the workload back up, even if the context is cancelled. If the controller already removed a pod, its
+// replacement restores the replicas.
+func (as *ActionService) abortDelete(ctx context.Context, pod *v1.Pod, workload Workload) {
+	ctx = context.WithoutCancel(ctx)
+	lh := klog.FromContext(ctx)
+
+	as.clearDeletionCost(ctx, pod)
+
+	// a scale down failing to be undone is left in the journal, so a cancel tries again, see compensateCancelled
+	if err := as.revertScale(ctx, workload, -1); err != nil {
+		lh.Error(err, "error undoing the scale down of the aborted delete")
+	}
+}
+
+// deletionCandidates returns the running pods of the workload other than the named pod and not marked for deletion
+// by another action.
+func (as *ActionService) deletionCandidates(pod *v1.Pod, selector labels.Selector) ([]*v1.Pod, error) {
+	cached, err := as.pods.Pods(pod.Namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*v1.Pod
+	for _, p := range cached {
+		if p.Name == pod.Name || p.DeletionTimestamp != nil || markedForDeletion(p) {
+			continue
+		}
+		candidates = append(candidates, p)
+	}
+	return candidates, nil
+}
+
+// isTerminating returns whether the cached pod is gone or being deleted.
+func (as *ActionService) isTerminating(pod *v1.Pod) (bool, error) {
+	cached, err := as.pods.Pods(pod.Namespace).Get(pod.Name)
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return cached.DeletionTimestamp != nil || cached.UID != pod.UID, nil
+}
+
+// waitForDeletion waits until the controller removes a pod after a scale down. It returns nil if it removed the named
+// pod, the candidate it removed instead, or the named pod itself if none was removed in time.
+func (as *ActionService) waitForDeletion(ctx context.Context, pod *v1.Pod, candidates []*v1.Pod) (*v1.Pod, error) {
+	var victim *v1.Pod
+	err := wait.PollUntilContextTimeout(ctx, deletePollInterval, as.timeouts(ctx).DeleteVerify, true, func(context.Context) (bool, error) {
+		terminating, err := as.isTerminating(pod)
+		if err != nil || terminating {
+			return terminating, err
+		}
+
+		for _, candidate := range candidates {
+			terminating, err := as.isTerminating(candidate)
+			if err != nil {
+				return false, err
+			}
+			if terminating {
+				victim = candidate
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if wait.Interrupted(err) && ctx.Err() == nil {
+		return pod, nil
+	}
+	return victim, err
 }
 
 type DeleteArgs struct {
 	Pod `json:"pod"`
+	ActionOptions
 }
 
 type DeleteReply struct {
-	Message string `json:"message"`
+	Message  string `json:"message"`
+	ActionID string `json:"actionId"`
+	// Status of the action, for a repeated idempotency key that of the original action
+	Status string `json:"status,omitempty"`
+	Plan   *Plan  `json:"plan,omitempty"`
+}
+
+type DeleteStatusArgs struct {
+	ActionID string `json:"actionId"`
+}
+
+// DeleteStatusReply reports the pods a completed delete terminated.
+type DeleteStatusReply struct {
+	Pod Pod `json:"pod"`
+	// TerminatedPods are the named pod and, if the ReplicaSet controller removed another pod, that pod, which is
+	// replaced on its node
+	TerminatedPods []Pod `json:"terminatedPods"`
+	// Fallback is why the named pod was deleted directly, timeout or mismatch, empty if the controller removed it
+	Fallback string `json:"fallback,omitempty"`
+}
+
+func deleteKey(id string) string {
+	return fmt.Sprintf("wam:delete:%s", id)
+}
+
+func (as *ActionService) saveDelete(ctx context.Context, id string, record *DeleteStatusReply) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return as.rdb.Set(context.WithoutCancel(ctx), deleteKey(id), encoded, migrationTTL).Err()
+}
+
+func (as *ActionService) loadDelete(ctx context.Context, id string) (*DeleteStatusReply, error) {
+	encoded, err := as.rdb.Get(ctx, deleteKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("no completed delete with action ID %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record := &DeleteStatusReply{}
+	if err := json.Unmarshal(encoded, record); err != nil {
+		return nil, err
+	}
+	return record, nil
 }
@@ -0,0 +1,199 @@
+package actions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+func TestWaitForDeletion(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		deleted string
+		want    string
+	}{
+		{name: "named pod removed", deleted: "a-0", want: ""},
+		{name: "another pod removed", deleted: "a-1", want: "a-1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			objects := newWorkload("a", "node-1", "node-1", "node-2")
+			for _, object := range objects {
+				// a-2 is the pod of another delete
+				if pod, ok := object.(*v1.Pod); ok && pod.Name == "a-2" {
+					pod.Annotations = map[string]string{deletionCostAnnotation: minDeletionCost, markedAnnotation: "true"}
+				}
+			}
+			client := fake.NewSimpleClientset(objects...)
+			as := NewActionService(client, nil, wamconfig.Actions{}, nil, nil, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			defer as.cancel()
+			if err := as.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			pod, err := as.pods.Pods("default").Get("a-0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			candidates, err := as.deletionCandidates(pod, labels.SelectorFromSet(labels.Set{"app": "a"}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(candidates) != 1 || candidates[0].Name != "a-1" {
+				t.Fatalf("expected candidate a-1, got %v", candidates)
+			}
+
+			err = client.CoreV1().Pods("default").Delete(ctx, tc.deleted, metav1.DeleteOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			victim, err := as.waitForDeletion(ctx, pod, candidates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if victim != nil {
+				got = victim.Name
+			}
+			if got != tc.want {
+				t.Errorf("expected victim %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDeleteHandlerTimeout(t *testing.T) {
+	client := fake.NewSimpleClientset(newWorkload("a", "node-1", "node-2")...)
+	replicas := int32(2)
+	client.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		return true, &autoscalingv1.Scale{Spec: autoscalingv1.ScaleSpec{Replicas: replicas}}, nil
+	})
+	client.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		scale := action.(k8stesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+		replicas = scale.Spec.Replicas
+		return true, scale, nil
+	})
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	as := NewActionService(client, rdb, wamconfig.Actions{}, nil, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer as.cancel()
+	if err := as.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the controller removes no pod, so the named pod is deleted directly
+	ctx = as.withOverrides(ctx, &Timeouts{DeleteVerifySeconds: 1}, nil)
+	status, err := as.DeleteHandler(ctx, &DeleteArgs{Pod: Pod{Namespace: "default", Name: "a-0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &DeleteStatusReply{
+		Pod:            Pod{Namespace: "default", Name: "a-0"},
+		TerminatedPods: []Pod{{Namespace: "default", Name: "a-0"}},
+		Fallback:       "timeout",
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("expected status %+v, got %+v", want, status)
+	}
+	if replicas != 1 {
+		t.Errorf("expected the workload to be scaled down to 1 replica, got %d", replicas)
+	}
+	if _, err := client.CoreV1().Pods("default").Get(ctx, "a-0", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the named pod to be deleted, got %v", err)
+	}
+	if queued, _ := mr.List(Workload{Namespace: "default", APIVersion: "apps/v1", Kind: "Deployment", Name: "a"}.QueueName()); len(queued) != 0 {
+		t.Errorf("expected no replacement to be suggested, got %v", queued)
+	}
+
+	if err := as.saveDelete(ctx, "1", status); err != nil {
+		t.Fatal(err)
+	}
+	reply := &DeleteStatusReply{}
+	if err := as.DeleteStatus(httptest.NewRequest(http.MethodPost, "/rpc", nil), &DeleteStatusArgs{ActionID: "1"}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply, want) {
+		t.Errorf("expected the stored status %+v, got %+v", want, reply)
+	}
+}
+
+func TestDeleteHandlerAborted(t *testing.T) {
+	client := fake.NewSimpleClientset(newWorkload("a", "node-1", "node-2")...)
+	replicas := int32(2)
+	client.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		return true, &autoscalingv1.Scale{Spec: autoscalingv1.ScaleSpec{Replicas: replicas}}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		scale := action.(k8stesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+		replicas = scale.Spec.Replicas
+		// the action is cancelled while it waits for the pod to terminate
+		cancel()
+		return true, scale, nil
+	})
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	as := NewActionService(client, rdb, wamconfig.Actions{}, nil, nil, nil)
+	defer as.cancel()
+	if err := as.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := as.DeleteHandler(ctx, &DeleteArgs{Pod: Pod{Namespace: "default", Name: "a-0"}}); err == nil {
+		t.Fatal("expected the delete to fail")
+	}
+
+	if replicas != 2 {
+		t.Errorf("expected the scale down to be undone, got %d replicas", replicas)
+	}
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "a-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pod.Annotations[deletionCostAnnotation]; ok {
+		t.Errorf("expected the deletion cost to be removed, got %v", pod.Annotations)
+	}
+	if _, ok := pod.Annotations[markedAnnotation]; ok {
+		t.Errorf("expected the marked annotation to be removed, got %v", pod.Annotations)
+	}
+}
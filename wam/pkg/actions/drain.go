@@ -0,0 +1,325 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/audit"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/logging"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	"slices"
+	"strings"
+)
+
+// mirrorPodAnnotation marks the API server's copies of static pods, which the kubelet runs from its manifests.
+const mirrorPodAnnotation = "kubernetes.io/config.mirror"
+
+type DrainArgs struct {
+	Node `json:"node"`
+	// Targets are the nodes the pods may be moved to, all other schedulable and ready nodes by default
+	Targets []string `json:"targets,omitempty"`
+	// MaxSurge is the number of pods moved at the same time, 1 by default
+	MaxSurge int `json:"maxSurge,omitempty"`
+	// RelocateStatefulSets also moves the StatefulSet pods, which are left on the node by default. Each is evicted
+	// before its replacement starts, see RelocateHandler, so its StatefulSet runs one pod short meanwhile.
+	RelocateStatefulSets bool `json:"relocateStatefulSets,omitempty"`
+	ActionOptions
+}
+
+type DrainReply struct {
+	Message  string `json:"message"`
+	ActionID string `json:"actionId"`
+	// Status of the drain, for a repeated idempotency key that of the original drain
+	Status string `json:"status,omitempty"`
+	// Moves are the planned moves of a dry run
+	Moves []PodMigration `json:"moves,omitempty"`
+	// Skipped are the pods left on the node
+	Skipped []SkippedPod `json:"skipped,omitempty"`
+}
+
+// SkippedPod is a pod a drain leaves on the node.
+type SkippedPod struct {
+	Pod    Pod    `json:"pod"`
+	Reason string `json:"reason"`
+}
+
+func validateDrainReq(args *DrainArgs) error {
+	if args.Node.Name == "" {
+		return fmt.Errorf("node name is required")
+	}
+
+	if slices.Contains(args.Targets, args.Node.Name) {
+		return fmt.Errorf("the drained node cannot be a target")
+	}
+
+	if args.MaxSurge == 0 {
+		args.MaxSurge = 1
+	}
+	if args.MaxSurge < 0 {
+		return fmt.Errorf("maxSurge must be positive")
+	}
+
+	return nil
+}
+
+// skipReason returns why a drain leaves the pod on its node, or "" if the pod is moved.
+func (as *ActionService) skipReason(ctx context.Context, args *DrainArgs, pod *v1.Pod) string {
+	if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+		return "completed"
+	}
+	if pod.DeletionTimestamp != nil {
+		return "terminating"
+	}
+	if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+		return "static pod"
+	}
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == "DaemonSet" {
+			return "DaemonSet pod"
+		}
+	}
+	if getPodsStatefulSet(pod) != nil && !args.RelocateStatefulSets {
+		return "StatefulSet pod"
+	}
+	if !as.isRelocatable(ctx, pod) {
+		return "not owned by a Deployment or StatefulSet"
+	}
+
+	return ""
+}
+
+// nodeAllocation is the share of a node's allocatable CPU and memory requested by its pods.
+type nodeAllocation struct {
+	name                         string
+	allocatableCPU, requestedCPU int64
+	allocatableMem, requestedMem int64
+}
+
+func (na *nodeAllocation) add(pod *v1.Pod) {
+	cpu, mem := podRequests(&pod.Spec)
+	na.requestedCPU += cpu
+	na.requestedMem += mem
+}
+
+// podRequests returns the CPU in millicores and the memory in bytes requested by the containers of a pod.
+func podRequests(spec *v1.PodSpec) (int64, int64) {
+	var cpu, mem int64
+	for _, container := range spec.Containers {
+		cpu += container.Resources.Requests.Cpu().MilliValue()
+		mem += container.Resources.Requests.Memory().Value()
+	}
+	return cpu, mem
+}
+
+// score is the mean of the requested shares of CPU and memory, like the scheduler's LeastAllocated strategy.
+func (na *nodeAllocation) score() float64 {
+	share := func(requested, allocatable int64) float64 {
+		if allocatable == 0 {
+			return 1
+		}
+		return float64(requested) / float64(allocatable)
+	}
+
+	return (share(na.requestedCPU, na.allocatableCPU) + share(na.requestedMem, na.allocatableMem)) / 2
+}
+
+// nodeAllocations returns the allocation of the target nodes of a drain.
+func (as *ActionService) nodeAllocations(ctx context.Context, args *DrainArgs) ([]*nodeAllocation, error) {
+	nodes, err := as.schedulableNodes(ctx, args.Targets, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var allocations []*nodeAllocation
+	byName := map[string]*nodeAllocation{}
+	for _, node := range nodes {
+		if node.Name == args.Node.Name {
+			continue
+		}
+
+		allocation := &nodeAllocation{
+			name:           node.Name,
+			allocatableCPU: node.Status.Allocatable.Cpu().MilliValue(),
+			allocatableMem: node.Status.Allocatable.Memory().Value(),
+		}
+		allocations = append(allocations, allocation)
+		byName[node.Name] = allocation
+	}
+	if len(allocations) == 0 {
+		return nil, fmt.Errorf("no schedulable and ready target nodes")
+	}
+
+	pods, err := as.k8sClient.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		allocation, ok := byName[pod.Spec.NodeName]
+		if !ok || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		allocation.add(&pod)
+	}
+
+	return allocations, nil
+}
+
+// resolveDrain expands a drain into moves of the Deployment pods on the node, and the StatefulSet pods if the drain
+// relocates them, each to the least allocated target counting the pods moved there before it, and the pods left on
+// the node.
+func (as *ActionService) resolveDrain(ctx context.Context, args *DrainArgs) ([]PodMigration, []SkippedPod, error) {
+	if _, err := as.k8sClient.CoreV1().Nodes().Get(ctx, args.Node.Name, metav1.GetOptions{}); err != nil {
+		return nil, nil, err
+	}
+
+	allocations, err := as.nodeAllocations(ctx, args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	podList, err := as.k8sClient.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: "spec.nodeName=" + args.Node.Name,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pods := podList.Items
+	slices.SortFunc(pods, func(a, b v1.Pod) int {
+		return strings.Compare(a.Namespace+"/"+a.Name, b.Namespace+"/"+b.Name)
+	})
+
+	var moves []PodMigration
+	var skipped []SkippedPod
+	for _, pod := range pods {
+		if pod.Spec.NodeName != args.Node.Name {
+			continue
+		}
+		if reason := as.skipReason(ctx, args, &pod); reason != "" {
+			skipped = append(skipped, SkippedPod{Pod: Pod{Namespace: pod.Namespace, Name: pod.Name, Cluster: as.name}, Reason: reason})
+			continue
+		}
+
+		target := allocations[0]
+		for _, allocation := range allocations[1:] {
+			if allocation.score() < target.score() {
+				target = allocation
+			}
+		}
+		target.add(&pod)
+
+		moves = append(moves, PodMigration{
+			Pod:    Pod{Namespace: pod.Namespace, Name: pod.Name, Cluster: as.name},
+			From:   args.Node.Name,
+			To:     target.name,
+			Status: migrationPending,
+		})
+	}
+
+	return moves, skipped, nil
+}
+
+func (as *ActionService) cordon(ctx context.Context, node string) error {
+	patch := []byte(`{"spec":{"unschedulable":true}}`)
+	_, err := as.k8sClient.CoreV1().Nodes().Patch(ctx, node, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// DrainHandler cordons the node and moves its pods away, see runMoves. The node stays cordoned if a move fails.
+func (as *ActionService) DrainHandler(ctx context.Context, id string, args *DrainArgs, moves []PodMigration) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "DrainHandler", trace.WithAttributes(
+		attribute.String("wam.node", args.Node.Name),
+		attribute.Int("wam.moves", len(moves)),
+		attribute.Int("wam.max_surge", args.MaxSurge),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	lh := klog.FromContext(ctx)
+
+	err = as.cordon(ctx, args.Node.Name)
+	if err != nil {
+		lh.Error(err, "error cordoning node")
+		return err
+	}
+	lh.V(2).Info("cordoned node")
+	as.event(ctx, nodeRef(args.Node.Name), v1.EventTypeNormal, reasonNodeCordoned, "Cordoned to drain %d pods", len(moves))
+	audit.Add(ctx, audit.Event{Type: audit.EventNodeCordoned, Node: args.Node.Name})
+
+	err = as.runMoves(ctx, id, &migrationRecord{Moves: moves}, args.MaxSurge)
+	if err != nil {
+		return err
+	}
+
+	lh.Info("drain action successful", "moves", len(moves))
+	return nil
+}
+
+// RelocateHandler replaces a StatefulSet pod with one on the given node. A StatefulSet cannot run a second pod with
+// the same identity, so unlike MoveHandler the pod is evicted first, which respects its disruption budgets, and its
+// replacement is placed on the node by a scheduling suggestion. The StatefulSet is one pod short until it is ready.
+func (as *ActionService) RelocateHandler(ctx context.Context, p Pod, node string) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "RelocateHandler", trace.WithAttributes(
+		attribute.String("wam.pod", p.Namespace+"/"+p.Name),
+		attribute.String("wam.node", node),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, lh := logging.WithValues(ctx, "pod", klog.KRef(p.Namespace, p.Name), "node", node)
+
+	pod, err := as.getPod(ctx, p.Namespace, p.Name)
+	if err != nil {
+		lh.Error(err, "error getting pod")
+		return err
+	}
+
+	owner := getPodsStatefulSet(pod)
+	if owner == nil {
+		return fmt.Errorf("pod %s is not owned by a StatefulSet", klog.KObj(pod))
+	}
+	workload := Workload{Namespace: p.Namespace, APIVersion: owner.APIVersion, Kind: owner.Kind, Name: owner.Name, Cluster: as.name}
+	queue := workload.QueueName()
+
+	ctx, lh = logging.WithValues(ctx, "workload", klog.KRef(p.Namespace, owner.Name))
+
+	suggestion, err := as.addSchedulingSuggestion(ctx, queue, node)
+	if err != nil {
+		lh.Error(err, "error adding scheduling suggestion")
+		return err
+	}
+
+	// an eviction blocked by a PodDisruptionBudget fails with too many requests, retried like the other API errors
+	err = as.retry(ctx, func(ctx context.Context) error {
+		return as.k8sClient.CoreV1().Pods(p.Namespace).EvictV1(ctx, &policyv1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{Namespace: p.Namespace, Name: p.Name},
+		})
+	})
+	if err != nil {
+		lh.Error(err, "error evicting pod")
+
+		if rerr := as.removeSchedulingSuggestion(ctx, queue, suggestion); rerr != nil {
+			lh.Error(rerr, "error removing scheduling suggestion")
+		}
+
+		return err
+	}
+
+	lh.V(2).Info("evicted pod, waiting for its replacement to become ready")
+	as.event(ctx, pod, v1.EventTypeNormal, reasonPodEvicted, "Evicted to be replaced on node %s", node)
+	audit.Add(ctx, audit.Event{Type: audit.EventPodEvicted, Workload: workloadKey(p.Namespace, owner.Name), Pod: p.Namespace + "/" + p.Name, Node: pod.Spec.NodeName})
+
+	_, err = as.waitToBeReady(ctx, actionRelocate, p.Namespace, suggestion, as.timeouts(ctx).Ready)
+	if err != nil {
+		lh.Error(err, "relocation failed at wait step")
+		return err
+	}
+
+	lh.Info("relocate action successful")
+
+	return nil
+}
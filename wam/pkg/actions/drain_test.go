@@ -0,0 +1,123 @@
+package actions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+func withRequests(pod *v1.Pod, cpu string) *v1.Pod {
+	pod.Spec.Containers = []v1.Container{{
+		Resources: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse(cpu)}},
+	}}
+	return pod
+}
+
+func TestDrainDryRun(t *testing.T) {
+	objects := newWorkload("a", "node-1", "node-1", "node-2")
+	for _, object := range objects {
+		if pod, ok := object.(*v1.Pod); ok {
+			withRequests(pod, "1")
+		}
+	}
+	for _, name := range []string{"node-1", "node-2", "node-3"} {
+		node := newNode(name, "a", true)
+		node.Status.Allocatable = v1.ResourceList{v1.ResourceCPU: resource.MustParse("4"), v1.ResourceMemory: resource.MustParse("8Gi")}
+		objects = append(objects, node)
+	}
+	// node-2 is busier than node-3 until two pods moved to node-3
+	objects = append(objects,
+		withRequests(&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "busy"},
+			Spec:       v1.PodSpec{NodeName: "node-2"},
+		}, "1"),
+		withRequests(&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       "default",
+				Name:            "db-0",
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "db"}},
+			},
+			Spec: v1.PodSpec{NodeName: "node-1"},
+		}, "3"),
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       "kube-system",
+				Name:            "proxy",
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "proxy"}},
+			},
+			Spec: v1.PodSpec{NodeName: "node-1"},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "kube-system",
+				Name:        "etcd-node-1",
+				Annotations: map[string]string{mirrorPodAnnotation: "hash"},
+			},
+			Spec: v1.PodSpec{NodeName: "node-1"},
+		},
+	)
+	client := fake.NewSimpleClientset(objects...)
+	as := NewActionService(client, nil, wamconfig.Actions{}, nil, nil, nil)
+
+	tests := []struct {
+		name                 string
+		relocateStatefulSets bool
+		wantMoves            []PodMigration
+		wantSkipped          []SkippedPod
+	}{
+		{
+			name: "StatefulSet pods skipped",
+			wantMoves: []PodMigration{
+				{Pod: Pod{Namespace: "default", Name: "a-0"}, From: "node-1", To: "node-3", Status: migrationPending},
+				{Pod: Pod{Namespace: "default", Name: "a-1"}, From: "node-1", To: "node-3", Status: migrationPending},
+			},
+			wantSkipped: []SkippedPod{
+				{Pod: Pod{Namespace: "default", Name: "db-0"}, Reason: "StatefulSet pod"},
+				{Pod: Pod{Namespace: "kube-system", Name: "etcd-node-1"}, Reason: "static pod"},
+				{Pod: Pod{Namespace: "kube-system", Name: "proxy"}, Reason: "DaemonSet pod"},
+			},
+		},
+		{
+			name:                 "StatefulSet pods relocated",
+			relocateStatefulSets: true,
+			wantMoves: []PodMigration{
+				{Pod: Pod{Namespace: "default", Name: "a-0"}, From: "node-1", To: "node-3", Status: migrationPending},
+				{Pod: Pod{Namespace: "default", Name: "a-1"}, From: "node-1", To: "node-3", Status: migrationPending},
+				{Pod: Pod{Namespace: "default", Name: "db-0"}, From: "node-1", To: "node-2", Status: migrationPending},
+			},
+			wantSkipped: []SkippedPod{
+				{Pod: Pod{Namespace: "kube-system", Name: "etcd-node-1"}, Reason: "static pod"},
+				{Pod: Pod{Namespace: "kube-system", Name: "proxy"}, Reason: "DaemonSet pod"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := &DrainArgs{
+				Node:                 Node{Name: "node-1"},
+				RelocateStatefulSets: test.relocateStatefulSets,
+				ActionOptions:        ActionOptions{DryRun: true},
+			}
+			reply := &DrainReply{}
+			if err := as.Drain(httptest.NewRequest(http.MethodPost, "/rpc", nil), args, reply); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(reply.Moves, test.wantMoves) {
+				t.Errorf("expected moves %+v, got %+v", test.wantMoves, reply.Moves)
+			}
+			if !reflect.DeepEqual(reply.Skipped, test.wantSkipped) {
+				t.Errorf("expected skipped pods %+v, got %+v", test.wantSkipped, reply.Skipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// reasons of the Events WAM emits on the objects it acts on, see kubectl describe
+const (
+	reasonCreateRequested      = "WAMCreateRequested"
+	reasonSuggestionQueued     = "WAMSuggestionQueued"
+	reasonPodPlaced            = "WAMPodPlaced"
+	reasonPodMarkedForDeletion = "WAMPodMarkedForDeletion"
+	reasonPodDeleted           = "WAMPodDeleted"
+	reasonMoveCompleted        = "WAMMoveCompleted"
+	reasonMoveFailed           = "WAMMoveFailed"
+	reasonSwapCompleted        = "WAMSwapCompleted"
+	reasonSwapAborted          = "WAMSwapAborted"
+	reasonNodeCordoned         = "WAMNodeCordoned"
+	reasonPodEvicted           = "WAMPodEvicted"
+	reasonActionRecovered      = "WAMActionRecovered"
+)
+
+// actionIDAnnotation is set on the Events to the ID of the action that emitted them
+const actionIDAnnotation = "wam.aces-eu/action-id"
+
+type actionIDKey struct{}
+
+// actionID returns the ID of the action of ctx, see startAction.
+func actionID(ctx context.Context) string {
+	id, _ := ctx.Value(actionIDKey{}).(string)
+	return id
+}
+
+// newEventRecorder returns a recorder sending Events to the API server and a function flushing and stopping it.
+func newEventRecorder(k8sClient clientset.Interface) (record.EventRecorder, func()) {
+	if k8sClient == nil {
+		return &record.FakeRecorder{}, func() {}
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8sClient.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "wam"}), broadcaster.Shutdown
+}
+
+// event emits an Event on the object naming the action of ctx.
+func (as *ActionService) event(ctx context.Context, object runtime.Object, eventType, reason, messageFmt string, args ...any) {
+	message := fmt.Sprintf(messageFmt, args...)
+
+	id := actionID(ctx)
+	if id == "" {
+		as.recorder.Event(object, eventType, reason, message)
+		return
+	}
+	as.recorder.AnnotatedEventf(object, map[string]string{actionIDAnnotation: id}, eventType, reason, "%s (action %s)", message, id)
+}
+
+// workloadRef references the workload as the object of an Event.
+func workloadRef(w Workload) *v1.ObjectReference {
+	return &v1.ObjectReference{APIVersion: w.APIVersion, Kind: w.Kind, Namespace: w.Namespace, Name: w.Name}
+}
+
+// podRef references the pod as the object of an Event, it need not exist anymore.
+func podRef(p Pod) *v1.ObjectReference {
+	return &v1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: p.Namespace, Name: p.Name}
+}
+
+// nodeRef references the node as the object of an Event.
+func nodeRef(name string) *v1.ObjectReference {
+	return &v1.ObjectReference{APIVersion: "v1", Kind: "Node", Name: name}
+}
@@ -0,0 +1,43 @@
+package actions
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+func TestEvent(t *testing.T) {
+	as := NewActionService(nil, nil, wamconfig.Actions{}, nil, nil, nil)
+	recorder := record.NewFakeRecorder(2)
+	as.recorder = recorder
+
+	a := Workload{Namespace: "default", APIVersion: "apps/v1", Kind: "Deployment", Name: "a"}
+	ctx := context.WithValue(context.Background(), actionIDKey{}, "123")
+	as.event(ctx, workloadRef(a), v1.EventTypeNormal, reasonMoveCompleted, "Moved pod %s to node %s", "a-0", "node-2")
+	as.event(context.Background(), nodeRef("node-2"), v1.EventTypeNormal, reasonNodeCordoned, "Cordoned")
+
+	if got, want := <-recorder.Events, "Normal WAMMoveCompleted Moved pod a-0 to node node-2 (action 123) map[wam.aces-eu/action-id:123]"; got != want {
+		t.Errorf("expected event %q, got %q", want, got)
+	}
+	if got, want := <-recorder.Events, "Normal WAMNodeCordoned Cordoned"; got != want {
+		t.Errorf("expected event %q, got %q", want, got)
+	}
+}
+
+func TestParseQueueName(t *testing.T) {
+	a := Workload{Namespace: "default", APIVersion: "apps/v1", Kind: "Deployment", Name: "a"}
+	if w, ok := parseQueueName(a.QueueName()); !ok || w != a {
+		t.Errorf("expected %+v, got %+v", a, w)
+	}
+	a.Cluster = "edge"
+	if w, ok := parseQueueName(a.QueueName()); !ok || w != a {
+		t.Errorf("expected %+v, got %+v", a, w)
+	}
+	if _, ok := parseQueueName("default:a"); ok {
+		t.Error("expected an invalid queue name")
+	}
+}
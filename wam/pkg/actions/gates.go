@@ -0,0 +1,76 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/readiness"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"time"
+)
+
+// gatePollInterval is the pause between two evaluations of the readiness gates of a pod
+const gatePollInterval = 2 * time.Second
+
+// waitForGates blocks until the pod passes all readiness gates at once. Errors of a gate, e.g. an unreachable
+// Prometheus, count as not passed, so a transient failure does not abort the action, and are reported on timeout.
+func (as *ActionService) waitForGates(ctx context.Context, pod *corev1.Pod, opts []readiness.Options, timeout time.Duration) (err error) {
+	if len(opts) == 0 {
+		return nil
+	}
+
+	ctx, span := tracing.Tracer().Start(ctx, "waitForGates", trace.WithAttributes(
+		attribute.String("wam.pod", pod.Namespace+"/"+pod.Name),
+		attribute.Int("wam.gates", len(opts)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	lh := klog.FromContext(ctx).WithValues("readyPod", klog.KObj(pod))
+
+	env := readiness.Env{Client: as.k8sClient, PrometheusURL: as.config.PrometheusURL}
+	gates := make([]readiness.Gate, len(opts))
+	for i, o := range opts {
+		gates[i], err = readiness.New(o, env)
+		if err != nil {
+			return err
+		}
+	}
+
+	var pending []string
+	var lastErr error
+	err = wait.PollUntilContextTimeout(ctx, gatePollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		current, err := as.pods.Pods(pod.Namespace).Get(pod.Name)
+		if err != nil {
+			return false, fmt.Errorf("error getting pod %s: %w", klog.KObj(pod), err)
+		}
+
+		pending = nil
+		for i, gate := range gates {
+			passed, err := gate.Passed(ctx, current)
+			if err != nil {
+				lh.V(2).Info("error evaluating readiness gate", "gate", opts[i].Type, "err", err)
+				lastErr = err
+			}
+			if !passed {
+				pending = append(pending, opts[i].Type)
+			}
+		}
+		return len(pending) == 0, nil
+	})
+	if wait.Interrupted(err) && ctx.Err() == nil {
+		if lastErr != nil {
+			return fmt.Errorf("pod %s did not pass readiness gates %v within %s, last error: %w", klog.KObj(pod), pending, timeout, lastErr)
+		}
+		return fmt.Errorf("pod %s did not pass readiness gates %v within %s", klog.KObj(pod), pending, timeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	lh.V(2).Info("pod passed readiness gates")
+	return nil
+}
@@ -0,0 +1,106 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/audit"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/auth"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+	"time"
+)
+
+const (
+	// defaultHistoryLimit is the number of records returned by a history request without a limit
+	defaultHistoryLimit = 100
+	// maxHistoryLimit bounds the number of records returned by a history request
+	maxHistoryLimit = 1000
+	// auditWriteTimeout bounds how long writing the record of an action may take
+	auditWriteTimeout = 10 * time.Second
+)
+
+type HistoryArgs struct {
+	// Workload as namespace/name selects the actions that changed the workload
+	Workload string `json:"workload,omitempty"`
+	// Node selects the actions that changed pods on the node or the node itself
+	Node string `json:"node,omitempty"`
+	// Caller selects the actions requested by the user
+	Caller string `json:"caller,omitempty"`
+	// Since and Until select the actions running at some point in between, e.g. 2024-05-01T10:00:00Z
+	Since time.Time `json:"since,omitempty"`
+	Until time.Time `json:"until,omitempty"`
+	// Limit is the maximum number of records returned, 100 by default
+	Limit int `json:"limit,omitempty"`
+}
+
+type HistoryReply struct {
+	// Records of the selected actions, the newest first
+	Records []audit.Record `json:"records"`
+}
+
+func validateHistoryReq(args *HistoryArgs) error {
+	if !args.Since.IsZero() && !args.Until.IsZero() && args.Until.Before(args.Since) {
+		return fmt.Errorf("until must not be before since")
+	}
+
+	if args.Limit == 0 {
+		args.Limit = defaultHistoryLimit
+	}
+	if args.Limit < 0 || args.Limit > maxHistoryLimit {
+		return fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit)
+	}
+
+	return nil
+}
+
+// recordAction writes the audit record of an action that started at start and finished with status and err, including
+// the events recorded with ctx.
+func (as *ActionService) recordAction(ctx context.Context, id string, action string, args any, start time.Time, status string, err error) {
+	if as.auditSink == nil {
+		return
+	}
+
+	record := &audit.Record{
+		ActionID: id,
+		Action:   action,
+		Status:   status,
+		Start:    start,
+		End:      time.Now(),
+		Events:   audit.Events(ctx),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if user, ok := auth.UserFrom(ctx); ok {
+		record.Caller = user.Name
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		record.TraceID = sc.TraceID().String()
+	}
+	record.Index()
+
+	lh := klog.FromContext(ctx)
+
+	record.Args, err = json.Marshal(args)
+	if err != nil {
+		lh.Error(err, "error encoding the arguments of the audit record")
+	}
+
+	// the record is written even if the action was interrupted
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditWriteTimeout)
+	defer cancel()
+
+	if err := as.auditSink.Write(ctx, record); err != nil {
+		lh.Error(err, "error writing audit record")
+	}
+}
+
+// queueWorkload returns the workload of a suggestion queue as namespace/name, see Workload.QueueName.
+func queueWorkload(queue string) string {
+	w, ok := parseQueueName(queue)
+	if !ok {
+		return queue
+	}
+	return workloadKey(w.Namespace, w.Name)
+}
@@ -0,0 +1,66 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/audit"
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+func TestHistory(t *testing.T) {
+	sink := audit.NewFileSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	as := NewActionService(nil, nil, wamconfig.Actions{}, nil, nil, sink)
+
+	ctx := audit.WithRecorder(context.Background())
+	queue := Workload{Namespace: "default", APIVersion: "apps/v1", Kind: "Deployment", Name: "a"}.QueueName()
+	audit.Add(ctx, audit.Event{Type: audit.EventSuggestion, Workload: queueWorkload(queue), Node: "node-2"})
+	args := &MoveArgs{Pod: Pod{Namespace: "default", Name: "a-0"}, Node: Node{Name: "node-2"}}
+	as.recordAction(ctx, "1", actionMove, args, time.Now(), statusSucceeded, nil)
+	as.recordAction(audit.WithRecorder(context.Background()), "2", actionDrain, &DrainArgs{Node: Node{Name: "node-3"}}, time.Now(), statusFailed, errors.New("boom"))
+
+	reply := &HistoryReply{}
+	err := as.History(httptest.NewRequest(http.MethodPost, "/rpc", nil), &HistoryArgs{Workload: "default/a"}, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Records) != 1 {
+		t.Fatalf("expected 1 record, got %+v", reply.Records)
+	}
+	record := reply.Records[0]
+	if record.ActionID != "1" || record.Action != actionMove || record.Status != statusSucceeded {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if string(record.Args) != `{"pod":{"namespace":"default","name":"a-0"},"node":{"name":"node-2"}}` {
+		t.Errorf("unexpected args %s", record.Args)
+	}
+
+	reply = &HistoryReply{}
+	err = as.History(httptest.NewRequest(http.MethodPost, "/rpc", nil), &HistoryArgs{}, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Records) != 2 || reply.Records[0].ActionID != "2" || reply.Records[0].Error != "boom" {
+		t.Errorf("expected the failed drain first, got %+v", reply.Records)
+	}
+}
+
+func TestValidateHistoryReq(t *testing.T) {
+	args := &HistoryArgs{}
+	if err := validateHistoryReq(args); err != nil || args.Limit != defaultHistoryLimit {
+		t.Errorf("expected the default limit, got %d, %v", args.Limit, err)
+	}
+
+	if err := validateHistoryReq(&HistoryArgs{Limit: maxHistoryLimit + 1}); err == nil {
+		t.Error("expected an error for a limit beyond the maximum")
+	}
+
+	if err := validateHistoryReq(&HistoryArgs{Since: time.Now(), Until: time.Now().Add(-time.Hour)}); err == nil {
+		t.Error("expected an error for until before since")
+	}
+}
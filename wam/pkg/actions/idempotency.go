@@ -0,0 +1,163 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/auth"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/policy"
+	"github.com/redis/go-redis/v9"
+	"k8s.io/klog/v2"
+)
+
+// statuses of an action stored with its idempotency key
+const (
+	statusAccepted  = "accepted"
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+	statusRejected  = "rejected"
+	// statusScheduled and statusExpired are those of an action deferred by its schedule, see deferAction
+	statusScheduled = "scheduled"
+	statusExpired   = "expired"
+	// statusCancelled is that of an action cancelled by the Cancel RPC
+	statusCancelled = "cancelled"
+)
+
+// idempotencyAttempts bounds how often deduplicate tries to store or read a key that expires in between
+const idempotencyAttempts = 3
+
+// idempotencyRecord is stored for an idempotency key, so a retried request returns the action it started first.
+type idempotencyRecord struct {
+	ActionID string `json:"actionId"`
+	Action   string `json:"action"`
+	Status   string `json:"status"`
+	// Error is the reason a rejected action was not started
+	Error string `json:"error,omitempty"`
+}
+
+// idempotencyKey scopes keys to the caller, so callers cannot see each other's actions.
+func idempotencyKey(ctx context.Context, key string) string {
+	caller := "anonymous"
+	if user, ok := auth.UserFrom(ctx); ok {
+		caller = user.Name
+	}
+	return fmt.Sprintf("wam:idempotency:%s:%s", caller, key)
+}
+
+// deduplicate stores the key with the new action and returns nil, or returns the record of the action that used the
+// key within the idempotency window.
+func (as *ActionService) deduplicate(ctx context.Context, key string, id string, action string) (*idempotencyRecord, error) {
+	if key == "" {
+		return nil, nil
+	}
+
+	encoded, err := json.Marshal(&idempotencyRecord{ActionID: id, Action: action, Status: statusAccepted})
+	if err != nil {
+		return nil, err
+	}
+
+	redisKey := idempotencyKey(ctx, key)
+	var existing []byte
+	for attempt := 1; ; attempt++ {
+		stored, err := as.rdb.SetNX(ctx, redisKey, encoded, as.config.IdempotencyWindow).Result()
+		if err != nil {
+			return nil, fmt.Errorf("error storing idempotency key: %w", err)
+		}
+		if stored {
+			return nil, nil
+		}
+
+		existing, err = as.rdb.Get(ctx, redisKey).Bytes()
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, redis.Nil) {
+			return nil, fmt.Errorf("error getting idempotency key: %w", err)
+		}
+		// expired in between, try again
+		if attempt == idempotencyAttempts {
+			return nil, fmt.Errorf("idempotency key %q expired while being read %d times", key, attempt)
+		}
+	}
+
+	record := &idempotencyRecord{}
+	if err := json.Unmarshal(existing, record); err != nil {
+		return nil, fmt.Errorf("error decoding idempotency record: %w", err)
+	}
+
+	// an action dispatched by the scheduler finds the key it was deferred with
+	if record.ActionID == id {
+		return nil, nil
+	}
+
+	if record.Action != action {
+		return nil, fmt.Errorf("idempotency key %q was already used for %s action %s", key, record.Action, record.ActionID)
+	}
+
+	klog.FromContext(ctx).V(2).Info("repeated idempotency key, returning the original action",
+		"idempotencyKey", key, "originalActionID", record.ActionID, "status", record.Status)
+
+	return record, nil
+}
+
+// replay returns the reply to a repeated request.
+func (r *idempotencyRecord) replay() (message string, actionID string, status string, err error) {
+	if r.Status == statusRejected {
+		return "", r.ActionID, r.Status, errors.New(r.Error)
+	}
+	return "duplicate", r.ActionID, r.Status, nil
+}
+
+// abortIdempotencyKey is called if the action of the key was not started. If a policy rejected it, repeated requests
+// are rejected the same way, otherwise the key is removed, so they are tried again.
+func (as *ActionService) abortIdempotencyKey(ctx context.Context, key string, id string, action string, actionErr error) {
+	if key == "" {
+		return
+	}
+
+	var v *policy.Violation
+	if errors.As(actionErr, &v) {
+		as.finishIdempotencyKey(ctx, key, id, action, statusRejected, actionErr)
+		return
+	}
+
+	if err := as.rdb.Del(context.WithoutCancel(ctx), idempotencyKey(ctx, key)).Err(); err != nil {
+		klog.FromContext(ctx).Error(err, "error removing idempotency key", "idempotencyKey", key)
+	}
+}
+
+// finishIdempotencyKey records the final status of the action started with the key, if any.
+func (as *ActionService) finishIdempotencyKey(ctx context.Context, key string, id string, action string, status string, actionErr error) {
+	if key == "" {
+		return
+	}
+
+	record := &idempotencyRecord{ActionID: id, Action: action, Status: status}
+	if status == statusRejected && actionErr != nil {
+		record.Error = actionErr.Error()
+	}
+
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "error encoding idempotency record")
+		return
+	}
+
+	// the window starts when the key is first used
+	err = as.rdb.SetArgs(context.WithoutCancel(ctx), idempotencyKey(ctx, key), encoded, redis.SetArgs{KeepTTL: true, Mode: "XX"}).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		klog.FromContext(ctx).Error(err, "error updating idempotency record", "idempotencyKey", key)
+	}
+}
+
+// statusOf returns the status of an action that finished with err, ctx is that of its handler.
+func statusOf(ctx context.Context, err error) string {
+	if err != nil && cancelled(ctx) {
+		return statusCancelled
+	}
+	if err != nil {
+		return statusFailed
+	}
+	return statusSucceeded
+}
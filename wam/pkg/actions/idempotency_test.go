@@ -0,0 +1,112 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/auth"
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/policy"
+)
+
+// newRedisActionService returns a service backed by an in-memory Redis.
+func newRedisActionService(t *testing.T) (*ActionService, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rdb.Close() })
+	return NewActionService(nil, rdb, wamconfig.Actions{IdempotencyWindow: time.Hour}, nil, nil, nil), mr
+}
+
+func TestDeduplicate(t *testing.T) {
+	as, mr := newRedisActionService(t)
+	ctx := context.Background()
+
+	record, err := as.deduplicate(ctx, "k", "a", actionMove)
+	if err != nil || record != nil {
+		t.Fatalf("expected the first use of the key to start the action, got %+v, %v", record, err)
+	}
+	if ttl := mr.TTL(idempotencyKey(ctx, "k")); ttl != time.Hour {
+		t.Errorf("expected the key to be kept for the idempotency window, got %v", ttl)
+	}
+
+	record, err = as.deduplicate(ctx, "k", "b", actionMove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || record.ActionID != "a" || record.Status != statusAccepted {
+		t.Errorf("expected the repeated key to return accepted action a, got %+v", record)
+	}
+
+	// the scheduler dispatches a deferred action with the ID it was deferred with
+	if record, err := as.deduplicate(ctx, "k", "a", actionMove); err != nil || record != nil {
+		t.Errorf("expected the action of the key itself to start, got %+v, %v", record, err)
+	}
+
+	if _, err := as.deduplicate(ctx, "k", "c", actionDelete); err == nil {
+		t.Error("expected an error for a key used with another action type")
+	}
+
+	// keys are scoped to the caller
+	other := auth.WithUser(ctx, &auth.User{Name: "other"})
+	if record, err := as.deduplicate(other, "k", "d", actionMove); err != nil || record != nil {
+		t.Errorf("expected the key of another caller to start the action, got %+v, %v", record, err)
+	}
+
+	if record, err := as.deduplicate(ctx, "", "e", actionMove); err != nil || record != nil {
+		t.Errorf("expected an action without key to start, got %+v, %v", record, err)
+	}
+}
+
+func TestAbortIdempotencyKey(t *testing.T) {
+	as, mr := newRedisActionService(t)
+	ctx := context.Background()
+
+	// an action failing before it started is tried again by a repeated request
+	if _, err := as.deduplicate(ctx, "k", "a", actionMove); err != nil {
+		t.Fatal(err)
+	}
+	as.abortIdempotencyKey(ctx, "k", "a", actionMove, errors.New("unreachable"))
+	if mr.Exists(idempotencyKey(ctx, "k")) {
+		t.Error("expected the key of a failed start to be removed")
+	}
+
+	// an action rejected by a policy is rejected the same way again
+	violation := &policy.Violation{Policy: "min-ready-replicas", Reason: "too few ready replicas"}
+	if _, err := as.deduplicate(ctx, "k", "b", actionMove); err != nil {
+		t.Fatal(err)
+	}
+	as.abortIdempotencyKey(ctx, "k", "b", actionMove, violation)
+
+	record, err := as.deduplicate(ctx, "k", "c", actionMove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || record.Status != statusRejected {
+		t.Fatalf("expected the rejected action, got %+v", record)
+	}
+	if ttl := mr.TTL(idempotencyKey(ctx, "k")); ttl != time.Hour {
+		t.Errorf("expected the rejection to keep the window of the key, got %v", ttl)
+	}
+
+	message, actionID, status, err := record.replay()
+	if err == nil || err.Error() != violation.Error() {
+		t.Errorf("expected the replay to fail with %q, got %v", violation.Error(), err)
+	}
+	if message != "" || actionID != "b" || status != statusRejected {
+		t.Errorf("expected the replay of rejected action b, got %q, %q, %q", message, actionID, status)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	record := &idempotencyRecord{ActionID: "a", Action: actionMove, Status: statusSucceeded}
+	message, actionID, status, err := record.replay()
+	if err != nil || message != "duplicate" || actionID != "a" || status != statusSucceeded {
+		t.Errorf("expected a duplicate of succeeded action a, got %q, %q, %q, %v", message, actionID, status, err)
+	}
+}
@@ -0,0 +1,184 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/klog/v2"
+)
+
+// journalKey is the Redis hash holding the journal entries of the running actions of all replicas by action ID
+const journalKey = "wam:journal"
+
+// replacementsKey is the Redis hash holding the suggestions queued for the replacements of deleted pods by suggestion
+// ID, see journalReplacement
+const replacementsKey = "wam:journal:replacements"
+
+// journalEntry records a running action, so any replica can cancel it, and the steps of the action that leave the
+// cluster in an intermediate state, so the reconciler can resume or compensate them if the replica running the action
+// dies, see reconciler.
+type journalEntry struct {
+	ActionID string `json:"actionId"`
+	Action   string `json:"action"`
+	// Namespaces are those the action touches, cancelling it is authorized in them
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Owner is the identity of the replica running the action
+	Owner string    `json:"owner"`
+	Start time.Time `json:"start"`
+	// Steps are the queued suggestions of the action whose outcome is not settled yet, by suggestion ID
+	Steps map[string]*journalStep `json:"steps,omitempty"`
+	// Marked are the pods the action set the lowest deletion cost on
+	Marked []Pod `json:"marked,omitempty"`
+	// Scales are the scale changes of the action a cancel reverts
+	Scales []journalScale `json:"scales,omitempty"`
+}
+
+// journalScale is a change of the replicas of a workload by an action.
+type journalScale struct {
+	Workload Workload `json:"workload"`
+	Delta    int32    `json:"delta"`
+}
+
+// journalStep is a suggestion queued by an action, possibly as the create step of a move.
+type journalStep struct {
+	Queue      string                `json:"queue"`
+	Suggestion *SchedulingSuggestion `json:"suggestion"`
+	Queued     time.Time             `json:"queued"`
+	// Scaled is set once the workload was scaled up for the suggestion, Replicas to the replicas after the scale up
+	Scaled   bool  `json:"scaled,omitempty"`
+	Replicas int32 `json:"replicas,omitempty"`
+	// Pod is the pod a move deletes once the pod placed by the suggestion is ready
+	Pod *Pod `json:"pod,omitempty"`
+	// Deleting is set once the move started to delete Pod
+	Deleting bool `json:"deleting,omitempty"`
+}
+
+// newIdentity returns the identity of the replica in the journal and the leader election. The hostname is the name of
+// the WAM pod, the random suffix tells a restarted container from its predecessor.
+func newIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "wam"
+	}
+	return fmt.Sprintf("%s_%s", hostname, uuid.NewUUID())
+}
+
+// journal applies the change to the journal entry of the action of ctx and stores the entry. Failing to store it is
+// logged, the action is not failed for it. Steps of calls without an action, e.g. by the reconciler, are not recorded.
+// Once the running actions are interrupted on shutdown the journal is left as is, so it keeps the steps their
+// handlers did not finish while unwinding.
+func (as *ActionService) journal(ctx context.Context, change func(entry *journalEntry)) {
+	id := actionID(ctx)
+	if id == "" || as.ctx.Err() != nil {
+		return
+	}
+
+	as.mu.Lock()
+	entry, ok := as.entries[id]
+	if !ok {
+		entry = &journalEntry{
+			ActionID: id,
+			Action:   as.inFlight[id],
+			Owner:    as.identity,
+			Start:    time.Now(),
+			Steps:    map[string]*journalStep{},
+		}
+		as.entries[id] = entry
+	}
+	change(entry)
+	encoded, err := json.Marshal(entry)
+	as.mu.Unlock()
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "error encoding journal entry")
+		return
+	}
+
+	if err := as.rdb.HSet(context.WithoutCancel(ctx), journalKey, id, encoded).Err(); err != nil {
+		klog.FromContext(ctx).Error(err, "error storing journal entry")
+	}
+}
+
+// journalSuggestion records a queued suggestion.
+func (as *ActionService) journalSuggestion(ctx context.Context, queue string, suggestion *SchedulingSuggestion) {
+	as.journal(ctx, func(entry *journalEntry) {
+		entry.Steps[string(suggestion.ID)] = &journalStep{Queue: queue, Suggestion: suggestion, Queued: time.Now()}
+	})
+}
+
+// journalStep applies the change to the step of the suggestion, if it is recorded.
+func (as *ActionService) journalStep(ctx context.Context, suggestion *SchedulingSuggestion, change func(step *journalStep)) {
+	as.journal(ctx, func(entry *journalEntry) {
+		if step, ok := entry.Steps[string(suggestion.ID)]; ok {
+			change(step)
+		}
+	})
+}
+
+// journalSettle removes the step of the suggestion once its outcome is settled, by completing or rolling it back.
+func (as *ActionService) journalSettle(ctx context.Context, suggestion *SchedulingSuggestion) {
+	as.journal(ctx, func(entry *journalEntry) {
+		delete(entry.Steps, string(suggestion.ID))
+	})
+}
+
+// journalMark records that the pod is set the lowest deletion cost.
+func (as *ActionService) journalMark(ctx context.Context, pod *v1.Pod) {
+	as.journal(ctx, func(entry *journalEntry) {
+		entry.Marked = append(entry.Marked, Pod{Namespace: pod.Namespace, Name: pod.Name, Cluster: as.name})
+	})
+}
+
+// journalScaled records that the workload was scaled by delta replicas.
+func (as *ActionService) journalScaled(ctx context.Context, workload Workload, delta int32) {
+	as.journal(ctx, func(entry *journalEntry) {
+		entry.Scales = append(entry.Scales, journalScale{Workload: workload, Delta: delta})
+	})
+}
+
+// journalUnscaled removes a scale change recorded by journalScaled once it is reverted or needs no reverting anymore.
+func (as *ActionService) journalUnscaled(ctx context.Context, workload Workload, delta int32) {
+	as.journal(ctx, func(entry *journalEntry) {
+		if i := slices.Index(entry.Scales, journalScale{Workload: workload, Delta: delta}); i >= 0 {
+			entry.Scales = slices.Delete(entry.Scales, i, i+1)
+		}
+	})
+}
+
+// journalReplacement records a suggestion queued for the replacement of a deleted pod. The controller creates the
+// replacement after the delete returned, so the suggestion is recorded apart from the entry of the action, if any, and
+// also when the delete runs outside an action, e.g. in a repair by the reconciler. The reconciler drops the record
+// once the suggestion is older than the move timeout, see removeStaleSuggestions.
+func (as *ActionService) journalReplacement(ctx context.Context, queue string, suggestion *SchedulingSuggestion) {
+	encoded, err := json.Marshal(&journalStep{Queue: queue, Suggestion: suggestion, Queued: time.Now()})
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "error encoding replacement suggestion")
+		return
+	}
+
+	if err := as.rdb.HSet(context.WithoutCancel(ctx), replacementsKey, string(suggestion.ID), encoded).Err(); err != nil {
+		klog.FromContext(ctx).Error(err, "error storing replacement suggestion")
+	}
+}
+
+// finishJournal removes the journal entry of a returned action. The entry of an action interrupted on shutdown is
+// kept, so the reconciler recovers its steps once this replica is gone.
+func (as *ActionService) finishJournal(ctx context.Context, id string, interrupted bool) {
+	as.mu.Lock()
+	_, ok := as.entries[id]
+	delete(as.entries, id)
+	as.mu.Unlock()
+
+	if !ok || interrupted {
+		return
+	}
+
+	if err := as.rdb.HDel(context.WithoutCancel(ctx), journalKey, id).Err(); err != nil {
+		klog.FromContext(ctx).Error(err, "error removing journal entry")
+	}
+}
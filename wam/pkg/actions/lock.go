@@ -0,0 +1,137 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/metrics"
+	"github.com/redis/go-redis/v9"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/klog/v2"
+	"time"
+)
+
+const (
+	// lockTTL bounds how long a lock is held if its owner dies without releasing it, its owner renews it until then
+	lockTTL = 30 * time.Second
+	// lockRenewInterval is the pause between two renewals of a held lock
+	lockRenewInterval = lockTTL / 3
+	// lockRetryInterval is the pause between two attempts to acquire a lock
+	lockRetryInterval = 100 * time.Millisecond
+)
+
+// releaseScript deletes the lock only if it is still held by the given token.
+var releaseScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+else
+	return 0
+end
+`)
+
+// renewScript extends the TTL of the lock only if it is still held by the given token.
+var renewScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+else
+	return 0
+end
+`)
+
+var errLockTimeout = errors.New("timed out waiting for lock")
+
+func lockKey(name string) string {
+	return fmt.Sprintf("wam:lock:%s", name)
+}
+
+// lock acquires a distributed lock shared by all WAM replicas and returns a function releasing it, waiting for it up to
+// the lock timeout of the action. It is used to serialize read-modify-write updates of a workload's scale. The lock is
+// renewed until it is released, so retried updates do not outlive it.
+func (as *ActionService) lock(ctx context.Context, name string) (func(), error) {
+	key := lockKey(name)
+	token := string(uuid.NewUUID())
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, as.timeouts(ctx).Lock)
+	defer cancel()
+
+	for {
+		ok, err := as.rdb.SetNX(ctx, key, token, lockTTL).Result()
+		if err != nil {
+			metrics.LockWaitDuration.WithLabelValues(metrics.OutcomeFailure).Observe(time.Since(start).Seconds())
+			return nil, fmt.Errorf("error acquiring lock %s: %w", key, err)
+		}
+
+		if ok {
+			metrics.LockWaitDuration.WithLabelValues(metrics.OutcomeSuccess).Observe(time.Since(start).Seconds())
+
+			as.mu.Lock()
+			as.locks[key] = token
+			as.mu.Unlock()
+
+			lh := klog.FromContext(ctx)
+			renewCtx, stopRenew := context.WithCancel(context.WithoutCancel(ctx))
+			go as.renewLock(renewCtx, key, token)
+
+			return func() {
+				stopRenew()
+
+				as.mu.Lock()
+				delete(as.locks, key)
+				as.mu.Unlock()
+
+				if err := releaseScript.Run(context.Background(), as.rdb, []string{key}, token).Err(); err != nil {
+					lh.Error(err, "error releasing lock", "lock", key)
+				}
+			}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			metrics.LockWaitDuration.WithLabelValues(metrics.OutcomeFailure).Observe(time.Since(start).Seconds())
+			return nil, fmt.Errorf("%w %s", errLockTimeout, key)
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// renewLock extends the TTL of the held lock until ctx is done or the lock was released, e.g. by releaseLocks.
+func (as *ActionService) renewLock(ctx context.Context, key string, token string) {
+	ticker := time.NewTicker(lockRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		renewed, err := renewScript.Run(ctx, as.rdb, []string{key}, token, lockTTL.Milliseconds()).Int()
+		if err != nil {
+			if ctx.Err() == nil {
+				klog.FromContext(ctx).Error(err, "error renewing lock", "lock", key)
+			}
+			continue
+		}
+		if renewed == 0 {
+			return
+		}
+	}
+}
+
+// releaseLocks releases all locks still held by this replica, so other replicas do not have to wait for their TTL.
+func (as *ActionService) releaseLocks(ctx context.Context) {
+	as.mu.Lock()
+	locks := as.locks
+	as.locks = map[string]string{}
+	as.mu.Unlock()
+
+	for key, token := range locks {
+		if err := releaseScript.Run(ctx, as.rdb, []string{key}, token).Err(); err != nil {
+			klog.FromContext(ctx).Error(err, "error releasing lock", "lock", key)
+			continue
+		}
+		klog.FromContext(ctx).Info("released lock held by an interrupted action", "lock", key)
+	}
+}
@@ -0,0 +1,409 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/logging"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/tracing"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// helmReleaseLabel is set by Helm charts following the Kubernetes recommended labels.
+const helmReleaseLabel = "app.kubernetes.io/instance"
+
+// migrationTTL is how long the progress of a migration can be queried.
+const migrationTTL = 24 * time.Hour
+
+// statuses of the moves of a migration
+const (
+	migrationPending = "pending"
+	migrationMoving  = "moving"
+	migrationMoved   = "moved"
+	migrationFailed  = "failed"
+)
+
+type MigrateAppArgs struct {
+	Namespace string `json:"namespace"`
+	// Cluster is the name of a remote cluster, the cluster WAM runs in if empty
+	Cluster string `json:"cluster,omitempty"`
+	// Selector selects the pods of the application, e.g. app=web
+	Selector string `json:"selector,omitempty"`
+	// Release selects the pods of a Helm release instead
+	Release string `json:"release,omitempty"`
+	// Nodes are the nodes the application is moved to
+	Nodes []string `json:"nodes,omitempty"`
+	// NodeSelector selects the nodes the application is moved to by label instead, e.g. topology.kubernetes.io/zone=b
+	NodeSelector string `json:"nodeSelector,omitempty"`
+	// MaxSurge is the number of pods moved at the same time, 1 by default
+	MaxSurge int `json:"maxSurge,omitempty"`
+	ActionOptions
+}
+
+type MigrateAppReply struct {
+	Message  string `json:"message"`
+	ActionID string `json:"actionId"`
+	// Status of the migration, for a repeated idempotency key that of the original migration
+	Status string `json:"status,omitempty"`
+	// Moves are the planned moves of a dry run
+	Moves []PodMigration `json:"moves,omitempty"`
+}
+
+type MigrateAppStatusArgs struct {
+	ActionID string `json:"actionId"`
+}
+
+type MigrateAppStatusReply struct {
+	Namespace string         `json:"namespace"`
+	Moves     []PodMigration `json:"moves"`
+}
+
+// PodMigration is the move of a single pod of a migration and its progress.
+type PodMigration struct {
+	Pod    Pod    `json:"pod"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// migrationRecord is stored in Redis to report the progress of a migration.
+type migrationRecord struct {
+	Namespace string         `json:"namespace"`
+	Moves     []PodMigration `json:"moves"`
+}
+
+func validateMigrateAppReq(args *MigrateAppArgs) error {
+	if args.Namespace == "" {
+		args.Namespace = "default"
+	}
+
+	if (args.Selector == "") == (args.Release == "") {
+		return fmt.Errorf("exactly one of selector and release must be specified")
+	}
+	if args.Selector != "" {
+		if _, err := labels.Parse(args.Selector); err != nil {
+			return fmt.Errorf("invalid selector: %w", err)
+		}
+	}
+
+	if (len(args.Nodes) == 0) == (args.NodeSelector == "") {
+		return fmt.Errorf("exactly one of nodes and nodeSelector must be specified")
+	}
+	if args.NodeSelector != "" {
+		if _, err := labels.Parse(args.NodeSelector); err != nil {
+			return fmt.Errorf("invalid nodeSelector: %w", err)
+		}
+	}
+
+	if args.MaxSurge == 0 {
+		args.MaxSurge = 1
+	}
+	if args.MaxSurge < 0 {
+		return fmt.Errorf("maxSurge must be positive")
+	}
+
+	return nil
+}
+
+func (args *MigrateAppArgs) podSelector() string {
+	if args.Release != "" {
+		return helmReleaseLabel + "=" + args.Release
+	}
+	return args.Selector
+}
+
+// schedulableNodes returns the schedulable and ready nodes of the given names or, if there are none, those matching
+// the label selector, sorted by name.
+func (as *ActionService) schedulableNodes(ctx context.Context, names []string, selector string) ([]v1.Node, error) {
+	var nodes []v1.Node
+	if len(names) == 0 {
+		nodeList, err := as.k8sClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+		nodes = nodeList.Items
+	} else {
+		for _, name := range names {
+			node, err := as.k8sClient.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, *node)
+		}
+	}
+
+	var schedulable []v1.Node
+	for _, node := range nodes {
+		if !node.Spec.Unschedulable && isNodeReady(&node) {
+			schedulable = append(schedulable, node)
+		}
+	}
+
+	slices.SortFunc(schedulable, func(a, b v1.Node) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return schedulable, nil
+}
+
+// targetNodes returns the names of the schedulable and ready target nodes of a migration.
+func (as *ActionService) targetNodes(ctx context.Context, args *MigrateAppArgs) ([]string, error) {
+	nodes, err := as.schedulableNodes(ctx, args.Nodes, args.NodeSelector)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no schedulable and ready target nodes")
+	}
+
+	var names []string
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+	return names, nil
+}
+
+func isNodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// resolveMigration expands a migration into the moves of the pods not yet on a target node. The pods are spread
+// evenly over the target nodes, counting the pods of the application already running there.
+func (as *ActionService) resolveMigration(ctx context.Context, args *MigrateAppArgs) ([]PodMigration, error) {
+	targets, err := as.targetNodes(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	podList, err := as.k8sClient.CoreV1().Pods(args.Namespace).List(ctx, metav1.ListOptions{LabelSelector: args.podSelector()})
+	if err != nil {
+		return nil, err
+	}
+
+	pods := podList.Items
+	slices.SortFunc(pods, func(a, b v1.Pod) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	perNode := map[string]int{}
+	var toMove []v1.Pod
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil || pod.Spec.NodeName == "" {
+			continue
+		}
+		if slices.Contains(targets, pod.Spec.NodeName) {
+			perNode[pod.Spec.NodeName]++
+			continue
+		}
+		toMove = append(toMove, pod)
+	}
+
+	var moves []PodMigration
+	for _, pod := range toMove {
+		if !as.isRelocatable(ctx, &pod) {
+			klog.FromContext(ctx).V(2).Info("skipping pod not owned by a Deployment or StatefulSet", "pod", klog.KObj(&pod))
+			continue
+		}
+
+		target := targets[0]
+		for _, node := range targets[1:] {
+			if perNode[node] < perNode[target] {
+				target = node
+			}
+		}
+		perNode[target]++
+
+		moves = append(moves, PodMigration{
+			Pod:    Pod{Namespace: pod.Namespace, Name: pod.Name, Cluster: as.name},
+			From:   pod.Spec.NodeName,
+			To:     target,
+			Status: migrationPending,
+		})
+	}
+
+	if len(moves) == 0 {
+		return nil, fmt.Errorf("no pods selected by %q to move", args.podSelector())
+	}
+
+	return moves, nil
+}
+
+func migrationKey(id string) string {
+	return fmt.Sprintf("wam:migration:%s", id)
+}
+
+func (as *ActionService) saveMigration(ctx context.Context, id string, record *migrationRecord) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return as.rdb.Set(context.WithoutCancel(ctx), migrationKey(id), encoded, migrationTTL).Err()
+}
+
+func (as *ActionService) loadMigration(ctx context.Context, id string) (*migrationRecord, error) {
+	encoded, err := as.rdb.Get(ctx, migrationKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("no migration with action ID %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record := &migrationRecord{}
+	if err := json.Unmarshal(encoded, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// MigrateAppHandler moves the pods of an application with up to maxSurge moves running at the same time, see runMoves.
+func (as *ActionService) MigrateAppHandler(ctx context.Context, id string, args *MigrateAppArgs, moves []PodMigration) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "MigrateAppHandler", trace.WithAttributes(
+		attribute.String("wam.selector", args.podSelector()),
+		attribute.Int("wam.moves", len(moves)),
+		attribute.Int("wam.max_surge", args.MaxSurge),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	err = as.runMoves(ctx, id, &migrationRecord{Namespace: args.Namespace, Moves: moves}, args.MaxSurge)
+	if err != nil {
+		return err
+	}
+
+	klog.FromContext(ctx).Info("migrate application action successful", "moves", len(moves))
+	return nil
+}
+
+// runMoves runs the moves of the record with up to maxSurge, at most ACTIONS_MAX_CONCURRENT_MOVES, of them at the same
+// time. Every move waits for the new pod to be ready before the old one is gone and is checked against the policies
+// right before it starts, so e.g. disruption budgets see the moves completed so far. The progress is stored under the
+// action ID for MigrateAppStatus.
+func (as *ActionService) runMoves(ctx context.Context, id string, record *migrationRecord, maxSurge int) error {
+	lh := klog.FromContext(ctx)
+
+	if as.config.MaxConcurrentMoves > 0 && maxSurge > as.config.MaxConcurrentMoves {
+		lh.V(2).Info("capping concurrent moves", "maxSurge", maxSurge, "cap", as.config.MaxConcurrentMoves)
+		maxSurge = as.config.MaxConcurrentMoves
+	}
+
+	var mu sync.Mutex
+	update := func(i int, status string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		record.Moves[i].Status = status
+		if err != nil {
+			record.Moves[i].Error = err.Error()
+		}
+		if err := as.saveMigration(ctx, id, record); err != nil {
+			lh.Error(err, "error saving migration progress")
+		}
+	}
+
+	if err := as.saveMigration(ctx, id, record); err != nil {
+		lh.Error(err, "error saving migration progress")
+	}
+
+	var errs []error
+	surge := make(chan struct{}, maxSurge)
+	var wg sync.WaitGroup
+	for i, move := range record.Moves {
+		select {
+		case surge <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(i int, move PodMigration) {
+			defer func() {
+				<-surge
+				wg.Done()
+			}()
+
+			moveCtx, moveLh := logging.WithValues(ctx, "pod", klog.KRef(move.Pod.Namespace, move.Pod.Name), "node", move.To)
+
+			// every move is dispatched on its own, so the moves of actions of a higher priority overtake the
+			// remaining ones
+			release, err := as.queue.admit(moveCtx)
+			if err == nil {
+				defer release()
+
+				update(i, migrationMoving, nil)
+				err = as.migratePod(moveCtx, fmt.Sprintf("%s-%d", id, i), move)
+			}
+			if err != nil {
+				moveLh.Error(err, "error moving pod")
+				update(i, migrationFailed, err)
+
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("moving pod %s: %w", klog.KRef(move.Pod.Namespace, move.Pod.Name), err))
+				mu.Unlock()
+				return
+			}
+
+			update(i, migrationMoved, nil)
+		}(i, move)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		lh.Info("moves finished with failures", "failed", len(errs), "moves", len(record.Moves))
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
+
+// isRelocatable reports whether the pod belongs to a Deployment or StatefulSet, whose pods migratePod can move.
+func (as *ActionService) isRelocatable(ctx context.Context, pod *v1.Pod) bool {
+	if getPodsStatefulSet(pod) != nil {
+		return true
+	}
+	_, err := as.getPodsDeployment(ctx, pod)
+	return err == nil
+}
+
+// migratePod moves a Deployment pod, or replaces a StatefulSet pod on the target node, see RelocateHandler.
+func (as *ActionService) migratePod(ctx context.Context, id string, move PodMigration) error {
+	pod, err := as.getPod(ctx, move.Pod.Namespace, move.Pod.Name)
+	if err != nil {
+		return err
+	}
+
+	if getPodsStatefulSet(pod) != nil {
+		release, err := as.checkPolicies(ctx, id, actionRelocate, nil, []Pod{move.Pod}, move.To)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		return as.RelocateHandler(ctx, move.Pod, move.To)
+	}
+
+	release, err := as.checkPolicies(ctx, id, actionMove, nil, []Pod{move.Pod}, move.To)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return as.MoveHandler(ctx, &MoveArgs{Pod: move.Pod, Node: Node{move.To, as.name}})
+}
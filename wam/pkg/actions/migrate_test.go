@@ -0,0 +1,100 @@
+package actions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+func newNode(name, zone string, ready bool) *v1.Node {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"zone": zone}},
+		Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}}},
+	}
+}
+
+func TestMigrateAppDryRun(t *testing.T) {
+	objects := newWorkload("a", "node-1", "node-1", "node-2", "node-3")
+	objects = append(objects,
+		newNode("node-1", "a", true),
+		newNode("node-2", "b", true),
+		newNode("node-3", "b", true),
+		// not ready, so nothing is moved there
+		newNode("node-4", "b", false),
+	)
+	client := fake.NewSimpleClientset(objects...)
+	as := NewActionService(client, nil, wamconfig.Actions{}, nil, nil, nil)
+
+	args := &MigrateAppArgs{Selector: "app=a", NodeSelector: "zone=b", ActionOptions: ActionOptions{DryRun: true}}
+	reply := &MigrateAppReply{}
+	if err := as.MigrateApp(httptest.NewRequest(http.MethodPost, "/rpc", nil), args, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// a-2 and a-3 already run in zone b, the pods on node-1 are spread over its nodes
+	want := []PodMigration{
+		{Pod: Pod{Namespace: "default", Name: "a-0"}, From: "node-1", To: "node-2", Status: migrationPending},
+		{Pod: Pod{Namespace: "default", Name: "a-1"}, From: "node-1", To: "node-3", Status: migrationPending},
+	}
+	if !reflect.DeepEqual(reply.Moves, want) {
+		t.Errorf("expected moves %+v, got %+v", want, reply.Moves)
+	}
+}
+
+func TestValidateMigrateAppReq(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    *MigrateAppArgs
+		wantErr bool
+	}{
+		{
+			name: "selector and nodes",
+			args: &MigrateAppArgs{Selector: "app=a", Nodes: []string{"node-1"}},
+		},
+		{
+			name: "release and node selector",
+			args: &MigrateAppArgs{Release: "web", NodeSelector: "zone=b"},
+		},
+		{
+			name:    "selector and release",
+			args:    &MigrateAppArgs{Selector: "app=a", Release: "web", Nodes: []string{"node-1"}},
+			wantErr: true,
+		},
+		{
+			name:    "no target",
+			args:    &MigrateAppArgs{Selector: "app=a"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid selector",
+			args:    &MigrateAppArgs{Selector: "app in (", Nodes: []string{"node-1"}},
+			wantErr: true,
+		},
+		{
+			name:    "negative surge",
+			args:    &MigrateAppArgs{Selector: "app=a", Nodes: []string{"node-1"}, MaxSurge: -1},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMigrateAppReq(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
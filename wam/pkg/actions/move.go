@@ -3,21 +3,26 @@ package actions
 import (
 	"context"
 	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/audit"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/logging"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/metrics"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/readiness"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	clientset "k8s.io/client-go/kubernetes"
-	"log"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
 	"time"
 )
 
-func (ma *MoveArgs) toCreateArgs(k8sClient *clientset.Clientset) (*CreateArgs, error) {
-	pod, err := k8sClient.CoreV1().Pods(ma.Pod.Namespace).Get(context.TODO(), ma.Pod.Name, metav1.GetOptions{})
+func (ma *MoveArgs) toCreateArgs(ctx context.Context, as *ActionService) (*CreateArgs, error) {
+	pod, err := as.getPod(ctx, ma.Pod.Namespace, ma.Pod.Name)
 	if err != nil {
 		return nil, err
 	}
 
-	deployment, err := getPodsDeployment(pod, k8sClient)
+	deployment, err := as.getPodsDeployment(ctx, pod)
 	if err != nil {
 		return nil, err
 	}
@@ -28,6 +33,8 @@ func (ma *MoveArgs) toCreateArgs(k8sClient *clientset.Clientset) (*CreateArgs, e
 			APIVersion: deployment.APIVersion,
 			Kind:       deployment.Kind,
 			Name:       deployment.Name,
+			// the workload of a move across clusters is the Deployment of the same name in the target cluster
+			Cluster: ma.Node.Cluster,
 		},
 		Node: ma.Node,
 	}, nil
@@ -39,45 +46,63 @@ func (ma *MoveArgs) toDeleteArgs() *DeleteArgs {
 	}
 }
 
-func (as *ActionService) waitToBeReady(namespace string, schedulingSuggestion *SchedulingSuggestion, timeout time.Duration) error {
-	watch, err := as.k8sClient.CoreV1().Pods(namespace).Watch(context.Background(), v1.ListOptions{})
+// waitToBeReady blocks until the pod created for the scheduling suggestion is ready, records the time it took under
+// the given action type and returns the pod. It is notified by the shared pod informer, see readyWaiters.
+func (as *ActionService) waitToBeReady(ctx context.Context, action string, namespace string, schedulingSuggestion *SchedulingSuggestion, timeout time.Duration) (_ *corev1.Pod, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "waitToBeReady", trace.WithAttributes(
+		attribute.String("wam.suggestion_id", string(schedulingSuggestion.ID)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	lh := klog.FromContext(ctx).WithValues("suggestionID", schedulingSuggestion.ID)
+
+	start := time.Now()
+
+	id := string(schedulingSuggestion.ID)
+	podReady := as.waiters.add(id)
+	defer as.waiters.remove(id)
+
+	// the pod may have become ready before the waiter was added
+	cached, err := as.pods.Pods(namespace).List(labels.Everything())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer watch.Stop()
-
-	// Channel to signal when the pod is ready
-	podReady := make(chan struct{})
-
-	// Start watching for events
-	go func() {
-		for event := range watch.ResultChan() {
-			pod, ok := event.Object.(*corev1.Pod)
-			if !ok {
-				continue
-			}
-
-			if hasSchedulingSuggestionID(pod, string(schedulingSuggestion.ID)) {
-				switch event.Type {
-				case "ADDED", "MODIFIED":
-					if isPodReady(pod) {
-						close(podReady)
-					}
-				}
-			}
+	for _, pod := range cached {
+		if hasSchedulingSuggestionID(pod, id) {
+			as.waiters.notify(pod)
 		}
-	}()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
 	select {
-	case <-podReady:
-		return nil
-	case <-time.After(timeout):
-		return fmt.Errorf("waiting for pod with %s exceeded timeout", string(schedulingSuggestion.ID))
+	case pod := <-podReady:
+		lh.V(2).Info("pod is ready", "readyPod", klog.KObj(pod), "readyNode", pod.Spec.NodeName)
+		span.AddEvent("pod ready", trace.WithAttributes(
+			attribute.String("wam.pod", pod.Name),
+			attribute.String("wam.pod.traceparent", pod.Annotations[traceParentAnnotation]),
+		))
+		metrics.PodReadyDuration.WithLabelValues(action).Observe(time.Since(start).Seconds())
+		as.event(ctx, pod, corev1.EventTypeNormal, reasonPodPlaced, "Placed on suggested node %s by suggestion %s and ready", pod.Spec.NodeName, id)
+		audit.Add(ctx, audit.Event{Type: audit.EventPodCreated, Pod: pod.Namespace + "/" + pod.Name, Node: pod.Spec.NodeName, SuggestionID: id})
+		return pod, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("waiting for pod with %s exceeded timeout", id)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for pod with %s: %w", id, ctx.Err())
 	}
 }
 
+const (
+	// suggestionIDAnnotation is set by the scheduler plugin to the ID of the suggestion it placed the pod by
+	suggestionIDAnnotation = "example.com/scheduling-suggestion-id"
+	// traceParentAnnotation is set by the scheduler plugin to the trace context it scheduled the pod in
+	traceParentAnnotation = "example.com/traceparent"
+)
+
 func hasSchedulingSuggestionID(pod *corev1.Pod, ID string) bool {
-	val, ok := pod.Annotations["example.com/scheduling-suggestion-id"]
+	val, ok := pod.Annotations[suggestionIDAnnotation]
 	return ok && val == ID
 }
 
@@ -90,39 +115,97 @@ func isPodReady(pod *corev1.Pod) bool {
 	return false
 }
 
-func (as *ActionService) MoveHandler(args *MoveArgs) {
-	createArgs, err := args.toCreateArgs(as.k8sClient)
+func (as *ActionService) MoveHandler(ctx context.Context, args *MoveArgs) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "MoveHandler", trace.WithAttributes(
+		attribute.String("wam.pod", args.Pod.Namespace+"/"+args.Pod.Name),
+		attribute.String("wam.node", args.Node.Name),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, lh := logging.WithValues(ctx,
+		"pod", klog.KRef(args.Pod.Namespace, args.Pod.Name),
+		"node", args.Node.Name,
+	)
+
+	// the new pod is created in the cluster of the node, which is the pod's own unless the pod moves across clusters
+	target, err := as.inCluster(args.Node.Cluster)
 	if err != nil {
-		log.Printf("%s: move action failed at determining the workload of %s\n", err.Error(), args.Pod.Name)
+		return err
 	}
 
-	schedulingSuggestion, err := as.CreateHandler(createArgs)
+	createArgs, err := args.toCreateArgs(ctx, as)
 	if err != nil {
-		log.Printf("move action failed at create step: %s\n", err.Error())
+		lh.Error(err, "move action failed at determining the workload of the pod")
+		return err
 	}
 
-	log.Printf("waiting for pod of workload %s on node %s to become ready\n", createArgs.Workload.Name, createArgs.Node.Name)
+	ctx, lh = logging.WithValues(ctx, "workload", klog.KRef(createArgs.Workload.Namespace, createArgs.Workload.Name))
+	defer func() {
+		if err != nil {
+			as.event(ctx, workloadRef(createArgs.Workload), corev1.EventTypeWarning, reasonMoveFailed,
+				"Moving pod %s to node %s failed: %v", args.Pod.Name, args.Node.Name, err)
+		}
+	}()
+
+	schedulingSuggestion, err := target.CreateHandler(ctx, createArgs)
+	if err != nil {
+		lh.Error(err, "move action failed at create step")
+		return err
+	}
+	// the move settles the step either way once it returns, the journal only tells about moves interrupted midway. A
+	// cancelled move leaves the step to be rolled back, see compensateCancelled.
+	as.journalStep(ctx, schedulingSuggestion, func(step *journalStep) { step.Pod = &args.Pod })
+	defer func() {
+		if err == nil || !cancelled(ctx) {
+			as.journalSettle(ctx, schedulingSuggestion)
+		}
+	}()
+
+	lh.V(2).Info("waiting for the new pod to become ready")
 
 	// todo: this can takes a while, so consider a better architecture than keeping a goroutine alive for so long
-	err = as.waitToBeReady(args.Pod.Namespace, schedulingSuggestion, 5*time.Minute)
+	pod, err := target.waitToBeReady(ctx, actionMove, args.Pod.Namespace, schedulingSuggestion, as.timeouts(ctx).Ready)
+	if err != nil {
+		lh.Error(err, "move action failed at wait step")
+		return err
+	}
+
+	err = target.waitForGates(ctx, pod, args.ReadinessGates, as.timeouts(ctx).ReadinessGates)
 	if err != nil {
-		log.Printf("move action failed at wait step: %s\n", err.Error())
+		lh.Error(err, "move action failed at readiness gates")
+		return err
 	}
 
-	log.Printf("done waiting, proceeding with delete\n")
+	lh.V(2).Info("done waiting, proceeding with delete")
+	as.journalStep(ctx, schedulingSuggestion, func(step *journalStep) { step.Deleting = true })
+
+	_, err = as.DeleteHandler(ctx, args.toDeleteArgs())
+	if err != nil {
+		lh.Error(err, "move action failed at delete step")
+		return err
+	}
 
-	as.DeleteHandler(args.toDeleteArgs())
+	lh.Info("move action successful")
+	as.event(ctx, workloadRef(createArgs.Workload), corev1.EventTypeNormal, reasonMoveCompleted,
+		"Moved pod %s to node %s as pod %s", args.Pod.Name, args.Node.Name, pod.Name)
 
-	log.Println("move action successful")
+	return nil
 }
 
 type MoveArgs struct {
 	Pod  `json:"pod"`
 	Node `json:"node"`
+	// ReadinessGates must be passed by the new pod, in addition to being ready, before the original pod is deleted
+	ReadinessGates []readiness.Options `json:"readinessGates,omitempty"`
+	ActionOptions
 }
 
 type MoveReply struct {
-	Message string `json:"message"`
+	Message  string `json:"message"`
+	ActionID string `json:"actionId"`
+	// Status of the action, for a repeated idempotency key that of the original action
+	Status string `json:"status,omitempty"`
+	Plan   *Plan  `json:"plan,omitempty"`
 }
 
 func validateMoveReq(args *MoveArgs) error {
@@ -138,5 +221,11 @@ func validateMoveReq(args *MoveArgs) error {
 		return fmt.Errorf("node name is required")
 	}
 
+	for _, gate := range args.ReadinessGates {
+		if _, err := readiness.New(gate, readiness.Env{}); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,31 @@
+package actions
+
+// ActionOptions are the options every action request accepts, the arguments of the actions embed them. The steps of a
+// batch take the options of the batch.
+type ActionOptions struct {
+	// DryRun returns the plan of the action instead of running it
+	DryRun bool `json:"dryRun,omitempty"`
+	// IdempotencyKey makes repeated requests return the action started by the first one instead of starting another
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// Schedule defers the action, it starts right away if nil
+	Schedule *Schedule `json:"schedule,omitempty"`
+	// Priority is low, normal or high, actions of a higher priority are dispatched first. Drains are high and
+	// rebalances and scales to a placement low by default, all other actions normal.
+	Priority string `json:"priority,omitempty"`
+	// Timeouts and Retry override the configured timeouts and retry policy of the action
+	Timeouts *Timeouts    `json:"timeouts,omitempty"`
+	Retry    *RetryPolicy `json:"retry,omitempty"`
+}
+
+func validateActionOptions(options *ActionOptions) error {
+	if err := validateSchedule(options.Schedule); err != nil {
+		return err
+	}
+	if err := validatePriority(options.Priority); err != nil {
+		return err
+	}
+	if err := validateTimeouts(options.Timeouts); err != nil {
+		return err
+	}
+	return validateRetryPolicy(options.Retry)
+}
@@ -0,0 +1,194 @@
+package actions
+
+import (
+	"context"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/policy"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Plan is what an action would do. It is returned instead of running the action if the request sets dryRun.
+type Plan struct {
+	// Workloads are the Deployments the action scales
+	Workloads []Workload `json:"workloads"`
+	// ScaleChanges are the replica updates of the workloads, in the order the action makes them
+	ScaleChanges []ScaleChange `json:"scaleChanges"`
+	// Suggestions are pushed to the queues of the workloads before they are scaled up
+	Suggestions []PlannedSuggestion `json:"suggestions"`
+	// Deletions are the pods preferentially deleted when the workloads are scaled down
+	Deletions []PlannedDeletion `json:"deletions"`
+	// Policies are the results of the policy checks, the action is rejected if one did not pass
+	Policies []policy.Result `json:"policies"`
+}
+
+type ScaleChange struct {
+	Workload Workload `json:"workload"`
+	From     int32    `json:"from"`
+	To       int32    `json:"to"`
+}
+
+type PlannedSuggestion struct {
+	Queue string `json:"queue"`
+	Node  string `json:"node"`
+}
+
+type PlannedDeletion struct {
+	Pod      Pod      `json:"pod"`
+	Node     string   `json:"node"`
+	Workload Workload `json:"workload"`
+}
+
+func (p *Plan) addWorkload(workload Workload) {
+	for _, w := range p.Workloads {
+		if w == workload {
+			return
+		}
+	}
+	p.Workloads = append(p.Workloads, workload)
+}
+
+func (as *ActionService) planCreate(ctx context.Context, id string, args *CreateArgs) (*Plan, error) {
+	scale, err := as.k8sClient.AppsV1().
+		Deployments(args.Workload.Namespace).
+		GetScale(ctx, args.Workload.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		Workloads:    []Workload{args.Workload},
+		ScaleChanges: []ScaleChange{{args.Workload, scale.Spec.Replicas, scale.Spec.Replicas + 1}},
+		Suggestions:  []PlannedSuggestion{{args.Workload.QueueName(), args.Node.Name}},
+	}
+
+	plan.Policies, err = as.evaluatePolicies(ctx, id, actionCreate, []Workload{args.Workload}, nil, args.Node.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+func (as *ActionService) planDelete(ctx context.Context, id string, args *DeleteArgs) (*Plan, error) {
+	removal, err := as.resolveDeploymentRemoval(ctx, args.Pod)
+	if err != nil {
+		return nil, err
+	}
+
+	workload := Workload{
+		Namespace:  removal.Workload.Namespace,
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Name:       removal.Workload.Name,
+		Cluster:    as.name,
+	}
+	replicas := *removal.Workload.Spec.Replicas
+
+	plan := &Plan{
+		Workloads:    []Workload{workload},
+		ScaleChanges: []ScaleChange{{workload, replicas, replicas - 1}},
+		Deletions:    []PlannedDeletion{{args.Pod, removal.Pod.Spec.NodeName, workload}},
+	}
+
+	plan.Policies, err = as.evaluatePolicies(ctx, id, actionDelete, nil, []Pod{args.Pod}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+func (as *ActionService) planMove(ctx context.Context, id string, args *MoveArgs) (*Plan, error) {
+	removal, err := as.resolveDeploymentRemoval(ctx, args.Pod)
+	if err != nil {
+		return nil, err
+	}
+
+	workload := Workload{
+		Namespace:  removal.Workload.Namespace,
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Name:       removal.Workload.Name,
+		Cluster:    as.name,
+	}
+	replicas := *removal.Workload.Spec.Replicas
+
+	// the new pod is ready before the old one is deleted
+	plan := &Plan{
+		Workloads: []Workload{workload},
+		ScaleChanges: []ScaleChange{
+			{workload, replicas, replicas + 1},
+			{workload, replicas + 1, replicas},
+		},
+		Suggestions: []PlannedSuggestion{{workload.QueueName(), args.Node.Name}},
+		Deletions:   []PlannedDeletion{{args.Pod, removal.Pod.Spec.NodeName, workload}},
+	}
+
+	// a move across clusters scales up the Deployment of the same name in the target cluster
+	if args.Node.Cluster != as.name {
+		target, err := as.inCluster(args.Node.Cluster)
+		if err != nil {
+			return nil, err
+		}
+		deployment, err := target.getDeployment(ctx, workload.Namespace, workload.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		targetWorkload := workload
+		targetWorkload.Cluster = target.name
+		targetReplicas := *deployment.Spec.Replicas
+
+		plan.Workloads = append(plan.Workloads, targetWorkload)
+		plan.ScaleChanges = []ScaleChange{
+			{targetWorkload, targetReplicas, targetReplicas + 1},
+			{workload, replicas, replicas - 1},
+		}
+		plan.Suggestions = []PlannedSuggestion{{targetWorkload.QueueName(), args.Node.Name}}
+	}
+
+	plan.Policies, err = as.evaluatePolicies(ctx, id, actionMove, nil, []Pod{args.Pod}, args.Node.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+func (as *ActionService) planSwap(ctx context.Context, id string, args *SwapArgs) (*Plan, error) {
+	t, err := as.resolveSwap(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+	for i, pod := range t.pods {
+		workload := t.createArgs[i].Workload
+		plan.addWorkload(workload)
+
+		// X is deleted from node X, the Y pods from node Y
+		node := t.nodeY
+		if i == 0 {
+			node = t.nodeX
+		}
+
+		plan.Deletions = append(plan.Deletions, PlannedDeletion{pod, node, workload})
+		plan.Suggestions = append(plan.Suggestions, PlannedSuggestion{workload.QueueName(), t.createArgs[i].Node.Name})
+	}
+
+	// all pods are deleted before they are re-created on the other node
+	for _, workload := range plan.Workloads {
+		key := TargetScaleKey{workload.Namespace, workload.Name}
+		plan.ScaleChanges = append(plan.ScaleChanges, ScaleChange{workload, t.currentScales[key], t.targetScales[key]})
+	}
+	for _, workload := range plan.Workloads {
+		key := TargetScaleKey{workload.Namespace, workload.Name}
+		plan.ScaleChanges = append(plan.ScaleChanges, ScaleChange{workload, t.targetScales[key], t.currentScales[key]})
+	}
+
+	plan.Policies, err = as.evaluatePolicies(ctx, id, actionSwap, nil, t.pods, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,139 @@
+package actions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+// newWorkload returns a Deployment with the given number of replicas, its ReplicaSet and a pod on each node.
+func newWorkload(name string, nodes ...string) []runtime.Object {
+	labels := map[string]string{"app": name}
+	replicas := int32(len(nodes))
+
+	objects := []runtime.Object{
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+			},
+			Status: appsv1.DeploymentStatus{Replicas: replicas, ReadyReplicas: replicas},
+		},
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       "default",
+				Name:            name + "-rs",
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: name}},
+			},
+		},
+	}
+
+	for i, node := range nodes {
+		objects = append(objects, &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       "default",
+				Name:            name + "-" + string(rune('0'+i)),
+				Labels:          labels,
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: name + "-rs"}},
+			},
+			Spec: v1.PodSpec{NodeName: node},
+		})
+	}
+
+	return objects
+}
+
+func TestSwapDryRun(t *testing.T) {
+	objects := append(newWorkload("a", "node-1", "node-2", "node-2"), newWorkload("b", "node-2", "node-2")...)
+	client := fake.NewSimpleClientset(objects...)
+	as := NewActionService(client, nil, wamconfig.Actions{}, nil, nil, nil)
+
+	args := &SwapArgs{
+		X:             Pod{Name: "a-0"},
+		Y:             []Pod{{Name: "b-0"}, {Name: "b-1"}},
+		ActionOptions: ActionOptions{DryRun: true},
+	}
+	reply := &SwapReply{}
+	if err := as.Swap(httptest.NewRequest(http.MethodPost, "/rpc", nil), args, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	a := Workload{Namespace: "default", APIVersion: "apps/v1", Kind: "Deployment", Name: "a"}
+	b := Workload{Namespace: "default", APIVersion: "apps/v1", Kind: "Deployment", Name: "b"}
+	want := &Plan{
+		Workloads: []Workload{a, b},
+		ScaleChanges: []ScaleChange{
+			{a, 3, 2},
+			{b, 2, 0},
+			{a, 2, 3},
+			{b, 0, 2},
+		},
+		Suggestions: []PlannedSuggestion{
+			{a.QueueName(), "node-2"},
+			{b.QueueName(), "node-1"},
+			{b.QueueName(), "node-1"},
+		},
+		Deletions: []PlannedDeletion{
+			{Pod{"default", "a-0", ""}, "node-1", a},
+			{Pod{"default", "b-0", ""}, "node-2", b},
+			{Pod{"default", "b-1", ""}, "node-2", b},
+		},
+	}
+	if !reflect.DeepEqual(reply.Plan, want) {
+		t.Errorf("expected plan\n%+v\ngot\n%+v", want, reply.Plan)
+	}
+
+	for _, action := range client.Actions() {
+		if action.GetVerb() != "get" && action.GetVerb() != "list" {
+			t.Errorf("dry run must not change anything, got %s %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+}
+
+func TestMoveDryRunAcrossClusters(t *testing.T) {
+	client := fake.NewSimpleClientset(newWorkload("a", "node-1", "node-2")...)
+	remote := fake.NewSimpleClientset(newWorkload("a", "edge-node-1")...)
+	as := NewActionService(client, nil, wamconfig.Actions{}, nil, nil, nil)
+	as.AddCluster("edge", remote)
+
+	args := &MoveArgs{
+		Pod:           Pod{Namespace: "default", Name: "a-0"},
+		Node:          Node{Name: "edge-node-2", Cluster: "edge"},
+		ActionOptions: ActionOptions{DryRun: true},
+	}
+	reply := &MoveReply{}
+	if err := as.Move(httptest.NewRequest(http.MethodPost, "/rpc", nil), args, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	a := Workload{Namespace: "default", APIVersion: "apps/v1", Kind: "Deployment", Name: "a"}
+	edgeA := a
+	edgeA.Cluster = "edge"
+	want := &Plan{
+		Workloads: []Workload{a, edgeA},
+		ScaleChanges: []ScaleChange{
+			{edgeA, 1, 2},
+			{a, 2, 1},
+		},
+		Suggestions: []PlannedSuggestion{{"edge/default:apps/v1:Deployment:a", "edge-node-2"}},
+		Deletions:   []PlannedDeletion{{Pod{"default", "a-0", ""}, "node-1", a}},
+	}
+	if !reflect.DeepEqual(reply.Plan, want) {
+		t.Errorf("expected plan\n%+v\ngot\n%+v", want, reply.Plan)
+	}
+
+	args.Node.Cluster = "unknown"
+	if err := as.Move(httptest.NewRequest(http.MethodPost, "/rpc", nil), args, reply); err == nil {
+		t.Error("expected a move to an unknown cluster to be rejected")
+	}
+}
@@ -0,0 +1,168 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/auth"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/metrics"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/policy"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/klog/v2"
+)
+
+// resolveRemoval gets a pod an action deletes and its Deployment, if it is not a StatefulSet pod.
+func (as *ActionService) resolveRemoval(ctx context.Context, p Pod) (policy.Removal, error) {
+	pod, err := as.getPod(ctx, p.Namespace, p.Name)
+	if err != nil {
+		return policy.Removal{}, err
+	}
+
+	if getPodsStatefulSet(pod) != nil {
+		return policy.Removal{Pod: pod}, nil
+	}
+
+	owner, err := as.getPodsDeployment(ctx, pod)
+	if err != nil {
+		return policy.Removal{}, err
+	}
+
+	deployment, err := as.getDeployment(ctx, pod.Namespace, owner.Name)
+	if err != nil {
+		return policy.Removal{}, err
+	}
+
+	return policy.Removal{Pod: pod, Workload: deployment}, nil
+}
+
+// resolveDeploymentRemoval is resolveRemoval for the deletes and moves, which only remove Deployment pods.
+func (as *ActionService) resolveDeploymentRemoval(ctx context.Context, p Pod) (policy.Removal, error) {
+	removal, err := as.resolveRemoval(ctx, p)
+	if err != nil {
+		return removal, err
+	}
+	if removal.Workload == nil {
+		return removal, fmt.Errorf("pod %s is owned by a StatefulSet, only Deployment pods can be deleted or moved", klog.KObj(removal.Pod))
+	}
+	return removal, nil
+}
+
+// policyRequest describes an action that creates a pod of each of the workloads on target and deletes the given pods.
+func (as *ActionService) policyRequest(ctx context.Context, id string, action string, workloads []Workload, removed []Pod, target string) (policy.Request, error) {
+	req := policy.Request{
+		ID:     id,
+		Action: action,
+		Caller: "anonymous",
+		Nodes:  []string{target},
+		// move waits for the new pod to be ready before deleting the old one
+		Surge:    action == actionMove,
+		Client:   as.k8sClient,
+		Priority: priorityLevels[priorityFrom(ctx)],
+	}
+	if user, ok := auth.UserFrom(ctx); ok {
+		req.Caller = user.Name
+	}
+
+	seen := map[string]*appsv1.Deployment{}
+	addWorkload := func(deployment *appsv1.Deployment) *appsv1.Deployment {
+		key := deployment.Namespace + "/" + deployment.Name
+		if known, ok := seen[key]; ok {
+			return known
+		}
+		seen[key] = deployment
+		req.Workloads = append(req.Workloads, deployment)
+		return deployment
+	}
+
+	for _, workload := range workloads {
+		deployment, err := as.getDeployment(ctx, workload.Namespace, workload.Name)
+		if err != nil {
+			return req, err
+		}
+		addWorkload(deployment)
+	}
+
+	for _, pod := range removed {
+		removal, err := as.resolveRemoval(ctx, pod)
+		if err != nil {
+			return req, err
+		}
+		// count all pods of a workload against the same Deployment object
+		if removal.Workload != nil {
+			removal.Workload = addWorkload(removal.Workload)
+		}
+		req.Removals = append(req.Removals, removal)
+		req.Nodes = append(req.Nodes, removal.Pod.Spec.NodeName)
+	}
+
+	return req, nil
+}
+
+// checkPolicies checks an action, see policyRequest. The returned function must be called once the action is done.
+// All actions pass if no policies are configured.
+func (as *ActionService) checkPolicies(ctx context.Context, id string, action string, workloads []Workload, removed []Pod, target string) (func(), error) {
+	if as.policies == nil {
+		return func() {}, nil
+	}
+
+	req, err := as.policyRequest(ctx, id, action, workloads, removed, target)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := as.policies.Check(ctx, req)
+	var v *policy.Violation
+	if errors.As(err, &v) {
+		metrics.ObserveRejected(action)
+	}
+
+	return release, err
+}
+
+// peekPolicies checks an action like checkPolicies, without counting it against the limits or taking its node slots.
+func (as *ActionService) peekPolicies(ctx context.Context, id string, action string, workloads []Workload, removed []Pod, target string) error {
+	if as.policies == nil {
+		return nil
+	}
+
+	req, err := as.policyRequest(ctx, id, action, workloads, removed, target)
+	if err != nil {
+		return err
+	}
+
+	err = as.policies.Peek(ctx, req)
+	var v *policy.Violation
+	if errors.As(err, &v) {
+		metrics.ObserveRejected(action)
+	}
+
+	return err
+}
+
+// policyCheck checks an action against the policies, see checkPolicies. If peek is set, it is checked like by
+// peekPolicies and the returned function is nil.
+type policyCheck func(ctx context.Context, peek bool) (func(), error)
+
+// checkPoliciesOf returns the policyCheck of an action, see policyRequest.
+func (as *ActionService) checkPoliciesOf(id string, action string, workloads []Workload, removed []Pod, target string) policyCheck {
+	return func(ctx context.Context, peek bool) (func(), error) {
+		if peek {
+			return nil, as.peekPolicies(ctx, id, action, workloads, removed, target)
+		}
+		return as.checkPolicies(ctx, id, action, workloads, removed, target)
+	}
+}
+
+// evaluatePolicies returns the results of the policies for an action without counting it, see policyRequest.
+func (as *ActionService) evaluatePolicies(ctx context.Context, id string, action string, workloads []Workload, removed []Pod, target string) ([]policy.Result, error) {
+	if as.policies == nil {
+		return nil, nil
+	}
+
+	req, err := as.policyRequest(ctx, id, action, workloads, removed, target)
+	if err != nil {
+		return nil, err
+	}
+
+	return as.policies.Evaluate(ctx, req)
+}
@@ -0,0 +1,170 @@
+package actions
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/metrics"
+)
+
+// priorities of actions, actions of a higher priority are dispatched first
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+var priorityLevels = map[string]int{PriorityLow: 0, PriorityNormal: 1, PriorityHigh: 2}
+
+// defaultPriorities are those of the actions requested without a priority, drains evacuate nodes while rebalances and
+// scales to a placement optimize, all other actions are normal
+var defaultPriorities = map[string]string{
+	actionDrain:            PriorityHigh,
+	actionRebalance:        PriorityLow,
+	actionScaleToPlacement: PriorityLow,
+}
+
+// stepwise actions are dispatched move by move rather than as a whole, so actions of a higher priority overtake their
+// remaining moves, see runMoves
+var stepwise = map[string]bool{actionMigrateApp: true, actionDrain: true, actionRebalance: true}
+
+type priorityKey struct{}
+
+func validatePriority(priority string) error {
+	if _, ok := priorityLevels[priority]; priority != "" && !ok {
+		return fmt.Errorf("priority must be %s, %s or %s", PriorityLow, PriorityNormal, PriorityHigh)
+	}
+	return nil
+}
+
+// withPriority returns ctx carrying the priority of the action, the action's default if it is empty.
+func withPriority(ctx context.Context, action string, priority string) context.Context {
+	if priority == "" {
+		priority = defaultPriorities[action]
+	}
+	if priority == "" {
+		priority = PriorityNormal
+	}
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// priorityFrom returns the priority of the action of ctx.
+func priorityFrom(ctx context.Context) string {
+	if priority, ok := ctx.Value(priorityKey{}).(string); ok {
+		return priority
+	}
+	return PriorityNormal
+}
+
+// dispatchQueue admits the handlers of the actions of a replica, and the moves of its stepwise actions, once fewer
+// than limit run. Waiting handlers are admitted by priority, those of the same priority in the order they arrived.
+type dispatchQueue struct {
+	// limit is the number of handlers running at the same time, there is no limit if it is 0
+	limit int
+
+	mu      sync.Mutex
+	running int
+	waiting waiters
+	// arrived counts the handlers that had to wait, it orders those of the same priority
+	arrived uint64
+}
+
+type waiter struct {
+	priority string
+	level    int
+	arrival  uint64
+	// admitted is closed once the waiter holds a slot
+	admitted chan struct{}
+	index    int
+}
+
+// waiters is a heap of the waiting handlers, the next to be admitted first
+type waiters []*waiter
+
+func (w waiters) Len() int { return len(w) }
+func (w waiters) Less(i, j int) bool {
+	if w[i].level != w[j].level {
+		return w[i].level > w[j].level
+	}
+	return w[i].arrival < w[j].arrival
+}
+func (w waiters) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+	w[i].index = i
+	w[j].index = j
+}
+func (w *waiters) Push(x any) {
+	item := x.(*waiter)
+	item.index = len(*w)
+	*w = append(*w, item)
+}
+func (w *waiters) Pop() any {
+	old := *w
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	item.index = -1
+	*w = old[:len(old)-1]
+	return item
+}
+
+func newDispatchQueue(limit int) *dispatchQueue {
+	return &dispatchQueue{limit: limit}
+}
+
+// admit blocks until a handler of the priority of the action of ctx may run and returns a function releasing its slot.
+func (q *dispatchQueue) admit(ctx context.Context) (func(), error) {
+	if q.limit <= 0 {
+		return func() {}, nil
+	}
+
+	priority := priorityFrom(ctx)
+
+	q.mu.Lock()
+	if q.running < q.limit && len(q.waiting) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return q.release, nil
+	}
+
+	w := &waiter{priority: priority, level: priorityLevels[priority], arrival: q.arrived, admitted: make(chan struct{})}
+	q.arrived++
+	heap.Push(&q.waiting, w)
+	metrics.QueuedActions.WithLabelValues(priority).Inc()
+	q.mu.Unlock()
+
+	select {
+	case <-w.admitted:
+		return q.release, nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		admitted := w.index < 0
+		if !admitted {
+			heap.Remove(&q.waiting, w.index)
+			metrics.QueuedActions.WithLabelValues(priority).Dec()
+		}
+		q.mu.Unlock()
+
+		if admitted {
+			// admitted in between, pass the slot on
+			q.release()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// release passes the slot of a finished handler on to the next waiting one.
+func (q *dispatchQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiting) == 0 {
+		q.running--
+		return
+	}
+
+	next := heap.Pop(&q.waiting).(*waiter)
+	metrics.QueuedActions.WithLabelValues(next.priority).Dec()
+	close(next.admitted)
+}
@@ -0,0 +1,149 @@
+package actions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+func TestDispatchQueue(t *testing.T) {
+	q := newDispatchQueue(1)
+
+	release, err := q.admit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan string, 3)
+	wait := func(action string, priority string) {
+		ctx := withPriority(context.Background(), action, priority)
+		release, err := q.admit(ctx)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		admitted <- priorityFrom(ctx)
+		release()
+	}
+
+	// queued in the order low, normal, high, waiting for each to be queued
+	for i, priority := range []string{PriorityLow, "", PriorityHigh} {
+		go wait(actionCreate, priority)
+		for {
+			q.mu.Lock()
+			queued := len(q.waiting)
+			q.mu.Unlock()
+			if queued == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	release()
+	for _, want := range []string{PriorityHigh, PriorityNormal, PriorityLow} {
+		if got := <-admitted; got != want {
+			t.Errorf("expected the %s action to be dispatched next, got %s", want, got)
+		}
+	}
+}
+
+func TestDispatchQueueCancel(t *testing.T) {
+	q := newDispatchQueue(1)
+
+	release, err := q.admit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.admit(ctx); err == nil {
+		t.Fatal("expected the wait to be interrupted")
+	}
+	if len(q.waiting) != 0 {
+		t.Errorf("expected the interrupted handler to leave the queue, %d waiting", len(q.waiting))
+	}
+
+	release()
+	if q.running != 0 {
+		t.Errorf("expected no running handlers, got %d", q.running)
+	}
+}
+
+func TestDefaultPriority(t *testing.T) {
+	for action, want := range map[string]string{
+		actionDrain:     PriorityHigh,
+		actionRebalance: PriorityLow,
+		actionMove:      PriorityNormal,
+	} {
+		if got := priorityFrom(withPriority(context.Background(), action, "")); got != want {
+			t.Errorf("expected %s actions to be %s by default, got %s", action, want, got)
+		}
+	}
+	if got := priorityFrom(withPriority(context.Background(), actionRebalance, PriorityHigh)); got != PriorityHigh {
+		t.Errorf("expected the requested priority, got %s", got)
+	}
+	if err := validatePriority("urgent"); err == nil {
+		t.Error("expected an unknown priority to be invalid")
+	}
+}
+
+func TestRunActionChecksPoliciesOnceAdmitted(t *testing.T) {
+	as := NewActionService(nil, nil, wamconfig.Actions{MaxConcurrentActions: 1}, nil, nil, nil)
+	ctx := context.Background()
+
+	started, block := make(chan struct{}), make(chan struct{})
+	_, _, _, err := as.runAction(ctx, "a", actionCreate, nil, &ActionOptions{}, nil, func(context.Context) (*actionRun, error) {
+		return &actionRun{handle: func(context.Context) error {
+			close(started)
+			<-block
+			return nil
+		}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	checks := make(chan bool, 2)
+	_, _, status, err := as.runAction(ctx, "b", actionCreate, nil, &ActionOptions{}, nil, func(context.Context) (*actionRun, error) {
+		return &actionRun{
+			check: func(_ context.Context, peek bool) (func(), error) {
+				checks <- peek
+				return func() {}, nil
+			},
+			handle: func(context.Context) error { return nil },
+		}, nil
+	})
+	if err != nil || status != statusAccepted {
+		t.Fatalf("expected the action to be accepted, got %q, %v", status, err)
+	}
+
+	if peek := <-checks; !peek {
+		t.Error("expected the request to be checked without counting it first")
+	}
+	select {
+	case <-checks:
+		t.Fatal("expected the waiting action not to take policy slots")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(block)
+	select {
+	case peek := <-checks:
+		if peek {
+			t.Error("expected the admitted action to be counted")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the admitted action to be checked")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := as.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+}
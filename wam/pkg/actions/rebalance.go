@@ -0,0 +1,226 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/placement"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"slices"
+	"strings"
+)
+
+type RebalanceArgs struct {
+	Workload `json:"workload"`
+	// Strategy decides where the pods of the workload should run
+	Strategy placement.Options `json:"strategy"`
+	// MaxSurge is the number of pods moved at the same time, 1 by default
+	MaxSurge int `json:"maxSurge,omitempty"`
+	ActionOptions
+}
+
+type RebalanceReply struct {
+	Message  string `json:"message"`
+	ActionID string `json:"actionId"`
+	// Status of the rebalance, for a repeated idempotency key that of the original rebalance
+	Status string `json:"status,omitempty"`
+	// Moves are the planned moves of a dry run
+	Moves []PodMigration `json:"moves,omitempty"`
+}
+
+func validateRebalanceReq(args *RebalanceArgs) error {
+	if args.Workload.APIVersion != "apps/v1" {
+		return fmt.Errorf("only apps/v1 workload API version is supported")
+	}
+
+	if args.Workload.Kind != "Deployment" && args.Workload.Kind != "StatefulSet" {
+		return fmt.Errorf("only Deployment and StatefulSet kinds are supported")
+	}
+
+	if args.Workload.Namespace == "" {
+		args.Workload.Namespace = "default"
+	}
+
+	if args.Workload.Name == "" {
+		return fmt.Errorf("workload name is required")
+	}
+
+	if _, err := placement.New(args.Strategy); err != nil {
+		return err
+	}
+
+	if args.MaxSurge == 0 {
+		args.MaxSurge = 1
+	}
+	if args.MaxSurge < 0 {
+		return fmt.Errorf("maxSurge must be positive")
+	}
+
+	return nil
+}
+
+// podTemplate returns the label selector and the pod template of the workload.
+func (as *ActionService) podTemplate(ctx context.Context, w Workload) (*metav1.LabelSelector, *v1.PodTemplateSpec, error) {
+	if w.Kind == "StatefulSet" {
+		sts, err := as.k8sClient.AppsV1().StatefulSets(w.Namespace).Get(ctx, w.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		return sts.Spec.Selector, &sts.Spec.Template, nil
+	}
+
+	deployment, err := as.getDeployment(ctx, w.Namespace, w.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return deployment.Spec.Selector, &deployment.Spec.Template, nil
+}
+
+// resolveRebalance computes the current placement of the workload's pods, lets the strategy place them and returns
+// the fewest moves turning the one into the other.
+func (as *ActionService) resolveRebalance(ctx context.Context, args *RebalanceArgs) ([]PodMigration, error) {
+	strategy, err := placement.New(args.Strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	labelSelector, template, err := as.podTemplate(ctx, args.Workload)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	workloadPods, err := as.k8sClient.CoreV1().Pods(args.Workload.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	// the workload's pods by node, sorted by name
+	current := map[string][]string{}
+	isWorkloadPod := map[string]bool{}
+	for _, pod := range workloadPods.Items {
+		if pod.DeletionTimestamp != nil || pod.Spec.NodeName == "" {
+			continue
+		}
+		current[pod.Spec.NodeName] = append(current[pod.Spec.NodeName], pod.Name)
+		isWorkloadPod[pod.Namespace+"/"+pod.Name] = true
+	}
+	for _, pods := range current {
+		slices.Sort(pods)
+	}
+
+	nodes, err := as.schedulableNodes(ctx, nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]placement.Node, len(nodes))
+	byName := map[string]*placement.Node{}
+	for i, node := range nodes {
+		candidates[i] = placement.Node{
+			Name:              node.Name,
+			Labels:            node.Labels,
+			AllocatableCPU:    node.Status.Allocatable.Cpu().MilliValue(),
+			AllocatableMemory: node.Status.Allocatable.Memory().Value(),
+			Replicas:          len(current[node.Name]),
+		}
+		byName[node.Name] = &candidates[i]
+	}
+
+	allPods, err := as.k8sClient.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range allPods.Items {
+		node, ok := byName[pod.Spec.NodeName]
+		if !ok || isWorkloadPod[pod.Namespace+"/"+pod.Name] || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		cpu, mem := podRequests(&pod.Spec)
+		node.RequestedCPU += cpu
+		node.RequestedMemory += mem
+	}
+
+	cpu, mem := podRequests(&template.Spec)
+	workload := placement.Workload{Replicas: len(isWorkloadPod), CPU: cpu, Memory: mem}
+
+	desired, err := strategy.Place(candidates, workload)
+	if err != nil {
+		return nil, err
+	}
+
+	placed := 0
+	for node, n := range desired {
+		if _, ok := byName[node]; !ok && n > 0 {
+			return nil, fmt.Errorf("strategy %s placed pods on unknown or unschedulable node %s", args.Strategy.Name, node)
+		}
+		placed += n
+	}
+	if placed != workload.Replicas {
+		return nil, fmt.Errorf("strategy %s placed %d of %d pods", args.Strategy.Name, placed, workload.Replicas)
+	}
+
+	moves := diffPlacement(args.Workload.Namespace, current, desired)
+	for i := range moves {
+		moves[i].Pod.Cluster = as.name
+	}
+	return moves, nil
+}
+
+// diffPlacement returns the moves taking the pods from the nodes running more than desired to those running fewer.
+func diffPlacement(namespace string, current map[string][]string, desired map[string]int) []PodMigration {
+	var surplus []PodMigration
+	for _, node := range sortedKeys(current) {
+		pods := current[node]
+		for _, pod := range pods[min(desired[node], len(pods)):] {
+			surplus = append(surplus, PodMigration{Pod: Pod{Namespace: namespace, Name: pod}, From: node})
+		}
+	}
+
+	var moves []PodMigration
+	for _, node := range sortedKeys(desired) {
+		for range desired[node] - len(current[node]) {
+			move := surplus[len(moves)]
+			move.To = node
+			move.Status = migrationPending
+			moves = append(moves, move)
+		}
+	}
+
+	return moves
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, strings.Compare)
+	return keys
+}
+
+// RebalanceHandler moves the pods of a workload to the placement of its strategy, see runMoves.
+func (as *ActionService) RebalanceHandler(ctx context.Context, id string, args *RebalanceArgs, moves []PodMigration) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "RebalanceHandler", trace.WithAttributes(
+		attribute.String("wam.workload", args.Workload.QueueName()),
+		attribute.String("wam.strategy", args.Strategy.Name),
+		attribute.Int("wam.moves", len(moves)),
+		attribute.Int("wam.max_surge", args.MaxSurge),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	err = as.runMoves(ctx, id, &migrationRecord{Namespace: args.Workload.Namespace, Moves: moves}, args.MaxSurge)
+	if err != nil {
+		return err
+	}
+
+	klog.FromContext(ctx).Info("rebalance action successful", "moves", len(moves))
+	return nil
+}
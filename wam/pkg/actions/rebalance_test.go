@@ -0,0 +1,61 @@
+package actions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/placement"
+)
+
+func TestRebalanceDryRun(t *testing.T) {
+	objects := newWorkload("a", "node-1", "node-1", "node-1", "node-2")
+	objects = append(objects,
+		newNode("node-1", "a", true),
+		newNode("node-2", "a", true),
+		newNode("node-3", "b", true),
+	)
+	client := fake.NewSimpleClientset(objects...)
+	as := NewActionService(client, nil, wamconfig.Actions{}, nil, nil, nil)
+
+	args := &RebalanceArgs{
+		Workload:      Workload{APIVersion: "apps/v1", Kind: "Deployment", Name: "a"},
+		Strategy:      placement.Options{Name: placement.SpreadEvenly},
+		ActionOptions: ActionOptions{DryRun: true},
+	}
+	reply := &RebalanceReply{}
+	if err := as.Rebalance(httptest.NewRequest(http.MethodPost, "/rpc", nil), args, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// node-1 keeps the remainder, one of its pods moves to the empty node
+	want := []PodMigration{
+		{Pod: Pod{Namespace: "default", Name: "a-2"}, From: "node-1", To: "node-3", Status: migrationPending},
+	}
+	if !reflect.DeepEqual(reply.Moves, want) {
+		t.Errorf("expected moves %+v, got %+v", want, reply.Moves)
+	}
+}
+
+func TestDiffPlacement(t *testing.T) {
+	current := map[string][]string{
+		"node-1": {"a-0", "a-1", "a-2"},
+		"node-2": {"a-3"},
+		// e.g. no longer schedulable
+		"node-4": {"a-4"},
+	}
+	desired := map[string]int{"node-1": 1, "node-2": 2, "node-3": 2}
+
+	want := []PodMigration{
+		{Pod: Pod{Namespace: "default", Name: "a-1"}, From: "node-1", To: "node-2", Status: migrationPending},
+		{Pod: Pod{Namespace: "default", Name: "a-2"}, From: "node-1", To: "node-3", Status: migrationPending},
+		{Pod: Pod{Namespace: "default", Name: "a-4"}, From: "node-4", To: "node-3", Status: migrationPending},
+	}
+	if got := diffPlacement("default", current, desired); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected moves %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,466 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/logging"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/metrics"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// replicaTTL is how long a replica counts as alive after its last heartbeat
+	replicaTTL = 30 * time.Second
+	// heartbeatInterval is the pause between two heartbeats of a replica
+	heartbeatInterval = 10 * time.Second
+)
+
+// kinds of repairs made by the reconciler, see metrics.Repairs
+const (
+	repairResumed         = "resumed"
+	repairCompensated     = "compensated"
+	repairStaleSuggestion = "stale-suggestion"
+	repairDeletionCost    = "deletion-cost"
+)
+
+func replicaKey(identity string) string {
+	return fmt.Sprintf("wam:replica:%s", identity)
+}
+
+// Heartbeat marks this replica as alive until the service is shut down. The reconciler recovers the journaled
+// actions of replicas that stopped doing so.
+func (as *ActionService) Heartbeat() {
+	wait.UntilWithContext(as.ctx, func(ctx context.Context) {
+		if err := as.rdb.Set(ctx, replicaKey(as.identity), time.Now().Format(time.RFC3339), replicaTTL).Err(); err != nil {
+			klog.FromContext(ctx).Error(err, "error refreshing heartbeat")
+		}
+	}, heartbeatInterval)
+}
+
+// stepOutcome is how the reconciler repairs a step of an interrupted action.
+type stepOutcome int
+
+const (
+	// stepSettled needs no repair
+	stepSettled stepOutcome = iota
+	// stepPending is left for a later round, as the pod of the move may still become ready
+	stepPending
+	// stepResume deletes the pod the move replaces
+	stepResume
+	// stepCompensate rolls the step back
+	stepCompensate
+)
+
+// decideStep decides how to repair a step of an interrupted action, given the pod placed by its suggestion or nil if
+// there is none yet.
+func decideStep(step *journalStep, placed *v1.Pod, now time.Time, moveTimeout time.Duration) stepOutcome {
+	if step.Pod == nil {
+		// a create is done once the workload is scaled up, the pending pod takes the suggestion when it is scheduled
+		if step.Scaled {
+			return stepSettled
+		}
+		return stepCompensate
+	}
+
+	if step.Deleting || (placed != nil && isPodReady(placed)) {
+		return stepResume
+	}
+	if now.Sub(step.Queued) < moveTimeout {
+		return stepPending
+	}
+	return stepCompensate
+}
+
+// reconciler repairs what actions interrupted by a dying replica left behind: it resumes or compensates the steps of
+// their journal entries and removes suggestions and deletion costs no running action accounts for.
+type reconciler struct {
+	as     *ActionService
+	config wamconfig.Reconciler
+	// suspects is the drift found by the previous round. Drift is only repaired if it is found twice in a row, so the
+	// suggestions and deletion costs of actions about to record them in the journal are left alone.
+	suspects map[string]bool
+}
+
+// Reconcile runs the reconciler every interval until ctx is done. It must run on a single replica, see leader.Run.
+func (as *ActionService) Reconcile(ctx context.Context, config wamconfig.Reconciler) {
+	r := &reconciler{as: as, config: config, suspects: map[string]bool{}}
+	wait.UntilWithContext(ctx, r.reconcile, config.Interval)
+}
+
+func (r *reconciler) reconcile(ctx context.Context) {
+	lh := klog.FromContext(ctx)
+
+	entries, err := r.as.loadJournal(ctx)
+	if err != nil {
+		lh.Error(err, "error loading journal")
+		return
+	}
+
+	for _, entry := range entries {
+		alive, err := r.as.rdb.Exists(ctx, replicaKey(entry.Owner)).Result()
+		if err != nil {
+			lh.Error(err, "error checking replica", "owner", entry.Owner)
+			continue
+		}
+		if alive == 0 {
+			r.recover(ctx, entry)
+		}
+	}
+
+	suspects := map[string]bool{}
+	r.removeStaleSuggestions(ctx, entries, suspects)
+	r.clearDeletionCosts(ctx, entries, suspects)
+	r.suspects = suspects
+}
+
+func (as *ActionService) loadJournal(ctx context.Context) ([]*journalEntry, error) {
+	encoded, err := as.rdb.HGetAll(ctx, journalKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*journalEntry, 0, len(encoded))
+	for id, value := range encoded {
+		entry := &journalEntry{}
+		if err := json.Unmarshal([]byte(value), entry); err != nil {
+			klog.FromContext(ctx).Error(err, "error decoding journal entry", "actionID", id)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// recover repairs the steps of an action whose replica is gone. Steps failing to be repaired and moves whose pod may
+// still become ready are kept for the next round.
+func (r *reconciler) recover(ctx context.Context, entry *journalEntry) {
+	ctx, lh := logging.WithValues(ctx, "interruptedActionID", entry.ActionID, "actionType", entry.Action, "owner", entry.Owner)
+	lh.Info("recovering action of a replica that is gone", "steps", len(entry.Steps))
+
+	for id, step := range entry.Steps {
+		workload, ok := parseQueueName(step.Queue)
+		if !ok {
+			lh.Info("dropping step with an unknown queue", "queue", step.Queue)
+			delete(entry.Steps, id)
+			continue
+		}
+		// the steps are repaired in the cluster of their workload
+		as, err := r.as.inCluster(workload.Cluster)
+		if err != nil {
+			lh.Error(err, "error resolving cluster of step", "suggestionID", id)
+			continue
+		}
+
+		placed, err := as.placedPod(workload.Namespace, step.Suggestion)
+		if err != nil {
+			lh.Error(err, "error listing pods", "suggestionID", id)
+			continue
+		}
+
+		switch decideStep(step, placed, time.Now(), r.config.MoveTimeout) {
+		case stepPending:
+			continue
+		case stepResume:
+			if err := as.resumeMove(ctx, workload, step); err != nil {
+				lh.Error(err, "error resuming move", "suggestionID", id)
+				continue
+			}
+			metrics.Repairs.WithLabelValues(repairResumed).Inc()
+			as.event(ctx, workloadRef(workload), v1.EventTypeNormal, reasonActionRecovered,
+				"Completed move of pod %s by action %s interrupted on replica %s", step.Pod.Name, entry.ActionID, entry.Owner)
+		case stepCompensate:
+			if err := as.compensate(ctx, workload, step, placed); err != nil {
+				lh.Error(err, "error compensating step", "suggestionID", id)
+				continue
+			}
+			metrics.Repairs.WithLabelValues(repairCompensated).Inc()
+			as.event(ctx, workloadRef(workload), v1.EventTypeNormal, reasonActionRecovered,
+				"Rolled back suggestion %s of %s action %s interrupted on replica %s", id, entry.Action, entry.ActionID, entry.Owner)
+		}
+		delete(entry.Steps, id)
+	}
+
+	if len(entry.Steps) > 0 {
+		encoded, err := json.Marshal(entry)
+		if err == nil {
+			err = r.as.rdb.HSet(ctx, journalKey, entry.ActionID, encoded).Err()
+		}
+		if err != nil {
+			lh.Error(err, "error storing journal entry")
+		}
+		return
+	}
+
+	if err := r.as.rdb.HDel(ctx, journalKey, entry.ActionID).Err(); err != nil {
+		lh.Error(err, "error removing journal entry")
+		return
+	}
+	lh.Info("recovered action")
+}
+
+// placedPod returns the pod placed by the suggestion, nil if there is none.
+func (as *ActionService) placedPod(namespace string, suggestion *SchedulingSuggestion) (*v1.Pod, error) {
+	pods, err := as.pods.Pods(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods {
+		if pod.DeletionTimestamp == nil && hasSchedulingSuggestionID(pod, string(suggestion.ID)) {
+			return pod, nil
+		}
+	}
+	return nil, nil
+}
+
+// resumeMove deletes the pod an interrupted move replaces. If the move already scaled the workload down, which is
+// told by the replicas being below those after its scale up, only the pod is deleted. The pod of a move across
+// clusters belongs to the workload of the same name in its own cluster, it is always deleted along with its replica.
+func (as *ActionService) resumeMove(ctx context.Context, workload Workload, step *journalStep) error {
+	source, err := as.inCluster(step.Pod.Cluster)
+	if err != nil {
+		return err
+	}
+
+	pod, err := source.getPod(ctx, step.Pod.Namespace, step.Pod.Name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if pod.DeletionTimestamp != nil {
+		return nil
+	}
+
+	if step.Deleting && step.Pod.Cluster == workload.Cluster {
+		scale, err := as.k8sClient.AppsV1().Deployments(workload.Namespace).GetScale(ctx, workload.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if scale.Spec.Replicas < step.Replicas {
+			err = as.retry(ctx, func(ctx context.Context) error {
+				return as.k8sClient.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+			})
+			if err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+			return nil
+		}
+	}
+
+	_, err = source.DeleteHandler(ctx, &DeleteArgs{Pod: *step.Pod})
+	return err
+}
+
+// compensate rolls back a step. A pod placed by the suggestion is deleted along with its replica, otherwise the
+// suggestion is removed and the scale up undone.
+func (as *ActionService) compensate(ctx context.Context, workload Workload, step *journalStep, placed *v1.Pod) error {
+	if placed != nil {
+		_, err := as.DeleteHandler(ctx, &DeleteArgs{Pod: Pod{Namespace: placed.Namespace, Name: placed.Name, Cluster: as.name}})
+		return err
+	}
+
+	if err := as.removeSchedulingSuggestion(ctx, step.Queue, step.Suggestion); err != nil {
+		return err
+	}
+	if !step.Scaled {
+		return nil
+	}
+
+	unlock, err := as.lock(ctx, step.Queue)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, to, err := as.scaleBy(ctx, workload.Namespace, workload.Name, -1)
+	if err != nil {
+		return err
+	}
+	klog.FromContext(ctx).V(2).Info("undid scale up", "workload", klog.KRef(workload.Namespace, workload.Name), "replicas", to)
+	return nil
+}
+
+// removeStaleSuggestions removes the suggestions no journal entry accounts for from the queues of workloads without
+// pending pods, as no pod will take them. Suggestions for the replacements of deleted pods are accounted for until
+// they are older than the move timeout, see journalReplacement.
+func (r *reconciler) removeStaleSuggestions(ctx context.Context, entries []*journalEntry, suspects map[string]bool) {
+	lh := klog.FromContext(ctx)
+
+	journaled := map[string]bool{}
+	for _, entry := range entries {
+		for id := range entry.Steps {
+			journaled[id] = true
+		}
+	}
+	for _, id := range r.replacements(ctx, time.Now()) {
+		journaled[id] = true
+	}
+
+	iter := r.as.rdb.ScanType(ctx, 0, QueuePattern, 100, QueueType).Iterator()
+	for iter.Next(ctx) {
+		queue := iter.Val()
+		workload, ok := parseQueueName(queue)
+		if !ok {
+			continue
+		}
+
+		encoded, err := r.as.rdb.LRange(ctx, queue, 0, -1).Result()
+		if err != nil {
+			lh.Error(err, "error reading queue", "queue", queue)
+			continue
+		}
+
+		stale := map[string]string{}
+		for _, value := range encoded {
+			suggestion := &SchedulingSuggestion{}
+			if err := json.Unmarshal([]byte(value), suggestion); err != nil || !journaled[string(suggestion.ID)] {
+				stale[string(suggestion.ID)] = value
+			}
+		}
+		if len(stale) == 0 {
+			continue
+		}
+
+		// queues of clusters this replica does not know are left to the replicas that do
+		as, err := r.as.inCluster(workload.Cluster)
+		if err != nil {
+			continue
+		}
+		pending, err := as.hasPendingPods(ctx, workload)
+		if err != nil {
+			lh.Error(err, "error listing pending pods", "queue", queue)
+			continue
+		}
+		if pending {
+			continue
+		}
+
+		for id, value := range stale {
+			key := "suggestion:" + queue + ":" + id
+			if !r.suspects[key] {
+				suspects[key] = true
+				continue
+			}
+
+			if err := r.as.rdb.LRem(ctx, queue, 1, value).Err(); err != nil {
+				lh.Error(err, "error removing stale suggestion", "queue", queue, "suggestionID", id)
+				continue
+			}
+			metrics.Repairs.WithLabelValues(repairStaleSuggestion).Inc()
+			lh.Info("removed stale suggestion", "queue", queue, "suggestionID", id)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		lh.Error(err, "error scanning suggestion queues")
+	}
+}
+
+// replacements returns the IDs of the suggestions for replacements queued less than the move timeout before now and
+// drops the records of the older ones.
+func (r *reconciler) replacements(ctx context.Context, now time.Time) []string {
+	lh := klog.FromContext(ctx)
+
+	encoded, err := r.as.rdb.HGetAll(ctx, replacementsKey).Result()
+	if err != nil {
+		lh.Error(err, "error loading replacement suggestions")
+		return nil
+	}
+
+	var ids []string
+	for id, value := range encoded {
+		step := &journalStep{}
+		if err := json.Unmarshal([]byte(value), step); err == nil && now.Sub(step.Queued) < r.config.MoveTimeout {
+			ids = append(ids, id)
+			continue
+		}
+		if err := r.as.rdb.HDel(ctx, replacementsKey, id).Err(); err != nil {
+			lh.Error(err, "error removing replacement suggestion", "suggestionID", id)
+		}
+	}
+	return ids
+}
+
+// hasPendingPods returns whether the workload has pods waiting to be scheduled.
+func (as *ActionService) hasPendingPods(ctx context.Context, workload Workload) (bool, error) {
+	labelSelector, _, err := as.podTemplate(ctx, workload)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return false, err
+	}
+
+	pods, err := as.pods.Pods(workload.Namespace).List(selector)
+	if err != nil {
+		return false, err
+	}
+	for _, pod := range pods {
+		if pod.Spec.NodeName == "" && pod.DeletionTimestamp == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// clearDeletionCosts removes the lowest deletion cost from running pods no journal entry marked, as they would be
+// removed by the next unrelated scale down of their workload. Only the costs WAM set are removed, see markedAnnotation,
+// in every cluster it knows.
+func (r *reconciler) clearDeletionCosts(ctx context.Context, entries []*journalEntry, suspects map[string]bool) {
+	journaled := map[Pod]bool{}
+	for _, entry := range entries {
+		for _, pod := range entry.Marked {
+			journaled[pod] = true
+		}
+	}
+
+	for name := range r.as.clusters {
+		as, err := r.as.inCluster(name)
+		if err != nil {
+			continue
+		}
+		as.clearClusterDeletionCosts(ctx, journaled, r.suspects, suspects)
+	}
+}
+
+func (as *ActionService) clearClusterDeletionCosts(ctx context.Context, journaled map[Pod]bool, previous, suspects map[string]bool) {
+	lh := klog.FromContext(ctx)
+
+	pods, err := as.pods.List(labels.Everything())
+	if err != nil {
+		lh.Error(err, "error listing pods", "cluster", as.name)
+		return
+	}
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil || !markedForDeletion(pod) ||
+			journaled[Pod{Namespace: pod.Namespace, Name: pod.Name, Cluster: as.name}] {
+			continue
+		}
+
+		key := "deletion-cost:" + string(pod.UID)
+		if !previous[key] {
+			suspects[key] = true
+			continue
+		}
+
+		if err := as.setDeletionCost(ctx, pod, ""); err != nil && !apierrors.IsNotFound(err) {
+			lh.Error(err, "error removing deletion cost", "markedPod", klog.KObj(pod), "cluster", as.name)
+			continue
+		}
+		metrics.Repairs.WithLabelValues(repairDeletionCost).Inc()
+		lh.Info("removed leftover deletion cost", "markedPod", klog.KObj(pod), "cluster", as.name)
+	}
+}
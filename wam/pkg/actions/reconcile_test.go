@@ -0,0 +1,147 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+func TestDecideStep(t *testing.T) {
+	now := time.Now()
+	ready := &v1.Pod{Status: v1.PodStatus{Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}}}
+	pending := &v1.Pod{}
+	original := &Pod{Namespace: "default", Name: "a-0"}
+
+	for _, tc := range []struct {
+		name   string
+		step   journalStep
+		placed *v1.Pod
+		want   stepOutcome
+	}{
+		{name: "create before scale up", step: journalStep{Queued: now}, want: stepCompensate},
+		{name: "create after scale up", step: journalStep{Queued: now, Scaled: true}, want: stepSettled},
+		{name: "move with ready pod", step: journalStep{Queued: now, Scaled: true, Pod: original}, placed: ready, want: stepResume},
+		{name: "move deleting", step: journalStep{Queued: now, Scaled: true, Pod: original, Deleting: true}, want: stepResume},
+		{name: "move within timeout", step: journalStep{Queued: now, Scaled: true, Pod: original}, placed: pending, want: stepPending},
+		{name: "move past timeout", step: journalStep{Queued: now.Add(-time.Hour), Scaled: true, Pod: original}, placed: pending, want: stepCompensate},
+		{name: "move without pod past timeout", step: journalStep{Queued: now.Add(-time.Hour), Scaled: true, Pod: original}, want: stepCompensate},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := decideStep(&tc.step, tc.placed, now, 5*time.Minute); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClearClusterDeletionCosts(t *testing.T) {
+	objects := newWorkload("a", "node-1", "node-1", "node-2")
+	for _, object := range objects {
+		pod, ok := object.(*v1.Pod)
+		if !ok {
+			continue
+		}
+		switch pod.Name {
+		case "a-0":
+			// marked by a delete that died midway
+			pod.Annotations = map[string]string{deletionCostAnnotation: minDeletionCost, markedAnnotation: "true"}
+		case "a-1":
+			// set by the user
+			pod.Annotations = map[string]string{deletionCostAnnotation: minDeletionCost}
+		}
+	}
+	client := fake.NewSimpleClientset(objects...)
+	as := NewActionService(client, nil, wamconfig.Actions{}, nil, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer as.cancel()
+	if err := as.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first round only suspects the drift
+	suspects := map[string]bool{}
+	as.clearClusterDeletionCosts(ctx, nil, nil, suspects)
+	if len(suspects) != 1 {
+		t.Fatalf("expected one suspect, got %v", suspects)
+	}
+	as.clearClusterDeletionCosts(ctx, nil, suspects, map[string]bool{})
+
+	for name, want := range map[string]string{"a-0": "", "a-1": minDeletionCost} {
+		pod, err := client.CoreV1().Pods("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pod.Annotations[deletionCostAnnotation]; got != want {
+			t.Errorf("expected pod %s to have deletion cost %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestRemoveStaleSuggestions(t *testing.T) {
+	client := fake.NewSimpleClientset(newWorkload("a", "node-1", "node-2")...)
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	as := NewActionService(client, rdb, wamconfig.Actions{}, nil, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer as.cancel()
+	if err := as.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	queue := Workload{Namespace: "default", APIVersion: "apps/v1", Kind: "Deployment", Name: "a"}.QueueName()
+	push := func(id string) *SchedulingSuggestion {
+		suggestion := &SchedulingSuggestion{ID: types.UID(id), NodeName: "node-1"}
+		encoded, err := json.Marshal(suggestion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mr.Lpush(queue, string(encoded)); err != nil {
+			t.Fatal(err)
+		}
+		return suggestion
+	}
+	// the replacement of a pod deleted by a repair
+	as.journalReplacement(ctx, queue, push("replacement"))
+	// the replacement of a pod deleted long ago
+	old, _ := json.Marshal(&journalStep{Queue: queue, Suggestion: push("old-replacement"), Queued: time.Now().Add(-time.Hour)})
+	mr.HSet(replacementsKey, "old-replacement", string(old))
+	// a leftover of an interrupted action
+	push("leftover")
+
+	r := &reconciler{as: as, config: wamconfig.Reconciler{MoveTimeout: time.Minute}, suspects: map[string]bool{}}
+	for range 2 {
+		suspects := map[string]bool{}
+		r.removeStaleSuggestions(ctx, nil, suspects)
+		r.suspects = suspects
+	}
+
+	queued, err := mr.List(queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 1 {
+		t.Fatalf("expected only the recent replacement to be kept, got %v", queued)
+	}
+	suggestion := &SchedulingSuggestion{}
+	if err := json.Unmarshal([]byte(queued[0]), suggestion); err != nil || suggestion.ID != "replacement" {
+		t.Errorf("expected the recent replacement to be kept, got %s", queued[0])
+	}
+	if fields, _ := mr.HKeys(replacementsKey); len(fields) != 1 || fields[0] != "replacement" {
+		t.Errorf("expected only the record of the recent replacement to be kept, got %v", fields)
+	}
+}
@@ -0,0 +1,187 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/metrics"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// classes of Kubernetes API errors a retry policy retries, see wamconfig.Retry
+const (
+	RetryConflict        = "conflict"
+	RetryServerError     = "server-error"
+	RetryTooManyRequests = "too-many-requests"
+	RetryTimeout         = "timeout"
+)
+
+// alwaysRetryAttempts is the number of attempts of a call failing with an error of a class it always retries, if the
+// retry policy allows fewer, see retry
+const alwaysRetryAttempts = 5
+
+// retryClasses are ordered from the most specific class, see retryClass
+var retryClasses = []string{RetryConflict, RetryTooManyRequests, RetryTimeout, RetryServerError}
+
+// RetryPolicy overrides the configured retry policy for a single action, unset fields keep the configured value.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts of a call including the first one, 1 disables retries
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// BaseMilliseconds is the backoff before the first retry, doubled before each further one up to CapMilliseconds
+	BaseMilliseconds int `json:"baseMilliseconds,omitempty"`
+	CapMilliseconds  int `json:"capMilliseconds,omitempty"`
+	// On are the classes of errors retried: conflict, server-error, too-many-requests and timeout
+	On []string `json:"on,omitempty"`
+}
+
+func validateRetryPolicy(policy *RetryPolicy) error {
+	if policy == nil {
+		return nil
+	}
+
+	if policy.MaxAttempts < 0 || policy.BaseMilliseconds < 0 || policy.CapMilliseconds < 0 {
+		return fmt.Errorf("retry's maxAttempts, baseMilliseconds and capMilliseconds must not be negative")
+	}
+	for _, class := range policy.On {
+		if !slices.Contains(retryClasses, class) {
+			return fmt.Errorf("retry's on must be %s, %s, %s or %s, not %q",
+				RetryConflict, RetryServerError, RetryTooManyRequests, RetryTimeout, class)
+		}
+	}
+
+	return nil
+}
+
+func (p *RetryPolicy) config() wamconfig.Retry {
+	if p == nil {
+		return wamconfig.Retry{}
+	}
+	return wamconfig.Retry{
+		MaxAttempts: p.MaxAttempts,
+		Base:        time.Duration(p.BaseMilliseconds) * time.Millisecond,
+		Cap:         time.Duration(p.CapMilliseconds) * time.Millisecond,
+		On:          p.On,
+	}
+}
+
+// retryClass returns the most specific of the classes the error belongs to, empty if it belongs to none. A gateway
+// timeout is a timeout before it is a server error.
+func retryClass(err error, classes []string) string {
+	for _, class := range retryClasses {
+		if !slices.Contains(classes, class) {
+			continue
+		}
+		switch class {
+		case RetryConflict:
+			if apierrors.IsConflict(err) {
+				return class
+			}
+		case RetryServerError:
+			var status apierrors.APIStatus
+			if errors.As(err, &status) && status.Status().Code >= 500 {
+				return class
+			}
+		case RetryTooManyRequests:
+			if apierrors.IsTooManyRequests(err) {
+				return class
+			}
+		case RetryTimeout:
+			if apierrors.IsTimeout(err) || apierrors.IsServerTimeout(err) {
+				return class
+			}
+		}
+	}
+	return ""
+}
+
+// retry calls the Kubernetes API by call until it succeeds, fails with an error the retry policy of ctx does not retry
+// or runs out of attempts, backing off exponentially in between. Errors of the always classes are retried regardless
+// of the policy, with at least alwaysRetryAttempts attempts.
+func (as *ActionService) retry(ctx context.Context, call func(ctx context.Context) error, always ...string) error {
+	policy := as.retryPolicy(ctx)
+	classes := append(slices.Clone(policy.On), always...)
+
+	backoff := min(policy.Base, policy.Cap)
+	for attempt := 1; ; attempt++ {
+		err := call(ctx)
+		if err == nil {
+			return nil
+		}
+		class := retryClass(err, classes)
+		if class == "" {
+			return err
+		}
+		maxAttempts := policy.MaxAttempts
+		if slices.Contains(always, class) {
+			maxAttempts = max(maxAttempts, alwaysRetryAttempts)
+		}
+		if attempt >= maxAttempts {
+			return err
+		}
+
+		klog.FromContext(ctx).V(2).Info("retrying Kubernetes API call", "attempt", attempt, "backoff", backoff, "err", err)
+		metrics.APIRetries.WithLabelValues(class).Inc()
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, policy.Cap)
+	}
+}
+
+// retryValue is retry for calls returning a value.
+func retryValue[T any](ctx context.Context, as *ActionService, call func(ctx context.Context) (T, error)) (T, error) {
+	var value T
+	err := as.retry(ctx, func(ctx context.Context) (err error) {
+		value, err = call(ctx)
+		return err
+	})
+	return value, err
+}
+
+// getPod gets a pod, retrying per the retry policy of ctx.
+func (as *ActionService) getPod(ctx context.Context, namespace string, name string) (*v1.Pod, error) {
+	return retryValue(ctx, as, func(ctx context.Context) (*v1.Pod, error) {
+		return as.k8sClient.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	})
+}
+
+// getDeployment gets a Deployment, retrying per the retry policy of ctx.
+func (as *ActionService) getDeployment(ctx context.Context, namespace string, name string) (*appsv1.Deployment, error) {
+	return retryValue(ctx, as, func(ctx context.Context) (*appsv1.Deployment, error) {
+		return as.k8sClient.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	})
+}
+
+// scaleBy changes the replicas of the Deployment by delta and returns them before and after. If another writer updated
+// the scale in between, it is read again and the change applied anew.
+func (as *ActionService) scaleBy(ctx context.Context, namespace string, name string, delta int32) (from int32, to int32, err error) {
+	err = as.retry(ctx, func(ctx context.Context) error {
+		scale, err := as.k8sClient.AppsV1().Deployments(namespace).GetScale(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("error getting scale: %w", err)
+		}
+
+		s := *scale
+		s.Spec.Replicas += delta
+
+		_, err = as.k8sClient.AppsV1().Deployments(namespace).UpdateScale(ctx, name, &s, metav1.UpdateOptions{})
+		if err != nil {
+			return fmt.Errorf("error updating scale: %w", err)
+		}
+
+		from, to = scale.Spec.Replicas, s.Spec.Replicas
+		return nil
+	}, RetryConflict)
+	return from, to, err
+}
@@ -0,0 +1,165 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+func TestRetryClass(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "conflict", err: apierrors.NewConflict(pods, "a", errors.New("changed")), want: RetryConflict},
+		{name: "server error", err: apierrors.NewServiceUnavailable("unavailable"), want: RetryServerError},
+		{name: "too many requests", err: apierrors.NewTooManyRequests("throttled", 1), want: RetryTooManyRequests},
+		{name: "timeout", err: apierrors.NewTimeoutError("timed out", 1), want: RetryTimeout},
+		{name: "not found", err: apierrors.NewNotFound(pods, "a"), want: ""},
+		{name: "other", err: errors.New("other"), want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := retryClass(test.err, retryClasses); got != test.want {
+				t.Errorf("expected class %q, got %q", test.want, got)
+			}
+		})
+	}
+
+	if got := retryClass(apierrors.NewConflict(pods, "a", errors.New("changed")), []string{RetryServerError}); got != "" {
+		t.Errorf("expected a conflict not to be retried by a server-error policy, got %q", got)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := apierrors.NewServiceUnavailable("unavailable")
+	conflict := apierrors.NewConflict(schema.GroupResource{Resource: "pods"}, "a", errors.New("changed"))
+
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		failures []error
+		always   []string
+		want     error
+		attempts int
+	}{
+		{name: "succeeds", policy: RetryPolicy{MaxAttempts: 3}, attempts: 1},
+		{name: "retried", policy: RetryPolicy{MaxAttempts: 3}, failures: []error{unavailable, unavailable}, attempts: 3},
+		{name: "out of attempts", policy: RetryPolicy{MaxAttempts: 2}, failures: []error{unavailable, unavailable},
+			want: unavailable, attempts: 2},
+		{name: "not retried", policy: RetryPolicy{MaxAttempts: 3, On: []string{RetryTimeout}}, failures: []error{unavailable},
+			want: unavailable, attempts: 1},
+		{name: "always retried", policy: RetryPolicy{MaxAttempts: 3, On: []string{RetryTimeout}}, failures: []error{conflict},
+			always: []string{RetryConflict}, attempts: 2},
+		{name: "always retried beyond the attempts", policy: RetryPolicy{MaxAttempts: 1}, failures: []error{conflict, conflict},
+			always: []string{RetryConflict}, attempts: 3},
+		{name: "always retried up to the floor", policy: RetryPolicy{MaxAttempts: 1},
+			failures: []error{conflict, conflict, conflict, conflict, conflict, conflict}, always: []string{RetryConflict},
+			want: conflict, attempts: alwaysRetryAttempts},
+		{name: "other classes keep the attempts", policy: RetryPolicy{MaxAttempts: 1, On: []string{RetryServerError}},
+			failures: []error{unavailable}, always: []string{RetryConflict}, want: unavailable, attempts: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			as := NewActionService(nil, nil, wamconfig.Actions{}, nil, nil, nil)
+			test.policy.BaseMilliseconds, test.policy.CapMilliseconds = 1, 2
+			ctx := as.withOverrides(context.Background(), nil, &test.policy)
+
+			attempts := 0
+			err := as.retry(ctx, func(context.Context) error {
+				attempts++
+				if attempts <= len(test.failures) {
+					return test.failures[attempts-1]
+				}
+				return nil
+			}, test.always...)
+
+			if !errors.Is(err, test.want) {
+				t.Errorf("expected error %v, got %v", test.want, err)
+			}
+			if attempts != test.attempts {
+				t.Errorf("expected %d attempts, got %d", test.attempts, attempts)
+			}
+		})
+	}
+}
+
+func TestScaleByRetriesConflicts(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	replicas := int32(2)
+	conflicts := 1
+	client.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		return true, &autoscalingv1.Scale{Spec: autoscalingv1.ScaleSpec{Replicas: replicas}}, nil
+	})
+	client.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		if conflicts > 0 {
+			// another writer scaled the workload in between
+			conflicts--
+			replicas = 3
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "deployments"}, "a", errors.New("changed"))
+		}
+		scale := action.(k8stesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+		replicas = scale.Spec.Replicas
+		return true, scale, nil
+	})
+
+	as := NewActionService(client, nil, wamconfig.Actions{Retry: wamconfig.Retry{Base: time.Millisecond}}, nil, nil, nil)
+	// the configured policy retries no class, scale updates retry conflicts regardless
+	ctx := as.withOverrides(context.Background(), nil, &RetryPolicy{On: []string{RetryTimeout}})
+
+	from, to, err := as.scaleBy(ctx, "default", "a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 3 || to != 4 || replicas != 4 {
+		t.Errorf("expected a scale from 3 to 4 replicas, got from %d to %d, stored %d", from, to, replicas)
+	}
+}
+
+func TestWithOverridesLimits(t *testing.T) {
+	as := NewActionService(nil, nil, wamconfig.Actions{
+		Timeouts: wamconfig.Timeouts{Max: time.Minute},
+		Retry:    wamconfig.Retry{MaxAttemptsLimit: 3, CapLimit: time.Second},
+	}, nil, nil, nil)
+
+	ctx := as.withOverrides(context.Background(),
+		&Timeouts{ReadySeconds: 3600, LockSeconds: 10},
+		&RetryPolicy{MaxAttempts: 1000, BaseMilliseconds: 5000, CapMilliseconds: 60000})
+
+	timeouts := as.timeouts(ctx)
+	if timeouts.Ready != time.Minute || timeouts.Lock != 10*time.Second {
+		t.Errorf("expected the ready timeout capped at 1m and the lock timeout kept at 10s, got %v and %v",
+			timeouts.Ready, timeouts.Lock)
+	}
+	// timeouts the request does not set keep the configured ones, even above the cap
+	if timeouts.Convergence != wamconfig.DefaultTimeouts().Convergence {
+		t.Errorf("expected the configured convergence timeout, got %v", timeouts.Convergence)
+	}
+
+	policy := as.retryPolicy(ctx)
+	if policy.MaxAttempts != 3 || policy.Base != time.Second || policy.Cap != time.Second {
+		t.Errorf("expected 3 attempts backing off 1s, got %d attempts backing off %v up to %v",
+			policy.MaxAttempts, policy.Base, policy.Cap)
+	}
+}
@@ -0,0 +1,552 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/audit"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/tracing"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// deletionCostAnnotation makes the ReplicaSet controller prefer deleting a pod when it scales down.
+// https://kubernetes.io/docs/concepts/workloads/controllers/replicaset/#pod-deletion-cost
+const deletionCostAnnotation = "controller.kubernetes.io/pod-deletion-cost"
+
+// markedAnnotation is set along with the deletion cost WAM sets, telling it from a deletion cost set by others.
+const markedAnnotation = "wam.aces.eu/marked-for-deletion"
+
+// statuses of a scale to placement
+const (
+	placementConverging = "converging"
+	placementConverged  = "converged"
+	placementFailed     = "failed"
+)
+
+type ScaleToPlacementArgs struct {
+	Workload `json:"workload"`
+	// Placement is the number of pods the workload should run on each node, nodes not listed run none
+	Placement map[string]int `json:"placement"`
+	ActionOptions
+}
+
+type ScaleToPlacementReply struct {
+	Message  string `json:"message"`
+	ActionID string `json:"actionId"`
+	// Status of the action, for a repeated idempotency key that of the original action
+	Status string `json:"status,omitempty"`
+	Plan   *Plan  `json:"plan,omitempty"`
+}
+
+type ScaleToPlacementStatusArgs struct {
+	ActionID string `json:"actionId"`
+}
+
+// ScaleToPlacementStatusReply reports whether the layout of the workload matches the requested placement.
+type ScaleToPlacementStatusReply struct {
+	Workload Workload `json:"workload"`
+	// Status is converging until the layout matches, converged or failed
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Desired is the requested placement, Current the ready pods per node when the status was last updated
+	Desired map[string]int `json:"desired"`
+	Current map[string]int `json:"current"`
+}
+
+func validateScaleToPlacementReq(args *ScaleToPlacementArgs) error {
+	if args.Workload.APIVersion != "apps/v1" {
+		return fmt.Errorf("only apps/v1 workload API version is supported")
+	}
+
+	if args.Workload.Kind != "Deployment" {
+		return fmt.Errorf("only Deployment kind is supported")
+	}
+
+	if args.Workload.Namespace == "" {
+		args.Workload.Namespace = "default"
+	}
+
+	if args.Workload.Name == "" {
+		return fmt.Errorf("workload name is required")
+	}
+
+	if len(args.Placement) == 0 {
+		return fmt.Errorf("placement is required")
+	}
+	for node, n := range args.Placement {
+		if node == "" {
+			return fmt.Errorf("node name is required")
+		}
+		if n < 0 {
+			return fmt.Errorf("number of pods on node %s must not be negative", node)
+		}
+	}
+
+	return nil
+}
+
+// placementChange is what it takes to get from the current layout of a workload to the requested placement.
+type placementChange struct {
+	workload Workload
+	selector labels.Selector
+	desired  map[string]int
+	current  map[string]int
+	// adds holds the node of every pod to create
+	adds []string
+	// removals are the pods to delete
+	removals []*v1.Pod
+}
+
+// workloadPods returns the pods of the workload from the informer cache, leaving out the terminating ones. It returns
+// an error if one of them is not scheduled yet, as the layout is still changing.
+func (as *ActionService) workloadPods(namespace string, selector labels.Selector) ([]*v1.Pod, error) {
+	cached, err := as.pods.Pods(namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []*v1.Pod
+	for _, pod := range cached {
+		if pod.DeletionTimestamp != nil || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		if pod.Spec.NodeName == "" {
+			return nil, fmt.Errorf("pod %s is not scheduled yet", klog.KObj(pod))
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+// resolvePlacement diffs the requested placement against the current pods of the workload. On nodes running too many
+// pods, the pods that are not ready are removed first.
+func (as *ActionService) resolvePlacement(ctx context.Context, args *ScaleToPlacementArgs) (*placementChange, error) {
+	deployment, err := as.getDeployment(ctx, args.Workload.Namespace, args.Workload.Name)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := as.workloadPods(args.Workload.Namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+	if deployment.Spec.Replicas != nil && int(*deployment.Spec.Replicas) != len(pods) {
+		return nil, fmt.Errorf("workload runs %d pods instead of %d replicas, retry once it settled", len(pods), *deployment.Spec.Replicas)
+	}
+
+	change := &placementChange{
+		workload: args.Workload,
+		selector: selector,
+		desired:  args.Placement,
+		current:  map[string]int{},
+	}
+
+	byNode := map[string][]*v1.Pod{}
+	for _, pod := range pods {
+		byNode[pod.Spec.NodeName] = append(byNode[pod.Spec.NodeName], pod)
+		change.current[pod.Spec.NodeName]++
+	}
+
+	for _, node := range sortedKeys(byNode) {
+		nodePods := byNode[node]
+		slices.SortFunc(nodePods, func(a, b *v1.Pod) int {
+			if isPodReady(a) != isPodReady(b) {
+				if isPodReady(a) {
+					return 1
+				}
+				return -1
+			}
+			return strings.Compare(a.Name, b.Name)
+		})
+
+		surplus := len(nodePods) - args.Placement[node]
+		if surplus > 0 {
+			change.removals = append(change.removals, nodePods[:surplus]...)
+		}
+	}
+
+	var added []string
+	for _, node := range sortedKeys(args.Placement) {
+		for range args.Placement[node] - change.current[node] {
+			change.adds = append(change.adds, node)
+		}
+		if args.Placement[node] > change.current[node] {
+			added = append(added, node)
+		}
+	}
+
+	if len(added) > 0 {
+		schedulable, err := as.schedulableNodes(ctx, added, "")
+		if err != nil {
+			return nil, err
+		}
+		if len(schedulable) != len(added) {
+			return nil, fmt.Errorf("pods can only be added to schedulable and ready nodes")
+		}
+	}
+
+	return change, nil
+}
+
+func (c *placementChange) removedPods() []Pod {
+	var pods []Pod
+	for _, pod := range c.removals {
+		pods = append(pods, Pod{Namespace: pod.Namespace, Name: pod.Name, Cluster: c.workload.Cluster})
+	}
+	return pods
+}
+
+func (c *placementChange) workloads() []Workload {
+	if len(c.adds) == 0 {
+		return nil
+	}
+	return []Workload{c.workload}
+}
+
+func (c *placementChange) replicas() int32 {
+	var replicas int32
+	for _, n := range c.current {
+		replicas += int32(n)
+	}
+	return replicas
+}
+
+func (as *ActionService) planScaleToPlacement(ctx context.Context, id string, change *placementChange) (plan *Plan, err error) {
+	plan = &Plan{
+		Workloads: []Workload{change.workload},
+	}
+	// resolvePlacement made sure the workload runs as many pods as it has replicas
+	if from, to := change.replicas(), change.replicas()+int32(len(change.adds)-len(change.removals)); to != from {
+		plan.ScaleChanges = append(plan.ScaleChanges, ScaleChange{change.workload, from, to})
+	}
+	for _, node := range change.adds {
+		plan.Suggestions = append(plan.Suggestions, PlannedSuggestion{change.workload.QueueName(), node})
+	}
+	for _, pod := range change.removals {
+		plan.Deletions = append(plan.Deletions, PlannedDeletion{Pod{pod.Namespace, pod.Name, as.name}, pod.Spec.NodeName, change.workload})
+	}
+
+	plan.Policies, err = as.evaluatePolicies(ctx, id, actionScaleToPlacement, change.workloads(), change.removedPods(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+func placementKey(id string) string {
+	return fmt.Sprintf("wam:placement:%s", id)
+}
+
+func (as *ActionService) savePlacement(ctx context.Context, id string, record *ScaleToPlacementStatusReply) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return as.rdb.Set(context.WithoutCancel(ctx), placementKey(id), encoded, migrationTTL).Err()
+}
+
+func (as *ActionService) loadPlacement(ctx context.Context, id string) (*ScaleToPlacementStatusReply, error) {
+	encoded, err := as.rdb.Get(ctx, placementKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("no scale to placement with action ID %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record := &ScaleToPlacementStatusReply{}
+	if err := json.Unmarshal(encoded, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// setDeletionCost sets or, for an empty cost, removes the deletion cost of a pod along with markedAnnotation.
+func (as *ActionService) setDeletionCost(ctx context.Context, pod *v1.Pod, cost string) error {
+	value, marked := "null", "null"
+	if cost != "" {
+		value, marked = fmt.Sprintf("%q", cost), `"true"`
+	}
+	patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:%s,%q:%s}}}`, deletionCostAnnotation, value, markedAnnotation, marked))
+
+	_, err := as.k8sClient.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// markedForDeletion reports whether WAM set the lowest deletion cost of the pod.
+func markedForDeletion(pod *v1.Pod) bool {
+	return pod.Annotations[markedAnnotation] == "true" && pod.Annotations[deletionCostAnnotation] == minDeletionCost
+}
+
+// readyLayout returns the number of ready pods of the workload per node and whether the workload runs further pods,
+// e.g. ones that are not ready yet or about to be deleted.
+func (as *ActionService) readyLayout(change *placementChange) (map[string]int, bool, error) {
+	cached, err := as.pods.Pods(change.workload.Namespace).List(change.selector)
+	if err != nil {
+		return nil, false, err
+	}
+
+	layout := map[string]int{}
+	others := false
+	for _, pod := range cached {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		if pod.DeletionTimestamp != nil || !isPodReady(pod) {
+			others = true
+			continue
+		}
+		layout[pod.Spec.NodeName]++
+	}
+	return layout, others, nil
+}
+
+func (c *placementChange) matches(layout map[string]int) bool {
+	for node, n := range layout {
+		if c.desired[node] != n {
+			return false
+		}
+	}
+	for node, n := range c.desired {
+		if layout[node] != n {
+			return false
+		}
+	}
+	return true
+}
+
+// ScaleToPlacementHandler queues a suggestion for every pod to add, marks the pods to remove with a deletion cost and
+// updates the scale of the workload once. Where pods are added and removed alike, the scale does not change that much,
+// so the remaining marked pods are deleted and their replacements take the suggestions. The handler returns once the
+// ready pods match the placement.
+func (as *ActionService) ScaleToPlacementHandler(ctx context.Context, id string, change *placementChange) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ScaleToPlacementHandler", trace.WithAttributes(
+		attribute.String("wam.workload", change.workload.QueueName()),
+		attribute.Int("wam.adds", len(change.adds)),
+		attribute.Int("wam.removals", len(change.removals)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	lh := klog.FromContext(ctx)
+
+	record := &ScaleToPlacementStatusReply{
+		Workload: change.workload,
+		Status:   placementConverging,
+		Desired:  change.desired,
+		Current:  change.current,
+	}
+	save := func() {
+		if err := as.savePlacement(ctx, id, record); err != nil {
+			lh.Error(err, "error saving placement status")
+		}
+	}
+	save()
+	defer func() {
+		if err != nil {
+			record.Status = placementFailed
+			record.Error = err.Error()
+		} else {
+			record.Status = placementConverged
+		}
+		save()
+	}()
+
+	err = as.applyPlacement(ctx, change)
+	if err != nil {
+		return err
+	}
+
+	paired := min(len(change.adds), len(change.removals))
+	if paired > 0 {
+		err = as.deletePaired(ctx, change, paired)
+		if err != nil {
+			return err
+		}
+	}
+
+	lh.V(2).Info("waiting for the layout to match the placement")
+
+	err = wait.PollUntilContextTimeout(ctx, time.Second, as.timeouts(ctx).Convergence, true, func(context.Context) (bool, error) {
+		layout, others, err := as.readyLayout(change)
+		if err != nil {
+			return false, err
+		}
+		if !maps.Equal(layout, record.Current) {
+			record.Current = layout
+			save()
+		}
+		return !others && change.matches(layout), nil
+	})
+	if err != nil {
+		lh.Error(err, "layout did not match the placement", "current", record.Current)
+		return fmt.Errorf("layout did not match the placement: %w", err)
+	}
+
+	lh.Info("scale to placement action successful")
+
+	return nil
+}
+
+// applyPlacement queues the suggestions, marks the pods to remove and updates the scale while holding the workload's
+// lock. It rolls everything back if one of the steps fails.
+func (as *ActionService) applyPlacement(ctx context.Context, change *placementChange) (err error) {
+	lh := klog.FromContext(ctx)
+	queue := change.workload.QueueName()
+
+	unlock, err := as.lock(ctx, queue)
+	if err != nil {
+		lh.Error(err, "error locking workload")
+		return err
+	}
+	defer unlock()
+
+	var suggestions []*SchedulingSuggestion
+	var marked []*v1.Pod
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, suggestion := range suggestions {
+			if rerr := as.removeSchedulingSuggestion(ctx, queue, suggestion); rerr != nil {
+				lh.Error(rerr, "error removing scheduling suggestion")
+			}
+		}
+		for _, pod := range marked {
+			if rerr := as.setDeletionCost(context.WithoutCancel(ctx), pod, ""); rerr != nil && !apierrors.IsNotFound(rerr) {
+				lh.Error(rerr, "error removing deletion cost", "removedPod", klog.KObj(pod))
+			}
+		}
+	}()
+
+	for _, pod := range change.removals {
+		as.journalMark(ctx, pod)
+		err = as.setDeletionCost(ctx, pod, minDeletionCost)
+		if err != nil {
+			lh.Error(err, "error setting deletion cost", "removedPod", klog.KObj(pod))
+			return err
+		}
+		marked = append(marked, pod)
+	}
+
+	for _, node := range change.adds {
+		suggestion, err := as.addSchedulingSuggestion(ctx, queue, node)
+		if err != nil {
+			lh.Error(err, "error adding scheduling suggestion")
+			return err
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+
+	delta := int32(len(change.adds) - len(change.removals))
+	if delta == 0 {
+		return nil
+	}
+
+	from, to, err := as.scaleBy(ctx, change.workload.Namespace, change.workload.Name, delta)
+	if err != nil {
+		lh.Error(err, "error updating scale")
+		return err
+	}
+
+	lh.V(2).Info("updated scale", "replicas", to)
+	as.journalScaled(ctx, change.workload, delta)
+	audit.Add(ctx, audit.Event{
+		Type:     audit.EventScale,
+		Workload: workloadKey(change.workload.Namespace, change.workload.Name),
+		Replicas: &audit.Replicas{From: from, To: to},
+	})
+
+	return nil
+}
+
+// deletePaired deletes the marked pods not removed by a scale down, up to the number of pods added and removed alike.
+// On a scale down, it waits for the controller to delete the pods first, as it might pick some of the marked ones. It
+// returns once the deleted pods are gone, so the convergence is not decided while they are still terminating.
+func (as *ActionService) deletePaired(ctx context.Context, change *placementChange, paired int) error {
+	lh := klog.FromContext(ctx)
+
+	total := int(change.replicas())
+	if target := total + len(change.adds) - len(change.removals); target < total {
+		err := wait.PollUntilContextTimeout(ctx, time.Second, as.timeouts(ctx).Convergence, true, func(context.Context) (bool, error) {
+			pods, err := as.workloadPods(change.workload.Namespace, change.selector)
+			return err == nil && len(pods) <= target, nil
+		})
+		if err != nil {
+			return fmt.Errorf("waiting for the scale down: %w", err)
+		}
+	}
+
+	var deleted []*v1.Pod
+	for _, removal := range change.removals {
+		if len(deleted) == paired {
+			break
+		}
+
+		pod, err := as.pods.Pods(removal.Namespace).Get(removal.Name)
+		if apierrors.IsNotFound(err) || (err == nil && pod.DeletionTimestamp != nil) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = as.retry(ctx, func(ctx context.Context) error {
+			return as.k8sClient.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			lh.Error(err, "error deleting pod", "removedPod", klog.KObj(pod))
+			return err
+		}
+		deleted = append(deleted, pod)
+		lh.V(2).Info("deleted pod, its replacement takes a suggestion", "removedPod", klog.KObj(pod))
+		audit.Add(ctx, audit.Event{Type: audit.EventPodDeleted, Workload: workloadKey(change.workload.Namespace, change.workload.Name), Pod: pod.Namespace + "/" + pod.Name, Node: pod.Spec.NodeName})
+	}
+
+	err := wait.PollUntilContextTimeout(ctx, deletePollInterval, as.timeouts(ctx).DeleteVerify, true, func(context.Context) (bool, error) {
+		for _, pod := range deleted {
+			gone, err := as.isGone(pod)
+			if err != nil || !gone {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for the deleted pods to be gone: %w", err)
+	}
+
+	return nil
+}
+
+// isGone reports whether the pod was removed from the informer cache, unlike isTerminating it does not count a pod
+// which is still shutting down.
+func (as *ActionService) isGone(pod *v1.Pod) (bool, error) {
+	cached, err := as.pods.Pods(pod.Namespace).Get(pod.Name)
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return cached.UID != pod.UID, nil
+}
@@ -0,0 +1,118 @@
+package actions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+func TestScaleToPlacementDryRun(t *testing.T) {
+	objects := newWorkload("a", "node-1", "node-1", "node-2")
+	for _, object := range objects {
+		if pod, ok := object.(*v1.Pod); ok && pod.Name != "a-0" {
+			pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+		}
+	}
+	objects = append(objects, newNode("node-3", "a", true))
+	client := fake.NewSimpleClientset(objects...)
+	as := NewActionService(client, nil, wamconfig.Actions{}, nil, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer as.cancel()
+	if err := as.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	a := Workload{Namespace: "default", APIVersion: "apps/v1", Kind: "Deployment", Name: "a"}
+	args := &ScaleToPlacementArgs{
+		Workload:      a,
+		Placement:     map[string]int{"node-1": 1, "node-2": 1, "node-3": 2},
+		ActionOptions: ActionOptions{DryRun: true},
+	}
+	reply := &ScaleToPlacementReply{}
+	if err := as.ScaleToPlacement(httptest.NewRequest(http.MethodPost, "/rpc", nil), args, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Plan{
+		Workloads:    []Workload{a},
+		ScaleChanges: []ScaleChange{{a, 3, 4}},
+		Suggestions: []PlannedSuggestion{
+			{a.QueueName(), "node-3"},
+			{a.QueueName(), "node-3"},
+		},
+		// a-0 is not ready, so it is removed from node-1
+		Deletions: []PlannedDeletion{{Pod{"default", "a-0", ""}, "node-1", a}},
+	}
+	if !reflect.DeepEqual(reply.Plan, want) {
+		t.Errorf("expected plan %+v, got %+v", want, reply.Plan)
+	}
+}
+
+func TestDeletePairedWaitsForRemoval(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		terminating bool
+		wantErr     bool
+	}{
+		{name: "removed"},
+		{name: "still terminating", terminating: true, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(newWorkload("a", "node-1", "node-2")...)
+			if tc.terminating {
+				// the pod is stuck shutting down, e.g. on a finalizer
+				client.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					pod, err := client.Tracker().Get(v1.SchemeGroupVersion.WithResource("pods"), "default", action.(k8stesting.DeleteAction).GetName())
+					if err != nil {
+						return true, nil, err
+					}
+					pod.(*v1.Pod).DeletionTimestamp = &metav1.Time{Time: time.Now()}
+					return true, nil, client.Tracker().Update(v1.SchemeGroupVersion.WithResource("pods"), pod, "default")
+				})
+			}
+			as := NewActionService(client, nil, wamconfig.Actions{}, nil, nil, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			defer as.cancel()
+			if err := as.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			pod, err := as.pods.Pods("default").Get("a-0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			change := &placementChange{
+				workload: Workload{Namespace: "default", APIVersion: "apps/v1", Kind: "Deployment", Name: "a"},
+				selector: labels.SelectorFromSet(labels.Set{"app": "a"}),
+				current:  map[string]int{"node-1": 1, "node-2": 1},
+				adds:     []string{"node-2"},
+				removals: []*v1.Pod{pod},
+			}
+
+			ctx = as.withOverrides(ctx, &Timeouts{DeleteVerifySeconds: 1}, nil)
+			err = as.deletePaired(ctx, change, 1)
+			if tc.wantErr && err == nil {
+				t.Error("expected the delete to fail while the pod is terminating")
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("expected the delete to succeed, got %v", err)
+			}
+		})
+	}
+}
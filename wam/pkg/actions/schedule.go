@@ -0,0 +1,442 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/auth"
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/cron"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/logging"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/metrics"
+	"github.com/redis/go-redis/v9"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// dueKey is the Redis sorted set of the IDs of the deferred actions by the Unix time they are due
+	dueKey = "wam:scheduled"
+	// claimedKey is the Redis sorted set of the IDs of the due actions the leader claimed by the Unix time it claimed
+	// them, until it dispatched them
+	claimedKey = "wam:scheduled:claimed"
+	// claimTimeout is how long the leader may take to dispatch a claimed action, after that the leader counts as lost
+	// and the action is recovered, see recoverClaimed
+	claimTimeout = time.Minute
+	// scheduledTTL is how long the status of a dispatched or expired action can be queried.
+	scheduledTTL = 24 * time.Hour
+	// statusDispatched is the status of a deferred action the scheduler started, the action reports its own outcome
+	statusDispatched = "dispatched"
+)
+
+// moveScript moves a member from the sorted set KEYS[1] to KEYS[2] with the score ARGV[2], if it is still in KEYS[1].
+var moveScript = redis.NewScript(`
+if redis.call("zrem", KEYS[1], ARGV[1]) == 1 then
+	redis.call("zadd", KEYS[2], ARGV[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// Schedule defers an action. The action starts once it is past NotBefore and, if there is a window, within a
+// maintenance window. It expires if it cannot start by NotAfter.
+type Schedule struct {
+	// NotBefore and NotAfter bound the start of the action, e.g. 2024-05-01T02:00:00Z
+	NotBefore time.Time `json:"notBefore,omitempty"`
+	NotAfter  time.Time `json:"notAfter,omitempty"`
+	// Window restricts the start of the action to recurring maintenance windows
+	Window *Window `json:"window,omitempty"`
+}
+
+// Window is a recurring maintenance window.
+type Window struct {
+	// Cron is the cron expression of the starts of the windows, e.g. 0 2 * * * for every night at 02:00
+	Cron string `json:"cron"`
+	// Minutes is the length of each window
+	Minutes int `json:"minutes"`
+	// TimeZone the cron expression is evaluated in, e.g. Europe/Ljubljana, UTC if empty
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// ScheduledAction is an action deferred by its schedule, stored until the scheduler dispatches it.
+type ScheduledAction struct {
+	ActionID string   `json:"actionId"`
+	Action   string   `json:"action"`
+	Status   string   `json:"status"`
+	Schedule Schedule `json:"schedule"`
+	// Due is when the action starts next, while it is scheduled
+	Due time.Time `json:"due,omitempty"`
+	// Error is the reason the dispatch of the action failed
+	Error string `json:"error,omitempty"`
+
+	// Args are the arguments the action is dispatched with
+	Args json.RawMessage `json:"args"`
+	// Namespaces are those the action was authorized in
+	Namespaces     []string   `json:"namespaces"`
+	Caller         *auth.User `json:"caller,omitempty"`
+	IdempotencyKey string     `json:"idempotencyKey,omitempty"`
+}
+
+type ScheduledStatusArgs struct {
+	ActionID string `json:"actionId"`
+}
+
+type ScheduledStatusReply struct {
+	Action string `json:"action"`
+	// Status is scheduled, dispatched, expired or failed, the outcome of a dispatched action is that of the action
+	Status   string    `json:"status"`
+	Schedule Schedule  `json:"schedule"`
+	Due      time.Time `json:"due,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// dispatchKey holds the ID of an action dispatched by the scheduler in the context of its request
+type dispatchKey struct{}
+
+func validateSchedule(schedule *Schedule) error {
+	if schedule == nil {
+		return nil
+	}
+
+	if !schedule.NotBefore.IsZero() && !schedule.NotAfter.IsZero() && schedule.NotAfter.Before(schedule.NotBefore) {
+		return fmt.Errorf("schedule's notAfter must not be before notBefore")
+	}
+
+	if schedule.Window != nil {
+		if _, _, err := schedule.Window.parse(); err != nil {
+			return err
+		}
+		if schedule.Window.Minutes < 1 {
+			return fmt.Errorf("schedule's window must last at least a minute")
+		}
+	}
+
+	if _, ok := schedule.next(time.Now()); !ok {
+		return fmt.Errorf("schedule does not let the action start before notAfter")
+	}
+
+	return nil
+}
+
+func (w *Window) parse() (*cron.Schedule, *time.Location, error) {
+	c, err := cron.Parse(w.Cron)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid schedule window: %w", err)
+	}
+	loc, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid schedule time zone: %w", err)
+	}
+	return c, loc, nil
+}
+
+// next returns the first time at or after now the schedule lets the action start, false if it does not before
+// NotAfter.
+func (s *Schedule) next(now time.Time) (time.Time, bool) {
+	start := now
+	if s.NotBefore.After(start) {
+		start = s.NotBefore
+	}
+
+	if s.Window != nil {
+		c, loc, err := s.Window.parse()
+		if err != nil {
+			return time.Time{}, false
+		}
+		// the first window opening after the start of a window still open at start
+		opens := c.Next(start.In(loc).Add(-time.Duration(s.Window.Minutes) * time.Minute))
+		if opens.IsZero() {
+			return time.Time{}, false
+		}
+		if opens.After(start) {
+			start = opens
+		}
+	}
+
+	if !s.NotAfter.IsZero() && start.After(s.NotAfter) {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+func scheduledKey(id string) string {
+	return fmt.Sprintf("wam:scheduled:%s", id)
+}
+
+// deferAction stores an action its schedule does not let start yet, so the scheduler dispatches it once it is due, and
+// returns true. It returns false if the action may start now, which includes the actions dispatched by the scheduler.
+func (as *ActionService) deferAction(ctx context.Context, id string, action string, schedule *Schedule, args any, idempotencyKey string, namespaces ...string) (bool, error) {
+	if schedule == nil || ctx.Value(dispatchKey{}) != nil {
+		return false, nil
+	}
+
+	now := time.Now()
+	due, ok := schedule.next(now)
+	if !ok {
+		return false, fmt.Errorf("schedule does not let the action start before notAfter")
+	}
+	if !due.After(now) {
+		return false, nil
+	}
+
+	encodedArgs, err := json.Marshal(args)
+	if err != nil {
+		return false, err
+	}
+	record := &ScheduledAction{
+		ActionID:       id,
+		Action:         action,
+		Status:         statusScheduled,
+		Schedule:       *schedule,
+		Due:            due,
+		Args:           encodedArgs,
+		Namespaces:     namespaces,
+		IdempotencyKey: idempotencyKey,
+	}
+	if user, ok := auth.UserFrom(ctx); ok {
+		record.Caller = user
+	}
+
+	if err := as.saveScheduled(ctx, record, 0); err != nil {
+		return false, fmt.Errorf("error storing scheduled action: %w", err)
+	}
+	if err := as.rdb.ZAdd(ctx, dueKey, redis.Z{Score: float64(due.Unix()), Member: id}).Err(); err != nil {
+		return false, fmt.Errorf("error scheduling action: %w", err)
+	}
+
+	as.finishIdempotencyKey(ctx, idempotencyKey, id, action, statusScheduled, nil)
+	metrics.ScheduledActions.WithLabelValues(action, statusScheduled).Inc()
+	klog.FromContext(ctx).V(2).Info("deferred action", "due", due)
+
+	return true, nil
+}
+
+func (as *ActionService) saveScheduled(ctx context.Context, record *ScheduledAction, ttl time.Duration) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return as.rdb.Set(context.WithoutCancel(ctx), scheduledKey(record.ActionID), encoded, ttl).Err()
+}
+
+func (as *ActionService) loadScheduled(ctx context.Context, id string) (*ScheduledAction, error) {
+	encoded, err := as.rdb.Get(ctx, scheduledKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("no scheduled action with action ID %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record := &ScheduledAction{}
+	if err := json.Unmarshal(encoded, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Dispatch starts the deferred actions once they are due, every interval until ctx is done. It is run by the replica
+// elected leader, the dispatched actions run on the leader like any other action.
+func (as *ActionService) Dispatch(ctx context.Context, config wamconfig.Scheduler) {
+	klog.FromContext(ctx).Info("starting scheduler", "interval", config.Interval)
+	wait.UntilWithContext(ctx, as.dispatchDue, config.Interval)
+}
+
+func (as *ActionService) dispatchDue(ctx context.Context) {
+	lh := klog.FromContext(ctx)
+
+	now := time.Now()
+	as.recoverClaimed(ctx, now)
+
+	ids, err := as.rdb.ZRangeByScore(ctx, dueKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(now.Unix(), 10)}).Result()
+	if err != nil {
+		lh.Error(err, "error listing due actions")
+		return
+	}
+
+	for _, id := range ids {
+		// moving the action from the due to the claimed set claims it, so a former leader finishing its round does not
+		// dispatch it again, and the action is recovered if this leader dies before it stored the outcome
+		claimed, err := moveScript.Run(ctx, as.rdb, []string{dueKey, claimedKey}, id, now.Unix()).Int()
+		if err != nil {
+			lh.Error(err, "error claiming due action", "scheduledActionID", id)
+			continue
+		}
+		if claimed == 0 {
+			continue
+		}
+		as.dispatchScheduled(ctx, id, now)
+
+		if err := as.rdb.ZRem(context.WithoutCancel(ctx), claimedKey, id).Err(); err != nil {
+			lh.Error(err, "error releasing claimed action", "scheduledActionID", id)
+		}
+	}
+}
+
+// recoverClaimed returns the actions claimed longer than claimTimeout ago to the due set, as the leader claiming them
+// died before it stored their outcome. An action found running was dispatched before and is only recorded as such.
+func (as *ActionService) recoverClaimed(ctx context.Context, now time.Time) {
+	lh := klog.FromContext(ctx)
+
+	ids, err := as.rdb.ZRangeByScore(ctx, claimedKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Add(-claimTimeout).Unix(), 10),
+	}).Result()
+	if err != nil {
+		lh.Error(err, "error listing claimed actions")
+		return
+	}
+
+	for _, id := range ids {
+		idLh := lh.WithValues("scheduledActionID", id)
+
+		exists, err := as.rdb.Exists(ctx, scheduledKey(id)).Result()
+		if err != nil {
+			idLh.Error(err, "error loading claimed action")
+			continue
+		}
+		var record *ScheduledAction
+		if exists == 1 {
+			if record, err = as.loadScheduled(ctx, id); err != nil {
+				idLh.Error(err, "error loading claimed action")
+				continue
+			}
+		}
+		// the outcome of the action was stored, only the claim was left behind
+		if record == nil || record.Status != statusScheduled {
+			if err := as.rdb.ZRem(ctx, claimedKey, id).Err(); err != nil {
+				idLh.Error(err, "error releasing claimed action")
+			}
+			continue
+		}
+
+		running, err := as.rdb.HExists(ctx, journalKey, id).Result()
+		if err != nil {
+			idLh.Error(err, "error checking whether the claimed action runs")
+			continue
+		}
+		if running {
+			record.Status = statusDispatched
+			record.Due = time.Time{}
+			if err := as.saveScheduled(ctx, record, scheduledTTL); err != nil {
+				idLh.Error(err, "error storing scheduled action")
+				continue
+			}
+			metrics.ScheduledActions.WithLabelValues(record.Action, record.Status).Inc()
+			if err := as.rdb.ZRem(ctx, claimedKey, id).Err(); err != nil {
+				idLh.Error(err, "error releasing claimed action")
+			}
+			continue
+		}
+
+		if err := moveScript.Run(ctx, as.rdb, []string{claimedKey, dueKey}, id, now.Unix()).Err(); err != nil {
+			idLh.Error(err, "error recovering claimed action")
+			continue
+		}
+		idLh.Info("recovered scheduled action claimed by a lost leader", "actionType", record.Action)
+	}
+}
+
+// dispatchScheduled starts a due action, expires it if its schedule no longer lets it start or defers it to the next
+// window if the current one closed in between.
+func (as *ActionService) dispatchScheduled(ctx context.Context, id string, now time.Time) {
+	ctx, lh := logging.WithValues(ctx, "scheduledActionID", id)
+
+	record, err := as.loadScheduled(ctx, id)
+	if err != nil {
+		lh.Error(err, "error loading scheduled action")
+		return
+	}
+	if record.Caller != nil {
+		ctx = auth.WithUser(ctx, record.Caller)
+	}
+
+	due, ok := record.Schedule.next(now)
+	switch {
+	case !ok:
+		record.Status = statusExpired
+		record.Error = "the schedule did not let the action start before notAfter"
+		as.finishIdempotencyKey(ctx, record.IdempotencyKey, id, record.Action, statusExpired, nil)
+		lh.Info("scheduled action expired", "actionType", record.Action, "notAfter", record.Schedule.NotAfter)
+	case due.After(now):
+		record.Due = due
+		err := as.saveScheduled(ctx, record, 0)
+		if err == nil {
+			err = as.rdb.ZAdd(ctx, dueKey, redis.Z{Score: float64(due.Unix()), Member: id}).Err()
+		}
+		if err != nil {
+			lh.Error(err, "error rescheduling action")
+		}
+		return
+	default:
+		err := as.dispatch(ctx, record)
+		if errors.Is(err, errShuttingDown) {
+			// the next leader dispatches it
+			if err := as.rdb.ZAdd(ctx, dueKey, redis.Z{Score: float64(due.Unix()), Member: id}).Err(); err != nil {
+				lh.Error(err, "error rescheduling action")
+			}
+			return
+		}
+
+		record.Status = statusDispatched
+		if err != nil {
+			record.Status = statusFailed
+			record.Error = err.Error()
+			lh.Info("error dispatching scheduled action", "actionType", record.Action, "err", err)
+		} else {
+			lh.V(2).Info("dispatched scheduled action", "actionType", record.Action)
+		}
+	}
+
+	record.Due = time.Time{}
+	metrics.ScheduledActions.WithLabelValues(record.Action, record.Status).Inc()
+	if err := as.saveScheduled(ctx, record, scheduledTTL); err != nil {
+		lh.Error(err, "error storing scheduled action")
+	}
+}
+
+// dispatch starts the action of the record through its RPC with the ID and the caller it was deferred with, so it is
+// authorized, checked against the policies and recorded as if it was requested now.
+func (as *ActionService) dispatch(ctx context.Context, record *ScheduledAction) error {
+	ctx = context.WithValue(ctx, dispatchKey{}, record.ActionID)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/rpc", nil)
+	if err != nil {
+		return err
+	}
+
+	switch record.Action {
+	case actionCreate:
+		return dispatchRPC(r, record.Args, as.Create)
+	case actionDelete:
+		return dispatchRPC(r, record.Args, as.Delete)
+	case actionMove:
+		return dispatchRPC(r, record.Args, as.Move)
+	case actionSwap:
+		return dispatchRPC(r, record.Args, as.Swap)
+	case actionBatch:
+		return dispatchRPC(r, record.Args, as.Batch)
+	case actionMigrateApp:
+		return dispatchRPC(r, record.Args, as.MigrateApp)
+	case actionDrain:
+		return dispatchRPC(r, record.Args, as.Drain)
+	case actionRebalance:
+		return dispatchRPC(r, record.Args, as.Rebalance)
+	case actionScaleToPlacement:
+		return dispatchRPC(r, record.Args, as.ScaleToPlacement)
+	}
+	return fmt.Errorf("unknown action %q", record.Action)
+}
+
+func dispatchRPC[A, R any](r *http.Request, encoded json.RawMessage, rpc func(*http.Request, *A, *R) error) error {
+	args := new(A)
+	if err := json.Unmarshal(encoded, args); err != nil {
+		return fmt.Errorf("error decoding arguments: %w", err)
+	}
+	return rpc(r, args, new(R))
+}
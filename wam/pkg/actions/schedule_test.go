@@ -0,0 +1,132 @@
+package actions
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	nightly := &Window{Cron: "0 2 * * *", Minutes: 120}
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		want     time.Time
+		ok       bool
+	}{
+		{
+			name:     "now",
+			schedule: Schedule{},
+			want:     now,
+			ok:       true,
+		},
+		{
+			name:     "not before",
+			schedule: Schedule{NotBefore: now.Add(time.Hour)},
+			want:     now.Add(time.Hour),
+			ok:       true,
+		},
+		{
+			name:     "next window",
+			schedule: Schedule{Window: nightly},
+			want:     time.Date(2024, 5, 2, 2, 0, 0, 0, time.UTC),
+			ok:       true,
+		},
+		{
+			name:     "open window",
+			schedule: Schedule{Window: &Window{Cron: "0 9 * * *", Minutes: 120}},
+			want:     now,
+			ok:       true,
+		},
+		{
+			name:     "window after not before",
+			schedule: Schedule{NotBefore: time.Date(2024, 5, 2, 3, 0, 0, 0, time.UTC), Window: nightly},
+			want:     time.Date(2024, 5, 2, 3, 0, 0, 0, time.UTC),
+			ok:       true,
+		},
+		{
+			name:     "window in time zone",
+			schedule: Schedule{Window: &Window{Cron: "0 2 * * *", Minutes: 60, TimeZone: "Europe/Ljubljana"}},
+			want:     time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC),
+			ok:       true,
+		},
+		{
+			name:     "no window before not after",
+			schedule: Schedule{NotAfter: now.Add(time.Hour), Window: nightly},
+			ok:       false,
+		},
+		{
+			name:     "expired",
+			schedule: Schedule{NotAfter: now.Add(-time.Minute)},
+			ok:       false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := test.schedule.next(now)
+			if ok != test.ok || (ok && !got.Equal(test.want)) {
+				t.Errorf("expected %v, %v, got %v, %v", test.want, test.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	now := time.Now()
+
+	for name, schedule := range map[string]*Schedule{
+		"not after before not before": {NotBefore: now.Add(time.Hour), NotAfter: now},
+		"invalid cron":                {Window: &Window{Cron: "0 25 * * *", Minutes: 60}},
+		"empty window":                {Window: &Window{Cron: "0 2 * * *"}},
+		"unknown time zone":           {Window: &Window{Cron: "0 2 * * *", Minutes: 60, TimeZone: "Mars/Olympus"}},
+		"expired":                     {NotAfter: now.Add(-time.Hour)},
+	} {
+		if err := validateSchedule(schedule); err == nil {
+			t.Errorf("expected schedule %q to be invalid", name)
+		}
+	}
+
+	if err := validateSchedule(&Schedule{NotBefore: now.Add(time.Hour), Window: &Window{Cron: "@daily", Minutes: 60}}); err != nil {
+		t.Errorf("expected a valid schedule, got %v", err)
+	}
+}
+
+func TestRecoverClaimed(t *testing.T) {
+	as, mr := newRedisActionService(t)
+	ctx := context.Background()
+	now := time.Now()
+	lost := float64(now.Add(-2 * claimTimeout).Unix())
+
+	for id, status := range map[string]string{"lost": statusScheduled, "running": statusScheduled, "done": statusDispatched} {
+		if err := as.saveScheduled(ctx, &ScheduledAction{ActionID: id, Action: actionMove, Status: status}, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mr.ZAdd(claimedKey, lost, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mr.HSet(journalKey, "running", "{}")
+	// the leader is still dispatching an action it claimed just now
+	if _, err := mr.ZAdd(claimedKey, float64(now.Unix()), "fresh"); err != nil {
+		t.Fatal(err)
+	}
+
+	as.recoverClaimed(ctx, now)
+
+	if due, _ := mr.ZMembers(dueKey); len(due) != 1 || due[0] != "lost" {
+		t.Errorf("expected only the action of the lost leader to be due again, got %v", due)
+	}
+	if claimed, _ := mr.ZMembers(claimedKey); len(claimed) != 1 || claimed[0] != "fresh" {
+		t.Errorf("expected only the fresh claim to be kept, got %v", claimed)
+	}
+	record, err := as.loadScheduled(ctx, "running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != statusDispatched {
+		t.Errorf("expected the running action to be recorded as dispatched, got %s", record.Status)
+	}
+}
@@ -1,97 +1,1041 @@
 package actions
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/audit"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/auth"
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/logging"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/metrics"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/policy"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/tracing"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/informers"
 	clientset "k8s.io/client-go/kubernetes"
-	"log"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
 	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	actionCreate = "create"
+	actionDelete = "delete"
+	actionMove   = "move"
+	actionSwap   = "swap"
+	actionBatch  = "batch"
+	// actionMigrateApp expands into moves of the pods of an application
+	actionMigrateApp = "migrate"
+	actionDrain      = "drain"
+	actionRebalance  = "rebalance"
+	// actionScaleToPlacement scales a workload to a number of pods per node
+	actionScaleToPlacement = "scale"
+	// actionRelocate replaces a StatefulSet pod on another node as part of a migration or drain
+	actionRelocate = "relocate"
+	// verbGet authorizes reading the progress of actions
+	verbGet = "get"
 )
 
 type ActionService struct {
-	k8sClient *clientset.Clientset
-	rdb       *redis.Client
+	// cluster is the cluster the service acts on, the cluster WAM runs in unless the service is a view returned by
+	// inCluster
+	*cluster
+	// state is shared by the service and its views
+	*state
+
+	// clusters are the clusters actions can target by name, including the local cluster under ""
+	clusters map[string]*cluster
+
+	rdb    *redis.Client
+	config wamconfig.Actions
+	// authorizer decides which caller may run which action, all callers are allowed if it is nil
+	authorizer *auth.Authorizer
+	// policies are the guardrails actions are checked against before they run, none are enforced if it is nil
+	policies *policy.Engine
+
+	// auditSink keeps the records of the executed actions, nil if the audit log is disabled
+	auditSink audit.Sink
+
+	// identity names this replica in the journal
+	identity string
 }
 
-func NewActionService(k8sClient *clientset.Clientset, rdb *redis.Client) *ActionService {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+// cluster holds the clients of a cluster WAM acts on.
+type cluster struct {
+	// name is the name actions target the cluster by, empty for the cluster WAM runs in
+	name      string
+	k8sClient clientset.Interface
+
+	// recorder emits Events on the objects acted on, stopEvents flushes them on shutdown
+	recorder   record.EventRecorder
+	stopEvents func()
+
+	// informers are started by Start, pods lists the pods of the cluster from their cache
+	informers informers.SharedInformerFactory
+	pods      corelisters.PodLister
+	// waiters are notified by the pod informer when the pods of scheduling suggestions are ready
+	waiters *readyWaiters
+}
+
+// state tracks the running actions of the replica.
+type state struct {
+	// ctx is cancelled to interrupt the running action handlers on shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// draining is set once Shutdown has been called
+	draining bool
+	// running counts the spawned action handlers
+	running sync.WaitGroup
+	// inFlight maps the IDs of running actions to their type
+	inFlight map[string]string
+	// cancels cancel the handlers of the running actions by action ID, see Cancel
+	cancels map[string]context.CancelCauseFunc
+	// locks maps the keys of the locks held by this replica to their token
+	locks map[string]string
+	// entries are the journal entries of the running actions by action ID
+	entries map[string]*journalEntry
+	// queue dispatches the spawned handlers by priority
+	queue *dispatchQueue
+}
+
+func newCluster(name string, k8sClient clientset.Interface) *cluster {
+	factory := informers.NewSharedInformerFactory(k8sClient, 0)
+
+	recorder, stopEvents := newEventRecorder(k8sClient)
+
+	waiters := newReadyWaiters()
+	podInformer := factory.Core().V1().Pods()
+	if _, err := podInformer.Informer().AddEventHandler(waiters.handler()); err != nil {
+		klog.Background().Error(err, "error adding pod event handler", "cluster", name)
+	}
+
+	return &cluster{
+		name:       name,
+		k8sClient:  k8sClient,
+		recorder:   recorder,
+		stopEvents: stopEvents,
+		informers:  factory,
+		pods:       podInformer.Lister(),
+		waiters:    waiters,
+	}
+}
+
+func NewActionService(k8sClient clientset.Interface, rdb *redis.Client, config wamconfig.Actions, authorizer *auth.Authorizer, policies *policy.Engine, auditSink audit.Sink) *ActionService {
+	ctx, cancel := context.WithCancel(context.Background())
+	// timeouts and retry settings left unset keep their defaults
+	config.Timeouts = wamconfig.DefaultTimeouts().Override(config.Timeouts)
+	config.Retry = wamconfig.DefaultRetry().Override(config.Retry)
+	local := newCluster("", k8sClient)
+
 	return &ActionService{
-		k8sClient,
-		rdb,
+		cluster: local,
+		state: &state{
+			ctx:      ctx,
+			cancel:   cancel,
+			inFlight: map[string]string{},
+			cancels:  map[string]context.CancelCauseFunc{},
+			locks:    map[string]string{},
+			entries:  map[string]*journalEntry{},
+			queue:    newDispatchQueue(config.MaxConcurrentActions),
+		},
+		clusters:   map[string]*cluster{"": local},
+		rdb:        rdb,
+		config:     config,
+		authorizer: authorizer,
+		policies:   policies,
+		auditSink:  auditSink,
+		identity:   newIdentity(),
+	}
+}
+
+// AddCluster registers a remote cluster actions can target by its name. It must be called before Start.
+func (as *ActionService) AddCluster(name string, k8sClient clientset.Interface) {
+	as.clusters[name] = newCluster(name, k8sClient)
+}
+
+// inCluster returns a view of the service acting on the named cluster, the local one if the name is empty. The view
+// shares the running actions, locks and journal with the service.
+func (as *ActionService) inCluster(name string) (*ActionService, error) {
+	c, ok := as.clusters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster %q", name)
+	}
+	view := *as
+	view.cluster = c
+	return &view, nil
+}
+
+// Identity returns the identity of this replica, e.g. in the leader election.
+func (as *ActionService) Identity() string {
+	return as.identity
+}
+
+// Start runs the informers until the service is shut down and waits for their caches to be filled or ctx to be done.
+func (as *ActionService) Start(ctx context.Context) error {
+	for name, c := range as.clusters {
+		c.informers.Start(as.ctx.Done())
+
+		for informer, synced := range c.informers.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				return fmt.Errorf("error syncing %v informer cache of cluster %q", informer, name)
+			}
+		}
+	}
+
+	klog.FromContext(ctx).V(2).Info("informer caches synced")
+	return nil
+}
+
+// startAction assigns an ID to an action call and starts its span, continuing the trace of the caller if there is
+// one. The returned context carries a logger adding the action ID, the action type and the given key-value pairs to
+// every line. It is not cancelled when the request completes, so handlers spawned by the call can keep using it.
+func startAction(r *http.Request, action string, keysAndValues ...any) (context.Context, trace.Span, string) {
+	// an action dispatched by the scheduler keeps the ID it was deferred with
+	id, ok := r.Context().Value(dispatchKey{}).(string)
+	if !ok {
+		id = string(uuid.NewUUID())
+	}
+
+	ctx, span := tracing.Tracer().Start(tracing.FromRequest(r), "action."+action,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("wam.action_id", id)),
+	)
+
+	keysAndValues = append([]any{"actionID", id, "actionType", action}, keysAndValues...)
+	if user, ok := auth.UserFrom(r.Context()); ok {
+		keysAndValues = append(keysAndValues, "user", user.Name)
+		span.SetAttributes(attribute.String("wam.user", user.Name))
+	}
+	ctx, _ = logging.WithValues(ctx, keysAndValues...)
+
+	ctx = context.WithValue(ctx, actionIDKey{}, id)
+
+	return context.WithoutCancel(ctx), span, id
+}
+
+// authorize checks that the caller may run the action in every namespace it touches.
+func (as *ActionService) authorize(ctx context.Context, action string, namespaces ...string) error {
+	if as.authorizer == nil {
+		return nil
+	}
+
+	checked := map[string]bool{}
+	for _, namespace := range namespaces {
+		if checked[namespace] {
+			continue
+		}
+		checked[namespace] = true
+
+		if err := as.authorizer.Authorize(ctx, action, namespace); err != nil {
+			if errors.Is(err, auth.ErrForbidden) {
+				klog.FromContext(ctx).V(2).Info("action not authorized", "err", err)
+				metrics.ObserveForbidden(action)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prepareAction returns ctx carrying the priority and the overrides of the action, see withPriority and
+// withOverrides, once the caller is authorized to run it in the namespaces.
+func (as *ActionService) prepareAction(ctx context.Context, action string, options *ActionOptions, namespaces ...string) (context.Context, error) {
+	ctx = withPriority(ctx, action, options.Priority)
+	ctx = as.withOverrides(ctx, options.Timeouts, options.Retry)
+	return ctx, as.authorize(ctx, action, namespaces...)
+}
+
+// actionRun is a resolved action, see runAction.
+type actionRun struct {
+	// check checks the action against the policies, nil for the actions whose moves are checked one by one as they
+	// progress
+	check policyCheck
+	// handle runs the action
+	handle func(ctx context.Context) error
+	// settle runs once handle succeeded, before the action is recorded
+	settle func(ctx context.Context)
+}
+
+// runAction runs the request of a prepared action that is not a dry run: a repeated idempotency key replays the first
+// request, an action its schedule does not let start yet is deferred, and any other action is resolved and spawned.
+// It returns the reply to the request, see idempotencyRecord.replay.
+//
+// The action is checked against the policies once it is admitted by the dispatch queue, see spawn, so actions waiting
+// for their turn neither hold node slots nor count against the rate limits. A check without counting the action
+// rejects requests the policies reject already right away.
+func (as *ActionService) runAction(ctx context.Context, id string, action string, args any, options *ActionOptions, namespaces []string, resolve func(ctx context.Context) (*actionRun, error)) (message string, actionID string, status string, err error) {
+	record, err := as.deduplicate(ctx, options.IdempotencyKey, id, action)
+	if err != nil {
+		return "", "", "", err
+	}
+	if record != nil {
+		return record.replay()
+	}
+
+	deferred, err := as.deferAction(ctx, id, action, options.Schedule, args, options.IdempotencyKey, namespaces...)
+	if err != nil {
+		as.abortIdempotencyKey(ctx, options.IdempotencyKey, id, action, err)
+		return "", "", "", err
+	}
+	if deferred {
+		return "scheduled", id, statusScheduled, nil
+	}
+
+	run, err := resolve(ctx)
+	if err == nil && run.check != nil {
+		_, err = run.check(ctx, true)
+	}
+	if err != nil {
+		as.abortIdempotencyKey(ctx, options.IdempotencyKey, id, action, err)
+		return "", "", "", err
 	}
+
+	err = as.spawn(ctx, id, action, namespaces, func(ctx context.Context) {
+		start := time.Now()
+
+		if run.check != nil {
+			release, err := run.check(ctx, false)
+			if err != nil {
+				// the policies rejected the action while it waited
+				status := statusOf(ctx, err)
+				var v *policy.Violation
+				if errors.As(err, &v) {
+					status = statusRejected
+				}
+				klog.FromContext(ctx).V(2).Info("admitted action not started", "status", status, "err", err)
+				as.finishIdempotencyKey(ctx, options.IdempotencyKey, id, action, status, err)
+				as.recordAction(ctx, id, action, args, start, status, err)
+				return
+			}
+			defer release()
+		}
+
+		err := run.handle(ctx)
+		metrics.ObserveAction(action, start, err)
+		as.finishIdempotencyKey(ctx, options.IdempotencyKey, id, action, statusOf(ctx, err), err)
+		if err == nil && run.settle != nil {
+			run.settle(ctx)
+		}
+		as.recordAction(ctx, id, action, args, start, statusOf(ctx, err), err)
+	})
+	if err != nil {
+		as.abortIdempotencyKey(ctx, options.IdempotencyKey, id, action, err)
+		return "", "", "", err
+	}
+	klog.FromContext(ctx).V(4).Info("spawned a handler, returning to the caller that the request has been accepted")
+
+	return "ok", id, statusAccepted, nil
 }
 
-func (as *ActionService) Create(r *http.Request, args *CreateArgs, reply *CreateReply) error {
-	err := validateCreateReq(args)
+func (as *ActionService) Create(r *http.Request, args *CreateArgs, reply *CreateReply) (err error) {
+	ctx, span, id := startAction(r, actionCreate,
+		"workload", klog.KRef(args.Workload.Namespace, args.Workload.Name),
+		"node", args.Node.Name,
+	)
+	defer func() { tracing.End(span, err) }()
+	lh := klog.FromContext(ctx)
+
+	err = validateCreateReq(args)
+	if err == nil {
+		err = validateActionOptions(&args.ActionOptions)
+	}
+	if err == nil {
+		as, err = as.inCluster(args.Workload.Cluster)
+	}
+	if err != nil {
+		lh.V(2).Info("invalid create request", "err", err)
+		metrics.ObserveInvalid(actionCreate)
+		return err
+	}
+
+	ctx, err = as.prepareAction(ctx, actionCreate, &args.ActionOptions, args.Workload.Namespace)
 	if err != nil {
 		return err
 	}
 
-	log.Println("create action called")
+	if args.DryRun {
+		reply.Plan, err = as.planCreate(ctx, id, args)
+		if err != nil {
+			lh.V(2).Info("error planning create action", "err", err)
+			return err
+		}
+		lh.V(2).Info("planned create action")
+
+		reply.Message = "dry run"
+		reply.ActionID = id
+		return nil
+	}
+
+	reply.Message, reply.ActionID, reply.Status, err = as.runAction(ctx, id, actionCreate, args, &args.ActionOptions,
+		[]string{args.Workload.Namespace}, func(ctx context.Context) (*actionRun, error) {
+			lh.V(2).Info("create action called")
+
+			var suggestion *SchedulingSuggestion
+			return &actionRun{
+				check: as.checkPoliciesOf(id, actionCreate, []Workload{args.Workload}, nil, args.Node.Name),
+				handle: func(ctx context.Context) (err error) {
+					suggestion, err = as.CreateHandler(ctx, args)
+					return err
+				},
+				// only needed to measure the time until the new pod is ready, the record includes the new pod
+				settle: func(ctx context.Context) {
+					if _, err := as.waitToBeReady(ctx, actionCreate, args.Workload.Namespace, suggestion, as.timeouts(ctx).Ready); err != nil {
+						lh.V(2).Info("new pod did not become ready", "err", err)
+					}
+				},
+			}, nil
+		})
+	return err
+}
+
+func (as *ActionService) Delete(r *http.Request, args *DeleteArgs, reply *DeleteReply) (err error) {
+	ctx, span, id := startAction(r, actionDelete,
+		"pod", klog.KRef(args.Pod.Namespace, args.Pod.Name),
+	)
+	defer func() { tracing.End(span, err) }()
+	lh := klog.FromContext(ctx)
+
+	err = validateDeleteReq(args)
+	if err == nil {
+		err = validateActionOptions(&args.ActionOptions)
+	}
+	if err == nil {
+		as, err = as.inCluster(args.Pod.Cluster)
+	}
+	if err != nil {
+		lh.V(2).Info("invalid delete request", "err", err)
+		metrics.ObserveInvalid(actionDelete)
+		return err
+	}
+
+	ctx, err = as.prepareAction(ctx, actionDelete, &args.ActionOptions, args.Pod.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if args.DryRun {
+		reply.Plan, err = as.planDelete(ctx, id, args)
+		if err != nil {
+			lh.V(2).Info("error planning delete action", "err", err)
+			return err
+		}
+		lh.V(2).Info("planned delete action")
+
+		reply.Message = "dry run"
+		reply.ActionID = id
+		return nil
+	}
+
+	reply.Message, reply.ActionID, reply.Status, err = as.runAction(ctx, id, actionDelete, args, &args.ActionOptions,
+		[]string{args.Pod.Namespace}, func(ctx context.Context) (*actionRun, error) {
+			lh.V(2).Info("delete action called")
 
-	reply.Message = "ok"
+			return &actionRun{
+				check: as.checkPoliciesOf(id, actionDelete, nil, []Pod{args.Pod}, ""),
+				handle: func(ctx context.Context) error {
+					status, err := as.DeleteHandler(ctx, args)
+					if err != nil {
+						return err
+					}
+					if err := as.saveDelete(ctx, id, status); err != nil {
+						lh.Error(err, "error saving the terminated pods")
+					}
+					return nil
+				},
+			}, nil
+		})
+	return err
+}
 
-	// todo: Think about a worker pool here
-	go func() {
-		_, _ = as.CreateHandler(args)
-	}()
-	log.Println("spawning a handler")
+// DeleteStatus reports the pods a completed delete terminated.
+func (as *ActionService) DeleteStatus(r *http.Request, args *DeleteStatusArgs, reply *DeleteStatusReply) error {
+	ctx, lh := logging.WithValues(r.Context(), "actionID", args.ActionID)
 
-	log.Println("returning to the caller that the request has been accepted")
+	record, err := as.loadDelete(ctx, args.ActionID)
+	if err != nil {
+		lh.V(2).Info("error loading delete", "err", err)
+		return err
+	}
+
+	err = as.authorize(ctx, verbGet, record.Pod.Namespace)
+	if err != nil {
+		return err
+	}
+
+	*reply = *record
 	return nil
 }
 
-func (as *ActionService) Delete(r *http.Request, args *DeleteArgs, reply *DeleteReply) error {
-	err := validateDeleteReq(args)
+func (as *ActionService) Move(r *http.Request, args *MoveArgs, reply *MoveReply) (err error) {
+	ctx, span, id := startAction(r, actionMove,
+		"pod", klog.KRef(args.Pod.Namespace, args.Pod.Name),
+		"node", args.Node.Name,
+	)
+	defer func() { tracing.End(span, err) }()
+	lh := klog.FromContext(ctx)
+
+	err = validateMoveReq(args)
+	if err == nil {
+		err = validateActionOptions(&args.ActionOptions)
+	}
+	if err == nil {
+		// the pod is created in the cluster of the node, see MoveHandler
+		_, err = as.inCluster(args.Node.Cluster)
+	}
+	if err == nil {
+		as, err = as.inCluster(args.Pod.Cluster)
+	}
 	if err != nil {
+		lh.V(2).Info("invalid move request", "err", err)
+		metrics.ObserveInvalid(actionMove)
 		return err
 	}
 
-	log.Println("delete action called")
+	ctx, err = as.prepareAction(ctx, actionMove, &args.ActionOptions, args.Pod.Namespace)
+	if err != nil {
+		return err
+	}
 
-	reply.Message = "ok"
+	if args.DryRun {
+		reply.Plan, err = as.planMove(ctx, id, args)
+		if err != nil {
+			lh.V(2).Info("error planning move action", "err", err)
+			return err
+		}
+		lh.V(2).Info("planned move action")
 
-	// todo: Think about a worker pool here
-	go as.DeleteHandler(args)
-	log.Println("spawning a handler")
+		reply.Message = "dry run"
+		reply.ActionID = id
+		return nil
+	}
+
+	reply.Message, reply.ActionID, reply.Status, err = as.runAction(ctx, id, actionMove, args, &args.ActionOptions,
+		[]string{args.Pod.Namespace}, func(ctx context.Context) (*actionRun, error) {
+			lh.V(2).Info("move action called")
+
+			return &actionRun{
+				check: as.checkPoliciesOf(id, actionMove, nil, []Pod{args.Pod}, args.Node.Name),
+				handle: func(ctx context.Context) error {
+					return as.MoveHandler(ctx, args)
+				},
+			}, nil
+		})
+	return err
+}
+
+func (as *ActionService) Swap(r *http.Request, args *SwapArgs, reply *SwapReply) (err error) {
+	ctx, span, id := startAction(r, actionSwap,
+		"x", klog.KRef(args.X.Namespace, args.X.Name),
+		"y", args.Y,
+	)
+	defer func() { tracing.End(span, err) }()
+	lh := klog.FromContext(ctx)
+
+	err = validateSwapReq(args)
+	if err == nil {
+		err = validateActionOptions(&args.ActionOptions)
+	}
+	if err == nil {
+		as, err = as.inCluster(args.X.Cluster)
+	}
+	if err != nil {
+		lh.V(2).Info("invalid swap request", "err", err)
+		metrics.ObserveInvalid(actionSwap)
+		return err
+	}
+
+	namespaces := []string{args.X.Namespace}
+	for _, pod := range args.Y {
+		namespaces = append(namespaces, pod.Namespace)
+	}
+	ctx, err = as.prepareAction(ctx, actionSwap, &args.ActionOptions, namespaces...)
+	if err != nil {
+		return err
+	}
 
-	log.Println("returning to the caller that the request has been accepted")
+	if args.DryRun {
+		reply.Plan, err = as.planSwap(ctx, id, args)
+		if err != nil {
+			lh.V(2).Info("error planning swap action", "err", err)
+			return err
+		}
+		lh.V(2).Info("planned swap action")
+
+		reply.Message = "dry run"
+		reply.ActionID = id
+		return nil
+	}
+
+	reply.Message, reply.ActionID, reply.Status, err = as.runAction(ctx, id, actionSwap, args, &args.ActionOptions,
+		namespaces, func(ctx context.Context) (*actionRun, error) {
+			lh.V(2).Info("swap action called")
+
+			return &actionRun{
+				check: as.checkPoliciesOf(id, actionSwap, nil, append([]Pod{args.X}, args.Y...), ""),
+				handle: func(ctx context.Context) error {
+					return as.SwapHandler(ctx, args)
+				},
+			}, nil
+		})
+	return err
+}
+
+func (as *ActionService) Batch(r *http.Request, args *BatchArgs, reply *BatchReply) (err error) {
+	ctx, span, id := startAction(r, actionBatch,
+		"steps", len(args.Actions),
+		"mode", args.Mode,
+		"atomic", args.Atomic,
+	)
+	defer func() { tracing.End(span, err) }()
+	lh := klog.FromContext(ctx)
+
+	err = validateBatchReq(args)
+	if err == nil {
+		err = validateActionOptions(&args.ActionOptions)
+	}
+	for i := 0; err == nil && i < len(args.Actions); i++ {
+		if _, err = as.inCluster(args.Actions[i].cluster()); err != nil {
+			err = fmt.Errorf("action at index %d: %w", i, err)
+		}
+	}
+	if err != nil {
+		lh.V(2).Info("invalid batch request", "err", err)
+		metrics.ObserveInvalid(actionBatch)
+		return err
+	}
+
+	// every action is authorized on its own
+	ctx, err = as.prepareAction(ctx, actionBatch, &args.ActionOptions)
+	if err != nil {
+		return err
+	}
+	for i := range args.Actions {
+		ba := &args.Actions[i]
+		err = as.authorize(ctx, ba.action(), ba.namespaces()...)
+		if err != nil {
+			return fmt.Errorf("action at index %d: %w", i, err)
+		}
+	}
+
+	if args.DryRun {
+		for i := range args.Actions {
+			view, _ := as.inCluster(args.Actions[i].cluster())
+			plan, err := view.planBatchAction(ctx, fmt.Sprintf("%s-%d", id, i), &args.Actions[i])
+			if err != nil {
+				lh.V(2).Info("error planning batch action", "step", i, "err", err)
+				return fmt.Errorf("action at index %d: %w", i, err)
+			}
+			reply.Plans = append(reply.Plans, plan)
+		}
+		lh.V(2).Info("planned batch action")
+
+		reply.Message = "dry run"
+		reply.ActionID = id
+		return nil
+	}
+
+	reply.Message, reply.ActionID, reply.Status, err = as.runAction(ctx, id, actionBatch, args, &args.ActionOptions,
+		args.namespaces(), func(ctx context.Context) (*actionRun, error) {
+			steps := make([]*batchStep, len(args.Actions))
+			for i := range args.Actions {
+				// every action acts on its own cluster
+				view, _ := as.inCluster(args.Actions[i].cluster())
+				step, err := view.resolveBatchStep(ctx, i, &args.Actions[i])
+				if err != nil {
+					return nil, fmt.Errorf("action at index %d: %w", i, err)
+				}
+				steps[i] = step
+			}
+
+			lh.V(2).Info("batch action called")
+
+			return &actionRun{
+				check: func(ctx context.Context, peek bool) (func(), error) {
+					var releases []func()
+					release := func() {
+						for _, release := range releases {
+							release()
+						}
+					}
+
+					for i := range args.Actions {
+						ba := &args.Actions[i]
+						view, _ := as.inCluster(ba.cluster())
+						workloads, removed, target := ba.policyArgs()
+						check := view.checkPoliciesOf(fmt.Sprintf("%s-%d", id, i), ba.action(), workloads, removed, target)
+						stepRelease, err := check(ctx, peek)
+						if err != nil {
+							release()
+							return nil, fmt.Errorf("action at index %d: %w", i, err)
+						}
+						if stepRelease != nil {
+							releases = append(releases, stepRelease)
+						}
+					}
+					return release, nil
+				},
+				handle: func(ctx context.Context) error {
+					return as.BatchHandler(ctx, args, steps)
+				},
+			}, nil
+		})
+	return err
+}
+
+func (as *ActionService) MigrateApp(r *http.Request, args *MigrateAppArgs, reply *MigrateAppReply) (err error) {
+	ctx, span, id := startAction(r, actionMigrateApp,
+		"namespace", args.Namespace,
+		"selector", args.podSelector(),
+		"maxSurge", args.MaxSurge,
+	)
+	defer func() { tracing.End(span, err) }()
+	lh := klog.FromContext(ctx)
+
+	err = validateMigrateAppReq(args)
+	if err == nil {
+		err = validateActionOptions(&args.ActionOptions)
+	}
+	if err == nil {
+		as, err = as.inCluster(args.Cluster)
+	}
+	if err != nil {
+		lh.V(2).Info("invalid migrate application request", "err", err)
+		metrics.ObserveInvalid(actionMigrateApp)
+		return err
+	}
+
+	ctx, err = as.prepareAction(ctx, actionMigrateApp, &args.ActionOptions, args.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if args.DryRun {
+		reply.Moves, err = as.resolveMigration(ctx, args)
+		if err != nil {
+			lh.V(2).Info("error planning migrate application action", "err", err)
+			return err
+		}
+		lh.V(2).Info("planned migrate application action", "moves", len(reply.Moves))
+
+		reply.Message = "dry run"
+		reply.ActionID = id
+		return nil
+	}
+
+	reply.Message, reply.ActionID, reply.Status, err = as.runAction(ctx, id, actionMigrateApp, args, &args.ActionOptions,
+		[]string{args.Namespace}, func(ctx context.Context) (*actionRun, error) {
+			moves, err := as.resolveMigration(ctx, args)
+			if err != nil {
+				lh.V(2).Info("error resolving migrate application action", "err", err)
+				return nil, err
+			}
+
+			lh.V(2).Info("migrate application action called", "moves", len(moves))
+
+			// the moves are checked against the policies one by one as the migration progresses
+			return &actionRun{
+				handle: func(ctx context.Context) error {
+					return as.MigrateAppHandler(ctx, id, args, moves)
+				},
+			}, nil
+		})
+	return err
+}
+
+// MigrateAppStatus reports the progress of every pod of a migration.
+func (as *ActionService) MigrateAppStatus(r *http.Request, args *MigrateAppStatusArgs, reply *MigrateAppStatusReply) error {
+	ctx, lh := logging.WithValues(r.Context(), "actionID", args.ActionID)
+
+	record, err := as.loadMigration(ctx, args.ActionID)
+	if err != nil {
+		lh.V(2).Info("error loading migration", "err", err)
+		return err
+	}
+
+	err = as.authorize(ctx, verbGet, record.Namespace)
+	if err != nil {
+		return err
+	}
+
+	reply.Namespace = record.Namespace
+	reply.Moves = record.Moves
 	return nil
 }
 
-func (as *ActionService) Move(r *http.Request, args *MoveArgs, reply *MoveReply) error {
-	err := validateMoveReq(args)
+func (as *ActionService) Drain(r *http.Request, args *DrainArgs, reply *DrainReply) (err error) {
+	ctx, span, id := startAction(r, actionDrain,
+		"node", args.Node.Name,
+		"maxSurge", args.MaxSurge,
+	)
+	defer func() { tracing.End(span, err) }()
+	lh := klog.FromContext(ctx)
+
+	err = validateDrainReq(args)
+	if err == nil {
+		err = validateActionOptions(&args.ActionOptions)
+	}
+	if err == nil {
+		as, err = as.inCluster(args.Node.Cluster)
+	}
+	if err != nil {
+		lh.V(2).Info("invalid drain request", "err", err)
+		metrics.ObserveInvalid(actionDrain)
+		return err
+	}
+
+	// a drain moves pods of any namespace, so the caller must be allowed to drain cluster-wide
+	ctx, err = as.prepareAction(ctx, actionDrain, &args.ActionOptions, "")
 	if err != nil {
 		return err
 	}
 
-	log.Println("move action called")
+	if args.DryRun {
+		reply.Moves, reply.Skipped, err = as.resolveDrain(ctx, args)
+		if err != nil {
+			lh.V(2).Info("error planning drain action", "err", err)
+			return err
+		}
+		lh.V(2).Info("planned drain action", "moves", len(reply.Moves), "skipped", len(reply.Skipped))
+
+		reply.Message = "dry run"
+		reply.ActionID = id
+		return nil
+	}
+
+	var skipped []SkippedPod
+	reply.Message, reply.ActionID, reply.Status, err = as.runAction(ctx, id, actionDrain, args, &args.ActionOptions,
+		[]string{""}, func(ctx context.Context) (*actionRun, error) {
+			var moves []PodMigration
+			var err error
+			moves, skipped, err = as.resolveDrain(ctx, args)
+			if err != nil {
+				lh.V(2).Info("error resolving drain action", "err", err)
+				return nil, err
+			}
+
+			lh.V(2).Info("drain action called", "moves", len(moves), "skipped", len(skipped))
 
-	reply.Message = "ok"
+			// the moves are checked against the policies one by one as the drain progresses
+			return &actionRun{
+				handle: func(ctx context.Context) error {
+					return as.DrainHandler(ctx, id, args, moves)
+				},
+			}, nil
+		})
+	if reply.Status == statusAccepted {
+		reply.Skipped = skipped
+	}
+	return err
+}
 
-	// todo: Think about a worker pool here
-	go as.MoveHandler(args)
-	log.Println("spawning a handler")
+func (as *ActionService) Rebalance(r *http.Request, args *RebalanceArgs, reply *RebalanceReply) (err error) {
+	ctx, span, id := startAction(r, actionRebalance,
+		"workload", klog.KRef(args.Workload.Namespace, args.Workload.Name),
+		"strategy", args.Strategy.Name,
+		"maxSurge", args.MaxSurge,
+	)
+	defer func() { tracing.End(span, err) }()
+	lh := klog.FromContext(ctx)
 
-	log.Println("returning to the caller that the request has been accepted")
+	err = validateRebalanceReq(args)
+	if err == nil {
+		err = validateActionOptions(&args.ActionOptions)
+	}
+	if err == nil {
+		as, err = as.inCluster(args.Workload.Cluster)
+	}
+	if err != nil {
+		lh.V(2).Info("invalid rebalance request", "err", err)
+		metrics.ObserveInvalid(actionRebalance)
+		return err
+	}
+
+	ctx, err = as.prepareAction(ctx, actionRebalance, &args.ActionOptions, args.Workload.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if args.DryRun {
+		reply.Moves, err = as.resolveRebalance(ctx, args)
+		if err != nil {
+			lh.V(2).Info("error planning rebalance action", "err", err)
+			return err
+		}
+		lh.V(2).Info("planned rebalance action", "moves", len(reply.Moves))
+
+		reply.Message = "dry run"
+		reply.ActionID = id
+		return nil
+	}
+
+	reply.Message, reply.ActionID, reply.Status, err = as.runAction(ctx, id, actionRebalance, args, &args.ActionOptions,
+		[]string{args.Workload.Namespace}, func(ctx context.Context) (*actionRun, error) {
+			moves, err := as.resolveRebalance(ctx, args)
+			if err != nil {
+				lh.V(2).Info("error resolving rebalance action", "err", err)
+				return nil, err
+			}
+
+			lh.V(2).Info("rebalance action called", "moves", len(moves))
+
+			// the moves are checked against the policies one by one as the rebalance progresses
+			return &actionRun{
+				handle: func(ctx context.Context) error {
+					return as.RebalanceHandler(ctx, id, args, moves)
+				},
+			}, nil
+		})
+	return err
+}
+
+func (as *ActionService) ScaleToPlacement(r *http.Request, args *ScaleToPlacementArgs, reply *ScaleToPlacementReply) (err error) {
+	ctx, span, id := startAction(r, actionScaleToPlacement,
+		"workload", klog.KRef(args.Workload.Namespace, args.Workload.Name),
+		"placement", args.Placement,
+	)
+	defer func() { tracing.End(span, err) }()
+	lh := klog.FromContext(ctx)
+
+	err = validateScaleToPlacementReq(args)
+	if err == nil {
+		err = validateActionOptions(&args.ActionOptions)
+	}
+	if err == nil {
+		as, err = as.inCluster(args.Workload.Cluster)
+	}
+	if err != nil {
+		lh.V(2).Info("invalid scale to placement request", "err", err)
+		metrics.ObserveInvalid(actionScaleToPlacement)
+		return err
+	}
+
+	ctx, err = as.prepareAction(ctx, actionScaleToPlacement, &args.ActionOptions, args.Workload.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if args.DryRun {
+		change, err := as.resolvePlacement(ctx, args)
+		if err == nil {
+			reply.Plan, err = as.planScaleToPlacement(ctx, id, change)
+		}
+		if err != nil {
+			lh.V(2).Info("error planning scale to placement action", "err", err)
+			return err
+		}
+		lh.V(2).Info("planned scale to placement action")
+
+		reply.Message = "dry run"
+		reply.ActionID = id
+		return nil
+	}
+
+	reply.Message, reply.ActionID, reply.Status, err = as.runAction(ctx, id, actionScaleToPlacement, args, &args.ActionOptions,
+		[]string{args.Workload.Namespace}, func(ctx context.Context) (*actionRun, error) {
+			change, err := as.resolvePlacement(ctx, args)
+			if err != nil {
+				lh.V(2).Info("error resolving scale to placement action", "err", err)
+				return nil, err
+			}
+
+			lh.V(2).Info("scale to placement action called", "adds", len(change.adds), "removals", len(change.removals))
+
+			return &actionRun{
+				check: as.checkPoliciesOf(id, actionScaleToPlacement, change.workloads(), change.removedPods(), ""),
+				handle: func(ctx context.Context) error {
+					return as.ScaleToPlacementHandler(ctx, id, change)
+				},
+			}, nil
+		})
+	return err
+}
+
+// ScaleToPlacementStatus reports whether the layout of a workload converged to the placement requested for it.
+func (as *ActionService) ScaleToPlacementStatus(r *http.Request, args *ScaleToPlacementStatusArgs, reply *ScaleToPlacementStatusReply) error {
+	ctx, lh := logging.WithValues(r.Context(), "actionID", args.ActionID)
+
+	record, err := as.loadPlacement(ctx, args.ActionID)
+	if err != nil {
+		lh.V(2).Info("error loading placement", "err", err)
+		return err
+	}
+
+	err = as.authorize(ctx, verbGet, record.Workload.Namespace)
+	if err != nil {
+		return err
+	}
+
+	*reply = *record
+	return nil
+}
+
+// ScheduledStatus reports whether an action deferred by its schedule is waiting, was dispatched or expired.
+func (as *ActionService) ScheduledStatus(r *http.Request, args *ScheduledStatusArgs, reply *ScheduledStatusReply) error {
+	ctx, lh := logging.WithValues(r.Context(), "actionID", args.ActionID)
+
+	record, err := as.loadScheduled(ctx, args.ActionID)
+	if err != nil {
+		lh.V(2).Info("error loading scheduled action", "err", err)
+		return err
+	}
+
+	err = as.authorize(ctx, verbGet, record.Namespaces...)
+	if err != nil {
+		return err
+	}
+
+	reply.Action = record.Action
+	reply.Status = record.Status
+	reply.Schedule = record.Schedule
+	reply.Due = record.Due
+	reply.Error = record.Error
 	return nil
 }
 
-func (as *ActionService) Swap(r *http.Request, args *SwapArgs, reply *SwapReply) error {
-	err := validateSwapReq(args)
+func (as *ActionService) History(r *http.Request, args *HistoryArgs, reply *HistoryReply) error {
+	ctx, lh := logging.WithValues(r.Context(), "actionType", "history")
+
+	err := validateHistoryReq(args)
 	if err != nil {
+		lh.V(2).Info("invalid history request", "err", err)
 		return err
 	}
 
-	log.Println("swap action called")
+	// the records span namespaces, so the caller must be allowed to read them cluster-wide
+	err = as.authorize(ctx, verbGet, "")
+	if err != nil {
+		return err
+	}
 
-	reply.Message = "ok"
+	if as.auditSink == nil {
+		return fmt.Errorf("the audit log is disabled")
+	}
 
-	// todo: Think about a worker pool here
-	// ensure that no other actions related to the workloads accessed by the swap action run in parallel
-	// since they might affect the wait part of the action or even prevent the action to succeed
-	go as.SwapHandler(args)
-	log.Println("spawning a handler")
+	reply.Records, err = as.auditSink.Query(ctx, audit.Filter{
+		Workload: args.Workload,
+		Node:     args.Node,
+		Caller:   args.Caller,
+		Since:    args.Since,
+		Until:    args.Until,
+		Limit:    args.Limit,
+	})
+	if err != nil {
+		lh.Error(err, "error querying audit log")
+		return err
+	}
+	if reply.Records == nil {
+		reply.Records = []audit.Record{}
+	}
 
-	log.Println("returning to the caller that the request has been accepted")
 	return nil
 }
@@ -0,0 +1,127 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/audit"
+	"k8s.io/klog/v2"
+)
+
+// unwindTimeout bounds how long Shutdown waits for interrupted handlers to roll back before releasing their locks.
+const unwindTimeout = 5 * time.Second
+
+var errShuttingDown = errors.New("WAM is shutting down and does not accept new actions")
+
+// spawn runs an accepted action touching the namespaces in the background. The handler context is cancelled if the
+// action is cancelled, see Cancel, or still running when the shutdown grace period ends and records the audit events
+// of the action. spawn refuses the action once Shutdown has been called.
+func (as *ActionService) spawn(ctx context.Context, id string, action string, namespaces []string, handler func(ctx context.Context)) error {
+	as.mu.Lock()
+	if as.draining {
+		as.mu.Unlock()
+		return errShuttingDown
+	}
+
+	as.running.Add(1)
+	as.inFlight[id] = action
+
+	ctx, cancel := context.WithCancelCause(audit.WithRecorder(ctx))
+	stop := context.AfterFunc(as.ctx, func() { cancel(nil) })
+	as.cancels[id] = cancel
+	as.mu.Unlock()
+
+	// the action is journaled before the caller learns its ID, so it can be cancelled right away
+	as.journal(ctx, func(entry *journalEntry) { entry.Namespaces = namespaces })
+
+	go func() {
+		defer func() {
+			stop()
+			cancel(nil)
+
+			// the steps a cancelled handler did not finish are rolled back before the action is done
+			if cancelled(ctx) {
+				as.compensateCancelled(ctx, id)
+			}
+			as.finishJournal(ctx, id, as.ctx.Err() != nil)
+
+			as.mu.Lock()
+			delete(as.inFlight, id)
+			delete(as.cancels, id)
+			as.mu.Unlock()
+
+			as.running.Done()
+		}()
+
+		// stepwise actions are dispatched move by move. A handler whose wait was interrupted still runs, it fails fast
+		// on the cancelled context and records its outcome.
+		if !stepwise[action] {
+			if release, err := as.queue.admit(ctx); err == nil {
+				defer release()
+			}
+		}
+
+		handler(ctx)
+	}()
+
+	return nil
+}
+
+// Accepting returns an error once the service started to shut down, it is used by the readiness check.
+func (as *ActionService) Accepting(context.Context) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if as.draining {
+		return errShuttingDown
+	}
+	return nil
+}
+
+// Shutdown stops accepting new actions and waits for the running ones to finish until ctx is done. Actions still
+// running then are logged with their ID, so they can be retried, and interrupted. Locks that their handlers did not
+// manage to release are released before Shutdown returns.
+func (as *ActionService) Shutdown(ctx context.Context) error {
+	lh := klog.FromContext(ctx)
+	defer func() {
+		for _, c := range as.clusters {
+			c.stopEvents()
+		}
+	}()
+
+	as.mu.Lock()
+	as.draining = true
+	as.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		as.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		lh.Info("all running actions finished")
+		return nil
+	case <-ctx.Done():
+	}
+
+	as.mu.Lock()
+	for id, action := range as.inFlight {
+		lh.Info("interrupting action that did not finish within the grace period", "actionID", id, "actionType", action)
+	}
+	as.mu.Unlock()
+
+	as.cancel()
+
+	select {
+	case <-done:
+	case <-time.After(unwindTimeout):
+		lh.Info("interrupted actions did not return in time")
+	}
+
+	as.releaseLocks(context.Background())
+
+	return ctx.Err()
+}
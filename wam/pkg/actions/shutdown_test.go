@@ -0,0 +1,75 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+func TestShutdown(t *testing.T) {
+	t.Run("waits for running actions", func(t *testing.T) {
+		as := NewActionService(nil, nil, wamconfig.Actions{}, nil, nil, nil)
+
+		finished := make(chan struct{})
+		if err := as.spawn(context.Background(), "a", actionCreate, nil, func(ctx context.Context) {
+			time.Sleep(50 * time.Millisecond)
+			close(finished)
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := as.Shutdown(ctx); err != nil {
+			t.Fatalf("expected running action to finish, got %v", err)
+		}
+
+		select {
+		case <-finished:
+		default:
+			t.Error("Shutdown returned before the running action finished")
+		}
+	})
+
+	t.Run("interrupts actions after the grace period", func(t *testing.T) {
+		as := NewActionService(nil, nil, wamconfig.Actions{}, nil, nil, nil)
+
+		interrupted := make(chan struct{})
+		if err := as.spawn(context.Background(), "a", actionSwap, nil, func(ctx context.Context) {
+			<-ctx.Done()
+			close(interrupted)
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := as.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+		}
+
+		select {
+		case <-interrupted:
+		default:
+			t.Error("running action was not interrupted")
+		}
+	})
+
+	t.Run("refuses new actions", func(t *testing.T) {
+		as := NewActionService(nil, nil, wamconfig.Actions{}, nil, nil, nil)
+
+		if err := as.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := as.Accepting(context.Background()); !errors.Is(err, errShuttingDown) {
+			t.Errorf("expected %v, got %v", errShuttingDown, err)
+		}
+		if err := as.spawn(context.Background(), "b", actionCreate, nil, func(context.Context) {}); !errors.Is(err, errShuttingDown) {
+			t.Errorf("expected %v, got %v", errShuttingDown, err)
+		}
+	})
+}
@@ -3,9 +3,13 @@ package actions
 import (
 	"context"
 	"fmt"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/metrics"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	clientset "k8s.io/client-go/kubernetes"
-	"log"
+	"k8s.io/klog/v2"
 	"time"
 )
 
@@ -14,17 +18,18 @@ func (p *Pod) toDeleteArgs() *DeleteArgs {
 		Pod: Pod{
 			Namespace: p.Namespace,
 			Name:      p.Name,
+			Cluster:   p.Cluster,
 		},
 	}
 }
 
-func (p *Pod) toCreateArgs(k8sClient *clientset.Clientset, nodeName string) (*CreateArgs, error) {
-	pod, err := k8sClient.CoreV1().Pods(p.Namespace).Get(context.TODO(), p.Name, metav1.GetOptions{})
+func (p *Pod) toCreateArgs(ctx context.Context, as *ActionService, nodeName string) (*CreateArgs, error) {
+	pod, err := as.getPod(ctx, p.Namespace, p.Name)
 	if err != nil {
 		return nil, err
 	}
 
-	deployment, err := getPodsDeployment(pod, k8sClient)
+	deployment, err := as.getPodsDeployment(ctx, pod)
 	if err != nil {
 		return nil, err
 	}
@@ -35,9 +40,11 @@ func (p *Pod) toCreateArgs(k8sClient *clientset.Clientset, nodeName string) (*Cr
 			APIVersion: deployment.APIVersion,
 			Kind:       deployment.Kind,
 			Name:       deployment.Name,
+			Cluster:    p.Cluster,
 		},
 		Node: Node{
-			Name: nodeName,
+			Name:    nodeName,
+			Cluster: p.Cluster,
 		},
 	}, nil
 }
@@ -47,107 +54,187 @@ type TargetScaleKey struct {
 	DeploymentName string
 }
 
-func (as *ActionService) SwapHandler(args *SwapArgs) {
-	pods := make([]Pod, len(args.Y)+1)
-	pods[0] = args.X
-	for i := 0; i < len(args.Y); i++ {
-		pods[i+1] = args.Y[i]
+// swapTargets is what a swap resolves before it changes anything.
+type swapTargets struct {
+	// pods are X followed by the Y pods
+	pods  []Pod
+	nodeX string
+	nodeY string
+	// currentScales are the replicas of the workloads before the swap
+	currentScales map[TargetScaleKey]int32
+	// desiredScales are the desired replicas of the workloads before the swap
+	desiredScales map[TargetScaleKey]int32
+	// targetScales are the replicas of the workloads once the pods are deleted
+	targetScales map[TargetScaleKey]int32
+	selectors    map[TargetScaleKey]map[string]string
+	// createArgs re-create the pods on the other node, in the order of the pods
+	createArgs []*CreateArgs
+}
+
+// resolveSwap resolves the nodes and workloads of the pods of a swap and the replicas they are scaled to.
+func (as *ActionService) resolveSwap(ctx context.Context, args *SwapArgs) (*swapTargets, error) {
+	lh := klog.FromContext(ctx)
+
+	t := &swapTargets{
+		pods:          make([]Pod, len(args.Y)+1),
+		currentScales: make(map[TargetScaleKey]int32),
+		desiredScales: make(map[TargetScaleKey]int32),
+		targetScales:  make(map[TargetScaleKey]int32),
+		selectors:     make(map[TargetScaleKey]map[string]string),
+		createArgs:    make([]*CreateArgs, len(args.Y)+1),
 	}
 
-	targetScales := make(map[TargetScaleKey]int32)
-	selectors := make(map[TargetScaleKey]map[string]string)
-	nodeX := ""
-	nodeY := ""
+	t.pods[0] = args.X
+	for i := 0; i < len(args.Y); i++ {
+		t.pods[i+1] = args.Y[i]
+	}
 
-	for i, pod := range pods {
-		podObj, err := as.k8sClient.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
+	for i, pod := range t.pods {
+		podObj, err := as.getPod(ctx, pod.Namespace, pod.Name)
 		if err != nil {
-			log.Printf("error getting pod: %v\n", err)
-			return
+			lh.Error(err, "error getting pod", "pod", klog.KRef(pod.Namespace, pod.Name))
+			return nil, err
 		}
 
 		nodeName := podObj.Spec.NodeName
 		if i == 0 {
-			nodeX = nodeName
-		} else if nodeY == "" {
-			nodeY = nodeName
-		} else if nodeY != nodeName {
+			t.nodeX = nodeName
+		} else if t.nodeY == "" {
+			t.nodeY = nodeName
+		} else if t.nodeY != nodeName {
 			// verify all Y pod nodes are the same
-			log.Printf("aborting move: all Y pods must be running on the same node: %s != %s\n", nodeY, nodeName)
-			return
+			lh.Info("aborting swap: all Y pods must be running on the same node", "nodeY", t.nodeY, "node", nodeName)
+			return nil, fmt.Errorf("all Y pods must be running on the same node: %s != %s", t.nodeY, nodeName)
 		}
 
-		deployment, err := getPodsDeployment(podObj, as.k8sClient)
+		deployment, err := as.getPodsDeployment(ctx, podObj)
 		if err != nil {
-			log.Printf("error getting pod's owner reference: %v\n", err)
-			return
+			lh.Error(err, "error getting pod's owner reference", "pod", klog.KObj(podObj))
+			return nil, err
 		}
 
-		deploymentObj, _ := as.k8sClient.AppsV1().Deployments(pod.Namespace).Get(context.TODO(), deployment.Name, metav1.GetOptions{})
+		deploymentObj, err := as.getDeployment(ctx, pod.Namespace, deployment.Name)
 		if err != nil {
-			log.Printf("error getting pod's deployment: %v\n", err)
-			return
+			lh.Error(err, "error getting pod's deployment", "pod", klog.KObj(podObj))
+			return nil, err
 		}
 
 		scale := deploymentObj.Status.Replicas
-		if err != nil {
-			log.Printf("error getting pod's deployment current scale: %v\n", err)
-			return
-		}
 
 		key := TargetScaleKey{pod.Namespace, deployment.Name}
-		_, ok := targetScales[key]
+		_, ok := t.targetScales[key]
 		if !ok {
-			targetScales[key] = scale
-			selectors[key] = deploymentObj.Spec.Selector.MatchLabels
+			t.currentScales[key] = scale
+			// the API server defaults unset replicas to 1
+			t.desiredScales[key] = 1
+			if deploymentObj.Spec.Replicas != nil {
+				t.desiredScales[key] = *deploymentObj.Spec.Replicas
+			}
+			t.targetScales[key] = scale
+			t.selectors[key] = deploymentObj.Spec.Selector.MatchLabels
 		}
 
-		targetScales[key] -= 1
+		t.targetScales[key] -= 1
 	}
 
 	// this will be used later on, but we need to prepare it here
-	createArgs := make([]*CreateArgs, len(pods))
-	for i, pod := range pods {
+	for i, pod := range t.pods {
 		if i == 0 {
-			ca, err := pod.toCreateArgs(as.k8sClient, nodeY)
+			ca, err := pod.toCreateArgs(ctx, as, t.nodeY)
 			if err != nil {
-				log.Printf("error creating create args: %s", err.Error())
-				return
+				lh.Error(err, "error creating create args", "pod", klog.KRef(pod.Namespace, pod.Name))
+				return nil, err
 			}
-			createArgs[i] = ca
+			t.createArgs[i] = ca
 		} else {
-			ca, err := pod.toCreateArgs(as.k8sClient, nodeX)
+			ca, err := pod.toCreateArgs(ctx, as, t.nodeX)
 			if err != nil {
-				log.Printf("error creating create args: %s", err.Error())
-				return
+				lh.Error(err, "error creating create args", "pod", klog.KRef(pod.Namespace, pod.Name))
+				return nil, err
 			}
-			createArgs[i] = ca
+			t.createArgs[i] = ca
 		}
 	}
 
-	log.Printf("deleting x and y pods\n")
-	// here, calling create for pods of the same workload is UNSAFE! since there is no locking mechanism (yet)
-	// for prototype purposes we hence call creates sequentially
+	return t, nil
+}
+
+func (as *ActionService) SwapHandler(ctx context.Context, args *SwapArgs) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "SwapHandler", trace.WithAttributes(
+		attribute.String("wam.x", args.X.Namespace+"/"+args.X.Name),
+		attribute.Int("wam.y_count", len(args.Y)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	lh := klog.FromContext(ctx)
+
+	phaseStart := time.Now()
+
+	t, err := as.resolveSwap(ctx, args)
+	if err != nil {
+		return err
+	}
+	pods, nodeX, nodeY := t.pods, t.nodeX, t.nodeY
+	targetScales, selectors, createArgs := t.targetScales, t.selectors, t.createArgs
+
+	// every workload of the swap tells about its outcome
+	defer func() {
+		notified := map[Workload]bool{}
+		for _, createArg := range createArgs {
+			if notified[createArg.Workload] {
+				continue
+			}
+			notified[createArg.Workload] = true
+
+			if err != nil {
+				as.event(ctx, workloadRef(createArg.Workload), corev1.EventTypeWarning, reasonSwapAborted,
+					"Swapping pods between nodes %s and %s aborted: %v", nodeX, nodeY, err)
+			} else {
+				as.event(ctx, workloadRef(createArg.Workload), corev1.EventTypeNormal, reasonSwapCompleted,
+					"Swapped pods between nodes %s and %s", nodeX, nodeY)
+			}
+		}
+	}()
+
+	observeSwapPhase(span, swapPhaseResolve, &phaseStart)
+
+	// a cancelled swap re-creates the pods it deleted on their own nodes, so the workloads keep their replicas
+	created := 0
+	defer func() {
+		if err != nil && cancelled(ctx) {
+			as.restoreSwap(context.WithoutCancel(ctx), t, created)
+		}
+	}()
+
+	lh.V(2).Info("deleting x and y pods", "nodeX", nodeX, "nodeY", nodeY)
+	// deletes of pods of the same workload are serialized by the workload lock
 	for _, pod := range pods {
-		as.DeleteHandler(pod.toDeleteArgs())
+		if _, err := as.DeleteHandler(ctx, pod.toDeleteArgs()); err != nil {
+			lh.Error(err, "error deleting pod", "pod", klog.KRef(pod.Namespace, pod.Name))
+			return err
+		}
 	}
 
-	log.Printf("waiting for 1 X pod to be deleted and %d Y pods to be deleted\n", len(args.Y))
+	observeSwapPhase(span, swapPhaseDelete, &phaseStart)
+
+	lh.V(2).Info("waiting for 1 X pod and the Y pods to be deleted", "yCount", len(args.Y))
 
-	timeout := time.Minute * 5
-	timer := time.NewTimer(timeout)
+	timeouts := as.timeouts(ctx)
+	timer := time.NewTimer(timeouts.SwapDeletes)
+	defer timer.Stop()
 
 	// once the delete target is met, it is removed from the map
 	// wait until all targets have been met or timeout is reached (deleting a pod could take a long time...)
 	for len(targetScales) > 0 {
+		lh.V(3).Info("waiting for deletes", "workloadsLeft", len(targetScales))
+
 		select {
 		case <-timer.C:
-			log.Println("waiting for deletes exceeded timeout")
-			return
-		default:
-			log.Printf("waiting for deletes: %d left\n", len(targetScales))
-			time.Sleep(30 * time.Second)
-
+			lh.Info("waiting for deletes exceeded timeout")
+			return fmt.Errorf("waiting for deletes exceeded timeout")
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for deletes: %w", ctx.Err())
+		case <-time.After(timeouts.SwapPollInterval):
 			for key := range targetScales {
 				targetScale := targetScales[key]
 				selector := selectors[key]
@@ -155,47 +242,118 @@ func (as *ActionService) SwapHandler(args *SwapArgs) {
 				// does not include pods that are terminating
 				//currentScale, err := as.k8sClient.AppsV1().
 				//	Deployments(key.Namespace).
-				//	GetScale(context.TODO(), key.DeploymentName, metav1.GetOptions{})
+				//	GetScale(ctx, key.DeploymentName, metav1.GetOptions{})
 				//if err != nil {
-				//	log.Printf("error getting deployment's current scale: %v\n", err)
+				//	lh.Error(err, "error getting deployment's current scale")
 				//	return
 				//}
 
-				podList, err := as.k8sClient.CoreV1().Pods(key.Namespace).List(context.TODO(), metav1.ListOptions{
-					LabelSelector: metav1.FormatLabelSelector(&metav1.LabelSelector{MatchLabels: selector}),
+				podList, err := retryValue(ctx, as, func(ctx context.Context) (*corev1.PodList, error) {
+					return as.k8sClient.CoreV1().Pods(key.Namespace).List(ctx, metav1.ListOptions{
+						LabelSelector: metav1.FormatLabelSelector(&metav1.LabelSelector{MatchLabels: selector}),
+					})
 				})
 				if err != nil {
-					panic(err.Error())
+					lh.Error(err, "error listing pods of deployment", "workload", klog.KRef(key.Namespace, key.DeploymentName))
+					return err
 				}
 				currentScale := len(podList.Items) // including terminating pods
 
 				if int32(currentScale) <= targetScale {
 					delete(targetScales, key)
-					log.Printf("deployment %s in namespace %s reached target scale %d\n", key.DeploymentName, key.Namespace, targetScale)
+					lh.V(2).Info("deployment reached target scale", "workload", klog.KRef(key.Namespace, key.DeploymentName), "replicas", targetScale)
 				}
 			}
 		}
 	}
 
-	log.Printf("all deletes have completed")
-	log.Printf("continuing with creates")
+	observeSwapPhase(span, swapPhaseWaitDeleted, &phaseStart)
+
+	lh.V(2).Info("all deletes have completed, continuing with creates")
 
-	// here, calling create for pods of the same workload is UNSAFE! since there is no locking mechanism (yet)
-	// for prototype purposes we hence call creates sequentially
+	// creates of pods of the same workload are serialized by the workload lock
 	for _, createArg := range createArgs {
-		_, _ = as.CreateHandler(createArg)
+		suggestion, err := as.CreateHandler(ctx, createArg)
+		if err != nil {
+			lh.Error(err, "error creating a replica", "workload", klog.KRef(createArg.Workload.Namespace, createArg.Workload.Name))
+			return err
+		}
+		// the creates restore the replicas the swap removed, a cancel does not roll them back
+		as.journalSettle(ctx, suggestion)
+		created++
 	}
 
-	log.Println("swap action successful")
+	observeSwapPhase(span, swapPhaseCreate, &phaseStart)
+
+	lh.Info("swap action successful")
+
+	return nil
+}
+
+// restoreSwap re-creates the pods of a cancelled swap on the nodes they ran on, until the workloads are back at the
+// replicas they had before the swap. The first created pods were re-created on the other node already.
+func (as *ActionService) restoreSwap(ctx context.Context, t *swapTargets, created int) {
+	lh := klog.FromContext(ctx)
+
+	for key, desired := range t.desiredScales {
+		workloadLh := lh.WithValues("workload", klog.KRef(key.Namespace, key.DeploymentName))
+
+		scale, err := as.k8sClient.AppsV1().Deployments(key.Namespace).GetScale(ctx, key.DeploymentName, metav1.GetOptions{})
+		if err != nil {
+			workloadLh.Error(err, "error getting scale of cancelled swap")
+			continue
+		}
+
+		missing := desired - scale.Spec.Replicas
+		for i := created; i < len(t.createArgs) && missing > 0; i++ {
+			workload := t.createArgs[i].Workload
+			if workload.Namespace != key.Namespace || workload.Name != key.DeploymentName {
+				continue
+			}
+			// X ran on the node of X, the Y pods on the node of the Y pods
+			node := t.nodeY
+			if i == 0 {
+				node = t.nodeX
+			}
+
+			suggestion, err := as.CreateHandler(ctx, &CreateArgs{Workload: workload, Node: Node{node, workload.Cluster}})
+			if err != nil {
+				workloadLh.Error(err, "error re-creating pod of cancelled swap", "node", node)
+				break
+			}
+			as.journalSettle(ctx, suggestion)
+			missing--
+			workloadLh.V(2).Info("re-created pod of cancelled swap", "node", node)
+		}
+	}
+}
+
+const (
+	swapPhaseResolve     = "resolve"
+	swapPhaseDelete      = "delete"
+	swapPhaseWaitDeleted = "wait_deleted"
+	swapPhaseCreate      = "create"
+)
+
+// observeSwapPhase records the duration of a finished swap phase and resets start for the next one.
+func observeSwapPhase(span trace.Span, phase string, start *time.Time) {
+	metrics.SwapPhaseDuration.WithLabelValues(phase).Observe(time.Since(*start).Seconds())
+	span.AddEvent("swap phase completed", trace.WithAttributes(attribute.String("wam.phase", phase)))
+	*start = time.Now()
 }
 
 type SwapArgs struct {
 	X Pod   `json:"x"`
 	Y []Pod `json:"y"`
+	ActionOptions
 }
 
 type SwapReply struct {
-	Message string `json:"message"`
+	Message  string `json:"message"`
+	ActionID string `json:"actionId"`
+	// Status of the action, for a repeated idempotency key that of the original action
+	Status string `json:"status,omitempty"`
+	Plan   *Plan  `json:"plan,omitempty"`
 }
 
 func validateSwapReq(args *SwapArgs) error {
@@ -208,7 +366,7 @@ func validateSwapReq(args *SwapArgs) error {
 	}
 
 	for i := range args.Y {
-		pod := args.Y[i]
+		pod := &args.Y[i]
 		if pod.Namespace == "" {
 			pod.Namespace = "default"
 		}
@@ -216,6 +374,10 @@ func validateSwapReq(args *SwapArgs) error {
 		if pod.Name == "" {
 			return fmt.Errorf("y pod's, at index %d, name must be specified", i)
 		}
+
+		if pod.Cluster != args.X.Cluster {
+			return fmt.Errorf("y pod, at index %d, must be in the cluster of the x pod", i)
+		}
 	}
 
 	return nil
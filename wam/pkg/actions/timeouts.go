@@ -0,0 +1,91 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+// Timeouts override the configured timeouts for a single action in seconds, unset ones keep the configured value.
+type Timeouts struct {
+	// ReadySeconds bounds how long a create, move or relocation waits for the new pod to become ready
+	ReadySeconds int `json:"readySeconds,omitempty"`
+	// ReadinessGatesSeconds bounds how long a move waits for the new pod to pass its readiness gates
+	ReadinessGatesSeconds int `json:"readinessGatesSeconds,omitempty"`
+	// DeleteVerifySeconds bounds how long a delete waits for the controller to remove a pod before deleting it directly
+	DeleteVerifySeconds int `json:"deleteVerifySeconds,omitempty"`
+	// SwapDeletesSeconds bounds how long a swap waits for its pods to be deleted, checking every SwapPollSeconds
+	SwapDeletesSeconds int `json:"swapDeletesSeconds,omitempty"`
+	SwapPollSeconds    int `json:"swapPollSeconds,omitempty"`
+	// ConvergenceSeconds bounds how long a scale to placement waits for the layout to match the placement
+	ConvergenceSeconds int `json:"convergenceSeconds,omitempty"`
+	// LockSeconds bounds how long the action waits for the lock of a workload
+	LockSeconds int `json:"lockSeconds,omitempty"`
+}
+
+func validateTimeouts(timeouts *Timeouts) error {
+	if timeouts == nil {
+		return nil
+	}
+
+	for _, seconds := range []int{timeouts.ReadySeconds, timeouts.ReadinessGatesSeconds, timeouts.DeleteVerifySeconds,
+		timeouts.SwapDeletesSeconds, timeouts.SwapPollSeconds, timeouts.ConvergenceSeconds, timeouts.LockSeconds} {
+		if seconds < 0 {
+			return fmt.Errorf("timeouts must not be negative")
+		}
+	}
+
+	return nil
+}
+
+func (t *Timeouts) config() wamconfig.Timeouts {
+	if t == nil {
+		return wamconfig.Timeouts{}
+	}
+	seconds := func(s int) time.Duration { return time.Duration(s) * time.Second }
+	return wamconfig.Timeouts{
+		Ready:            seconds(t.ReadySeconds),
+		ReadinessGates:   seconds(t.ReadinessGatesSeconds),
+		DeleteVerify:     seconds(t.DeleteVerifySeconds),
+		SwapDeletes:      seconds(t.SwapDeletesSeconds),
+		SwapPollInterval: seconds(t.SwapPollSeconds),
+		Convergence:      seconds(t.ConvergenceSeconds),
+		Lock:             seconds(t.LockSeconds),
+	}
+}
+
+type overridesKey struct{}
+
+// overrides are the timeouts and retry policy of an action, the configured ones overridden by its request
+type overrides struct {
+	timeouts wamconfig.Timeouts
+	retry    wamconfig.Retry
+}
+
+// withOverrides returns ctx carrying the configured timeouts and retry policy overridden by those of the request, which
+// are capped at the configured limits.
+func (as *ActionService) withOverrides(ctx context.Context, timeouts *Timeouts, retry *RetryPolicy) context.Context {
+	return context.WithValue(ctx, overridesKey{}, &overrides{
+		timeouts: as.config.Timeouts.Override(timeouts.config().Limit(as.config.Timeouts.Max)),
+		retry:    as.config.Retry.Override(retry.config().Limit(as.config.Retry.MaxAttemptsLimit, as.config.Retry.CapLimit)),
+	})
+}
+
+// timeouts returns the timeouts of the action of ctx, the configured ones for calls without an action, e.g. by the
+// reconciler.
+func (as *ActionService) timeouts(ctx context.Context) wamconfig.Timeouts {
+	if o, ok := ctx.Value(overridesKey{}).(*overrides); ok {
+		return o.timeouts
+	}
+	return as.config.Timeouts
+}
+
+// retryPolicy returns the retry policy of the action of ctx, the configured one for calls without an action.
+func (as *ActionService) retryPolicy(ctx context.Context) wamconfig.Retry {
+	if o, ok := ctx.Value(overridesKey{}).(*overrides); ok {
+		return o.retry
+	}
+	return as.config.Retry
+}
@@ -0,0 +1,67 @@
+package actions
+
+import (
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// readyWaiters notifies the actions waiting for the pods of their scheduling suggestions to become ready. It is fed by
+// the pod informer, so all actions share one watch.
+type readyWaiters struct {
+	mu sync.Mutex
+	// waiters maps suggestion IDs to the channel receiving the pod placed by the suggestion once it is ready
+	waiters map[string]chan *corev1.Pod
+}
+
+func newReadyWaiters() *readyWaiters {
+	return &readyWaiters{waiters: map[string]chan *corev1.Pod{}}
+}
+
+// add registers a waiter for the suggestion. The returned channel receives the ready pod exactly once.
+func (rw *readyWaiters) add(id string) <-chan *corev1.Pod {
+	ready := make(chan *corev1.Pod, 1)
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.waiters[id] = ready
+	return ready
+}
+
+// remove unregisters the waiter for the suggestion, if it has not been notified yet.
+func (rw *readyWaiters) remove(id string) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	delete(rw.waiters, id)
+}
+
+// notify passes the pod to the waiter for its suggestion if the pod is ready. The waiter is unregistered, so further
+// updates of the pod are ignored.
+func (rw *readyWaiters) notify(obj any) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.DeletionTimestamp != nil || !isPodReady(pod) {
+		return
+	}
+	id, ok := pod.Annotations[suggestionIDAnnotation]
+	if !ok {
+		return
+	}
+
+	rw.mu.Lock()
+	ready, ok := rw.waiters[id]
+	delete(rw.waiters, id)
+	rw.mu.Unlock()
+
+	if ok {
+		ready <- pod
+	}
+}
+
+// handler returns the informer event handler feeding the waiters.
+func (rw *readyWaiters) handler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    rw.notify,
+		UpdateFunc: func(_, obj any) { rw.notify(obj) },
+	}
+}
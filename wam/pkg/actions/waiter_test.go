@@ -0,0 +1,117 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+func suggestedPod(name, id string, ready bool) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        name,
+			Annotations: map[string]string{suggestionIDAnnotation: id},
+		},
+	}
+	if ready {
+		pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	}
+	return pod
+}
+
+func TestReadyWaitersNotifyOnce(t *testing.T) {
+	rw := newReadyWaiters()
+	ready := rw.add("s-1")
+
+	rw.notify(suggestedPod("a-0", "s-1", false))
+	rw.notify(suggestedPod("b-0", "s-2", true))
+	select {
+	case pod := <-ready:
+		t.Fatalf("unexpected notification for %s", pod.Name)
+	default:
+	}
+
+	// repeated updates of the ready pod notify the waiter once
+	for range 3 {
+		rw.notify(suggestedPod("a-0", "s-1", true))
+	}
+	if pod := <-ready; pod.Name != "a-0" {
+		t.Errorf("expected pod a-0, got %s", pod.Name)
+	}
+	select {
+	case <-ready:
+		t.Error("waiter notified twice")
+	default:
+	}
+	if len(rw.waiters) != 0 {
+		t.Errorf("expected no waiters, got %d", len(rw.waiters))
+	}
+}
+
+func TestWaitToBeReady(t *testing.T) {
+	client := fake.NewSimpleClientset(suggestedPod("early", "s-early", true))
+	as := NewActionService(client, nil, wamconfig.Actions{}, nil, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer as.cancel()
+	if err := as.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pod became ready before the action started waiting
+	_, err := as.waitToBeReady(ctx, actionCreate, "default", &SchedulingSuggestion{ID: "s-early"}, time.Second)
+	if err != nil {
+		t.Errorf("expected the ready pod in the cache to be found, got %v", err)
+	}
+
+	// many actions share the informer
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := types.UID(fmt.Sprintf("s-%d", i))
+			_, errs[i] = as.waitToBeReady(ctx, actionCreate, "default", &SchedulingSuggestion{ID: id}, 10*time.Second)
+		}()
+	}
+	for i := range errs {
+		pod, err := client.CoreV1().Pods("default").Create(ctx, suggestedPod(fmt.Sprintf("p-%d", i), fmt.Sprintf("s-%d", i), false), metav1.CreateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+		if _, err := client.CoreV1().Pods("default").UpdateStatus(ctx, pod, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("waiter %d: %v", i, err)
+		}
+	}
+
+	// a cancelled action stops waiting
+	cancelled, cancelWait := context.WithCancel(ctx)
+	cancelWait()
+	_, err = as.waitToBeReady(cancelled, actionCreate, "default", &SchedulingSuggestion{ID: "s-never"}, time.Minute)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if len(as.waiters.waiters) != 0 {
+		t.Errorf("expected no waiters left, got %d", len(as.waiters.waiters))
+	}
+}
@@ -0,0 +1,192 @@
+// Package audit keeps an immutable history of the actions WAM executed, for post-incident analysis.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	clientset "k8s.io/client-go/kubernetes"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+// names of the sinks
+const (
+	SinkRedis  = "redis"
+	SinkFile   = "file"
+	SinkEvents = "events"
+)
+
+// types of the events of an action
+const (
+	EventScale        = "scale"
+	EventSuggestion   = "suggestion"
+	EventPodCreated   = "pod-created"
+	EventPodDeleted   = "pod-deleted"
+	EventPodEvicted   = "pod-evicted"
+	EventNodeCordoned = "node-cordoned"
+)
+
+// Record is the history of a single action.
+type Record struct {
+	ActionID string `json:"actionId"`
+	Action   string `json:"action"`
+	// Caller is the authenticated user that requested the action, empty if authentication is disabled
+	Caller string          `json:"caller,omitempty"`
+	Args   json.RawMessage `json:"args,omitempty"`
+	Status string          `json:"status"`
+	Error  string          `json:"error,omitempty"`
+	// TraceID links the record to the trace of the action
+	TraceID string    `json:"traceId,omitempty"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	// Events are the changes the action made to the cluster, in order
+	Events []Event `json:"events,omitempty"`
+	// Workloads and Nodes are those the events touched, as namespace/name and name
+	Workloads []string `json:"workloads,omitempty"`
+	Nodes     []string `json:"nodes,omitempty"`
+}
+
+// Event is a single change an action made to the cluster.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Workload and Pod are given as namespace/name
+	Workload     string    `json:"workload,omitempty"`
+	Pod          string    `json:"pod,omitempty"`
+	Node         string    `json:"node,omitempty"`
+	SuggestionID string    `json:"suggestionId,omitempty"`
+	Replicas     *Replicas `json:"replicas,omitempty"`
+}
+
+// Replicas is the change of a scale event.
+type Replicas struct {
+	From int32 `json:"from"`
+	To   int32 `json:"to"`
+}
+
+// Index sets the workloads and nodes of the record from its events.
+func (r *Record) Index() {
+	r.Workloads, r.Nodes = nil, nil
+	for _, event := range r.Events {
+		if event.Workload != "" && !slices.Contains(r.Workloads, event.Workload) {
+			r.Workloads = append(r.Workloads, event.Workload)
+		}
+		if event.Node != "" && !slices.Contains(r.Nodes, event.Node) {
+			r.Nodes = append(r.Nodes, event.Node)
+		}
+	}
+	slices.Sort(r.Workloads)
+	slices.Sort(r.Nodes)
+}
+
+// Filter selects records, zero values match all records.
+type Filter struct {
+	// Workload as namespace/name
+	Workload string
+	Node     string
+	Caller   string
+	// Since and Until select the records of the actions running at some point in between
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of records returned, the newest first
+	Limit int
+}
+
+func (f *Filter) Matches(r *Record) bool {
+	if f.Workload != "" && !slices.Contains(r.Workloads, f.Workload) {
+		return false
+	}
+	if f.Node != "" && !slices.Contains(r.Nodes, f.Node) {
+		return false
+	}
+	if f.Caller != "" && r.Caller != f.Caller {
+		return false
+	}
+	if !f.Since.IsZero() && r.End.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && r.Start.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Sink persists records and queries them.
+type Sink interface {
+	Write(ctx context.Context, record *Record) error
+	// Query returns the records matching the filter, the newest first.
+	Query(ctx context.Context, filter Filter) ([]Record, error)
+}
+
+// New returns the sink selected by the config, nil if the audit log is disabled.
+func New(config wamconfig.Audit, rdb *redis.Client, k8sClient clientset.Interface) (Sink, error) {
+	switch config.Sink {
+	case "":
+		return nil, nil
+	case SinkRedis:
+		return NewRedisSink(rdb, config.MaxLen), nil
+	case SinkFile:
+		return NewFileSink(config.File), nil
+	case SinkEvents:
+		return NewEventSink(k8sClient, config.Namespace), nil
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q, expected %s, %s or %s", config.Sink, SinkRedis, SinkFile, SinkEvents)
+	}
+}
+
+type recorderKey struct{}
+
+// recorder collects the events of an action.
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// WithRecorder returns a context collecting the events added with it, see Add and Events.
+func WithRecorder(ctx context.Context) context.Context {
+	return context.WithValue(ctx, recorderKey{}, &recorder{})
+}
+
+// Add records the event for the action of ctx, if it has a recorder.
+func Add(ctx context.Context, event Event) {
+	r, ok := ctx.Value(recorderKey{}).(*recorder)
+	if !ok {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+// Events returns the events recorded for the action of ctx.
+func Events(ctx context.Context) []Event {
+	r, ok := ctx.Value(recorderKey{}).(*recorder)
+	if !ok {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.events)
+}
+
+// newest sorts the records by end, the newest first, and keeps up to limit of them.
+func newest(records []Record, limit int) []Record {
+	slices.SortStableFunc(records, func(a, b Record) int {
+		return b.End.Compare(a.End)
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records
+}
@@ -0,0 +1,126 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var t0 = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+func testRecords() []*Record {
+	records := []*Record{
+		{
+			ActionID: "1", Action: "move", Caller: "alice", Status: "succeeded",
+			Start: t0, End: t0.Add(time.Minute),
+			Events: []Event{
+				{Type: EventSuggestion, Workload: "default/a", Node: "node-2"},
+				{Type: EventScale, Workload: "default/a", Replicas: &Replicas{From: 2, To: 3}},
+				{Type: EventPodCreated, Pod: "default/a-2", Node: "node-2"},
+				{Type: EventPodDeleted, Workload: "default/a", Pod: "default/a-0", Node: "node-1"},
+			},
+		},
+		{
+			ActionID: "2", Action: "drain", Caller: "bob", Status: "failed", Error: "boom",
+			Start: t0.Add(2 * time.Minute), End: t0.Add(5 * time.Minute),
+			Events: []Event{{Type: EventNodeCordoned, Node: "node-3"}},
+		},
+		{
+			ActionID: "3", Action: "create", Caller: "alice", Status: "succeeded",
+			Start: t0.Add(10 * time.Minute), End: t0.Add(11 * time.Minute),
+			Events: []Event{{Type: EventSuggestion, Workload: "default/b", Node: "node-3"}},
+		},
+	}
+	for _, record := range records {
+		record.Index()
+	}
+	return records
+}
+
+func ids(records []Record) []string {
+	var ids []string
+	for _, record := range records {
+		ids = append(ids, record.ActionID)
+	}
+	return ids
+}
+
+func TestIndex(t *testing.T) {
+	record := testRecords()[0]
+	if !reflect.DeepEqual(record.Workloads, []string{"default/a"}) {
+		t.Errorf("unexpected workloads %v", record.Workloads)
+	}
+	if !reflect.DeepEqual(record.Nodes, []string{"node-1", "node-2"}) {
+		t.Errorf("unexpected nodes %v", record.Nodes)
+	}
+}
+
+func testQueries(t *testing.T, sink Sink) {
+	t.Helper()
+	ctx := context.Background()
+
+	for _, record := range testRecords() {
+		if err := sink.Write(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"all", Filter{}, []string{"3", "2", "1"}},
+		{"limit", Filter{Limit: 2}, []string{"3", "2"}},
+		{"workload", Filter{Workload: "default/a"}, []string{"1"}},
+		{"node", Filter{Node: "node-3"}, []string{"3", "2"}},
+		{"caller", Filter{Caller: "alice"}, []string{"3", "1"}},
+		{"time range", Filter{Since: t0.Add(4 * time.Minute), Until: t0.Add(9 * time.Minute)}, []string{"2"}},
+		{"no match", Filter{Caller: "carol"}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			records, err := sink.Query(ctx, tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(records); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected records %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	sink := NewFileSink(filepath.Join(t.TempDir(), "audit", "audit.jsonl"))
+
+	records, err := sink.Query(context.Background(), Filter{})
+	if err != nil || len(records) != 0 {
+		t.Fatalf("expected no records before the first write, got %v, %v", records, err)
+	}
+
+	testQueries(t, sink)
+}
+
+func TestEventSink(t *testing.T) {
+	testQueries(t, NewEventSink(fake.NewSimpleClientset(), "wam"))
+}
+
+func TestRecorder(t *testing.T) {
+	Add(context.Background(), Event{Type: EventScale})
+
+	ctx := WithRecorder(context.Background())
+	Add(ctx, Event{Type: EventScale, Workload: "default/a"})
+	Add(ctx, Event{Type: EventPodDeleted, Pod: "default/a-0"})
+
+	events := Events(ctx)
+	if len(events) != 2 || events[0].Type != EventScale || events[1].Type != EventPodDeleted {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if events[0].Time.IsZero() {
+		t.Error("expected the event time to be set")
+	}
+}
@@ -0,0 +1,102 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+)
+
+const (
+	// auditLabel marks the Events holding audit records
+	auditLabel = "wam.aces-eu/audit"
+	// recordAnnotation holds the record of an Event as JSON
+	recordAnnotation = "wam.aces-eu/audit-record"
+	// component is the source of the Events
+	component = "wam"
+)
+
+// eventSink creates a Kubernetes Event per record in WAM's namespace, involving the WAM pod that ran the action. The
+// API server keeps Events for an hour by default, so the sink suits forwarding records, e.g. with an event
+// exporter, rather than keeping them.
+type eventSink struct {
+	k8sClient clientset.Interface
+	namespace string
+	// pod is the name of the WAM pod, its hostname
+	pod string
+}
+
+func NewEventSink(k8sClient clientset.Interface, namespace string) Sink {
+	pod, _ := os.Hostname()
+	return &eventSink{k8sClient: k8sClient, namespace: namespace, pod: pod}
+}
+
+func (s *eventSink) Write(ctx context.Context, record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	reason, eventType := "ActionSucceeded", v1.EventTypeNormal
+	if record.Error != "" {
+		reason, eventType = "ActionFailed", v1.EventTypeWarning
+	}
+	message := fmt.Sprintf("%s action %s %s", record.Action, record.ActionID, record.Status)
+	if record.Caller != "" {
+		message += " for " + record.Caller
+	}
+	if record.Error != "" {
+		message += ": " + record.Error
+	}
+
+	_, err = s.k8sClient.CoreV1().Events(s.namespace).Create(ctx, &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   s.namespace,
+			Name:        "wam-audit-" + record.ActionID,
+			Labels:      map[string]string{auditLabel: "true"},
+			Annotations: map[string]string{recordAnnotation: string(data)},
+		},
+		InvolvedObject: v1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  s.namespace,
+			Name:       s.pod,
+		},
+		Reason:              reason,
+		Message:             message,
+		Type:                eventType,
+		Source:              v1.EventSource{Component: component},
+		ReportingController: component,
+		ReportingInstance:   s.pod,
+		FirstTimestamp:      metav1.NewTime(record.End),
+		LastTimestamp:       metav1.NewTime(record.End),
+		Count:               1,
+	}, metav1.CreateOptions{})
+	return err
+}
+
+func (s *eventSink) Query(ctx context.Context, filter Filter) ([]Record, error) {
+	events, err := s.k8sClient.CoreV1().Events(s.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: auditLabel + "=true",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, event := range events.Items {
+		var record Record
+		if err := json.Unmarshal([]byte(event.Annotations[recordAnnotation]), &record); err != nil {
+			return nil, fmt.Errorf("error decoding audit record of event %s: %w", event.Name, err)
+		}
+		if filter.Matches(&record) {
+			records = append(records, record)
+		}
+	}
+
+	return newest(records, filter.Limit), nil
+}
@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// streamKey is the Redis stream holding the records
+	streamKey = "wam:audit"
+	// queryBatch is the number of records read from the stream at once
+	queryBatch = 500
+)
+
+// redisSink appends records to a Redis stream shared by all WAM replicas. The stream is trimmed to about maxLen
+// records.
+type redisSink struct {
+	rdb    *redis.Client
+	maxLen int64
+}
+
+func NewRedisSink(rdb *redis.Client, maxLen int64) Sink {
+	return &redisSink{rdb: rdb, maxLen: maxLen}
+}
+
+func (s *redisSink) Write(ctx context.Context, record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return s.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamKey,
+		MaxLen: s.maxLen,
+		Approx: true,
+		Values: map[string]any{"record": data},
+	}).Err()
+}
+
+// Query reads the stream backwards from its end. Entries are added when an action ends, so the stream is not read
+// beyond the entries added before since.
+func (s *redisSink) Query(ctx context.Context, filter Filter) ([]Record, error) {
+	stop := "-"
+	if !filter.Since.IsZero() {
+		stop = strconv.FormatInt(filter.Since.UnixMilli(), 10)
+	}
+
+	var records []Record
+	start := "+"
+	for filter.Limit <= 0 || len(records) < filter.Limit {
+		messages, err := s.rdb.XRevRangeN(ctx, streamKey, start, stop, queryBatch).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, message := range messages {
+			data, ok := message.Values["record"].(string)
+			if !ok {
+				continue
+			}
+			var record Record
+			if err := json.Unmarshal([]byte(data), &record); err != nil {
+				return nil, fmt.Errorf("error decoding audit record %s: %w", message.ID, err)
+			}
+			if filter.Matches(&record) {
+				records = append(records, record)
+			}
+		}
+
+		if len(messages) < queryBatch {
+			break
+		}
+		// continue before the oldest entry read
+		start = "(" + messages[len(messages)-1].ID
+	}
+
+	return newest(records, filter.Limit), nil
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Group and Resource form the synthetic resource actions are authorized against, e.g. a caller needs the verb
+	// move on workloadactions.wam.aces-eu.io in a namespace to move pods in it.
+	Group    = "wam.aces-eu.io"
+	Resource = "workloadactions"
+
+	// tokenCacheTTL bounds how long a token stays authenticated without asking the API server again.
+	tokenCacheTTL = 30 * time.Second
+)
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden       = errors.New("forbidden")
+)
+
+// User is the authenticated caller of the action API.
+type User struct {
+	Name   string
+	UID    string
+	Groups []string
+	Extra  map[string][]string
+}
+
+type userKey struct{}
+
+// WithUser returns ctx carrying the authenticated user.
+func WithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFrom returns the authenticated user stored in ctx by the Authenticator, if any.
+func UserFrom(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userKey{}).(*User)
+	return user, ok
+}
+
+type cachedUser struct {
+	user    *User
+	expires time.Time
+}
+
+// Authenticator identifies callers by a verified TLS client certificate or, if there is none, by a ServiceAccount
+// bearer token which is checked with a TokenReview.
+type Authenticator struct {
+	client    kubernetes.Interface
+	audiences []string
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]cachedUser
+}
+
+func NewAuthenticator(client kubernetes.Interface, audiences []string) *Authenticator {
+	return &Authenticator{
+		client:    client,
+		audiences: audiences,
+		cache:     map[[sha256.Size]byte]cachedUser{},
+	}
+}
+
+// Middleware rejects unauthenticated requests with 401 and passes the user of the others to next in the request
+// context.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.Authenticate(r)
+		if err != nil {
+			klog.FromContext(r.Context()).V(2).Info("rejecting unauthenticated request", "remoteAddr", r.RemoteAddr, "err", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="wam"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+	})
+}
+
+// Authenticate returns the user making the request.
+func (a *Authenticator) Authenticate(r *http.Request) (*User, error) {
+	// the TLS config only verifies certificates signed by the client CA, see ServerTLSConfig
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		return &User{
+			Name:   cert.Subject.CommonName,
+			Groups: cert.Subject.Organization,
+		}, nil
+	}
+
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, fmt.Errorf("%w: no client certificate or bearer token", ErrUnauthenticated)
+	}
+
+	return a.reviewToken(r.Context(), token)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func (a *Authenticator) reviewToken(ctx context.Context, token string) (*User, error) {
+	key := sha256.Sum256([]byte(token))
+
+	a.mu.Lock()
+	cached, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.user, nil
+	}
+
+	review, err := a.client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: a.audiences,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error reviewing token: %w", err)
+	}
+
+	if !review.Status.Authenticated {
+		return nil, fmt.Errorf("%w: %s", ErrUnauthenticated, review.Status.Error)
+	}
+
+	user := &User{
+		Name:   review.Status.User.Username,
+		UID:    review.Status.User.UID,
+		Groups: review.Status.User.Groups,
+		Extra:  map[string][]string{},
+	}
+	for k, v := range review.Status.User.Extra {
+		user.Extra[k] = v
+	}
+
+	a.mu.Lock()
+	now := time.Now()
+	for k, c := range a.cache {
+		if now.After(c.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = cachedUser{user: user, expires: now.Add(tokenCacheTTL)}
+	a.mu.Unlock()
+
+	return user, nil
+}
+
+// Authorizer decides with SubjectAccessReviews whether a user may run an action in a namespace, so RBAC rules on
+// the synthetic workloadactions resource control which agent may act on which namespace.
+type Authorizer struct {
+	client kubernetes.Interface
+}
+
+func NewAuthorizer(client kubernetes.Interface) *Authorizer {
+	return &Authorizer{client: client}
+}
+
+// Authorize returns an error wrapping ErrForbidden if the user in ctx may not use the verb in the namespace.
+func (a *Authorizer) Authorize(ctx context.Context, verb string, namespace string) error {
+	user, ok := UserFrom(ctx)
+	if !ok {
+		return fmt.Errorf("%w: no authenticated user", ErrForbidden)
+	}
+
+	extra := map[string]authorizationv1.ExtraValue{}
+	for k, v := range user.Extra {
+		extra[k] = v
+	}
+
+	review, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     Group,
+				Resource:  Resource,
+			},
+			User:   user.Name,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("error reviewing access: %w", err)
+	}
+
+	if !review.Status.Allowed {
+		return fmt.Errorf("%w: user %q cannot %s %s.%s in namespace %q", ErrForbidden, user.Name, verb, Resource, Group, namespace)
+	}
+
+	return nil
+}
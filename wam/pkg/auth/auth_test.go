@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const agentToken = "agent-token"
+
+// newFakeClient authenticates agentToken as the agent ServiceAccount, which may only move pods in namespace apps.
+func newFakeClient() *fake.Clientset {
+	client := fake.NewSimpleClientset()
+
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == agentToken {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: "system:serviceaccount:aiops:agent"}
+		}
+		return true, review, nil
+	})
+
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = review.Spec.User == "system:serviceaccount:aiops:agent" &&
+			attrs.Group == Group && attrs.Resource == Resource &&
+			attrs.Verb == "move" && attrs.Namespace == "apps"
+		return true, review, nil
+	})
+
+	return client
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{
+			name:       "no credentials",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "invalid token",
+			authorization: "Bearer other-token",
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "valid token",
+			authorization: "Bearer " + agentToken,
+			wantStatus:    http.StatusOK,
+		},
+	}
+
+	authenticator := NewAuthenticator(newFakeClient(), nil)
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := UserFrom(r.Context()); !ok {
+			t.Error("expected authenticated user in request context")
+		}
+	}))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/rpc", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	authorizer := NewAuthorizer(newFakeClient())
+	agent := WithUser(context.Background(), &User{Name: "system:serviceaccount:aiops:agent"})
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		verb      string
+		namespace string
+		wantErr   error
+	}{
+		{
+			name:      "allowed",
+			ctx:       agent,
+			verb:      "move",
+			namespace: "apps",
+		},
+		{
+			name:      "other namespace",
+			ctx:       agent,
+			verb:      "move",
+			namespace: "kube-system",
+			wantErr:   ErrForbidden,
+		},
+		{
+			name:      "other verb",
+			ctx:       agent,
+			verb:      "delete",
+			namespace: "apps",
+			wantErr:   ErrForbidden,
+		},
+		{
+			name:      "unauthenticated",
+			ctx:       context.Background(),
+			verb:      "move",
+			namespace: "apps",
+			wantErr:   ErrForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authorizer.Authorize(tt.ctx, tt.verb, tt.namespace)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
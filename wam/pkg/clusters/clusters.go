@@ -0,0 +1,86 @@
+// Package clusters loads the clients of the remote clusters WAM runs actions in besides its own cluster.
+package clusters
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// ClusterLabel labels the Secrets holding the kubeconfig of a remote cluster with the name of the cluster
+	ClusterLabel = "wam.aces-eu/cluster"
+	// kubeconfigKey is the key of the kubeconfig in the data of a Secret
+	kubeconfigKey = "kubeconfig"
+)
+
+// Load returns the clients of the remote clusters by name, read from the kubeconfig files of the configured directory
+// and the labelled Secrets of the configured namespace, which are read with k8sClient. A cluster found in both is
+// taken from its Secret.
+func Load(ctx context.Context, config wamconfig.Clusters, k8sClient clientset.Interface) (map[string]clientset.Interface, error) {
+	kubeconfigs := map[string][]byte{}
+
+	if config.KubeconfigDir != "" {
+		files, err := os.ReadDir(config.KubeconfigDir)
+		if err != nil {
+			return nil, fmt.Errorf("error reading kubeconfig directory: %w", err)
+		}
+		for _, file := range files {
+			// skips the hidden entries of mounted Secrets and ConfigMaps, e.g. ..data
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			kubeconfig, err := os.ReadFile(filepath.Join(config.KubeconfigDir, file.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("error reading kubeconfig of cluster %q: %w", file.Name(), err)
+			}
+			kubeconfigs[file.Name()] = kubeconfig
+		}
+	}
+
+	if config.SecretNamespace != "" {
+		secrets, err := k8sClient.CoreV1().Secrets(config.SecretNamespace).List(ctx, metav1.ListOptions{LabelSelector: ClusterLabel})
+		if err != nil {
+			return nil, fmt.Errorf("error listing cluster secrets: %w", err)
+		}
+		for _, secret := range secrets.Items {
+			kubeconfig, ok := secret.Data[kubeconfigKey]
+			if !ok {
+				return nil, fmt.Errorf("secret %s/%s has no %s key", secret.Namespace, secret.Name, kubeconfigKey)
+			}
+			kubeconfigs[secret.Labels[ClusterLabel]] = kubeconfig
+		}
+	}
+
+	clients := make(map[string]clientset.Interface, len(kubeconfigs))
+	for name, kubeconfig := range kubeconfigs {
+		if err := validateName(name); err != nil {
+			return nil, err
+		}
+		restConfig, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("error loading kubeconfig of cluster %q: %w", name, err)
+		}
+		client, err := clientset.NewForConfig(restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("error creating client of cluster %q: %w", name, err)
+		}
+		clients[name] = client
+	}
+	return clients, nil
+}
+
+// validateName rejects names that cannot prefix a suggestion queue, see actions.Workload.QueueName.
+func validateName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/:") {
+		return fmt.Errorf("invalid cluster name %q, it must be non-empty and not contain / or :", name)
+	}
+	return nil
+}
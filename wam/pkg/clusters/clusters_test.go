@@ -0,0 +1,76 @@
+package clusters
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+)
+
+const kubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: remote
+  cluster:
+    server: https://remote.example.com:6443
+contexts:
+- name: remote
+  context:
+    cluster: remote
+    user: wam
+current-context: remote
+users:
+- name: wam
+  user:
+    token: secret
+`
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "edge-1"), []byte(kubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// the hidden entries of a mounted Secret are skipped
+	if err := os.Mkdir(filepath.Join(dir, "..data"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".hidden"), []byte("invalid"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "wam", Name: "edge-2", Labels: map[string]string{ClusterLabel: "edge-2"}},
+			Data:       map[string][]byte{kubeconfigKey: []byte(kubeconfig)},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "wam", Name: "unrelated"},
+			Data:       map[string][]byte{"password": []byte("invalid")},
+		},
+	)
+
+	clients, err := Load(context.Background(), wamconfig.Clusters{KubeconfigDir: dir, SecretNamespace: "wam"}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 2 || clients["edge-1"] == nil || clients["edge-2"] == nil {
+		t.Errorf("expected clients of edge-1 and edge-2, got %v", clients)
+	}
+}
+
+func TestLoadInvalidName(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "edge:1"), []byte(kubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(context.Background(), wamconfig.Clusters{KubeconfigDir: dir}, fake.NewSimpleClientset()); err == nil {
+		t.Error("expected a cluster name with a colon to be rejected")
+	}
+}
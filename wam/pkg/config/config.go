@@ -3,6 +3,7 @@ package config
 import (
 	"bytes"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 	"gopkg.in/yaml.v2"
@@ -11,12 +12,30 @@ import (
 // env variable example: REDIS_PORT=1234
 
 type Config struct {
-	Server Server `mapstructure:"SERVER"`
-	Redis  Redis  `mapstructure:"REDIS"`
+	Server  Server  `mapstructure:"SERVER"`
+	Redis   Redis   `mapstructure:"REDIS"`
+	Tracing Tracing `mapstructure:"TRACING"`
+	Log     Log     `mapstructure:"LOG"`
+	Auth    Auth    `mapstructure:"AUTH"`
+	Policy  Policy  `mapstructure:"POLICY"`
+	Actions Actions `mapstructure:"ACTIONS"`
+	Audit   Audit   `mapstructure:"AUDIT"`
+	Leader  Leader  `mapstructure:"LEADER"`
+	// Reconciler is run by the replica elected leader
+	Reconciler Reconciler `mapstructure:"RECONCILER"`
+	// Scheduler is run by the replica elected leader
+	Scheduler Scheduler `mapstructure:"SCHEDULER"`
+	Clusters  Clusters  `mapstructure:"CLUSTERS"`
 }
 
 type Server struct {
 	Address string `mapstructure:"ADDRESS"`
+	// ShutdownGracePeriod is how long running actions may take to finish after SIGTERM before they are interrupted.
+	// The yaml tag keeps the key of the default in line with the SERVER_SHUTDOWN_GRACE_PERIOD env variable.
+	ShutdownGracePeriod time.Duration `mapstructure:"SHUTDOWN_GRACE_PERIOD" yaml:"SHUTDOWN_GRACE_PERIOD"`
+	// TLSCertFile and TLSKeyFile enable HTTPS if both are set.
+	TLSCertFile string `mapstructure:"TLS_CERT_FILE" yaml:"TLS_CERT_FILE"`
+	TLSKeyFile  string `mapstructure:"TLS_KEY_FILE" yaml:"TLS_KEY_FILE"`
 }
 
 type Redis struct {
@@ -25,8 +44,268 @@ type Redis struct {
 	Password string `mapstructure:"PASSWORD"`
 }
 
+type Tracing struct {
+	// Endpoint of the OTLP gRPC collector, e.g. otel-collector:4317. Tracing is disabled if empty.
+	Endpoint string `mapstructure:"ENDPOINT"`
+	// Insecure disables TLS towards the collector.
+	Insecure bool `mapstructure:"INSECURE"`
+}
+
+type Log struct {
+	// Verbosity enables log lines up to this V level, like the -v flag of Kubernetes components.
+	Verbosity int `mapstructure:"VERBOSITY"`
+}
+
+type Auth struct {
+	// Enabled requires callers of the action API to authenticate and authorizes every action with a
+	// SubjectAccessReview.
+	Enabled bool `mapstructure:"ENABLED"`
+	// Audiences the bearer tokens must be issued for, e.g. AUTH_AUDIENCES=wam,api. The API server's default if empty.
+	Audiences []string `mapstructure:"AUDIENCES"`
+	// ClientCAFile enables authentication with client certificates signed by this CA, it requires TLS.
+	ClientCAFile string `mapstructure:"CLIENT_CA_FILE" yaml:"CLIENT_CA_FILE"`
+}
+
+// Policy configures the guardrails every action is checked against, zero values disable a limit.
+type Policy struct {
+	// ProtectedNamespaces are never acted on, e.g. POLICY_PROTECTED_NAMESPACES=kube-system,monitoring.
+	ProtectedNamespaces []string `mapstructure:"PROTECTED_NAMESPACES" yaml:"PROTECTED_NAMESPACES"`
+	// ProtectedLabels protect pods and workloads carrying one of the labels, given as key or key=value.
+	ProtectedLabels []string `mapstructure:"PROTECTED_LABELS" yaml:"PROTECTED_LABELS"`
+	// RespectDisruptionBudgets rejects actions deleting more pods than their PodDisruptionBudgets allow.
+	RespectDisruptionBudgets bool `mapstructure:"RESPECT_DISRUPTION_BUDGETS" yaml:"RESPECT_DISRUPTION_BUDGETS"`
+	// MinReadyReplicas is the number of ready replicas an action may not take a workload below.
+	MinReadyReplicas int32 `mapstructure:"MIN_READY_REPLICAS" yaml:"MIN_READY_REPLICAS"`
+	// CallerActionsPerMinute limits the actions of a single caller.
+	CallerActionsPerMinute int `mapstructure:"CALLER_ACTIONS_PER_MINUTE" yaml:"CALLER_ACTIONS_PER_MINUTE"`
+	// WorkloadActionsPerMinute limits the actions on a single workload.
+	WorkloadActionsPerMinute int `mapstructure:"WORKLOAD_ACTIONS_PER_MINUTE" yaml:"WORKLOAD_ACTIONS_PER_MINUTE"`
+	// MaxConcurrentActionsPerNode limits the actions running on a single node across all replicas.
+	MaxConcurrentActionsPerNode int `mapstructure:"MAX_CONCURRENT_ACTIONS_PER_NODE" yaml:"MAX_CONCURRENT_ACTIONS_PER_NODE"`
+}
+
+type Actions struct {
+	// IdempotencyWindow is how long an idempotency key maps to the action it was first used for.
+	IdempotencyWindow time.Duration `mapstructure:"IDEMPOTENCY_WINDOW" yaml:"IDEMPOTENCY_WINDOW"`
+	// MaxConcurrentMoves caps the pods a single migration, drain or rebalance moves at the same time.
+	MaxConcurrentMoves int `mapstructure:"MAX_CONCURRENT_MOVES" yaml:"MAX_CONCURRENT_MOVES"`
+	// MaxConcurrentActions caps the actions, and the moves of migrations, drains and rebalances, a replica runs at the
+	// same time. Waiting ones are dispatched by priority. There is no cap if it is 0, then priorities have no effect.
+	MaxConcurrentActions int `mapstructure:"MAX_CONCURRENT_ACTIONS" yaml:"MAX_CONCURRENT_ACTIONS"`
+	// PrometheusURL is the base URL of the Prometheus API queried by prometheus readiness gates, e.g.
+	// http://prometheus.monitoring:9090.
+	PrometheusURL string `mapstructure:"PROMETHEUS_URL" yaml:"PROMETHEUS_URL"`
+	// Timeouts and Retry apply to all actions, a request may override them for its action.
+	Timeouts Timeouts `mapstructure:"TIMEOUTS"`
+	Retry    Retry    `mapstructure:"RETRY"`
+}
+
+// Timeouts bound the waits of the actions, e.g. ACTIONS_TIMEOUTS_READY=10m.
+type Timeouts struct {
+	// Ready bounds how long a create, move or relocation waits for the new pod to become ready.
+	Ready time.Duration `mapstructure:"READY"`
+	// ReadinessGates bounds how long a move waits for the new pod to pass its readiness gates.
+	ReadinessGates time.Duration `mapstructure:"READINESS_GATES" yaml:"READINESS_GATES"`
+	// DeleteVerify bounds how long a delete waits for the controller to remove a pod after the scale down, before it
+	// deletes the pod directly.
+	DeleteVerify time.Duration `mapstructure:"DELETE_VERIFY" yaml:"DELETE_VERIFY"`
+	// SwapDeletes bounds how long a swap waits for its pods to be deleted, checking every SwapPollInterval.
+	SwapDeletes      time.Duration `mapstructure:"SWAP_DELETES" yaml:"SWAP_DELETES"`
+	SwapPollInterval time.Duration `mapstructure:"SWAP_POLL_INTERVAL" yaml:"SWAP_POLL_INTERVAL"`
+	// Convergence bounds how long a scale to placement waits for the layout to match the placement.
+	Convergence time.Duration `mapstructure:"CONVERGENCE"`
+	// Lock bounds how long an action waits for the lock of a workload.
+	Lock time.Duration `mapstructure:"LOCK"`
+	// Max caps each of the timeouts a request sets for its action.
+	Max time.Duration `mapstructure:"MAX"`
+}
+
+// Override returns the timeouts with the non-zero ones of o taking precedence.
+func (t Timeouts) Override(o Timeouts) Timeouts {
+	override(&t.Ready, o.Ready)
+	override(&t.ReadinessGates, o.ReadinessGates)
+	override(&t.DeleteVerify, o.DeleteVerify)
+	override(&t.SwapDeletes, o.SwapDeletes)
+	override(&t.SwapPollInterval, o.SwapPollInterval)
+	override(&t.Convergence, o.Convergence)
+	override(&t.Lock, o.Lock)
+	override(&t.Max, o.Max)
+	return t
+}
+
+// Limit returns the timeouts capped at max, unless max is zero.
+func (t Timeouts) Limit(max time.Duration) Timeouts {
+	for _, timeout := range []*time.Duration{&t.Ready, &t.ReadinessGates, &t.DeleteVerify, &t.SwapDeletes,
+		&t.SwapPollInterval, &t.Convergence, &t.Lock} {
+		limit(timeout, max)
+	}
+	return t
+}
+
+// Retry is the policy failed Kubernetes API calls of the actions are retried by, with a backoff doubling from Base up
+// to Cap, e.g. ACTIONS_RETRY_ON=conflict,server-error.
+type Retry struct {
+	// MaxAttempts is the number of attempts of a call including the first one, 1 disables retries.
+	MaxAttempts int           `mapstructure:"MAX_ATTEMPTS" yaml:"MAX_ATTEMPTS"`
+	Base        time.Duration `mapstructure:"BASE"`
+	Cap         time.Duration `mapstructure:"CAP"`
+	// On are the classes of errors retried: conflict, server-error for 5xx responses, too-many-requests and timeout.
+	// Scale updates are retried on conflicts regardless, with at least 5 attempts even if MaxAttempts is lower.
+	On []string `mapstructure:"ON"`
+	// MaxAttemptsLimit and CapLimit cap the attempts and the backoff a request sets for its action.
+	MaxAttemptsLimit int           `mapstructure:"MAX_ATTEMPTS_LIMIT" yaml:"MAX_ATTEMPTS_LIMIT"`
+	CapLimit         time.Duration `mapstructure:"CAP_LIMIT" yaml:"CAP_LIMIT"`
+}
+
+// Override returns the policy with the non-zero fields of o taking precedence.
+func (r Retry) Override(o Retry) Retry {
+	override(&r.MaxAttempts, o.MaxAttempts)
+	override(&r.Base, o.Base)
+	override(&r.Cap, o.Cap)
+	if o.On != nil {
+		r.On = o.On
+	}
+	override(&r.MaxAttemptsLimit, o.MaxAttemptsLimit)
+	override(&r.CapLimit, o.CapLimit)
+	return r
+}
+
+// Limit returns the policy with its attempts capped at maxAttempts and its backoff at maxBackoff, unless they are zero.
+func (r Retry) Limit(maxAttempts int, maxBackoff time.Duration) Retry {
+	limit(&r.MaxAttempts, maxAttempts)
+	limit(&r.Base, maxBackoff)
+	limit(&r.Cap, maxBackoff)
+	return r
+}
+
+func override[T comparable](value *T, o T) {
+	var zero T
+	if o != zero {
+		*value = o
+	}
+}
+
+func limit[T int | time.Duration](value *T, max T) {
+	if max > 0 && *value > max {
+		*value = max
+	}
+}
+
+// DefaultTimeouts returns the timeouts of the actions unless configured otherwise.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Ready:            5 * time.Minute,
+		ReadinessGates:   5 * time.Minute,
+		DeleteVerify:     30 * time.Second,
+		SwapDeletes:      5 * time.Minute,
+		SwapPollInterval: 30 * time.Second,
+		Convergence:      5 * time.Minute,
+		Lock:             30 * time.Second,
+		Max:              30 * time.Minute,
+	}
+}
+
+// DefaultRetry returns the retry policy of the actions unless configured otherwise.
+func DefaultRetry() Retry {
+	return Retry{
+		MaxAttempts: 5,
+		Base:        200 * time.Millisecond,
+		Cap:         5 * time.Second,
+		On:          []string{"conflict", "server-error", "too-many-requests", "timeout"},
+		// a request cannot retry a call for longer than about 5 minutes
+		MaxAttemptsLimit: 10,
+		CapLimit:         30 * time.Second,
+	}
+}
+
+// Audit configures where the history of the executed actions is kept.
+type Audit struct {
+	// Sink is redis, file or events, an empty sink disables the audit log.
+	Sink string `mapstructure:"SINK"`
+	// File is the JSON lines file the file sink appends to.
+	File string `mapstructure:"FILE"`
+	// MaxLen is about the number of records the redis sink keeps, older records are trimmed.
+	MaxLen int64 `mapstructure:"MAX_LEN" yaml:"MAX_LEN"`
+	// Namespace is the namespace of WAM, the events sink creates its Events there.
+	Namespace string `mapstructure:"NAMESPACE"`
+}
+
+// Leader configures the election of the replica running the reconciler.
+type Leader struct {
+	// Namespace and LeaseName locate the Lease the replicas compete for, the namespace is usually that of WAM.
+	Namespace string `mapstructure:"NAMESPACE"`
+	LeaseName string `mapstructure:"LEASE_NAME" yaml:"LEASE_NAME"`
+	// LeaseDuration is how long the other replicas wait before taking over from a leader that stopped renewing.
+	LeaseDuration time.Duration `mapstructure:"LEASE_DURATION" yaml:"LEASE_DURATION"`
+}
+
+// Reconciler configures the repair of actions interrupted by a dying replica and of the drift they leave behind.
+type Reconciler struct {
+	Enabled bool `mapstructure:"ENABLED"`
+	// Interval is the pause between two reconciliations. Drift is repaired once it is found twice in a row, so it is
+	// also the least time a suggestion or deletion cost is left alone.
+	Interval time.Duration `mapstructure:"INTERVAL"`
+	// MoveTimeout is how long the pod of an interrupted move may take to become ready before the move is compensated.
+	MoveTimeout time.Duration `mapstructure:"MOVE_TIMEOUT" yaml:"MOVE_TIMEOUT"`
+}
+
+// Scheduler configures the dispatch of actions deferred by their schedule.
+type Scheduler struct {
+	// Interval is how often the deferred actions are checked, so an action may start up to this late.
+	Interval time.Duration `mapstructure:"INTERVAL"`
+}
+
+// Clusters configures the remote clusters actions can be run in besides the cluster of WAM, by name.
+type Clusters struct {
+	// KubeconfigDir holds a kubeconfig file per remote cluster, named after the cluster.
+	KubeconfigDir string `mapstructure:"KUBECONFIG_DIR" yaml:"KUBECONFIG_DIR"`
+	// SecretNamespace is searched for Secrets labelled wam.aces-eu/cluster=<name> holding the kubeconfig of a remote
+	// cluster under the kubeconfig key. No Secrets are read if empty.
+	SecretNamespace string `mapstructure:"SECRET_NAMESPACE" yaml:"SECRET_NAMESPACE"`
+}
+
 func defaultConfig() *Config {
-	return &Config{}
+	return &Config{
+		Server: Server{
+			ShutdownGracePeriod: 30 * time.Second,
+		},
+		Log: Log{
+			Verbosity: 2,
+		},
+		Auth: Auth{
+			Enabled: true,
+		},
+		Policy: Policy{
+			ProtectedNamespaces:      []string{"kube-system"},
+			RespectDisruptionBudgets: true,
+		},
+		Actions: Actions{
+			IdempotencyWindow:    24 * time.Hour,
+			MaxConcurrentMoves:   4,
+			MaxConcurrentActions: 10,
+			Timeouts:             DefaultTimeouts(),
+			Retry:                DefaultRetry(),
+		},
+		Audit: Audit{
+			Sink:      "redis",
+			File:      "/var/lib/wam/audit.jsonl",
+			MaxLen:    100000,
+			Namespace: "default",
+		},
+		Leader: Leader{
+			Namespace:     "default",
+			LeaseName:     "wam-leader",
+			LeaseDuration: 15 * time.Second,
+		},
+		Reconciler: Reconciler{
+			Enabled:     true,
+			Interval:    time.Minute,
+			MoveTimeout: 5 * time.Minute,
+		},
+		Scheduler: Scheduler{
+			Interval: 10 * time.Second,
+		},
+	}
 }
 
 func New() (*Config, error) {
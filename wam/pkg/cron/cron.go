@@ -0,0 +1,177 @@
+// Package cron parses the standard five field cron expressions of the maintenance windows actions are scheduled in.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSearch bounds the search for the next time an expression matches, e.g. 0 0 30 2 * never does
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+// Schedule is a parsed cron expression.
+type Schedule struct {
+	// the bits of the matching minutes, hours, days of the month, months and days of the week, Sunday is 0
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set if the field is *, if neither is, a day matches if either field does
+	domAny, dowAny bool
+}
+
+type field struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = field{0, 59, nil}
+	hourField   = field{0, 23, nil}
+	domField    = field{1, 31, nil}
+	monthField  = field{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 is Sunday too
+	dowField = field{0, 7, map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses an expression of the minute, hour, day of month, month and day of week fields, e.g. 0 2 * * mon-fri,
+// or one of the macros @yearly, @monthly, @weekly, @daily and @hourly. A field is *, a value, a range a-b or a list
+// of them, each optionally with a step, e.g. */15 or 1-5/2.
+func Parse(expr string) (*Schedule, error) {
+	if macro, ok := macros[strings.TrimSpace(expr)]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, has %d", expr, len(fields))
+	}
+
+	s := &Schedule{
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+	var err error
+	for i, f := range []struct {
+		bits  *uint64
+		field field
+		name  string
+	}{
+		{&s.minute, minuteField, "minute"},
+		{&s.hour, hourField, "hour"},
+		{&s.dom, domField, "day of month"},
+		{&s.month, monthField, "month"},
+		{&s.dow, dowField, "day of week"},
+	} {
+		*f.bits, err = f.field.parse(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s field %q: %w", f.name, fields[i], err)
+		}
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	return s, nil
+}
+
+func (f field) parse(expr string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		step := 1
+		if rangeExpr, stepExpr, ok := strings.Cut(part, "/"); ok {
+			var err error
+			step, err = strconv.Atoi(stepExpr)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepExpr)
+			}
+			part = rangeExpr
+		}
+
+		low, high := f.min, f.max
+		if part != "*" {
+			lowExpr, highExpr, isRange := strings.Cut(part, "-")
+			var err error
+			low, err = f.value(lowExpr)
+			if err != nil {
+				return 0, err
+			}
+			high = low
+			if isRange {
+				high, err = f.value(highExpr)
+				if err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// a/n is a shorthand of a-max/n
+				high = f.max
+			}
+			if high < low {
+				return 0, fmt.Errorf("range %q ends before it starts", part)
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (f field) value(expr string) (int, error) {
+	if v, ok := f.names[strings.ToLower(expr)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(expr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", expr)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d is out of range %d-%d", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+// Next returns the first minute after t the schedule matches, in the location of t. It returns the zero time if the
+// schedule does not match within five years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	limit := t.Add(maxSearch)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Minute).Add(time.Duration(60-t.Minute()) * time.Minute)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,70 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// checkTimeout bounds how long a single check may take, it must be shorter than the probe timeout.
+const checkTimeout = 2 * time.Second
+
+// Check reports whether WAM can do its work, it returns an error if it cannot.
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Kubernetes checks that the API server is reachable.
+func Kubernetes(client kubernetes.Interface) Check {
+	return Check{
+		Name: "kubernetes",
+		Check: func(ctx context.Context) error {
+			return client.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+		},
+	}
+}
+
+// Redis checks that the suggestion store is reachable.
+func Redis(rdb *redis.Client) Check {
+	return Check{
+		Name: "redis",
+		Check: func(ctx context.Context) error {
+			return rdb.Ping(ctx).Err()
+		},
+	}
+}
+
+// Handler runs all checks and responds with 200 if they pass and with 503 otherwise. Like the health endpoints of
+// Kubernetes components, the body lists the result of every check.
+func Handler(checks ...Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		defer cancel()
+
+		var body strings.Builder
+		failed := false
+		for _, check := range checks {
+			if err := check.Check(ctx); err != nil {
+				klog.FromContext(ctx).V(2).Info("health check failed", "path", r.URL.Path, "check", check.Name, "err", err)
+				fmt.Fprintf(&body, "[-]%s failed: %v\n", check.Name, err)
+				failed = true
+				continue
+			}
+			fmt.Fprintf(&body, "[+]%s ok\n", check.Name)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = fmt.Fprint(w, body.String())
+	})
+}
@@ -0,0 +1,51 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	ok := Check{Name: "ok", Check: func(context.Context) error { return nil }}
+	broken := Check{Name: "broken", Check: func(context.Context) error { return errors.New("unreachable") }}
+
+	tests := []struct {
+		name       string
+		checks     []Check
+		wantStatus int
+		wantBody   []string
+	}{
+		{
+			name:       "all checks pass",
+			checks:     []Check{ok},
+			wantStatus: http.StatusOK,
+			wantBody:   []string{"[+]ok ok"},
+		},
+		{
+			name:       "one check fails",
+			checks:     []Check{ok, broken},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   []string{"[+]ok ok", "[-]broken failed: unreachable"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			Handler(tt.checks...).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("expected %q in body %q", want, rec.Body.String())
+				}
+			}
+		})
+	}
+}
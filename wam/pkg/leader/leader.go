@@ -0,0 +1,56 @@
+// Package leader elects one of the WAM replicas to run the work that must not run on several replicas at once, e.g.
+// the reconciler.
+package leader
+
+import (
+	"context"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+// Run campaigns for the Lease until ctx is done and runs lead whenever this replica becomes the leader. The context
+// passed to lead is cancelled when the replica loses the Lease. The Lease is released when ctx is done, so another
+// replica takes over without waiting for it to expire.
+func Run(ctx context.Context, k8sClient clientset.Interface, config wamconfig.Leader, identity string, lead func(ctx context.Context)) {
+	lh := klog.FromContext(ctx).WithValues("lease", klog.KRef(config.Namespace, config.LeaseName), "identity", identity)
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: config.Namespace,
+			Name:      config.LeaseName,
+		},
+		Client:     k8sClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	for ctx.Err() == nil {
+		// RunOrDie returns whenever the leadership is lost, the replica then campaigns again
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   config.LeaseDuration,
+			RenewDeadline:   config.LeaseDuration * 2 / 3,
+			RetryPeriod:     config.LeaseDuration / 5,
+			ReleaseOnCancel: true,
+			Name:            config.LeaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					lh.Info("started leading")
+					lead(klog.NewContext(ctx, lh))
+				},
+				OnStoppedLeading: func() {
+					lh.Info("stopped leading")
+				},
+				OnNewLeader: func(leader string) {
+					if leader != identity {
+						lh.V(2).Info("following the leader", "leader", leader)
+					}
+				},
+			},
+		})
+	}
+}
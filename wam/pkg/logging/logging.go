@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+	"github.com/go-logr/logr"
+	"k8s.io/klog/v2"
+)
+
+// Setup makes klog, and with it client-go, write structured JSON lines to stderr.
+// Loggers are retrieved with klog.FromContext like in the scheduler plugin; lines logged with V(n) are written if n
+// is at most the configured verbosity.
+func Setup(config wamconfig.Log) logr.Logger {
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+		AddSource: true,
+		// logr maps V(n) to slog level -n
+		Level: slog.Level(-config.Verbosity),
+	})
+
+	logger := logr.FromSlogHandler(handler)
+	klog.SetLogger(logger)
+
+	return logger
+}
+
+type fieldsKey struct{}
+
+// fields are the key-value pairs added to a context logger by WithValues.
+type fields struct {
+	base   klog.Logger
+	keys   []string
+	values map[string]any
+}
+
+// WithValues returns ctx with a logger that adds the key-value pairs to every line, and that logger.
+// Unlike logr.Logger.WithValues, a key that was already added to ctx is overwritten instead of repeated, so nested
+// handlers can add the fields they know about without duplicating those of their caller.
+func WithValues(ctx context.Context, keysAndValues ...any) (context.Context, klog.Logger) {
+	f := &fields{values: map[string]any{}}
+	if parent, ok := ctx.Value(fieldsKey{}).(*fields); ok {
+		f.base = parent.base
+		f.keys = append(f.keys, parent.keys...)
+		for k, v := range parent.values {
+			f.values[k] = v
+		}
+	} else {
+		f.base = klog.FromContext(ctx)
+	}
+
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		if _, ok := f.values[key]; !ok {
+			f.keys = append(f.keys, key)
+		}
+		f.values[key] = keysAndValues[i+1]
+	}
+
+	kv := make([]any, 0, 2*len(f.keys))
+	for _, key := range f.keys {
+		kv = append(kv, key, f.values[key])
+	}
+
+	lh := f.base.WithValues(kv...)
+	ctx = context.WithValue(ctx, fieldsKey{}, f)
+	return klog.NewContext(ctx, lh), lh
+}
@@ -0,0 +1,35 @@
+package logging
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr/funcr"
+	"k8s.io/klog/v2"
+)
+
+func TestWithValuesOverwritesKeys(t *testing.T) {
+	var lines []string
+	logger := funcr.New(func(prefix, args string) {
+		lines = append(lines, args)
+	}, funcr.Options{})
+
+	ctx := klog.NewContext(context.Background(), logger)
+	ctx, _ = WithValues(ctx, "actionID", "a", "pod", "default/x")
+	_, lh := WithValues(ctx, "pod", "default/y", "node", "n1")
+	lh.Info("test")
+
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %d", len(lines))
+	}
+	line := lines[0]
+	if strings.Count(line, `"pod"`) != 1 {
+		t.Errorf("expected key pod once, got %s", line)
+	}
+	for _, want := range []string{`"actionID"="a"`, `"pod"="default/y"`, `"node"="n1"`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("expected %s in %s", want, line)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "wam"
+
+const (
+	OutcomeSuccess   = "success"
+	OutcomeFailure   = "failure"
+	OutcomeInvalid   = "invalid"
+	OutcomeForbidden = "forbidden"
+	OutcomeRejected  = "rejected"
+)
+
+var (
+	// ActionsTotal counts actions by type and outcome.
+	ActionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "actions_total",
+		Help:      "Number of actions handled, by action type and outcome.",
+	}, []string{"action", "outcome"})
+
+	// ActionDuration measures how long action handlers run.
+	ActionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "action_duration_seconds",
+		Help:      "Duration of action handlers, by action type and outcome.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"action", "outcome"})
+
+	// PodReadyDuration measures the time from pushing a suggestion until the suggested pod is ready.
+	PodReadyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pod_ready_duration_seconds",
+		Help:      "Time from queuing a scheduling suggestion until the resulting pod is ready, by action type.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"action"})
+
+	// SwapPhaseDuration measures the individual phases of a swap action.
+	SwapPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "swap_phase_duration_seconds",
+		Help:      "Duration of the phases of a swap action.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"phase"})
+
+	// PolicyViolations counts actions rejected by a policy.
+	PolicyViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "policy_violations_total",
+		Help:      "Number of actions rejected by a policy, by action type and policy.",
+	}, []string{"action", "policy"})
+
+	// DeleteFallbacks counts deletes in which the ReplicaSet controller did not remove the named pod, so WAM deleted
+	// it directly.
+	DeleteFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delete_fallbacks_total",
+		Help:      "Number of deletes in which the named pod was deleted directly, by reason.",
+	}, []string{"reason"})
+
+	// Repairs counts the steps of interrupted actions and the drift the reconciler repaired.
+	Repairs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconciler_repairs_total",
+		Help:      "Number of repairs made by the reconciler, by kind.",
+	}, []string{"kind"})
+
+	// ScheduledActions counts the actions deferred by their schedule, by what became of them.
+	ScheduledActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scheduled_actions_total",
+		Help:      "Number of actions deferred by their schedule, by action and outcome.",
+	}, []string{"action", "outcome"})
+
+	// QueuedActions is the number of action handlers of a replica waiting to be dispatched.
+	QueuedActions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queued_actions",
+		Help:      "Number of action handlers waiting for a dispatch slot, by priority.",
+	}, []string{"priority"})
+
+	// APIRetries counts the retried Kubernetes API calls of the actions, by the class of the error retried.
+	APIRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_retries_total",
+		Help:      "Number of retried Kubernetes API calls, by error class.",
+	}, []string{"class"})
+
+	// LockWaitDuration measures how long handlers wait to acquire a workload lock.
+	LockWaitDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "lock_wait_duration_seconds",
+		Help:      "Time spent waiting to acquire a workload lock, by result.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"result"})
+)
+
+// ObserveAction records the outcome and duration of an action that started at start.
+func ObserveAction(action string, start time.Time, err error) {
+	outcome := OutcomeSuccess
+	if err != nil {
+		outcome = OutcomeFailure
+	}
+
+	ActionsTotal.WithLabelValues(action, outcome).Inc()
+	ActionDuration.WithLabelValues(action, outcome).Observe(time.Since(start).Seconds())
+}
+
+// ObserveInvalid records an action request that was rejected by validation.
+func ObserveInvalid(action string) {
+	ActionsTotal.WithLabelValues(action, OutcomeInvalid).Inc()
+}
+
+// ObserveForbidden records an action request that the caller was not authorized to make.
+func ObserveForbidden(action string) {
+	ActionsTotal.WithLabelValues(action, OutcomeForbidden).Inc()
+}
+
+// ObserveRejected records an action request that was rejected by a policy.
+func ObserveRejected(action string) {
+	ActionsTotal.WithLabelValues(action, OutcomeRejected).Inc()
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"k8s.io/klog/v2"
+)
+
+var queueDepthDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "queue_depth"),
+	"Number of scheduling suggestions waiting in the queue of a workload.",
+	[]string{"workload"}, nil,
+)
+
+// QueueDepthCollector reads the suggestion queue lengths from Redis on every scrape,
+// so the values are accurate regardless of which WAM replica or scheduler touched the queues.
+type QueueDepthCollector struct {
+	rdb *redis.Client
+	// pattern and keyType select the queues, see actions.QueuePattern
+	pattern string
+	keyType string
+	timeout time.Duration
+}
+
+func NewQueueDepthCollector(rdb *redis.Client, pattern string, keyType string) *QueueDepthCollector {
+	return &QueueDepthCollector{
+		rdb:     rdb,
+		pattern: pattern,
+		keyType: keyType,
+		timeout: 5 * time.Second,
+	}
+}
+
+func (c *QueueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+}
+
+func (c *QueueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	iter := c.rdb.ScanType(ctx, 0, c.pattern, 100, c.keyType).Iterator()
+	for iter.Next(ctx) {
+		queue := iter.Val()
+
+		depth, err := c.rdb.LLen(ctx, queue).Result()
+		if err != nil {
+			klog.Background().Error(err, "error getting length of queue", "queue", queue)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(depth), queue)
+	}
+	if err := iter.Err(); err != nil {
+		klog.Background().Error(err, "error scanning suggestion queues")
+	}
+}
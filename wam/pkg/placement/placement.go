@@ -0,0 +1,250 @@
+package placement
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// names of the built-in strategies
+const (
+	SpreadEvenly     = "spread-evenly"
+	BinPack          = "bin-pack"
+	LabelConstrained = "label-constrained"
+)
+
+// Node is a node a workload can be placed on.
+type Node struct {
+	Name   string
+	Labels map[string]string
+	// AllocatableCPU in millicores and AllocatableMemory in bytes are the resources of the node for pods.
+	AllocatableCPU    int64
+	AllocatableMemory int64
+	// RequestedCPU and RequestedMemory are requested by the pods of other workloads on the node.
+	RequestedCPU    int64
+	RequestedMemory int64
+	// Replicas is the number of pods of the placed workload on the node.
+	Replicas int
+}
+
+// memoryShare is the share of the node's memory requested with the given number of pods of the workload.
+func (n *Node) memoryShare(w Workload, replicas int) float64 {
+	if n.AllocatableMemory == 0 {
+		return 1
+	}
+	return float64(n.RequestedMemory+int64(replicas)*w.Memory) / float64(n.AllocatableMemory)
+}
+
+// fits returns how many pods of the workload fit into the resources of the node left by other workloads, -1 if the
+// workload requests no resources.
+func (n *Node) fits(w Workload) int {
+	fits := -1
+	limit := func(allocatable, requested, perPod int64) {
+		if perPod <= 0 {
+			return
+		}
+		k := int(max(allocatable-requested, 0) / perPod)
+		if fits < 0 || k < fits {
+			fits = k
+		}
+	}
+	limit(n.AllocatableCPU, n.RequestedCPU, w.CPU)
+	limit(n.AllocatableMemory, n.RequestedMemory, w.Memory)
+	return fits
+}
+
+// Workload is the workload a strategy places.
+type Workload struct {
+	Replicas int
+	// CPU in millicores and Memory in bytes are requested by each pod.
+	CPU    int64
+	Memory int64
+}
+
+// Strategy decides on which nodes the pods of a workload should run.
+type Strategy interface {
+	// Place returns the number of pods of the workload each node should run, in total the workload's replicas.
+	// Nodes missing from the result should run none.
+	Place(nodes []Node, workload Workload) (map[string]int, error)
+}
+
+// Options select and configure a strategy, they are part of the rebalance action's request.
+type Options struct {
+	Name string `json:"name"`
+	// NodeSelector restricts the label-constrained strategy to the matching nodes, e.g. disktype=ssd.
+	NodeSelector string `json:"nodeSelector,omitempty"`
+	// MaxMemoryRequested excludes nodes on which more than this share of the memory would be requested, e.g. 0.5.
+	MaxMemoryRequested float64 `json:"maxMemoryRequested,omitempty"`
+}
+
+// Factory creates a strategy from the options of a request.
+type Factory func(opts Options) (Strategy, error)
+
+var (
+	mu         sync.RWMutex
+	strategies = map[string]Factory{
+		SpreadEvenly: func(Options) (Strategy, error) { return spreadEvenly{}, nil },
+		BinPack:      func(Options) (Strategy, error) { return binPack{}, nil },
+		LabelConstrained: func(opts Options) (Strategy, error) {
+			if opts.NodeSelector == "" {
+				return nil, fmt.Errorf("strategy %s requires a nodeSelector", LabelConstrained)
+			}
+			selector, err := labels.Parse(opts.NodeSelector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid nodeSelector: %w", err)
+			}
+			return labelConstrained{selector: selector}, nil
+		},
+	}
+)
+
+// Register makes a strategy available under the name, replacing a strategy registered before.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	strategies[name] = factory
+}
+
+// Names returns the names of the registered strategies.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var names []string
+	for name := range strategies {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// New returns the strategy selected by the options.
+func New(opts Options) (Strategy, error) {
+	mu.RLock()
+	factory, ok := strategies[opts.Name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %q, expected one of %s", opts.Name, strings.Join(Names(), ", "))
+	}
+
+	strategy, err := factory(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.MaxMemoryRequested < 0 || opts.MaxMemoryRequested > 1 {
+		return nil, fmt.Errorf("maxMemoryRequested must be between 0 and 1")
+	}
+	if opts.MaxMemoryRequested > 0 {
+		strategy = memoryLimited{Strategy: strategy, max: opts.MaxMemoryRequested}
+	}
+
+	return strategy, nil
+}
+
+// memoryLimited leaves out the nodes whose memory is already requested beyond the limit by other workloads.
+type memoryLimited struct {
+	Strategy
+	max float64
+}
+
+func (s memoryLimited) Place(nodes []Node, w Workload) (map[string]int, error) {
+	var candidates []Node
+	for _, node := range nodes {
+		if node.memoryShare(w, 0) <= s.max {
+			candidates = append(candidates, node)
+		}
+	}
+	return s.Strategy.Place(candidates, w)
+}
+
+// spreadEvenly runs the same number of pods on every node, give or take one. The nodes running more of the pods
+// already keep the remainder, so as few pods as possible move.
+type spreadEvenly struct{}
+
+func (spreadEvenly) Place(nodes []Node, w Workload) (map[string]int, error) {
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes to place %d pods on", w.Replicas)
+	}
+
+	order := slices.Clone(nodes)
+	sort.SliceStable(order, func(i, j int) bool {
+		if order[i].Replicas != order[j].Replicas {
+			return order[i].Replicas > order[j].Replicas
+		}
+		if order[i].memoryShare(w, 0) != order[j].memoryShare(w, 0) {
+			return order[i].memoryShare(w, 0) < order[j].memoryShare(w, 0)
+		}
+		return order[i].Name < order[j].Name
+	})
+
+	placement := map[string]int{}
+	for i, node := range order {
+		n := w.Replicas / len(order)
+		if i < w.Replicas%len(order) {
+			n++
+		}
+		if n > 0 {
+			placement[node.Name] = n
+		}
+	}
+	return placement, nil
+}
+
+// binPack fills the fullest nodes first, so the other nodes can be freed. Nodes running pods of the workload come
+// first, so as few pods as possible move.
+type binPack struct{}
+
+func (binPack) Place(nodes []Node, w Workload) (map[string]int, error) {
+	order := slices.Clone(nodes)
+	sort.SliceStable(order, func(i, j int) bool {
+		if order[i].Replicas != order[j].Replicas {
+			return order[i].Replicas > order[j].Replicas
+		}
+		if order[i].memoryShare(w, 0) != order[j].memoryShare(w, 0) {
+			return order[i].memoryShare(w, 0) > order[j].memoryShare(w, 0)
+		}
+		return order[i].Name < order[j].Name
+	})
+
+	placement := map[string]int{}
+	left := w.Replicas
+	for _, node := range order {
+		if left == 0 {
+			break
+		}
+
+		n := left
+		if fits := node.fits(w); fits >= 0 && fits < n {
+			n = fits
+		}
+		if n > 0 {
+			placement[node.Name] = n
+			left -= n
+		}
+	}
+
+	if left > 0 {
+		return nil, fmt.Errorf("%d of %d pods do not fit on the nodes", left, w.Replicas)
+	}
+	return placement, nil
+}
+
+// labelConstrained spreads the pods evenly over the nodes matching the selector.
+type labelConstrained struct {
+	selector labels.Selector
+}
+
+func (s labelConstrained) Place(nodes []Node, w Workload) (map[string]int, error) {
+	var candidates []Node
+	for _, node := range nodes {
+		if s.selector.Matches(labels.Set(node.Labels)) {
+			candidates = append(candidates, node)
+		}
+	}
+	return spreadEvenly{}.Place(candidates, w)
+}
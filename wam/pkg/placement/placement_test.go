@@ -0,0 +1,99 @@
+package placement
+
+import (
+	"reflect"
+	"testing"
+)
+
+const gi = 1 << 30
+
+func TestStrategies(t *testing.T) {
+	nodes := []Node{
+		{Name: "node-1", Labels: map[string]string{"zone": "a"}, AllocatableCPU: 4000, AllocatableMemory: 8 * gi, RequestedMemory: 6 * gi, Replicas: 3},
+		{Name: "node-2", Labels: map[string]string{"zone": "a"}, AllocatableCPU: 4000, AllocatableMemory: 8 * gi, RequestedMemory: 2 * gi, Replicas: 1},
+		{Name: "node-3", Labels: map[string]string{"zone": "b"}, AllocatableCPU: 4000, AllocatableMemory: 8 * gi, RequestedMemory: 1 * gi},
+	}
+	workload := Workload{Replicas: 4, CPU: 1000, Memory: gi}
+
+	tests := []struct {
+		name    string
+		opts    Options
+		want    map[string]int
+		wantErr bool
+	}{
+		{
+			name: "spread evenly keeps the remainder where most pods run",
+			opts: Options{Name: SpreadEvenly},
+			want: map[string]int{"node-1": 2, "node-2": 1, "node-3": 1},
+		},
+		{
+			name: "bin pack fills the nodes running the workload",
+			opts: Options{Name: BinPack},
+			// node-1 has room for 2 pods
+			want: map[string]int{"node-1": 2, "node-2": 2},
+		},
+		{
+			name: "label constrained",
+			opts: Options{Name: LabelConstrained, NodeSelector: "zone=a"},
+			want: map[string]int{"node-1": 2, "node-2": 2},
+		},
+		{
+			name: "memory limited",
+			opts: Options{Name: SpreadEvenly, MaxMemoryRequested: 0.5},
+			want: map[string]int{"node-2": 2, "node-3": 2},
+		},
+		{
+			name:    "label constrained without selector",
+			opts:    Options{Name: LabelConstrained},
+			wantErr: true,
+		},
+		{
+			name:    "no matching nodes",
+			opts:    Options{Name: LabelConstrained, NodeSelector: "zone=c"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown strategy",
+			opts:    Options{Name: "random"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy, err := New(tt.opts)
+			var got map[string]int
+			if err == nil {
+				got, err = strategy.Place(nodes, workload)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected placement %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+type everythingOn string
+
+func (s everythingOn) Place(_ []Node, w Workload) (map[string]int, error) {
+	return map[string]int{string(s): w.Replicas}, nil
+}
+
+func TestRegister(t *testing.T) {
+	Register("everything-on-node-3", func(Options) (Strategy, error) { return everythingOn("node-3"), nil })
+
+	strategy, err := New(Options{Name: "everything-on-node-3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := strategy.Place(nil, Workload{Replicas: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"node-3": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected placement %v, got %v", want, got)
+	}
+}
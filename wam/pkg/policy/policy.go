@@ -0,0 +1,504 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+	"github.com/ACES-EU/workload-actions-manager/wam/pkg/metrics"
+	"github.com/redis/go-redis/v9"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// names of the policies, they are part of the error returned for a violation
+const (
+	ProtectedNamespaces = "protected-namespaces"
+	ProtectedLabels     = "protected-labels"
+	DisruptionBudget    = "pod-disruption-budget"
+	MinReadyReplicas    = "min-ready-replicas"
+	CallerRateLimit     = "caller-rate-limit"
+	WorkloadRateLimit   = "workload-rate-limit"
+	NodeConcurrency     = "node-concurrency"
+)
+
+const (
+	// rateWindow is the window the per-caller and per-workload rate limits count actions in
+	rateWindow = time.Minute
+	// nodeSlotTTL bounds how long a crashed replica occupies a node's action slot, the slots of running actions are
+	// renewed until then
+	nodeSlotTTL = time.Minute
+	// nodeSlotRenewInterval is the pause between two renewals of the slots of a running action
+	nodeSlotRenewInterval = nodeSlotTTL / 3
+)
+
+// Violation is returned for an action that is rejected by a policy.
+type Violation struct {
+	Policy string
+	Reason string
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("rejected by policy %s: %s", v.Policy, v.Reason)
+}
+
+func violation(policy string, format string, args ...any) *Violation {
+	return &Violation{Policy: policy, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Removal is a pod an action deletes and the Deployment it belongs to. Workload is nil for pods of a StatefulSet,
+// which are replaced rather than scaled down.
+type Removal struct {
+	Pod      *v1.Pod
+	Workload *appsv1.Deployment
+}
+
+// Request describes an action for the policy checks.
+type Request struct {
+	// ID identifies the action in the node slots
+	ID     string
+	Action string
+	// Caller is the user the caller rate limit applies to
+	Caller string
+	// Workloads are the Deployments the action scales
+	Workloads []*appsv1.Deployment
+	// Removals are the pods the action deletes
+	Removals []Removal
+	// Nodes are the nodes the action creates pods on or deletes pods from
+	Nodes []string
+	// Surge is set if replacement pods are ready before the pods are deleted, so the action never lowers the number
+	// of ready replicas
+	Surge bool
+	// Client reads the PodDisruptionBudgets of the cluster the action deletes pods in, the engine's if nil
+	Client kubernetes.Interface
+	// Priority of the action, the node slots held by actions of a lower priority do not hold it back
+	Priority int
+}
+
+// Engine checks actions against the guardrails configured by the operator before their handlers run.
+type Engine struct {
+	k8sClient kubernetes.Interface
+	rdb       *redis.Client
+	config    wamconfig.Policy
+}
+
+func NewEngine(k8sClient kubernetes.Interface, rdb *redis.Client, config wamconfig.Policy) *Engine {
+	return &Engine{
+		k8sClient: k8sClient,
+		rdb:       rdb,
+		config:    config,
+	}
+}
+
+// Result is the outcome of a single policy for an action, it is part of the plan of a dry run.
+type Result struct {
+	Policy string `json:"policy"`
+	Passed bool   `json:"passed"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type check struct {
+	policy  string
+	enabled bool
+	// run returns a *Violation if the action breaks the policy. If peek is set, the action is not counted against
+	// the limits.
+	run func(ctx context.Context, req Request, peek bool) error
+}
+
+func (e *Engine) checks() []check {
+	return []check{
+		{ProtectedNamespaces, len(e.config.ProtectedNamespaces) > 0, e.checkProtectedNamespaces},
+		{ProtectedLabels, len(e.config.ProtectedLabels) > 0, e.checkProtectedLabels},
+		{DisruptionBudget, e.config.RespectDisruptionBudgets, e.checkDisruptionBudgets},
+		{MinReadyReplicas, e.config.MinReadyReplicas > 0, e.checkMinReadyReplicas},
+		// the rate limits come last, so rejected actions do not count against them
+		{CallerRateLimit, e.config.CallerActionsPerMinute > 0, e.checkCallerRateLimit},
+		{WorkloadRateLimit, e.config.WorkloadActionsPerMinute > 0, e.checkWorkloadRateLimit},
+		{NodeConcurrency, e.config.MaxConcurrentActionsPerNode > 0, e.peekNodeSlots},
+	}
+}
+
+// Check returns a *Violation if the action breaks a policy. Otherwise, the action holds a slot on each of its nodes
+// until the returned function is called.
+func (e *Engine) Check(ctx context.Context, req Request) (func(), error) {
+	for _, c := range e.checks() {
+		// the node slots are acquired below
+		if !c.enabled || c.policy == NodeConcurrency {
+			continue
+		}
+		if err := c.run(ctx, req, false); err != nil {
+			return nil, e.observe(ctx, req, err)
+		}
+	}
+
+	release, err := e.acquireNodeSlots(ctx, req)
+	if err != nil {
+		return nil, e.observe(ctx, req, err)
+	}
+
+	return release, nil
+}
+
+// Peek returns a *Violation if the action breaks a policy, without counting the action against the limits or taking
+// slots on its nodes.
+func (e *Engine) Peek(ctx context.Context, req Request) error {
+	for _, c := range e.checks() {
+		if !c.enabled {
+			continue
+		}
+		if err := c.run(ctx, req, true); err != nil {
+			return e.observe(ctx, req, err)
+		}
+	}
+	return nil
+}
+
+// Evaluate returns the result of every enabled policy for the action without counting it against the limits.
+func (e *Engine) Evaluate(ctx context.Context, req Request) ([]Result, error) {
+	var results []Result
+	for _, c := range e.checks() {
+		if !c.enabled {
+			continue
+		}
+
+		result := Result{Policy: c.policy, Passed: true}
+		if err := c.run(ctx, req, true); err != nil {
+			var v *Violation
+			if !errors.As(err, &v) {
+				return nil, err
+			}
+			result.Passed = false
+			result.Reason = v.Reason
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func (e *Engine) observe(ctx context.Context, req Request, err error) error {
+	var v *Violation
+	if errors.As(err, &v) {
+		klog.FromContext(ctx).V(2).Info("action rejected by policy", "policy", v.Policy, "reason", v.Reason)
+		metrics.PolicyViolations.WithLabelValues(req.Action, v.Policy).Inc()
+	}
+	return err
+}
+
+func (e *Engine) checkProtectedNamespaces(_ context.Context, req Request, _ bool) error {
+	for _, namespace := range req.namespaces() {
+		if slices.Contains(e.config.ProtectedNamespaces, namespace) {
+			return violation(ProtectedNamespaces, "namespace %s is protected", namespace)
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine) checkProtectedLabels(_ context.Context, req Request, _ bool) error {
+	for _, workload := range req.Workloads {
+		if label, ok := e.protectedLabel(workload.Labels); ok {
+			return violation(ProtectedLabels, "workload %s has protected label %s", klog.KObj(workload), label)
+		}
+	}
+	for _, removal := range req.Removals {
+		if label, ok := e.protectedLabel(removal.Pod.Labels); ok {
+			return violation(ProtectedLabels, "pod %s has protected label %s", klog.KObj(removal.Pod), label)
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine) protectedLabel(objLabels map[string]string) (string, bool) {
+	for _, protected := range e.config.ProtectedLabels {
+		key, value, hasValue := strings.Cut(protected, "=")
+		v, ok := objLabels[key]
+		if ok && (!hasValue || v == value) {
+			return protected, true
+		}
+	}
+
+	return "", false
+}
+
+func (r Request) namespaces() []string {
+	var namespaces []string
+	for _, workload := range r.Workloads {
+		namespaces = append(namespaces, workload.Namespace)
+	}
+	for _, removal := range r.Removals {
+		namespaces = append(namespaces, removal.Pod.Namespace)
+	}
+	return namespaces
+}
+
+func (e *Engine) checkDisruptionBudgets(ctx context.Context, req Request, _ bool) error {
+	if len(req.Removals) == 0 {
+		return nil
+	}
+
+	namespaces := map[string]bool{}
+	for _, removal := range req.Removals {
+		namespaces[removal.Pod.Namespace] = true
+	}
+
+	client := e.k8sClient
+	if req.Client != nil {
+		client = req.Client
+	}
+
+	for namespace := range namespaces {
+		pdbs, err := client.PolicyV1().PodDisruptionBudgets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("error listing pod disruption budgets: %w", err)
+		}
+
+		for _, pdb := range pdbs.Items {
+			selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+			if err != nil || selector.Empty() {
+				continue
+			}
+
+			disrupted := 0
+			for _, removal := range req.Removals {
+				if removal.Pod.Namespace == namespace && selector.Matches(labels.Set(removal.Pod.Labels)) {
+					disrupted++
+				}
+			}
+
+			if disrupted > int(pdb.Status.DisruptionsAllowed) {
+				return violation(DisruptionBudget, "deleting %d pods would violate pod disruption budget %s which allows %d disruptions",
+					disrupted, klog.KObj(&pdb), pdb.Status.DisruptionsAllowed)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine) checkMinReadyReplicas(_ context.Context, req Request, _ bool) error {
+	if req.Surge {
+		return nil
+	}
+
+	removed := map[*appsv1.Deployment]int32{}
+	for _, removal := range req.Removals {
+		if removal.Workload != nil {
+			removed[removal.Workload]++
+		}
+	}
+
+	for workload, n := range removed {
+		ready := workload.Status.ReadyReplicas
+		if ready-n < e.config.MinReadyReplicas {
+			return violation(MinReadyReplicas, "deleting %d pods would leave workload %s with %d of at least %d ready replicas",
+				n, klog.KObj(workload), max(ready-n, 0), e.config.MinReadyReplicas)
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine) checkCallerRateLimit(ctx context.Context, req Request, peek bool) error {
+	return e.checkRateLimit(ctx, CallerRateLimit, req.Caller, e.config.CallerActionsPerMinute, peek)
+}
+
+func (e *Engine) checkWorkloadRateLimit(ctx context.Context, req Request, peek bool) error {
+	for _, workload := range req.Workloads {
+		name := workload.Namespace + "/" + workload.Name
+		if err := e.checkRateLimit(ctx, WorkloadRateLimit, name, e.config.WorkloadActionsPerMinute, peek); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine) checkRateLimit(ctx context.Context, policy string, name string, perMinute int, peek bool) error {
+	// a fixed window counter shared by all replicas
+	key := fmt.Sprintf("wam:ratelimit:%s:%s", policy, name)
+
+	var count int
+	var err error
+	if peek {
+		// count the action as if it ran
+		count, err = e.rdb.Get(ctx, key).Int()
+		if errors.Is(err, redis.Nil) {
+			err = nil
+		}
+		count++
+	} else {
+		count, err = rateScript.Run(ctx, e.rdb, []string{key}, rateWindow.Milliseconds()).Int()
+	}
+	if err != nil {
+		return fmt.Errorf("error checking %s: %w", policy, err)
+	}
+
+	if count > perMinute {
+		return violation(policy, "%s exceeded %d actions per minute", name, perMinute)
+	}
+
+	return nil
+}
+
+// rateScript counts an action in the current window and returns the number of actions in it.
+var rateScript = redis.NewScript(`
+local count = redis.call("incr", KEYS[1])
+if count == 1 then
+	redis.call("pexpire", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// nodeSlotsScript adds the action to the sets of running actions of all its nodes, unless one of them is full. Members
+// are prefixed with the priority of their action, only those of the same or a higher priority count towards the
+// limit. It returns the 1-based index of the full node, or 0 if the action was added.
+var nodeSlotsScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local expires = tonumber(ARGV[2])
+local max = tonumber(ARGV[3])
+local priority = tonumber(ARGV[5])
+for i, key in ipairs(KEYS) do
+	redis.call("zremrangebyscore", key, "-inf", now)
+	local running = 0
+	for _, member in ipairs(redis.call("zrange", key, 0, -1)) do
+		local p = tonumber(string.match(member, "^(-?%d+):"))
+		if p == nil or p >= priority then
+			running = running + 1
+		end
+	end
+	if running >= max then
+		return i
+	end
+end
+for _, key in ipairs(KEYS) do
+	redis.call("zadd", key, expires, ARGV[4])
+	redis.call("pexpireat", key, expires)
+end
+return 0
+`)
+
+// renewNodeSlotsScript extends the expiry of the action in the sets of its nodes it is still a member of.
+var renewNodeSlotsScript = redis.NewScript(`
+local expires = tonumber(ARGV[1])
+for _, key in ipairs(KEYS) do
+	if redis.call("zscore", key, ARGV[2]) then
+		redis.call("zadd", key, expires, ARGV[2])
+		redis.call("pexpireat", key, expires)
+	end
+end
+return 0
+`)
+
+func nodeSlotsKey(node string) string {
+	return fmt.Sprintf("wam:node:%s:actions", node)
+}
+
+// slot is the member of the action in the node slot sets.
+func (r Request) slot() string {
+	return fmt.Sprintf("%d:%s", r.Priority, r.ID)
+}
+
+func (r Request) nodes() (nodes []string, keys []string) {
+	for _, node := range r.Nodes {
+		if node != "" && !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+			keys = append(keys, nodeSlotsKey(node))
+		}
+	}
+	return nodes, keys
+}
+
+// peekNodeSlots checks that the nodes of the action have a free slot without taking it.
+func (e *Engine) peekNodeSlots(ctx context.Context, req Request, _ bool) error {
+	nodes, keys := req.nodes()
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	for i, key := range keys {
+		members, err := e.rdb.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: "(" + now, Max: "+inf"}).Result()
+		if err != nil {
+			return fmt.Errorf("error checking %s: %w", NodeConcurrency, err)
+		}
+		running := 0
+		for _, member := range members {
+			prefix, _, _ := strings.Cut(member, ":")
+			if priority, err := strconv.Atoi(prefix); err != nil || priority >= req.Priority {
+				running++
+			}
+		}
+		if running >= e.config.MaxConcurrentActionsPerNode {
+			return violation(NodeConcurrency, "node %s already runs %d actions", nodes[i], e.config.MaxConcurrentActionsPerNode)
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine) acquireNodeSlots(ctx context.Context, req Request) (func(), error) {
+	if e.config.MaxConcurrentActionsPerNode <= 0 {
+		return func() {}, nil
+	}
+
+	nodes, keys := req.nodes()
+	if len(keys) == 0 {
+		return func() {}, nil
+	}
+
+	now := time.Now()
+	full, err := nodeSlotsScript.Run(ctx, e.rdb, keys,
+		now.UnixMilli(), now.Add(nodeSlotTTL).UnixMilli(), e.config.MaxConcurrentActionsPerNode, req.slot(), req.Priority,
+	).Int()
+	if err != nil {
+		return nil, fmt.Errorf("error checking %s: %w", NodeConcurrency, err)
+	}
+
+	if full > 0 {
+		return nil, violation(NodeConcurrency, "node %s already runs %d actions", nodes[full-1], e.config.MaxConcurrentActionsPerNode)
+	}
+
+	lh := klog.FromContext(ctx)
+	renewCtx, stopRenew := context.WithCancel(context.WithoutCancel(ctx))
+	go e.renewNodeSlots(renewCtx, req, keys)
+
+	return func() {
+		stopRenew()
+		for _, key := range keys {
+			if err := e.rdb.ZRem(context.Background(), key, req.slot()).Err(); err != nil {
+				lh.Error(err, "error releasing node slot", "key", key)
+			}
+		}
+	}, nil
+}
+
+// renewNodeSlots extends the slots of a running action until ctx is done, so actions running longer than nodeSlotTTL
+// keep their slots.
+func (e *Engine) renewNodeSlots(ctx context.Context, req Request, keys []string) {
+	ticker := time.NewTicker(nodeSlotRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := e.renewNodeSlotsOnce(ctx, req, keys, time.Now()); err != nil && ctx.Err() == nil {
+			klog.FromContext(ctx).Error(err, "error renewing node slots", "keys", keys)
+		}
+	}
+}
+
+// renewNodeSlotsOnce extends the slots the action still holds to expire nodeSlotTTL after now.
+func (e *Engine) renewNodeSlotsOnce(ctx context.Context, req Request, keys []string, now time.Time) error {
+	return renewNodeSlotsScript.Run(ctx, e.rdb, keys, now.Add(nodeSlotTTL).UnixMilli(), req.slot()).Err()
+}
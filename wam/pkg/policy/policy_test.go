@@ -0,0 +1,206 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newDeployment(namespace string, ready int32, labels map[string]string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "app", Labels: labels},
+		Status:     appsv1.DeploymentStatus{ReadyReplicas: ready},
+	}
+}
+
+func newPod(namespace string, name string, labels map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+		Spec:       v1.PodSpec{NodeName: "node-1"},
+	}
+}
+
+func TestCheck(t *testing.T) {
+	appLabels := map[string]string{"app": "app"}
+
+	pdb := &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "app"},
+		Spec:       policyv1.PodDisruptionBudgetSpec{Selector: &metav1.LabelSelector{MatchLabels: appLabels}},
+		Status:     policyv1.PodDisruptionBudgetStatus{DisruptionsAllowed: 1},
+	}
+
+	config := wamconfig.Policy{
+		ProtectedNamespaces:      []string{"kube-system"},
+		ProtectedLabels:          []string{"wam.aces-eu.io/protected=true", "critical"},
+		RespectDisruptionBudgets: true,
+		MinReadyReplicas:         2,
+	}
+
+	removal := func(namespace string, name string, workload *appsv1.Deployment, labels map[string]string) Removal {
+		return Removal{Pod: newPod(namespace, name, labels), Workload: workload}
+	}
+
+	tests := []struct {
+		name       string
+		req        Request
+		wantPolicy string
+	}{
+		{
+			name: "allowed",
+			req: func() Request {
+				workload := newDeployment("apps", 3, nil)
+				return Request{Action: "delete", Removals: []Removal{removal("apps", "a", workload, appLabels)}}
+			}(),
+		},
+		{
+			name: "protected namespace",
+			req: Request{
+				Action:    "create",
+				Workloads: []*appsv1.Deployment{newDeployment("kube-system", 3, nil)},
+			},
+			wantPolicy: ProtectedNamespaces,
+		},
+		{
+			name: "protected label with value",
+			req: func() Request {
+				workload := newDeployment("apps", 3, nil)
+				labels := map[string]string{"wam.aces-eu.io/protected": "true"}
+				return Request{Action: "delete", Removals: []Removal{removal("apps", "a", workload, labels)}}
+			}(),
+			wantPolicy: ProtectedLabels,
+		},
+		{
+			name: "protected label key",
+			req: Request{
+				Action:    "create",
+				Workloads: []*appsv1.Deployment{newDeployment("apps", 3, map[string]string{"critical": ""})},
+			},
+			wantPolicy: ProtectedLabels,
+		},
+		{
+			name: "disruption budget",
+			req: func() Request {
+				workload := newDeployment("apps", 5, nil)
+				return Request{Action: "swap", Removals: []Removal{
+					removal("apps", "a", workload, appLabels),
+					removal("apps", "b", workload, appLabels),
+				}}
+			}(),
+			wantPolicy: DisruptionBudget,
+		},
+		{
+			name: "min ready replicas",
+			req: func() Request {
+				workload := newDeployment("apps", 2, nil)
+				return Request{Action: "delete", Removals: []Removal{removal("apps", "a", workload, nil)}}
+			}(),
+			wantPolicy: MinReadyReplicas,
+		},
+		{
+			name: "min ready replicas with surge",
+			req: func() Request {
+				workload := newDeployment("apps", 2, nil)
+				return Request{Action: "move", Surge: true, Removals: []Removal{removal("apps", "a", workload, nil)}}
+			}(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := NewEngine(fake.NewSimpleClientset(pdb), nil, config)
+
+			release, err := engine.Check(context.Background(), tt.req)
+
+			if tt.wantPolicy == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				release()
+				return
+			}
+
+			var v *Violation
+			if !errors.As(err, &v) {
+				t.Fatalf("expected violation of %s, got %v", tt.wantPolicy, err)
+			}
+			if v.Policy != tt.wantPolicy {
+				t.Errorf("expected violation of %s, got %s", tt.wantPolicy, v.Policy)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	engine := NewEngine(fake.NewSimpleClientset(), nil, wamconfig.Policy{
+		ProtectedNamespaces: []string{"kube-system"},
+		MinReadyReplicas:    2,
+	})
+
+	workload := newDeployment("apps", 2, nil)
+	results, err := engine.Evaluate(context.Background(), Request{
+		Action:   "delete",
+		Removals: []Removal{{Pod: newPod("apps", "a", nil), Workload: workload}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("expected results of the 2 enabled policies, got %+v", results)
+	}
+	if results[0].Policy != ProtectedNamespaces || !results[0].Passed {
+		t.Errorf("expected %s to pass, got %+v", ProtectedNamespaces, results[0])
+	}
+	if results[1].Policy != MinReadyReplicas || results[1].Passed || results[1].Reason == "" {
+		t.Errorf("expected %s to fail with a reason, got %+v", MinReadyReplicas, results[1])
+	}
+}
+
+func TestRenewNodeSlots(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	engine := NewEngine(fake.NewSimpleClientset(), rdb, wamconfig.Policy{MaxConcurrentActionsPerNode: 1})
+	ctx := context.Background()
+
+	req := Request{ID: "a", Action: "move", Nodes: []string{"node-1"}}
+	release, err := engine.Check(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{nodeSlotsKey("node-1")}
+
+	// an action running past the TTL keeps its slot while it renews it
+	later := time.Now().Add(2 * nodeSlotTTL)
+	if err := engine.renewNodeSlotsOnce(ctx, req, keys, later); err != nil {
+		t.Fatal(err)
+	}
+	score, err := rdb.ZScore(ctx, keys[0], req.slot()).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := float64(later.Add(nodeSlotTTL).UnixMilli()); score != want {
+		t.Errorf("expected the slot to expire at %v, got %v", want, score)
+	}
+
+	// a released slot is not taken again by a late renewal
+	release()
+	if err := engine.renewNodeSlotsOnce(ctx, req, keys, later); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(keys[0]) {
+		members, _ := rdb.ZRange(ctx, keys[0], 0, -1).Result()
+		t.Errorf("expected the released slot to stay free, got %v", members)
+	}
+}
@@ -0,0 +1,344 @@
+// Package readiness provides the gates a pod created by a make-before-break action must pass before the pod it
+// replaces is deleted.
+package readiness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+)
+
+// types of the built-in gates
+const (
+	MinReadySeconds = "min-ready-seconds"
+	Condition       = "condition"
+	HTTPGet         = "http-get"
+	EndpointSlice   = "endpoint-slice"
+	Prometheus      = "prometheus"
+)
+
+// Gate is a condition a pod must meet in addition to being ready.
+type Gate interface {
+	// Passed returns whether the pod meets the condition. It is called repeatedly until it does.
+	Passed(ctx context.Context, pod *v1.Pod) (bool, error)
+}
+
+// Options select and configure a gate, they are part of the move action's request. The URL and the query may
+// reference the new pod as $namespace, $pod, $podIP and $node.
+type Options struct {
+	Type string `json:"type"`
+	// Seconds the pod must have been ready for, for the min-ready-seconds gate.
+	Seconds int `json:"seconds,omitempty"`
+	// Condition is the pod condition that must be True, e.g. one set by a service mesh, for the condition gate.
+	Condition string `json:"condition,omitempty"`
+	// URL must answer GET with a 2xx status, e.g. http://$podIP:8080/warm, for the http-get gate. Its host must be
+	// $podIP and its port one of the container ports of the pod, so the gate only reaches the pod itself.
+	URL string `json:"url,omitempty"`
+	// Service must list the pod as a ready endpoint in its EndpointSlices, for the endpoint-slice gate.
+	Service string `json:"service,omitempty"`
+	// Query must return a non-empty result of non-zero values, e.g. cache_warm{pod="$pod"}, for the prometheus gate.
+	Query string `json:"query,omitempty"`
+}
+
+// Env is what gates need from WAM to evaluate.
+type Env struct {
+	Client clientset.Interface
+	HTTP   *http.Client
+	// PrometheusURL is the base URL of the Prometheus API the prometheus gate queries.
+	PrometheusURL string
+}
+
+// httpTimeout bounds a request of a gate, the gates are evaluated again after a failed one
+const httpTimeout = 5 * time.Second
+
+// defaultHTTP is the client of the gates if Env has none. It does not follow redirects, a redirect does not pass.
+var defaultHTTP = &http.Client{
+	Timeout: httpTimeout,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Factory creates a gate from the options of a request.
+type Factory func(opts Options, env Env) (Gate, error)
+
+var (
+	mu    sync.RWMutex
+	gates = map[string]Factory{
+		MinReadySeconds: func(opts Options, _ Env) (Gate, error) {
+			if opts.Seconds <= 0 {
+				return nil, fmt.Errorf("gate %s requires positive seconds", MinReadySeconds)
+			}
+			return minReady{duration: time.Duration(opts.Seconds) * time.Second}, nil
+		},
+		Condition: func(opts Options, _ Env) (Gate, error) {
+			if opts.Condition == "" {
+				return nil, fmt.Errorf("gate %s requires a condition", Condition)
+			}
+			return condition{conditionType: v1.PodConditionType(opts.Condition)}, nil
+		},
+		HTTPGet: func(opts Options, env Env) (Gate, error) {
+			if opts.URL == "" {
+				return nil, fmt.Errorf("gate %s requires a url", HTTPGet)
+			}
+			u, err := url.Parse(opts.URL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid url: %w", err)
+			}
+			if (u.Scheme != "http" && u.Scheme != "https") || u.User != nil || u.Hostname() != "$podIP" {
+				return nil, fmt.Errorf("gate %s requires an http or https url on $podIP, e.g. http://$podIP:8080/warm", HTTPGet)
+			}
+			return httpGet{url: u, client: env.HTTP}, nil
+		},
+		EndpointSlice: func(opts Options, env Env) (Gate, error) {
+			if opts.Service == "" {
+				return nil, fmt.Errorf("gate %s requires a service", EndpointSlice)
+			}
+			return endpointSlice{service: opts.Service, client: env.Client}, nil
+		},
+		Prometheus: func(opts Options, env Env) (Gate, error) {
+			if opts.Query == "" {
+				return nil, fmt.Errorf("gate %s requires a query", Prometheus)
+			}
+			return prometheus{query: opts.Query, baseURL: env.PrometheusURL, client: env.HTTP}, nil
+		},
+	}
+)
+
+// Register makes a gate available under the type, replacing a gate registered before.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	gates[name] = factory
+}
+
+// Types returns the types of the registered gates.
+func Types() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var types []string
+	for name := range gates {
+		types = append(types, name)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// New returns the gate selected by the options.
+func New(opts Options, env Env) (Gate, error) {
+	mu.RLock()
+	factory, ok := gates[opts.Type]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown readiness gate %q, expected one of %s", opts.Type, strings.Join(Types(), ", "))
+	}
+
+	if env.HTTP == nil {
+		env.HTTP = defaultHTTP
+	}
+	return factory(opts, env)
+}
+
+// expand replaces the references to the pod in s.
+func expand(s string, pod *v1.Pod) string {
+	return strings.NewReplacer(
+		"$namespace", pod.Namespace,
+		"$podIP", pod.Status.PodIP,
+		"$pod", pod.Name,
+		"$node", pod.Spec.NodeName,
+	).Replace(s)
+}
+
+func podCondition(pod *v1.Pod, conditionType v1.PodConditionType) *v1.PodCondition {
+	for i := range pod.Status.Conditions {
+		if pod.Status.Conditions[i].Type == conditionType {
+			return &pod.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// minReady passes once the pod has been ready for the duration, like the minReadySeconds of a Deployment.
+type minReady struct {
+	duration time.Duration
+}
+
+func (g minReady) Passed(_ context.Context, pod *v1.Pod) (bool, error) {
+	ready := podCondition(pod, v1.PodReady)
+	if ready == nil || ready.Status != v1.ConditionTrue {
+		return false, nil
+	}
+	return time.Since(ready.LastTransitionTime.Time) >= g.duration, nil
+}
+
+// condition passes once the pod condition is True.
+type condition struct {
+	conditionType v1.PodConditionType
+}
+
+func (g condition) Passed(_ context.Context, pod *v1.Pod) (bool, error) {
+	c := podCondition(pod, g.conditionType)
+	return c != nil && c.Status == v1.ConditionTrue, nil
+}
+
+// httpGet passes once the URL answers with a 2xx status. The URL is requested from the pod's IP only.
+type httpGet struct {
+	url    *url.URL
+	client *http.Client
+}
+
+func (g httpGet) Passed(ctx context.Context, pod *v1.Pod) (bool, error) {
+	if pod.Status.PodIP == "" {
+		return false, nil
+	}
+
+	port := g.url.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[g.url.Scheme]
+	}
+	if !hasContainerPort(pod, port) {
+		return false, fmt.Errorf("port %s is not a container port of pod %s", port, pod.Name)
+	}
+
+	target := *g.url
+	target.Host = net.JoinHostPort(pod.Status.PodIP, port)
+	target.Path, target.RawPath = expand(g.url.Path, pod), ""
+	target.RawQuery = expand(g.url.RawQuery, pod)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		// the pod may not listen yet
+		return false, nil
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 300, nil
+}
+
+// hasContainerPort reports whether a container of the pod declares the TCP port.
+func hasContainerPort(pod *v1.Pod, port string) bool {
+	for _, container := range pod.Spec.Containers {
+		for _, p := range container.Ports {
+			if strconv.Itoa(int(p.ContainerPort)) == port && (p.Protocol == "" || p.Protocol == v1.ProtocolTCP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// endpointSlice passes once an EndpointSlice of the service lists the pod as a ready endpoint, i.e. once the service
+// routes traffic to it.
+type endpointSlice struct {
+	service string
+	client  clientset.Interface
+}
+
+func (g endpointSlice) Passed(ctx context.Context, pod *v1.Pod) (bool, error) {
+	endpointSlices, err := g.client.DiscoveryV1().EndpointSlices(pod.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + g.service,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, slice := range endpointSlices.Items {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" || endpoint.TargetRef.Name != pod.Name {
+				continue
+			}
+			if endpoint.Conditions.Ready != nil && *endpoint.Conditions.Ready {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// prometheus passes once the instant query returns a non-empty result of non-zero values.
+type prometheus struct {
+	query   string
+	baseURL string
+	client  *http.Client
+}
+
+// queryResponse is the part of the Prometheus API response to an instant query the gate uses.
+type queryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			// Value is a [timestamp, "value"] pair
+			Value []any `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+func (g prometheus) Passed(ctx context.Context, pod *v1.Pod) (bool, error) {
+	if g.baseURL == "" {
+		return false, fmt.Errorf("gate %s requires a Prometheus URL to be configured", Prometheus)
+	}
+
+	u := strings.TrimSuffix(g.baseURL, "/") + "/api/v1/query?" + url.Values{"query": {expand(g.query, pod)}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var qr queryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&qr); err != nil {
+		return false, fmt.Errorf("error decoding Prometheus response: %w", err)
+	}
+	if qr.Status != "success" {
+		return false, fmt.Errorf("prometheus query failed: %s", qr.Error)
+	}
+	if qr.Data.ResultType != "vector" {
+		return false, fmt.Errorf("prometheus query returned a %s, expected a vector", qr.Data.ResultType)
+	}
+
+	if len(qr.Data.Result) == 0 {
+		return false, nil
+	}
+	for _, sample := range qr.Data.Result {
+		if len(sample.Value) != 2 {
+			return false, fmt.Errorf("unexpected Prometheus sample %v", sample.Value)
+		}
+		s, _ := sample.Value[1].(string)
+		value, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return false, fmt.Errorf("unexpected Prometheus value %v", sample.Value[1])
+		}
+		if value == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,201 @@
+package readiness
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newPod(readySince time.Time, conditions ...v1.PodConditionType) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "a-0"},
+		Spec:       v1.PodSpec{NodeName: "node-1"},
+		Status: v1.PodStatus{
+			PodIP: "127.0.0.1",
+			Conditions: []v1.PodCondition{{
+				Type:               v1.PodReady,
+				Status:             v1.ConditionTrue,
+				LastTransitionTime: metav1.NewTime(readySince),
+			}},
+		},
+	}
+	for _, c := range conditions {
+		pod.Status.Conditions = append(pod.Status.Conditions, v1.PodCondition{Type: c, Status: v1.ConditionTrue})
+	}
+	return pod
+}
+
+func passed(t *testing.T, opts Options, env Env, pod *v1.Pod) bool {
+	t.Helper()
+	gate, err := New(opts, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := gate.Passed(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestNew(t *testing.T) {
+	for _, opts := range []Options{
+		{Type: "unknown"},
+		{Type: MinReadySeconds},
+		{Type: Condition},
+		{Type: HTTPGet},
+		{Type: EndpointSlice},
+		{Type: Prometheus},
+	} {
+		if _, err := New(opts, Env{}); err == nil {
+			t.Errorf("expected an error for %+v", opts)
+		}
+	}
+}
+
+func TestMinReadySeconds(t *testing.T) {
+	opts := Options{Type: MinReadySeconds, Seconds: 30}
+	if passed(t, opts, Env{}, newPod(time.Now())) {
+		t.Error("expected a pod ready just now not to pass")
+	}
+	if !passed(t, opts, Env{}, newPod(time.Now().Add(-time.Minute))) {
+		t.Error("expected a pod ready for a minute to pass")
+	}
+}
+
+func TestCondition(t *testing.T) {
+	opts := Options{Type: Condition, Condition: "mesh.example.com/registered"}
+	if passed(t, opts, Env{}, newPod(time.Now())) {
+		t.Error("expected a pod without the condition not to pass")
+	}
+	if !passed(t, opts, Env{}, newPod(time.Now(), "mesh.example.com/registered")) {
+		t.Error("expected a pod with the condition to pass")
+	}
+}
+
+func TestHTTPGet(t *testing.T) {
+	warm := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/redirect":
+			http.Redirect(w, r, "/warm/a-0", http.StatusFound)
+		case r.URL.Path != "/warm/a-0" || !warm:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := newPod(time.Now())
+	pod.Spec.Containers = []v1.Container{{Ports: []v1.ContainerPort{{ContainerPort: int32(port)}}}}
+
+	opts := Options{Type: HTTPGet, URL: fmt.Sprintf("http://$podIP:%d/warm/$pod", port)}
+	if passed(t, opts, Env{}, pod) {
+		t.Error("expected a cold pod not to pass")
+	}
+	warm = true
+	if !passed(t, opts, Env{}, pod) {
+		t.Error("expected a warm pod to pass")
+	}
+
+	redirect := Options{Type: HTTPGet, URL: fmt.Sprintf("http://$podIP:%d/redirect", port)}
+	if passed(t, redirect, Env{}, pod) {
+		t.Error("expected a redirect not to be followed")
+	}
+
+	gate, err := New(Options{Type: HTTPGet, URL: "http://$podIP:1/warm"}, Env{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gate.Passed(context.Background(), pod); err == nil {
+		t.Error("expected an error for a port the pod does not declare")
+	}
+
+	for _, target := range []string{server.URL + "/warm/$pod", "http://$podIP@example.com/", "file:///etc/passwd"} {
+		if _, err := New(Options{Type: HTTPGet, URL: target}, Env{}); err == nil {
+			t.Errorf("expected url %s to be rejected", target)
+		}
+	}
+}
+
+func TestEndpointSlice(t *testing.T) {
+	ready := true
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "a-abcde",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "a"},
+		},
+		Endpoints: []discoveryv1.Endpoint{{
+			Addresses:  []string{"127.0.0.1"},
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+			TargetRef:  &v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "a-0"},
+		}},
+	}
+	env := Env{Client: fake.NewSimpleClientset(slice)}
+
+	if !passed(t, Options{Type: EndpointSlice, Service: "a"}, env, newPod(time.Now())) {
+		t.Error("expected a pod listed by the service to pass")
+	}
+	if passed(t, Options{Type: EndpointSlice, Service: "b"}, env, newPod(time.Now())) {
+		t.Error("expected a pod not listed by the service not to pass")
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	// a stand-in for the Prometheus query API
+	values := map[string]string{`cache_warm{pod="a-0"}`: "1", `cache_warm{pod="b-0"}`: "0"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		result := ""
+		if value, ok := values[r.URL.Query().Get("query")]; ok {
+			result = fmt.Sprintf(`{"metric":{},"value":[1700000000,%q]}`, value)
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[%s]}}`, result)
+	}))
+	defer server.Close()
+
+	env := Env{PrometheusURL: server.URL}
+	pod := newPod(time.Now())
+	if !passed(t, Options{Type: Prometheus, Query: `cache_warm{pod="$pod"}`}, env, pod) {
+		t.Error("expected a non-zero result to pass")
+	}
+
+	pod.Name = "b-0"
+	if passed(t, Options{Type: Prometheus, Query: `cache_warm{pod="$pod"}`}, env, pod) {
+		t.Error("expected a zero result not to pass")
+	}
+
+	pod.Name = "c-0"
+	if passed(t, Options{Type: Prometheus, Query: `cache_warm{pod="$pod"}`}, env, pod) {
+		t.Error("expected an empty result not to pass")
+	}
+
+	gate, err := New(Options{Type: Prometheus, Query: "up"}, Env{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gate.Passed(context.Background(), pod); err == nil {
+		t.Error("expected an error without a Prometheus URL")
+	}
+}
@@ -0,0 +1,58 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	wamconfig "github.com/ACES-EU/workload-actions-manager/wam/pkg/config"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPropagationThroughSuggestion(t *testing.T) {
+	shutdown, err := Setup(context.Background(), wamconfig.Tracing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = shutdown(context.Background()) }()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := tp.Tracer("test")
+
+	ctx, parent := tracer.Start(context.Background(), "CreateHandler")
+
+	// the trace context travels through Redis as part of the JSON encoded suggestion
+	encoded, err := json.Marshal(Inject(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var carrier map[string]string
+	if err := json.Unmarshal(encoded, &carrier); err != nil {
+		t.Fatal(err)
+	}
+
+	_, child := tracer.Start(Extract(context.Background(), carrier), "WAM.Schedule")
+	child.End()
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+
+	childSpan, parentSpan := spans[0], spans[1]
+	if childSpan.SpanContext.TraceID() != parentSpan.SpanContext.TraceID() {
+		t.Errorf("expected both spans in trace %s, got %s", parentSpan.SpanContext.TraceID(), childSpan.SpanContext.TraceID())
+	}
+	if childSpan.Parent.SpanID() != parentSpan.SpanContext.SpanID() {
+		t.Errorf("expected parent span %s, got %s", parentSpan.SpanContext.SpanID(), childSpan.Parent.SpanID())
+	}
+}
+
+func TestInjectWithoutSpan(t *testing.T) {
+	if carrier := Inject(context.Background()); carrier != nil {
+		t.Errorf("expected no trace context, got %v", carrier)
+	}
+}